@@ -2,9 +2,11 @@
 package clientcore
 
 import (
+	"context"
 	"fmt"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/broflake/common"
@@ -17,53 +19,88 @@ type BroflakeEngine struct {
 	ui                UI
 	wg                *sync.WaitGroup
 	netstated         string
-	tag               string
+	rtcOpt            *liveOptions[WebRTCOptions]
+	egOpt             *liveOptions[EgressOptions]
 	netstateHeartbeat time.Duration
 	netstateStop      chan struct{}
+	consumers         *safeConsumerMap
+	ctx               context.Context
+	routines          *sync.WaitGroup
+	events            *eventHub
+	paths             *safePathMap
+	pRouter           TableRouter
+	quic              atomic.Pointer[QUICLayer]
+	log               common.Logger
+	throughput        atomic.Int64 // The downstream throughput we last published
 }
 
 func NewBroflakeEngine(cTable, pTable *WorkerTable, ui UI, wg *sync.WaitGroup, netstated, tag string) *BroflakeEngine {
+	rtcOpt := NewDefaultWebRTCOptions()
+	rtcOpt.Tag = tag
+	liveRTCOpt := newLiveOptions(rtcOpt)
+
 	return &BroflakeEngine{
 		cTable,
 		pTable,
 		ui,
 		wg,
 		netstated,
-		tag,
+		liveRTCOpt,
+		newLiveOptions(NewDefaultEgressOptions()),
 		1 * time.Minute,
 		make(chan struct{}, 0),
+		newSafeConsumerMap(),
+		context.Background(),
+		nil,
+		newEventHub(),
+		newSafePathMap(),
+		nil,
+		atomic.Pointer[QUICLayer]{},
+		common.NewLogger("component", "engine", "tag", liveTag{liveRTCOpt}),
+		atomic.Int64{},
 	}
 }
 
 func (b *BroflakeEngine) start() {
 	b.cTable.Start()
 	b.pTable.Start()
-	common.Debug("▶ Broflake started!")
+	b.log.Info("▶ Broflake started!")
 
 	if b.netstated != "" {
+		if b.routines != nil {
+			b.routines.Add(1)
+		}
+
 		go func() {
-			common.Debug("Netstate hearbeat ON")
+			if b.routines != nil {
+				defer b.routines.Done()
+			}
+
+			b.log.Debug("netstate heartbeat on")
 
 			for {
-				common.Debug("Netstate HEARTBEAT")
+				b.log.Debug("netstate heartbeat")
 				err := netstatecl.Exec(
 					b.netstated,
 					&netstatecl.Instruction{
 						Op:   netstatecl.OpConsumerState,
-						Args: netstatecl.EncodeArgsOpConsumerState(connectedConsumers.slice()),
-						Tag:  b.tag,
+						Args: netstatecl.EncodeArgsOpConsumerState(b.consumers.slice()),
+						Tag:  b.tag(),
 					},
 				)
 
 				if err != nil {
-					common.Debugf("Netstate client Exec error: %v", err)
+					b.log.Warn("netstate client exec error", "err", err)
+					b.events.publish(ErrorEvent{Source: "netstate", Err: err})
 				}
 
 				select {
 				case <-time.After(b.netstateHeartbeat):
 					// Do nothing, iterate the loop
 				case <-b.netstateStop:
-					defer common.Debug("Netstate heartbeat OFF")
+					defer b.log.Debug("netstate heartbeat off")
+					return
+				case <-b.ctx.Done():
 					return
 				}
 			}
@@ -72,29 +109,176 @@ func (b *BroflakeEngine) start() {
 }
 
 func (b *BroflakeEngine) stop() {
+	b.stopWorkers()
+
+	go func() {
+		b.awaitStopped()
+		b.ui.OnReady()
+	}()
+}
+
+func (b *BroflakeEngine) stopWorkers() {
 	b.cTable.Stop()
 	b.pTable.Stop()
+}
 
-	go func() {
-		b.wg.Wait()
+// awaitStopped blocks until every worker has exited and the netstate heartbeat is off
+func (b *BroflakeEngine) awaitStopped() {
+	b.wg.Wait()
 
-		if b.netstated != "" {
-			b.netstateStop <- struct{}{}
+	if b.netstated != "" {
+		select {
+		case b.netstateStop <- struct{}{}:
+		case <-b.ctx.Done():
 		}
+	}
 
-		common.Debug("■ Broflake stopped.")
-		b.ui.OnReady()
-	}()
+	b.log.Info("■ Broflake stopped.")
+}
+
+// tag returns the tag from the current WebRTCOptions
+func (b *BroflakeEngine) tag() string {
+	o, _, _ := b.rtcOpt.load()
+	return o.Tag
+}
+
+// UpdateWebRTCOptions replaces the options used by this engine's WebRTC workers. Each worker picks
+// up the new options the next time it resets to state 0, and workers which are still trying to
+// reach the discovery server reset right away. Connections in progress are left alone, since none
+// of these options matter once signaling is under way. A nil HttpClient or Clock keeps
+// the current one. A nil STUNBatch keeps the current one too; otherwise, or if STUNBatchSize has
+// changed, each worker repopulates its STUN cache at its next reset.
+func (b *BroflakeEngine) UpdateWebRTCOptions(opt *WebRTCOptions) error {
+	if opt == nil {
+		return fmt.Errorf("nil WebRTCOptions")
+	}
+
+	o := *opt
+	b.rtcOpt.update(&o, func(prev, next *WebRTCOptions) bool {
+		if next.HttpClient == nil {
+			next.HttpClient = prev.HttpClient
+		}
+
+		if next.Clock == nil {
+			next.Clock = prev.Clock
+		}
+
+		if next.STUNBatch == nil {
+			next.STUNBatch = prev.STUNBatch
+		}
+
+		next.stunGen = prev.stunGen
+		if opt.STUNBatch != nil || next.STUNBatchSize != prev.STUNBatchSize {
+			next.stunGen++
+		}
+
+		return false
+	})
+
+	b.log.Info("WebRTC options updated", "discoverySrv", o.DiscoverySrv, "tag", o.Tag)
+	return nil
+}
+
+// UpdateEgressOptions replaces the options used by this engine's egress workers. Each worker picks
+// up the new options the next time it resets to state 0. If the egress server's address has
+// changed, connected workers disconnect from the old server and reset right away. A new token
+// doesn't disturb connected workers, since the egress server only checks it when they connect.
+// Workers may move between the transports which carry datagrams, but not between those and
+// WebSockets, since each needs its own kind of worker.
+func (b *BroflakeEngine) UpdateEgressOptions(opt *EgressOptions) error {
+	if opt == nil {
+		return fmt.Errorf("nil EgressOptions")
+	}
+
+	if err := opt.validate(); err != nil {
+		return err
+	}
+
+	if prev, _, _ := b.egOpt.load(); opt.datagram() != prev.datagram() {
+		return fmt.Errorf("can't change egress transport from '%v' to '%v' at runtime", prev.Transport, opt.Transport)
+	}
+
+	o := *opt
+	if o.Tag == "" {
+		o.Tag = b.tag()
+	}
+
+	b.egOpt.update(&o, func(prev, next *EgressOptions) bool {
+		return next.Addr != prev.Addr || next.Endpoint != prev.Endpoint || next.Transport != prev.Transport
+	})
+
+	b.log.Info("egress options updated", "addr", o.Addr, "transport", o.Transport)
+	return nil
+}
+
+// OnFSMTransition registers a hook which is called every time a worker in the consumer table or the
+// producer table changes state. 'table' is "consumer" or "producer". Hooks are called from the
+// worker's goroutine, so they must not block.
+func (b *BroflakeEngine) OnFSMTransition(hook func(table string, workerIdx int, t FSMTransition)) {
+	b.cTable.OnTransition(func(workerIdx int, t FSMTransition) { hook("consumer", workerIdx, t) })
+	b.pTable.OnTransition(func(workerIdx int, t FSMTransition) { hook("producer", workerIdx, t) })
+}
+
+// Subscribe returns a Subscription to this engine's event stream. bufferSz is the number of events
+// which may be queued for a slow subscriber before new events are dropped; if it's <= 0, a default
+// is used. Throughput, consumer connection and chunk drop events are only published on native
+// builds; on wasm, those go to the JavaScript API instead.
+func (b *BroflakeEngine) Subscribe(bufferSz int) *Subscription {
+	return b.events.subscribe(bufferSz)
+}
+
+// FSMHistory returns the most recent transitions for a worker in the consumer table or the
+// producer table, oldest first
+func (b *BroflakeEngine) FSMHistory(table string, workerIdx int) []FSMTransition {
+	switch table {
+	case "consumer":
+		return b.cTable.History(workerIdx)
+	case "producer":
+		return b.pTable.History(workerIdx)
+	default:
+		return nil
+	}
 }
 
 func (b *BroflakeEngine) debug() {
-	common.Debugf("NumGoroutine: %v", runtime.NumGoroutine())
+	b.log.Info("debug", "goroutines", runtime.NumGoroutine())
+
+	for name, t := range map[string]*WorkerTable{"consumer": b.cTable, "producer": b.pTable} {
+		for i := range t.slot {
+			idx, state, since := t.slot[i].State()
+			b.log.Info("debug", "table", name, "worker", i, "state", state, "idx", idx, "for", time.Since(since))
+		}
+	}
 }
 
 func NewBroflake(bfOpt *BroflakeOptions, rtcOpt *WebRTCOptions, egOpt *EgressOptions) (bfconn *BroflakeConn, ui *UIImpl, err error) {
+	bfconn, ui, err = newBroflake(context.Background(), nil, bfOpt, rtcOpt, egOpt)
+	if err != nil {
+		return bfconn, ui, err
+	}
+
+	// Fire our UI events to announce that we're ready
+	ui.OnReady()
+	ui.OnStartup()
+	return bfconn, ui, nil
+}
+
+// newBroflake builds a Broflake instance and starts its bus, routers and UI handlers, but not its
+// workers. Everything it starts runs until ctx is cancelled; routines, if non-nil, tracks it all.
+func newBroflake(
+	ctx context.Context,
+	routines *sync.WaitGroup,
+	bfOpt *BroflakeOptions,
+	rtcOpt *WebRTCOptions,
+	egOpt *EgressOptions,
+) (bfconn *BroflakeConn, ui *UIImpl, err error) {
+	if bfOpt == nil {
+		bfOpt = NewDefaultBroflakeOptions()
+	}
+
 	if bfOpt.ClientType != "desktop" && bfOpt.ClientType != "widget" {
 		err = fmt.Errorf("Invalid clientType '%v\n'", bfOpt.ClientType)
-		common.Debugf(err.Error())
+		common.NewLogger("component", "engine").Error("can't build Broflake", "err", err)
 		return bfconn, ui, err
 	}
 
@@ -105,10 +289,6 @@ func NewBroflake(bfOpt *BroflakeOptions, rtcOpt *WebRTCOptions, egOpt *EgressOpt
 	var pRouter TableRouter
 	var wgReady sync.WaitGroup
 
-	if bfOpt == nil {
-		bfOpt = NewDefaultBroflakeOptions()
-	}
-
 	if rtcOpt == nil {
 		rtcOpt = NewDefaultWebRTCOptions()
 	}
@@ -117,6 +297,21 @@ func NewBroflake(bfOpt *BroflakeOptions, rtcOpt *WebRTCOptions, egOpt *EgressOpt
 		egOpt = NewDefaultEgressOptions()
 	}
 
+	if err = egOpt.validate(); err != nil {
+		common.NewLogger("component", "engine").Error("can't build Broflake", "err", err)
+		return bfconn, ui, err
+	}
+
+	if egOpt.Tag == "" && rtcOpt.Tag != "" {
+		o := *egOpt
+		o.Tag = rtcOpt.Tag
+		egOpt = &o
+	}
+
+	// Workers share their options, so that BroflakeEngine can update them at runtime
+	liveRTCOpt := newLiveOptions(rtcOpt)
+	liveEgOpt := newLiveOptions(egOpt)
+
 	// The boot DAG:
 	// build cTable/pTable -> build the Broflake struct -> run ui.Init -> set up the bus and bind
 	// the upstream/downstream handlers -> build cRouter/pRouter -> start the bus, init the routers,
@@ -135,27 +330,56 @@ func NewBroflake(bfOpt *BroflakeOptions, rtcOpt *WebRTCOptions, egOpt *EgressOpt
 		// Desktop peers consume connectivity over WebRTC
 		var pfsms []WorkerFSM
 		for i := 0; i < bfOpt.PTableSize; i++ {
-			pfsms = append(pfsms, *NewConsumerWebRTC(rtcOpt, &wgReady))
+			pfsms = append(pfsms, *newConsumerWebRTC(liveRTCOpt, &wgReady))
 		}
 		pTable = NewWorkerTable(pfsms)
 	case "widget":
 		// Widget peers share connectivity over WebRTC
 		var cfsms []WorkerFSM
 		for i := 0; i < bfOpt.CTableSize; i++ {
-			cfsms = append(cfsms, *NewProducerWebRTC(rtcOpt, &wgReady))
+			cfsms = append(cfsms, *newProducerWebRTC(liveRTCOpt, &wgReady))
 		}
 		cTable = NewWorkerTable(cfsms)
 
-		// Widget peers consume connectivity from an egress server over WebSocket
+		// Widget peers consume connectivity from an egress server, over WebSocket unless they're
+		// configured to use a transport which carries datagrams
 		var pfsms []WorkerFSM
 		for i := 0; i < bfOpt.PTableSize; i++ {
-			pfsms = append(pfsms, *NewEgressConsumerWebSocket(egOpt, &wgReady))
+			if egOpt.datagram() {
+				pfsms = append(pfsms, *newEgressConsumerDatagram(liveEgOpt, &wgReady))
+			} else {
+				pfsms = append(pfsms, *newEgressConsumerWebSocket(liveEgOpt, &wgReady))
+			}
 		}
 		pTable = NewWorkerTable(pfsms)
 	}
 
+	// Step 1.5: Apply the flow policy to all workers before anyone starts sending chunks
+	cTable.setFlowPolicy(bfOpt.FlowPolicy, bfOpt.FlowBlockTimeout)
+	pTable.setFlowPolicy(bfOpt.FlowPolicy, bfOpt.FlowBlockTimeout)
+
 	// Step 2: Build Broflake
 	broflake := NewBroflakeEngine(cTable, pTable, ui, &wgReady, bfOpt.Netstated, rtcOpt.Tag)
+	broflake.ctx = ctx
+	broflake.routines = routines
+	broflake.rtcOpt = liveRTCOpt
+	broflake.egOpt = liveEgOpt
+	broflake.log = common.NewLogger("component", "engine", "tag", liveTag{liveRTCOpt})
+
+	// Step 2.5: Give every worker a logger which identifies it, and turn on its telemetry. Our tag
+	// may be updated at runtime, so the loggers look it up with every message.
+	cTable.setLogger(common.NewLogger("component", "worker", "tag", liveTag{liveRTCOpt}, "table", "consumer"))
+	pTable.setLogger(common.NewLogger("component", "worker", "tag", liveTag{liveRTCOpt}, "table", "producer"))
+	cTable.instrument("consumer")
+	pTable.instrument("producer")
+
+	broflake.OnFSMTransition(func(table string, workerIdx int, t FSMTransition) {
+		broflake.events.publish(FSMStateEvent{Table: table, WorkerIdx: workerIdx, Transition: t})
+	})
+
+	if bfconn != nil {
+		bfconn.engine = broflake
+	}
 
 	// Step 3: Init the UI (this constructs and exposes the JavaScript API as required)
 	ui.Init(broflake)
@@ -163,8 +387,8 @@ func NewBroflake(bfOpt *BroflakeOptions, rtcOpt *WebRTCOptions, egOpt *EgressOpt
 	// Step 4: Set up the bus, bind upstream and downstream UI handlers
 	var bus = NewIpcObserver(
 		bfOpt.BusBufferSz,
-		UpstreamUIHandler(*ui, bfOpt.Netstated, rtcOpt.Tag),
-		DownstreamUIHandler(*ui, bfOpt.Netstated, rtcOpt.Tag),
+		UpstreamUIHandler(*ui, bfOpt.Netstated),
+		DownstreamUIHandler(ctx, routines, *ui, bfOpt.Netstated),
 	)
 
 	// Step 5: Build consumer router and producer router
@@ -177,11 +401,22 @@ func NewBroflake(bfOpt *BroflakeOptions, rtcOpt *WebRTCOptions, egOpt *EgressOpt
 		pRouter = NewProducerPoolRouter(bus.Upstream, pTable)
 	}
 
-	// Step 6: Start the bus, init the routers, fire our UI events to announce that we're ready
-	bus.Start()
-	cRouter.Init()
-	pRouter.Init()
-	ui.OnReady()
-	ui.OnStartup()
+	// Step 5.5: Report each producer's path assertions, which the routers otherwise keep to themselves
+	pRouter.observe(func(msg IPCMsg, workerIdx workerID) {
+		if msg.IpcType == PathAssertionIPC {
+			pa := msg.Data.(common.PathAssertion)
+			if broflake.paths.set(int(workerIdx), pa) {
+				broflake.events.publish(PathAssertionEvent{WorkerIdx: int(workerIdx), PathAssertion: pa})
+			}
+		}
+	})
+
+	broflake.pRouter = pRouter
+
+	// Step 6: Start the bus, init the routers
+	bus.Start(ctx, routines)
+	cRouter.Init(ctx, routines)
+	pRouter.Init(ctx, routines)
+	FlowUIHandler(ctx, routines, *ui, cTable, pTable)
 	return bfconn, ui, nil
 }
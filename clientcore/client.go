@@ -0,0 +1,180 @@
+// client.go provides a Broflake instance with an explicit lifecycle, for embedding in native Go
+// applications which may run several instances in one process, or tear one down and rebuild it
+package clientcore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+var (
+	ErrClientClosed  = errors.New("client is closed")
+	ErrClientStarted = errors.New("client is already started")
+	ErrClientStopped = errors.New("client is not started")
+)
+
+// Client is a self-contained Broflake instance. Unlike NewBroflake, NewClient doesn't start the
+// client's workers; call Start to do that. A Client may be stopped and started again any number of
+// times. Close releases every goroutine and connection owned by the Client, after which it can't
+// be used again. Cancelling the context passed to NewClient closes the Client.
+type Client struct {
+	engine   *BroflakeEngine
+	conn     *BroflakeConn
+	http     *http.Client
+	ctx      context.Context
+	cancel   context.CancelFunc
+	routines sync.WaitGroup
+	stopCtx  func() bool
+	mx       sync.Mutex
+	started  bool
+	closed   bool
+}
+
+func NewClient(ctx context.Context, bfOpt *BroflakeOptions, rtcOpt *WebRTCOptions, egOpt *EgressOptions) (*Client, error) {
+	if rtcOpt == nil {
+		rtcOpt = NewDefaultWebRTCOptions()
+	}
+
+	c := &Client{http: rtcOpt.HttpClient}
+	c.ctx, c.cancel = context.WithCancel(ctx)
+
+	bfconn, ui, err := newBroflake(c.ctx, &c.routines, bfOpt, rtcOpt, egOpt)
+	if err != nil {
+		c.cancel()
+		return nil, err
+	}
+
+	c.engine = ui.BroflakeEngine
+	c.conn = bfconn
+	c.stopCtx = context.AfterFunc(ctx, func() { c.Close() })
+	return c, nil
+}
+
+// Conn returns the BroflakeConn for proxying the user's own traffic. Only desktop clients have
+// one; for widgets, Conn returns nil.
+func (c *Client) Conn() *BroflakeConn {
+	return c.conn
+}
+
+// Engine returns the BroflakeEngine underlying this Client, for observing its workers
+func (c *Client) Engine() *BroflakeEngine {
+	return c.engine
+}
+
+// Subscribe returns a Subscription to this Client's event stream. See BroflakeEngine.Subscribe.
+// Closing the Client closes all of its Subscriptions.
+func (c *Client) Subscribe(bufferSz int) *Subscription {
+	return c.engine.Subscribe(bufferSz)
+}
+
+// UpdateOptions updates the WebRTC and egress options used by this Client's workers, without
+// restarting them. Either may be nil, to leave it as it is. See BroflakeEngine.UpdateWebRTCOptions
+// and BroflakeEngine.UpdateEgressOptions.
+func (c *Client) UpdateOptions(rtcOpt *WebRTCOptions, egOpt *EgressOptions) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.closed {
+		return ErrClientClosed
+	}
+
+	if rtcOpt != nil {
+		if err := c.engine.UpdateWebRTCOptions(rtcOpt); err != nil {
+			return err
+		}
+	}
+
+	if egOpt != nil {
+		if err := c.engine.UpdateEgressOptions(egOpt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Start this Client's workers
+func (c *Client) Start() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.closed {
+		return ErrClientClosed
+	}
+
+	if c.started {
+		return ErrClientStarted
+	}
+
+	c.engine.start()
+	c.started = true
+	return nil
+}
+
+// Started returns true if this Client's workers are started
+func (c *Client) Started() bool {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.started
+}
+
+// Stop this Client's workers, blocking until they have all exited and released their connections
+func (c *Client) Stop() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.closed {
+		return ErrClientClosed
+	}
+
+	if !c.started {
+		return ErrClientStopped
+	}
+
+	c.stop()
+	return nil
+}
+
+func (c *Client) stop() {
+	c.engine.stopWorkers()
+	c.engine.awaitStopped()
+	c.started = false
+}
+
+// Close stops this Client if it's started, then shuts down its bus, routers and UI handlers and
+// closes its BroflakeConn. Close blocks until all of the Client's goroutines have exited. Closing
+// a closed Client is a no-op.
+func (c *Client) Close() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	c.stopCtx()
+
+	if c.started {
+		c.stop()
+	}
+
+	c.cancel()
+	c.routines.Wait()
+
+	if c.conn != nil {
+		c.conn.Close()
+	}
+
+	// Our workers are gone, so any keepalive connections to the discovery server are ours to close,
+	// including those made with an HttpClient which was swapped in by an update
+	c.http.CloseIdleConnections()
+	if rtcOpt, _, _ := c.engine.rtcOpt.load(); rtcOpt.HttpClient != c.http {
+		rtcOpt.HttpClient.CloseIdleConnections()
+	}
+	c.engine.events.close()
+
+	c.closed = true
+	return nil
+}
@@ -0,0 +1,505 @@
+//go:build !wasm
+
+package clientcore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/getlantern/broflake/clientcore/sim"
+	"github.com/getlantern/broflake/common"
+)
+
+// startEgressStandIn serves WebSocket connections which swallow everything sent to them, which is
+// all a widget needs to advertise connectivity
+func startEgressStandIn(t *testing.T) string {
+	addr, _ := startCountingEgressStandIn(t)
+	return addr
+}
+
+// startCountingEgressStandIn is a startEgressStandIn which counts the connections it accepts
+func startCountingEgressStandIn(t *testing.T) (string, *atomic.Int32) {
+	var accepted atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.CloseNow()
+		accepted.Add(1)
+
+		for {
+			if _, _, err := c.Read(r.Context()); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), &accepted
+}
+
+func newSimClient(t *testing.T, ctx context.Context, e *simEnv, clientType string, peer int, egressAddr string) *Client {
+	bfOpt := NewDefaultBroflakeOptions()
+	bfOpt.ClientType = clientType
+	bfOpt.CTableSize = 1
+	bfOpt.PTableSize = 1
+
+	rtcOpt := e.options(peer)
+	rtcOpt.Clock = realClock{}
+	rtcOpt.HttpClient = &http.Client{Transport: &http.Transport{}}
+
+	egOpt := NewDefaultEgressOptions()
+	egOpt.Addr = egressAddr
+	egOpt.ErrorBackoff = 100 * time.Millisecond
+
+	c, err := NewClient(ctx, bfOpt, rtcOpt, egOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// awaitProxy blocks until the desktop client's WebRTC consumer reaches its proxy state
+func awaitProxy(t *testing.T, c *Client, proxying chan struct{}) {
+	t.Helper()
+
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-proxying:
+	case <-time.After(simTimeout):
+		t.Fatalf("timed out awaiting proxy state; history: %+v", c.Engine().FSMHistory("producer", 0))
+	}
+}
+
+// clientGoroutines returns the stacks of running goroutines which are executing clientcore code.
+// Goroutines merely created by clientcore, like the fire-and-forget NAT telemetry probes, don't
+// count.
+func clientGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	var owned []string
+
+	for _, g := range strings.Split(string(buf[:runtime.Stack(buf, true)]), "\n\n") {
+		for _, line := range strings.Split(g, "\n") {
+			if strings.HasPrefix(line, "github.com/getlantern/broflake/clientcore.") &&
+				!strings.Contains(line, "clientcore.Test") &&
+				!strings.Contains(line, "clientcore.awaitGoroutines") &&
+				!strings.Contains(line, "clientcore.clientGoroutines") {
+				owned = append(owned, g)
+				break
+			}
+		}
+	}
+
+	return owned
+}
+
+// awaitGoroutines waits for every goroutine executing clientcore code to exit
+func awaitGoroutines(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+
+	for {
+		owned := clientGoroutines()
+		if len(owned) == 0 {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("%v clientcore goroutines still running:\n%s", len(owned), strings.Join(owned, "\n\n"))
+		}
+		<-time.After(50 * time.Millisecond)
+	}
+}
+
+func TestClientLifecycle(t *testing.T) {
+	e := newSimEnv(t, 2*time.Second, 2*time.Second, sim.NATEasy, sim.NATEasy)
+	egressAddr := startEgressStandIn(t)
+
+	widget := newSimClient(t, context.Background(), e, "widget", 0, egressAddr)
+	desktop := newSimClient(t, context.Background(), e, "desktop", 1, "")
+
+	proxying := make(chan struct{}, 16)
+	desktop.Engine().OnFSMTransition(func(table string, workerIdx int, tr FSMTransition) {
+		if table == "producer" && tr.To == consumerStateProxy {
+			proxying <- struct{}{}
+		}
+	})
+
+	if err := widget.Start(); err != nil {
+		t.Fatal(err)
+	}
+	awaitProxy(t, desktop, proxying)
+
+	// Restarting must bring the client back up from scratch
+	if err := desktop.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if idx, _, _ := desktop.Engine().pTable.slot[0].State(); idx != consumerStateNew {
+		t.Fatalf("stopped worker is in state %v, expected %v", idx, consumerStateNew)
+	}
+
+	awaitProxy(t, desktop, proxying)
+
+	if err := desktop.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := widget.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := desktop.Conn().ReadFrom(make([]byte, 1)); err == nil {
+		t.Fatal("expected ReadFrom on a closed client's BroflakeConn to fail")
+	}
+
+	awaitGoroutines(t)
+}
+
+func TestClientEvents(t *testing.T) {
+	e := newSimEnv(t, 2*time.Second, 2*time.Second, sim.NATEasy, sim.NATEasy)
+	egressAddr := startEgressStandIn(t)
+
+	widget := newSimClient(t, context.Background(), e, "widget", 0, egressAddr)
+	desktop := newSimClient(t, context.Background(), e, "desktop", 1, "")
+	defer widget.Close()
+
+	sub := desktop.Subscribe(1024)
+
+	if err := widget.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := desktop.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A desktop which has found a volunteer sees its producer worker reach the proxy state, and
+	// that worker asserts a path to the egress server
+	var proxying, asserted bool
+	timeout := time.After(simTimeout)
+
+	for !proxying || !asserted {
+		select {
+		case ev := <-sub.C:
+			switch ev := ev.(type) {
+			case FSMStateEvent:
+				if ev.Table == "producer" && ev.Transition.To == consumerStateProxy {
+					proxying = true
+				}
+			case PathAssertionEvent:
+				if !ev.PathAssertion.Nil() {
+					asserted = true
+				}
+			}
+		case <-timeout:
+			t.Fatalf("timed out awaiting events; proxying: %v, asserted: %v", proxying, asserted)
+		}
+	}
+
+	desktop.Close()
+
+	for range sub.C {
+		// Drain until closing the client closes the subscription
+	}
+}
+
+func TestThroughputEvents(t *testing.T) {
+	ui := UIImpl{BroflakeEngine: &BroflakeEngine{events: newEventHub()}}
+	sub := ui.BroflakeEngine.Subscribe(16)
+
+	// An idle client doesn't report its idleness over and over, only changes in throughput
+	for _, bytesPerSec := range []int{0, 0, 100, 100, 0, 0} {
+		ui.OnDownstreamThroughput(bytesPerSec)
+	}
+	ui.BroflakeEngine.events.close()
+
+	var got []int
+	for e := range sub.C {
+		got = append(got, e.(ThroughputEvent).BytesPerSec)
+	}
+
+	if len(got) != 2 || got[0] != 100 || got[1] != 0 {
+		t.Fatalf("got throughput events %v, expected [100 0]", got)
+	}
+}
+
+func TestFlowUIHandlerStops(t *testing.T) {
+	ui := UIImpl{BroflakeEngine: &BroflakeEngine{events: newEventHub()}}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	FlowUIHandler(ctx, &wg, ui, NewWorkerTable(nil), NewWorkerTable(nil))
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("FlowUIHandler's sampling goroutine outlived its context")
+	}
+}
+
+func TestClientStats(t *testing.T) {
+	e := newSimEnv(t, 2*time.Second, 2*time.Second, sim.NATEasy, sim.NATEasy)
+	egressAddr := startEgressStandIn(t)
+
+	widget := newSimClient(t, context.Background(), e, "widget", 0, egressAddr)
+	desktop := newSimClient(t, context.Background(), e, "desktop", 1, "")
+	defer widget.Close()
+	defer desktop.Close()
+
+	proxying := make(chan struct{}, 16)
+	desktop.Engine().OnFSMTransition(func(table string, workerIdx int, tr FSMTransition) {
+		if table == "producer" && tr.To == consumerStateProxy {
+			proxying <- struct{}{}
+		}
+	})
+
+	if err := widget.Start(); err != nil {
+		t.Fatal(err)
+	}
+	awaitProxy(t, desktop, proxying)
+
+	// Send a chunk from the user stream through the producer table
+	if _, err := desktop.Conn().WriteTo(make([]byte, 100), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(simTimeout)
+
+	for {
+		s := desktop.Engine().Stats()
+		p := s.Producers[0]
+
+		if p.BytesOut == 100 {
+			if p.State != consumerStateProxy || p.StateName != "proxy" {
+				t.Fatalf("producer is in state %v (%v), expected proxy", p.State, p.StateName)
+			}
+
+			if p.PathAssertion == nil || p.PathAssertion.Nil() {
+				t.Fatal("expected a connected producer to report a non-nil path assertion")
+			}
+
+			if p.STUNCacheSize == nil || *p.STUNCacheSize != 1 {
+				t.Fatalf("got STUN cache size %v, expected 1", p.STUNCacheSize)
+			}
+
+			if route, ok := s.Routes[0]; !ok || route != 0 {
+				t.Fatalf("got routes %v, expected the user stream to be routed to producer 0", s.Routes)
+			}
+
+			if s.QUIC != nil {
+				t.Fatal("expected no QUIC stats without a QUICLayer")
+			}
+
+			if _, err := json.Marshal(s); err != nil {
+				t.Fatal(err)
+			}
+
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out awaiting producer traffic; stats: %+v", s)
+		}
+		<-time.After(50 * time.Millisecond)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	e := newSimEnv(t, 2*time.Second, 2*time.Second, sim.NATEasy)
+	c := newSimClient(t, context.Background(), e, "desktop", 0, "")
+
+	if err := c.Stop(); err != ErrClientStopped {
+		t.Fatalf("Stop before Start: got %v, expected %v", err, ErrClientStopped)
+	}
+
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Start(); err != ErrClientStarted {
+		t.Fatalf("Start twice: got %v, expected %v", err, ErrClientStarted)
+	}
+
+	c.Close()
+
+	if err := c.Start(); err != ErrClientClosed {
+		t.Fatalf("Start after Close: got %v, expected %v", err, ErrClientClosed)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close twice: got %v, expected nil", err)
+	}
+
+	if _, err := NewClient(context.Background(), &BroflakeOptions{ClientType: "toaster"}, nil, nil); err == nil {
+		t.Fatal("expected an error constructing a client with an invalid type")
+	}
+}
+
+func TestClientContextCancel(t *testing.T) {
+	e := newSimEnv(t, 2*time.Second, 2*time.Second, sim.NATEasy)
+	ctx, cancel := context.WithCancel(context.Background())
+	c := newSimClient(t, ctx, e, "desktop", 0, "")
+
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	deadline := time.Now().Add(simTimeout)
+
+	for c.Start() != ErrClientClosed {
+		if time.Now().After(deadline) {
+			t.Fatal("cancelling the client's context didn't close it")
+		}
+		<-time.After(50 * time.Millisecond)
+	}
+}
+
+// Two clients in one process must not share state
+func TestClientIsolation(t *testing.T) {
+	e := newSimEnv(t, 2*time.Second, 2*time.Second, sim.NATEasy, sim.NATEasy)
+	a := newSimClient(t, context.Background(), e, "widget", 0, "")
+	b := newSimClient(t, context.Background(), e, "widget", 1, "")
+	defer a.Close()
+	defer b.Close()
+
+	a.Engine().consumers.set(0, common.ConsumerInfo{Addr: net.ParseIP("192.0.2.7"), Tag: "a"})
+
+	if len(b.Engine().consumers.slice()) != 0 {
+		t.Fatal("a consumer connected to one client is visible to another")
+	}
+}
+
+func TestClientUpdateTag(t *testing.T) {
+	e := newSimEnv(t, 2*time.Second, 2*time.Second, sim.NATEasy)
+	c := newSimClient(t, context.Background(), e, "widget", 0, "")
+	defer c.Close()
+
+	defer common.ConfigureLogging("", "")
+	var buf bytes.Buffer
+	common.SetLogger(common.NewSlogLogger(slog.New(slog.NewTextHandler(&buf, nil))))
+
+	rtcOpt := e.options(0)
+	rtcOpt.Tag = "renamed"
+	if err := c.UpdateOptions(rtcOpt, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loggers built before the update report the new tag
+	buf.Reset()
+	c.Engine().log.Info("hello")
+	c.Engine().pTable.slot[0].log.Info("hello")
+
+	if got := buf.String(); strings.Count(got, "tag=renamed") != 2 {
+		t.Fatalf("expected both loggers to report the new tag, got %q", got)
+	}
+}
+
+func TestClientUpdateOptions(t *testing.T) {
+	e := newSimEnv(t, 2*time.Second, 2*time.Second, sim.NATEasy)
+	addrA, acceptedA := startCountingEgressStandIn(t)
+	addrB, acceptedB := startCountingEgressStandIn(t)
+
+	widget := newSimClient(t, context.Background(), e, "widget", 0, addrA)
+
+	transitions := make(chan FSMTransition, 64)
+	widget.Engine().OnFSMTransition(func(table string, workerIdx int, tr FSMTransition) {
+		if table == "producer" {
+			transitions <- tr
+		}
+	})
+
+	await := func(match func(tr FSMTransition) bool) FSMTransition {
+		t.Helper()
+		for {
+			select {
+			case tr := <-transitions:
+				if match(tr) {
+					return tr
+				}
+			case <-time.After(simTimeout):
+				t.Fatalf("timed out awaiting transition; history: %+v", widget.Engine().FSMHistory("producer", 0))
+			}
+		}
+	}
+
+	if err := widget.Start(); err != nil {
+		t.Fatal(err)
+	}
+	await(to(egressConsumerStateProxy))
+
+	// Updates which don't move the egress server leave the connection alone
+	egOpt := NewDefaultEgressOptions()
+	egOpt.Addr = addrA
+	egOpt.ErrorBackoff = time.Second
+
+	if err := widget.UpdateOptions(nil, egOpt); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case tr := <-transitions:
+		t.Fatalf("unexpected transition after update: %+v", tr)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Moving the egress server moves the connection
+	egOpt = NewDefaultEgressOptions()
+	egOpt.Addr = addrB
+
+	if err := widget.UpdateOptions(nil, egOpt); err != nil {
+		t.Fatal(err)
+	}
+
+	await(from(egressConsumerStateProxy, "egress server changed"))
+	await(to(egressConsumerStateProxy))
+
+	if acceptedA.Load() != 1 || acceptedB.Load() != 1 {
+		t.Fatalf("egress servers accepted %v and %v connections, expected 1 each", acceptedA.Load(), acceptedB.Load())
+	}
+
+	// Our egress consumers can't change between WebSocket and datagram transports
+	egOpt = NewDefaultEgressOptions()
+	egOpt.Addr = "udp://127.0.0.1:9"
+	egOpt.Transport = EgressTransportQUIC
+
+	if err := widget.UpdateOptions(nil, egOpt); err == nil {
+		t.Fatal("expected changing to a datagram transport to be refused")
+	}
+
+	if err := widget.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := widget.UpdateOptions(nil, egOpt); err != ErrClientClosed {
+		t.Fatalf("expected ErrClientClosed, got %v", err)
+	}
+
+	awaitGoroutines(t)
+}
@@ -0,0 +1,24 @@
+package clientcore
+
+import (
+	"time"
+)
+
+// Clock abstracts the passage of time for WorkerFSMs, such that the timeouts and backoffs which
+// govern their behavior can be driven deterministically in simulation
+type Clock interface {
+	Now() time.Time
+
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is a Clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,147 @@
+// control.go implements a small local HTTP API for controlling a desktop client, so installers and
+// browser extensions can check on it, start and stop it, and configure a browser to use it
+package clientcore
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// ControlOptions configures a control API handler
+type ControlOptions struct {
+	// The addresses at which browsers can reach the local HTTP and SOCKS5 proxies, for the PAC file.
+	// Either may be "", but not both.
+	HTTPProxy  string
+	SOCKSProxy string
+
+	// If non-nil, the PAC file sends destinations which this routes direct straight there
+	SplitTunnel *SplitTunnel
+
+	// If either is set, the API requires these credentials via Basic auth. The PAC file doesn't,
+	// since browsers fetch it without any.
+	Username string
+	Password string
+}
+
+// ControlStatus is the response to GET /status
+type ControlStatus struct {
+	Version    string `json:"version"`
+	Started    bool   `json:"started"`
+	Connected  bool   `json:"connected"` // To the egress server
+	HTTPProxy  string `json:"httpProxy,omitempty"`
+	SOCKSProxy string `json:"socksProxy,omitempty"`
+	PAC        string `json:"pac"` // The path of the PAC file
+}
+
+// NewControlHandler returns the control API for c:
+//
+//	GET  /proxy.pac  a PAC file pointing at the local proxies
+//	GET  /status     a ControlStatus, as JSON
+//	POST /start      start the client, or 409 if it's started
+//	POST /stop       stop the client, or 409 if it's stopped
+//
+// The handler refuses requests from web pages, which could otherwise stop the client or fingerprint
+// the user, but accepts them from browser extensions and other local programs.
+func NewControlHandler(c *Client, opt *ControlOptions) http.Handler {
+	log := common.NewLogger("component", "control")
+	lpOpt := &LocalProxyOptions{Username: opt.Username, Password: opt.Password}
+
+	lifecycle := func(f func() error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			err := f()
+			switch {
+			case err == nil:
+				w.WriteHeader(http.StatusNoContent)
+			case errors.Is(err, ErrClientStarted), errors.Is(err, ErrClientStopped):
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			}
+
+			log.Info("control API request", "path", r.URL.Path, "err", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /proxy.pac", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(PACFile(opt.HTTPProxy, opt.SOCKSProxy, opt.SplitTunnel)))
+	})
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		status := ControlStatus{
+			Version:    common.Version,
+			Started:    c.Started(),
+			HTTPProxy:  opt.HTTPProxy,
+			SOCKSProxy: opt.SOCKSProxy,
+			PAC:        "/proxy.pac",
+		}
+
+		if q := c.Engine().Stats().QUIC; q != nil {
+			status.Connected = q.Connected
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+
+	mux.HandleFunc("POST /start", lifecycle(c.Start))
+	mux.HandleFunc("POST /stop", lifecycle(c.Stop))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !localHost(r.Host) {
+			// A web page which rebinds its domain to our address can reach us, but only by its own name
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		if webOrigin(r.Header.Get("Origin")) {
+			// Browsers let web pages send us POSTs without asking first, but they always say who they are
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		if lpOpt.authRequired() && r.URL.Path != "/proxy.pac" {
+			username, password, ok := r.BasicAuth()
+			if !ok || !lpOpt.authorized(username, password) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="broflake"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// localHost returns true if host, from a Host header, names the local machine
+func localHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// webOrigin returns true if origin, from an Origin header, belongs to a web page. Sandboxed pages
+// and local files have the origin "null". Browser extensions have their own schemes.
+func webOrigin(origin string) bool {
+	if origin == "null" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
@@ -0,0 +1,157 @@
+//go:build !wasm
+
+package clientcore
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/broflake/clientcore/sim"
+)
+
+func TestControlAPI(t *testing.T) {
+	e := newSimEnv(t, 2*time.Second, 2*time.Second, sim.NATEasy)
+	c := newSimClient(t, context.Background(), e, "desktop", 0, "")
+	defer c.Close()
+
+	srv := httptest.NewServer(NewControlHandler(c, &ControlOptions{HTTPProxy: "127.0.0.1:1080", SOCKSProxy: "127.0.0.1:1081"}))
+	defer srv.Close()
+
+	do := func(method, path string, header http.Header) (int, string) {
+		t.Helper()
+
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if host := header.Get("Host"); host != "" {
+			req.Host = host
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+
+	status := func() ControlStatus {
+		t.Helper()
+
+		code, body := do(http.MethodGet, "/status", nil)
+		if code != http.StatusOK {
+			t.Fatalf("GET /status: %v %v", code, body)
+		}
+
+		var s ControlStatus
+		if err := json.Unmarshal([]byte(body), &s); err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	if s := status(); s.Started || s.HTTPProxy != "127.0.0.1:1080" {
+		t.Fatalf("unexpected status before starting: %+v", s)
+	}
+
+	for _, step := range []struct {
+		path string
+		want int
+	}{
+		{"/stop", http.StatusConflict},
+		{"/start", http.StatusNoContent},
+		{"/start", http.StatusConflict},
+	} {
+		if code, body := do(http.MethodPost, step.path, nil); code != step.want {
+			t.Fatalf("POST %v: got %v %v, expected %v", step.path, code, body, step.want)
+		}
+	}
+
+	if !status().Started {
+		t.Fatal("expected the client to be started")
+	}
+
+	// Web pages can't stop us, either by posting to us or by rebinding their own names to us
+	for _, header := range []http.Header{
+		{"Origin": {"https://evil.example"}},
+		{"Origin": {"null"}},
+		{"Host": {"evil.example"}},
+	} {
+		if code, _ := do(http.MethodPost, "/stop", header); code != http.StatusForbidden {
+			t.Fatalf("POST /stop with %v: got %v, expected it to be forbidden", header, code)
+		}
+	}
+
+	// But browser extensions can
+	if code, body := do(http.MethodPost, "/stop", http.Header{"Origin": {"moz-extension://1234"}}); code != http.StatusNoContent {
+		t.Fatalf("POST /stop from an extension: got %v %v", code, body)
+	}
+
+	if status().Started {
+		t.Fatal("expected the client to be stopped")
+	}
+
+	code, pac := do(http.MethodGet, "/proxy.pac", nil)
+	if code != http.StatusOK || !strings.Contains(pac, "PROXY 127.0.0.1:1080; SOCKS5 127.0.0.1:1081") {
+		t.Fatalf("GET /proxy.pac: %v\n%v", code, pac)
+	}
+
+	c.Close()
+	if code, _ := do(http.MethodPost, "/start", nil); code != http.StatusServiceUnavailable {
+		t.Fatalf("POST /start after Close: got %v, expected %v", code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestControlAPIAuth(t *testing.T) {
+	e := newSimEnv(t, 2*time.Second, 2*time.Second, sim.NATEasy)
+	c := newSimClient(t, context.Background(), e, "desktop", 0, "")
+	defer c.Close()
+
+	srv := httptest.NewServer(NewControlHandler(c, &ControlOptions{HTTPProxy: "127.0.0.1:1080", Username: "nelson", Password: "hunter2"}))
+	defer srv.Close()
+
+	get := func(path, username, password string) int {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if code := get("/status", "", ""); code != http.StatusUnauthorized {
+		t.Fatalf("GET /status without credentials: got %v", code)
+	}
+
+	if code := get("/status", "nelson", "hunter3"); code != http.StatusUnauthorized {
+		t.Fatalf("GET /status with bad credentials: got %v", code)
+	}
+
+	if code := get("/status", "nelson", "hunter2"); code != http.StatusOK {
+		t.Fatalf("GET /status with credentials: got %v", code)
+	}
+
+	// Browsers fetch PAC files without credentials
+	if code := get("/proxy.pac", "", ""); code != http.StatusOK {
+		t.Fatalf("GET /proxy.pac: got %v", code)
+	}
+}
@@ -6,6 +6,7 @@ package clientcore
 
 import (
 	"context"
+	"net/url"
 	"sync"
 	"time"
 
@@ -14,108 +15,176 @@ import (
 	"github.com/getlantern/broflake/common"
 )
 
+const (
+	egressConsumerStateDial = iota
+	egressConsumerStateProxy
+)
+
 func NewEgressConsumerWebSocket(options *EgressOptions, wg *sync.WaitGroup) *WorkerFSM {
-	return NewWorkerFSM(wg, []FSMstate{
-		FSMstate(func(ctx context.Context, com *ipcChan, input []interface{}) (int, []interface{}) {
-			// State 0
-			// (no input data)
-			common.Debugf("Egress consumer state 0, opening WebSocket connection...")
-
-			// We're resetting this slot, so send a nil path assertion IPC message
-			com.tx <- IPCMsg{IpcType: PathAssertionIPC, Data: common.PathAssertion{}}
-
-			// TODO: interesting quirk here: if the table router which manages this WorkerFSM implements
-			// non-multiplexed just-in-time strategy wherein it creates a new websocket connection for
-			// each new censored peer, we've got a chicken and egg deadlock: the consumer table won't
-			// start advertising connectivity until it detects a non-nil path assertion, and we won't
-			// have a non-nil path assertion until a censored peer connects to us. 3 poss solutions: make
-			// this egress consumer WorkerFSM always emit a (*, 1) path assertion, even when it doesn't
-			// have upstream connectivity... OR invent another special case for the host field which
-			// indicates "on request", as an escape hatch which indicates to a consumer table that it
-			// can use that slot to dial a lantern-controlled exit node, so we'd be emitting something
-			// like ($, 1)... OR just disallow just-in-time strategies, and make egress consumers
-			// pre-establish N websocket connections
-
-			options.ConnectTimeout = 15 * time.Second
-			ctx, cancel := context.WithTimeout(context.Background(), options.ConnectTimeout)
-			defer cancel()
-
-			// TODO: WSS
-
-			c, _, err := websocket.Dial(ctx, options.Addr+options.Endpoint, nil)
-			if err != nil {
-				common.Debugf("Couldn't connect to egress server at %v: %v", options.Addr, err)
-				<-time.After(options.ErrorBackoff)
-				return 0, []interface{}{}
-			}
-
-			return 1, []interface{}{c}
-		}),
-		FSMstate(func(ctx context.Context, com *ipcChan, input []interface{}) (int, []interface{}) {
-			// State 1
-			// input[0]: *websocket.Conn
-			c := input[0].(*websocket.Conn)
-			common.Debugf("Egress consumer state 1, WebSocket connection established!")
-
-			// Send a path assertion IPC message representing the connectivity now provided by this slot
-			// TODO: post-MVP we shouldn't be hardcoding (*, 1) here...
-			allowAll := []common.Endpoint{{Host: "*", Distance: 1}}
-			com.tx <- IPCMsg{IpcType: PathAssertionIPC, Data: common.PathAssertion{Allow: allowAll}}
-
-			// WebSocket read loop:
-			readStatus := make(chan error)
-			go func(ctx context.Context) {
-				for {
-					_, b, err := c.Read(ctx)
-					if err != nil {
-						readStatus <- err
-						return
-					}
+	return newEgressConsumerWebSocket(newLiveOptions(options), wg)
+}
 
-					// Wrap the chunk and send it on to the router
+func newEgressConsumerWebSocket(live *liveOptions[EgressOptions], wg *sync.WaitGroup) *WorkerFSM {
+	var options *EgressOptions
+	var reconnect <-chan struct{}
+	var c *websocket.Conn
+
+	fsm := NewWorkerFSM(wg, []FSMstate{
+		{
+			Name: "dial",
+			Next: []int{egressConsumerStateDial, egressConsumerStateProxy},
+			Run: func(ctx context.Context, com *ipcChan) (int, string) {
+				// State 0
+				log := common.LoggerFrom(ctx)
+
+				// Pick up any options which were updated since our last reset
+				options, _, reconnect = live.load()
+				log.Debug("opening WebSocket connection", "addr", options.Addr)
+
+				// We're resetting this slot, so send a nil path assertion IPC message
+				com.tx <- IPCMsg{IpcType: PathAssertionIPC, Data: common.PathAssertion{}}
+
+				// TODO: interesting quirk here: if the table router which manages this WorkerFSM implements
+				// non-multiplexed just-in-time strategy wherein it creates a new websocket connection for
+				// each new censored peer, we've got a chicken and egg deadlock: the consumer table won't
+				// start advertising connectivity until it detects a non-nil path assertion, and we won't
+				// have a non-nil path assertion until a censored peer connects to us. 3 poss solutions: make
+				// this egress consumer WorkerFSM always emit a (*, 1) path assertion, even when it doesn't
+				// have upstream connectivity... OR invent another special case for the host field which
+				// indicates "on request", as an escape hatch which indicates to a consumer table that it
+				// can use that slot to dial a lantern-controlled exit node, so we'd be emitting something
+				// like ($, 1)... OR just disallow just-in-time strategies, and make egress consumers
+				// pre-establish N websocket connections
+
+				dialCtx, cancel := context.WithTimeout(ctx, options.ConnectTimeout)
+				defer cancel()
+
+				// TODO: WSS
+
+				var err error
+				c, _, err = websocket.Dial(dialCtx, egressURL(options), egressDialOptions(options))
+				if err != nil {
+					log.Warn("couldn't connect to egress server", "addr", options.Addr, "err", err)
 					select {
-					case com.tx <- IPCMsg{IpcType: ChunkIPC, Data: b}:
-						// Do nothing, msg sent
-					default:
-						// Drop the chunk if we can't keep up with the data rate
+					case <-time.After(options.ErrorBackoff):
+					case <-ctx.Done():
 					}
+					return egressConsumerStateDial, "egress server unreachable"
 				}
-			}(ctx)
-
-			// Main loop:
-			// 1. handle chunks from the bus, write them to the WebSocket, detect and handle write errors
-			// 2. listen for errors from the read goroutine and handle them
-
-			// On read or write error, we counterintuitively close the websocket with StatusNormalClosure.
-			// This is to ensure that the egress server detects closed connections while respecting a
-			// quirk in our WS library's net.Conn wrapper: https://pkg.go.dev/nhooyr.io/websocket#NetConn
-			for {
-				select {
-				case msg := <-com.rx:
-					// Write the chunk to the websocket, detect and handle error
-					// TODO: is it safe to assume the message is a chunk type? Do we trust the router?
-					err := c.Write(context.Background(), websocket.MessageBinary, msg.Data.([]byte))
-					if err != nil {
-						c.Close(websocket.StatusNormalClosure, err.Error())
-						common.Debugf("Egress consumer WebSocket write error: %v", err)
-						return 0, []interface{}{}
+
+				return egressConsumerStateProxy, "WebSocket connected"
+			},
+		},
+		{
+			Name: "proxy",
+			Next: []int{egressConsumerStateDial},
+			Run: func(ctx context.Context, com *ipcChan) (int, string) {
+				// State 1
+				log := common.LoggerFrom(ctx)
+				log.Info("WebSocket connection established", "addr", options.Addr)
+
+				// State 0 replaces c when it redials, so this state and its read goroutine hold their own
+				// reference to the connection they were handed
+				conn := c
+
+				// Send a path assertion IPC message representing the connectivity now provided by this slot
+				// TODO: post-MVP we shouldn't be hardcoding (*, 1) here...
+				allowAll := []common.Endpoint{{Host: "*", Distance: 1}}
+				com.tx <- IPCMsg{IpcType: PathAssertionIPC, Data: common.PathAssertion{Allow: allowAll}}
+
+				// WebSocket read loop:
+				readStatus := make(chan error, 1)
+				go func(ctx context.Context) {
+					for {
+						_, b, err := conn.Read(ctx)
+						if err != nil {
+							readStatus <- err
+							return
+						}
+
+						// Wrap the chunk and send it on to the router, dropping it if we can't keep up
+						com.sendChunk(ctx, IPCMsg{IpcType: ChunkIPC, Data: b})
+					}
+				}(ctx)
+
+				// Main loop:
+				// 1. handle chunks from the bus, write them to the WebSocket, detect and handle write errors
+				// 2. listen for errors from the read goroutine and handle them
+				// 3. reconnect if our options have been updated such that this connection is stale
+
+				// On read or write error, we counterintuitively close the websocket with StatusNormalClosure.
+				// This is to ensure that the egress server detects closed connections while respecting a
+				// quirk in our WS library's net.Conn wrapper: https://pkg.go.dev/nhooyr.io/websocket#NetConn
+				for {
+					select {
+					case msg := <-com.rx:
+						// Write the chunk to the websocket, detect and handle error
+						// TODO: is it safe to assume the message is a chunk type? Do we trust the router?
+						err := conn.Write(context.Background(), websocket.MessageBinary, msg.Data.([]byte))
+						if err != nil {
+							conn.Close(websocket.StatusNormalClosure, err.Error())
+							log.Info("WebSocket write error", "err", err)
+							return egressConsumerStateDial, "WebSocket write error"
+						}
+					case <-reconnect:
+						conn.Close(websocket.StatusNormalClosure, "egress server changed")
+						log.Info("egress options changed, reconnecting")
+						return egressConsumerStateDial, "egress server changed"
+					case err := <-readStatus:
+						conn.Close(websocket.StatusNormalClosure, err.Error())
+						log.Info("WebSocket read error", "err", err)
+						return egressConsumerStateDial, "WebSocket read error"
+
+						// Ordinarily it would be incorrect to put a worker into an infinite loop without including
+						// a case to listen for context cancellation, but here we handle context cancellation in a
+						// non-explicit way. Since the worker context bounds the call to websocket.Read, worker
+						// context cancellation results in a Read error, which we trap to stop the child read
+						// goroutine, close the websocket, and return from this state, at which point the worker
+						// stop logic in protocol.go takes over and kills this goroutine.
 					}
-				case err := <-readStatus:
-					c.Close(websocket.StatusNormalClosure, err.Error())
-					common.Debugf("Egress consumer WebSocket read error: %v", err)
-					return 0, []interface{}{}
-
-					// Ordinarily it would be incorrect to put a worker into an infinite loop without including
-					// a case to listen for context cancellation, but here we handle context cancellation in a
-					// non-explicit way. Since the worker context bounds the call to websocket.Read, worker
-					// context cancellation results in a Read error, which we trap to stop the child read
-					// goroutine, close the websocket, and return from this state, at which point the worker
-					// stop logic in protocol.go takes over and kills this goroutine.
 				}
-			}
+			},
+		},
+	})
+
+	fsm.traceAttempts("egress_connection_attempt", egressConsumerStateDial, egressConsumerStateProxy)
 
-			// TODO: We shouldn't reach this code path, right?
-			return 0, []interface{}{}
-		}),
+	// The proxy state closes the WebSocket on its way out, but we may be stopped before we reach it
+	fsm.onStop(func() {
+		if c != nil {
+			c.Close(websocket.StatusNormalClosure, "stopped")
+		}
 	})
+
+	return fsm
+}
+
+// egressURL returns the URL of the egress server's WebSocket endpoint. We send our protocol version,
+// tag and client version as query parameters, since browsers can't set headers on WebSockets.
+func egressURL(options *EgressOptions) string {
+	u, err := url.Parse(options.Addr + options.Endpoint)
+	if err != nil {
+		return options.Addr + options.Endpoint
+	}
+
+	q := u.Query()
+	q.Set("version", common.Version)
+	if options.Tag != "" {
+		q.Set("tag", options.Tag)
+	}
+	if options.ClientVersion != "" {
+		q.Set("clientVersion", options.ClientVersion)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// egressDialOptions presents our token, if we have one, in a subprotocol
+func egressDialOptions(options *EgressOptions) *websocket.DialOptions {
+	opt := &websocket.DialOptions{}
+	if options.Token != "" {
+		opt.Subprotocols = []string{common.TokenSubprotocol(options.Token)}
+	}
+
+	return opt
 }
@@ -0,0 +1,299 @@
+// egress_consumer_datagram.go implements egress consumer behavior over transports which carry
+// chunks to the egress server as datagrams: plain UDP for native widgets, and WebTransport for
+// browsers which support it. The states are those of the WebSocket egress consumer (see
+// egress_consumer.go), but since datagrams aren't retransmitted or ordered, a chunk lost on its way
+// to or from the egress server doesn't hold up the chunks behind it.
+
+package clientcore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// egressDatagramConn is a connection to the egress server which carries a chunk in each datagram.
+// Closing it ends any read in progress.
+type egressDatagramConn interface {
+	readChunk() ([]byte, error)
+	writeChunk(b []byte) error
+	close(reason string)
+}
+
+func NewEgressConsumerDatagram(options *EgressOptions, wg *sync.WaitGroup) *WorkerFSM {
+	return newEgressConsumerDatagram(newLiveOptions(options), wg)
+}
+
+func newEgressConsumerDatagram(live *liveOptions[EgressOptions], wg *sync.WaitGroup) *WorkerFSM {
+	var options *EgressOptions
+	var reconnect <-chan struct{}
+	var c egressDatagramConn
+
+	fsm := NewWorkerFSM(wg, []FSMstate{
+		{
+			Name: "dial",
+			Next: []int{egressConsumerStateDial, egressConsumerStateProxy},
+			Run: func(ctx context.Context, com *ipcChan) (int, string) {
+				// State 0
+				log := common.LoggerFrom(ctx)
+
+				// Pick up any options which were updated since our last reset
+				options, _, reconnect = live.load()
+				log.Debug("connecting to egress server", "addr", options.Addr, "transport", options.Transport)
+
+				// We're resetting this slot, so send a nil path assertion IPC message
+				com.tx <- IPCMsg{IpcType: PathAssertionIPC, Data: common.PathAssertion{}}
+
+				dialCtx, cancel := context.WithTimeout(ctx, options.ConnectTimeout)
+				defer cancel()
+
+				var err error
+				c, err = dialEgressDatagram(dialCtx, options)
+				if err != nil {
+					log.Warn("couldn't connect to egress server", "addr", options.Addr, "transport", options.Transport, "err", err)
+					select {
+					case <-time.After(options.ErrorBackoff):
+					case <-ctx.Done():
+					}
+					return egressConsumerStateDial, "egress server unreachable"
+				}
+
+				return egressConsumerStateProxy, "connected"
+			},
+		},
+		{
+			Name: "proxy",
+			Next: []int{egressConsumerStateDial},
+			Run: func(ctx context.Context, com *ipcChan) (int, string) {
+				// State 1
+				log := common.LoggerFrom(ctx)
+				log.Info("egress connection established", "addr", options.Addr, "transport", options.Transport)
+
+				// Pin the connection we were handed: a redial in state 0 reassigns c while our reader may
+				// still be draining this one
+				conn := c
+
+				// Send a path assertion IPC message representing the connectivity now provided by this slot
+				// TODO: post-MVP we shouldn't be hardcoding (*, 1) here...
+				allowAll := []common.Endpoint{{Host: "*", Distance: 1}}
+				com.tx <- IPCMsg{IpcType: PathAssertionIPC, Data: common.PathAssertion{Allow: allowAll}}
+
+				// Unlike a WebSocket's, our reads aren't bounded by the worker context, so when it's
+				// cancelled, we close the connection to end them
+				stop := context.AfterFunc(ctx, func() { conn.close("stopped") })
+				defer stop()
+
+				readStatus := make(chan error, 1)
+				go func() {
+					for {
+						b, err := conn.readChunk()
+						if err != nil {
+							readStatus <- err
+							return
+						}
+
+						// Send the chunk on to the router, dropping it if we can't keep up
+						com.sendChunk(ctx, IPCMsg{IpcType: ChunkIPC, Data: b})
+					}
+				}()
+
+				for {
+					select {
+					case msg := <-com.rx:
+						if err := conn.writeChunk(msg.Data.([]byte)); err != nil {
+							conn.close(err.Error())
+							log.Info("egress write error", "err", err)
+							return egressConsumerStateDial, "write error"
+						}
+					case <-reconnect:
+						conn.close("egress server changed")
+						log.Info("egress options changed, reconnecting")
+						return egressConsumerStateDial, "egress server changed"
+					case err := <-readStatus:
+						conn.close(err.Error())
+						log.Info("egress read error", "err", err)
+						return egressConsumerStateDial, "read error"
+					}
+				}
+			},
+		},
+	})
+
+	fsm.traceAttempts("egress_connection_attempt", egressConsumerStateDial, egressConsumerStateProxy)
+
+	// The proxy state closes the connection on its way out, but we may be stopped before we reach it
+	fsm.onStop(func() {
+		if c != nil {
+			c.close("stopped")
+		}
+	})
+
+	return fsm
+}
+
+func dialEgressDatagram(ctx context.Context, options *EgressOptions) (egressDatagramConn, error) {
+	switch options.Transport {
+	case EgressTransportQUIC:
+		return dialEgressUDP(ctx, options)
+	case EgressTransportWebTransport:
+		return dialEgressWebTransport(ctx, options)
+	}
+
+	return nil, fmt.Errorf("egress transport '%v' doesn't carry datagrams", options.Transport)
+}
+
+// egressQuery returns what we present to the egress server when we connect. Over native QUIC, it
+// goes in a hello which travels in the clear, so it never includes our token, which we prove we
+// hold only if the egress server challenges us to.
+func egressQuery(options *EgressOptions) url.Values {
+	q := url.Values{"version": {common.Version}}
+	if options.Tag != "" {
+		q.Set("tag", options.Tag)
+	}
+	if options.ClientVersion != "" {
+		q.Set("clientVersion", options.ClientVersion)
+	}
+
+	return q
+}
+
+// egressSessionURL returns the URL of the egress server's WebTransport endpoint. Unlike over a
+// WebSocket, we present our token in the URL, which TLS keeps private.
+func egressSessionURL(options *EgressOptions) string {
+	q := egressQuery(options)
+	if options.Token != "" {
+		q.Set("token", options.Token)
+	}
+
+	return options.Addr + options.Endpoint + "?" + q.Encode()
+}
+
+// helloInterval is how long we wait for the egress server to answer our hello before saying it again
+const helloInterval = time.Second
+
+// maxDatagramSize bounds the chunks we receive over UDP
+const maxDatagramSize = 1500
+
+// udpEgressConn relays chunks to the egress server as they are, in plain UDP datagrams
+type udpEgressConn struct {
+	conn net.Conn
+	buf  []byte
+}
+
+func dialEgressUDP(ctx context.Context, options *EgressOptions) (egressDatagramConn, error) {
+	u, err := url.Parse(options.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &udpEgressConn{conn: conn, buf: make([]byte, maxDatagramSize)}
+	if err := c.hello(ctx, egressQuery(options), options.Token); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// hello introduces us to the egress server (see common.Hello), proving we hold token if it
+// challenges us to. Either of our messages may be lost, so we say hello until the egress server
+// answers.
+func (c *udpEgressConn) hello(ctx context.Context, q url.Values, token string) error {
+	hello := common.NewHello(q)
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	for {
+		if _, err := c.conn.Write(hello); err != nil {
+			return err
+		}
+
+		deadline := time.Now().Add(helloInterval)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		c.conn.SetReadDeadline(deadline)
+
+		n, err := c.conn.Read(c.buf)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		// Anything else is left over from a connection we've forgotten
+		status, ok := common.ParseHelloReply(c.buf[:n])
+		if !ok {
+			continue
+		}
+
+		// Our token never travels in the clear, so we answer the egress server's nonce with proof
+		// of it instead, and say hello again
+		if nonce, ok := common.ParseHelloChallenge(c.buf[:n]); ok && token != "" {
+			claims, proof, err := common.TokenProof(token, nonce)
+			if err != nil {
+				return err
+			}
+
+			q.Set("nonce", nonce)
+			q.Set("claims", claims)
+			q.Set("proof", proof)
+			hello = common.NewHello(q)
+			continue
+		}
+
+		if status != http.StatusOK {
+			return fmt.Errorf("egress server refused us: %v %v", status, http.StatusText(status))
+		}
+
+		return nil
+	}
+}
+
+func (c *udpEgressConn) readChunk() ([]byte, error) {
+	for {
+		n, err := c.conn.Read(c.buf)
+		if err != nil {
+			return nil, err
+		}
+
+		// The egress server may answer our hello more than once, but any other answer means it's
+		// forgotten us, and so won't accept our chunks until we say hello again
+		if n > 0 && c.buf[0] == common.Hello {
+			if status, ok := common.ParseHelloReply(c.buf[:n]); ok && status != http.StatusOK {
+				return nil, fmt.Errorf("egress server dropped us: %v %v", status, http.StatusText(status))
+			}
+			continue
+		}
+
+		b := make([]byte, n)
+		copy(b, c.buf)
+		return b, nil
+	}
+}
+
+func (c *udpEgressConn) writeChunk(b []byte) error {
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *udpEgressConn) close(reason string) {
+	c.conn.Close()
+}
@@ -0,0 +1,142 @@
+//go:build !wasm
+
+package clientcore
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/getlantern/broflake/common"
+)
+
+func TestDialEgressUDP(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Our stand-in egress server loses the first hello, answers the second one twice, relays a
+	// chunk, and then forgets the widget
+	chunk := []byte{0xc0, 1, 2, 3}
+	greetings := make(chan url.Values, 1)
+	go func() {
+		b := make([]byte, maxDatagramSize)
+		for hellos := 0; ; {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+
+			q, ok := common.ParseHello(b[:n])
+			if !ok {
+				continue
+			}
+
+			if hellos++; hellos == 1 {
+				continue
+			}
+
+			greetings <- q
+			conn.WriteTo(common.NewHelloReply(http.StatusOK), addr)
+			conn.WriteTo(common.NewHelloReply(http.StatusOK), addr)
+			conn.WriteTo(chunk, addr)
+			conn.WriteTo(common.NewHelloReply(http.StatusPreconditionRequired), addr)
+		}
+	}()
+
+	egOpt := NewDefaultEgressOptions()
+	egOpt.Addr = "udp://" + conn.LocalAddr().String()
+	egOpt.Transport = EgressTransportQUIC
+	egOpt.Tag = "NELSON WUZ HERE"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := dialEgressUDP(ctx, egOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close("done")
+
+	if q := <-greetings; q.Get("version") != common.Version || q.Get("tag") != egOpt.Tag {
+		t.Errorf("got hello %v, expected our version and tag", q)
+	}
+
+	if b, err := c.readChunk(); err != nil || !bytes.Equal(b, chunk) {
+		t.Fatalf("got %x %v, expected our chunk", b, err)
+	}
+
+	if _, err := c.readChunk(); err == nil {
+		t.Fatal("expected an error once the egress server forgot us")
+	}
+}
+
+func TestDialEgressUDPChallenge(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Our stand-in egress server challenges our first hello, and admits us once we answer
+	greetings := make(chan url.Values, 2)
+	go func() {
+		b := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+
+			q, ok := common.ParseHello(b[:n])
+			if !ok {
+				continue
+			}
+
+			greetings <- q
+			if q.Get("nonce") == "" {
+				conn.WriteTo(common.NewHelloChallenge("nonce-1"), addr)
+			} else {
+				conn.WriteTo(common.NewHelloReply(http.StatusOK), addr)
+			}
+		}
+	}()
+
+	key := []byte("NELSON WUZ HERE NELSON WUZ HERE!")
+	egOpt := NewDefaultEgressOptions()
+	egOpt.Addr = "udp://" + conn.LocalAddr().String()
+	egOpt.Transport = EgressTransportQUIC
+	egOpt.Token = common.SignToken(key, "widget-1", time.Now().Add(time.Minute))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := dialEgressDatagram(ctx, egOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close("done")
+
+	// Our hellos travel in the clear, so they mustn't carry our token
+	for i := 0; i < 2; i++ {
+		if q := <-greetings; q.Has("token") {
+			t.Errorf("got hello %v, expected it to leave out our token", q)
+		} else if i == 1 {
+			if _, err := common.VerifyTokenProof(key, q.Get("claims"), "nonce-1", q.Get("proof"), time.Now()); err != nil {
+				t.Errorf("expected our second hello to prove we hold our token: %v", err)
+			}
+		}
+	}
+
+	// Without a token, we can't answer
+	egOpt.Token = ""
+	if _, err := dialEgressDatagram(ctx, egOpt); err == nil {
+		t.Error("expected a challenge to be refused without a token")
+	}
+}
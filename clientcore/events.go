@@ -0,0 +1,159 @@
+// events.go provides a typed event stream for observing a Broflake instance from native Go code
+package clientcore
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/getlantern/broflake/common"
+)
+
+const defaultEventBufferSz = 256
+
+// An Event is one of the concrete event types below. Use a type switch to tell them apart.
+type Event interface {
+	event()
+}
+
+// ThroughputEvent reports a change in downstream throughput, which we measure several times per
+// second
+type ThroughputEvent struct {
+	BytesPerSec int
+}
+
+// ConsumerConnectionEvent reports that a consumer connected to or disconnected from one of our
+// consumer table workers
+type ConsumerConnectionEvent struct {
+	WorkerIdx int
+	Addr      net.IP
+	Connected bool
+}
+
+// PathAssertionEvent reports a change in the connectivity offered by one of our producer table
+// workers. A nil PathAssertion means the worker has lost its upstream connection.
+type PathAssertionEvent struct {
+	WorkerIdx     int
+	PathAssertion common.PathAssertion
+}
+
+// FSMStateEvent reports a state change in a worker in the consumer table or the producer table.
+// Table is "consumer" or "producer".
+type FSMStateEvent struct {
+	Table      string
+	WorkerIdx  int
+	Transition FSMTransition
+}
+
+// ChunkDropEvent reports chunks dropped by a worker since the previous ChunkDropEvent for it
+type ChunkDropEvent struct {
+	Table     string
+	WorkerIdx int
+	Chunks    int
+	Bytes     int
+}
+
+// QUICConnectionEvent reports that a QUICLayer running over this instance's BroflakeConn acquired
+// (Up) or lost (!Up) its connection to the egress server. Err describes why a connection was lost.
+type QUICConnectionEvent struct {
+	Up  bool
+	Err error
+}
+
+// ErrorEvent reports a non-fatal error. Source names the component which encountered it.
+type ErrorEvent struct {
+	Source string
+	Err    error
+}
+
+func (ThroughputEvent) event()         {}
+func (ConsumerConnectionEvent) event() {}
+func (PathAssertionEvent) event()      {}
+func (FSMStateEvent) event()           {}
+func (ChunkDropEvent) event()          {}
+func (QUICConnectionEvent) event()     {}
+func (ErrorEvent) event()              {}
+
+// A Subscription delivers events on C until it's closed. Events are delivered in the order they
+// were published. If a subscriber falls behind and C's buffer fills up, new events are dropped
+// (and counted) rather than blocking the publisher.
+type Subscription struct {
+	C       <-chan Event
+	c       chan Event
+	hub     *eventHub
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// Dropped returns the number of events which were discarded because C was full
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close this Subscription and close C. Closing a closed Subscription is a no-op.
+func (s *Subscription) Close() {
+	s.hub.unsubscribe(s)
+}
+
+// eventHub fans out published events to any number of subscribers without ever blocking
+type eventHub struct {
+	mx     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[*Subscription]struct{})}
+}
+
+func (h *eventHub) subscribe(bufferSz int) *Subscription {
+	if bufferSz <= 0 {
+		bufferSz = defaultEventBufferSz
+	}
+
+	c := make(chan Event, bufferSz)
+	s := &Subscription{C: c, c: c, hub: h}
+
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	if h.closed {
+		s.once.Do(func() { close(c) })
+		return s
+	}
+
+	h.subs[s] = struct{}{}
+	return s
+}
+
+func (h *eventHub) unsubscribe(s *Subscription) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	delete(h.subs, s)
+	s.once.Do(func() { close(s.c) })
+}
+
+func (h *eventHub) publish(e Event) {
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+
+	for s := range h.subs {
+		select {
+		case s.c <- e:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// close closes every Subscription; subsequent subscriptions are closed immediately
+func (h *eventHub) close() {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	h.closed = true
+
+	for s := range h.subs {
+		delete(h.subs, s)
+		s.once.Do(func() { close(s.c) })
+	}
+}
@@ -0,0 +1,86 @@
+package clientcore
+
+import (
+	"testing"
+
+	"github.com/getlantern/broflake/common"
+)
+
+func TestEventHubSlowSubscriber(t *testing.T) {
+	h := newEventHub()
+	slow := h.subscribe(2)
+	fast := h.subscribe(16)
+
+	// Nobody is reading from slow, so this must not block
+	for i := 0; i < 10; i++ {
+		h.publish(ThroughputEvent{BytesPerSec: i})
+	}
+
+	if slow.Dropped() != 8 {
+		t.Fatalf("slow subscriber dropped %v events, expected 8", slow.Dropped())
+	}
+
+	if fast.Dropped() != 0 {
+		t.Fatalf("fast subscriber dropped %v events, expected 0", fast.Dropped())
+	}
+
+	for i := 0; i < 10; i++ {
+		e := <-fast.C
+		if e.(ThroughputEvent).BytesPerSec != i {
+			t.Fatalf("got event %+v out of order, expected %v", e, i)
+		}
+	}
+}
+
+func TestEventHubClose(t *testing.T) {
+	h := newEventHub()
+	a := h.subscribe(1)
+	b := h.subscribe(1)
+
+	a.Close()
+	a.Close()
+
+	if _, ok := <-a.C; ok {
+		t.Fatal("expected a closed Subscription's channel to be closed")
+	}
+
+	h.publish(ErrorEvent{Source: "test"})
+	h.close()
+
+	if _, ok := <-b.C; !ok {
+		t.Fatal("expected an event published before the hub closed to be delivered")
+	}
+
+	if _, ok := <-b.C; ok {
+		t.Fatal("expected closing the hub to close its Subscriptions")
+	}
+
+	c := h.subscribe(1)
+	if _, ok := <-c.C; ok {
+		t.Fatal("expected subscribing to a closed hub to return a closed Subscription")
+	}
+
+	b.Close()
+	h.publish(ErrorEvent{Source: "test"})
+}
+
+func TestSafePathMapChanges(t *testing.T) {
+	m := newSafePathMap()
+	allowAll := common.PathAssertion{Allow: []common.Endpoint{{Host: "*", Distance: 1}}}
+
+	if m.set(0, common.PathAssertion{}) {
+		t.Fatal("a worker which has never asserted a path hasn't changed by asserting a nil one")
+	}
+
+	if !m.set(0, allowAll) {
+		t.Fatal("expected asserting a path to be a change")
+	}
+
+	if m.set(0, common.PathAssertion{Allow: []common.Endpoint{{Host: "*", Distance: 1}}}) {
+		t.Fatal("expected reasserting the same path not to be a change")
+	}
+
+	if !m.set(0, common.PathAssertion{}) || m.set(1, common.PathAssertion{}) {
+		t.Fatal("expected only the worker which lost its path to change")
+	}
+}
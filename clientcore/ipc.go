@@ -1,6 +1,14 @@
 // ipc.go defines structures and functionality for communication between client system components
 package clientcore
 
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
 // ChunkIPC: data plane traffic
 // PathAssertionIPC: how upstream processes describe their connectivity for downstream processes
 // ConsumerInfoIPC: how downstream processes describe their connectivity for upstream processes
@@ -18,6 +26,39 @@ const (
 	BroadcastRoute = workerID(-2)
 )
 
+// FlowPolicyDrop: when an ipcChan is full, drop the chunk immediately
+// FlowPolicyBlock: when an ipcChan is full, block for up to FlowBlockTimeout, then drop the chunk
+const (
+	FlowPolicyDrop FlowPolicy = iota
+	FlowPolicyBlock
+)
+
+// FlowPolicy describes how a sender behaves when it tries to send a chunk on a full ipcChan
+type FlowPolicy int
+
+func (p FlowPolicy) String() string {
+	switch p {
+	case FlowPolicyDrop:
+		return "drop"
+	case FlowPolicyBlock:
+		return "block"
+	default:
+		return "invalid"
+	}
+}
+
+// ParseFlowPolicy parses the name of a FlowPolicy: "drop" or "block"
+func ParseFlowPolicy(s string) (FlowPolicy, error) {
+	switch s {
+	case "drop":
+		return FlowPolicyDrop, nil
+	case "block":
+		return FlowPolicyBlock, nil
+	default:
+		return FlowPolicyDrop, fmt.Errorf("invalid flow policy '%v'", s)
+	}
+}
+
 type msgType int
 type workerID int
 
@@ -28,14 +69,69 @@ type IPCMsg struct {
 }
 
 type ipcChan struct {
-	tx chan IPCMsg
-	rx chan IPCMsg
+	tx           chan IPCMsg
+	rx           chan IPCMsg
+	policy       FlowPolicy
+	blockTimeout time.Duration
+	drops        flowStats
+	traffic      trafficStats
 }
 
 func newIpcChan(bufferSz int) *ipcChan {
 	return &ipcChan{tx: make(chan IPCMsg, bufferSz), rx: make(chan IPCMsg, bufferSz)}
 }
 
+// flowStats counts the chunks (and the bytes they carried) which were discarded because an
+// ipcChan was full. Counters are cumulative for the lifetime of the ipcChan.
+type flowStats struct {
+	chunks atomic.Uint64
+	bytes  atomic.Uint64
+}
+
+// setFlowPolicy configures the behavior of sendChunk for this ipcChan. It must be called before
+// the ipcChan is in use.
+func (c *ipcChan) setFlowPolicy(policy FlowPolicy, blockTimeout time.Duration) {
+	c.policy = policy
+	c.blockTimeout = blockTimeout
+}
+
+// sendChunk sends a ChunkIPC msg on tx, obeying this ipcChan's flow policy. If the chunk can't be
+// sent, it's dropped and counted. Returns true if the chunk was sent.
+func (c *ipcChan) sendChunk(ctx context.Context, msg IPCMsg) bool {
+	select {
+	case c.tx <- msg:
+		return true
+	default:
+		// The fast path failed, so tx is full
+	}
+
+	if c.policy == FlowPolicyBlock && c.blockTimeout > 0 {
+		timer := time.NewTimer(c.blockTimeout)
+		defer timer.Stop()
+
+		select {
+		case c.tx <- msg:
+			return true
+		case <-timer.C:
+			// Fall through and drop the chunk
+		case <-ctx.Done():
+			// Fall through and drop the chunk
+		}
+	}
+
+	c.drops.chunks.Add(1)
+	if b, ok := msg.Data.([]byte); ok {
+		c.drops.bytes.Add(uint64(len(b)))
+	}
+
+	return false
+}
+
+// dropped returns the cumulative number of chunks and bytes dropped by sendChunk
+func (c *ipcChan) dropped() (chunks, bytes uint64) {
+	return c.drops.chunks.Load(), c.drops.bytes.Load()
+}
+
 type ipcObserver struct {
 	Downstream *ipcChan
 	Upstream   *ipcChan
@@ -43,22 +139,34 @@ type ipcObserver struct {
 	onRx       func(IPCMsg)
 }
 
-func (o *ipcObserver) Start() {
-	go func() {
-		for {
-			msg := <-o.Downstream.tx
-			o.onTx(msg)
-			o.Upstream.tx <- msg
+// Start the bus. It runs until ctx is cancelled; wg, if non-nil, tracks its goroutines.
+func (o *ipcObserver) Start(ctx context.Context, wg *sync.WaitGroup) {
+	relay := func(from, to chan IPCMsg, observe func(IPCMsg)) {
+		if wg != nil {
+			defer wg.Done()
 		}
-	}()
 
-	go func() {
 		for {
-			msg := <-o.Upstream.rx
-			o.onRx(msg)
-			o.Downstream.rx <- msg
+			select {
+			case msg := <-from:
+				observe(msg)
+				select {
+				case to <- msg:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
 		}
-	}()
+	}
+
+	if wg != nil {
+		wg.Add(2)
+	}
+
+	go relay(o.Downstream.tx, o.Upstream.tx, o.onTx)
+	go relay(o.Upstream.rx, o.Downstream.rx, o.onRx)
 }
 
 func NewIpcObserver(bufferSz int, onTx, onRx func(IPCMsg)) *ipcObserver {
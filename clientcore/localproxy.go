@@ -0,0 +1,308 @@
+// localproxy.go implements the proxies which a desktop client serves to the user's apps
+package clientcore
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// LocalProxyOptions configures a LocalProxy. The zero value serves anyone who can connect, without
+// authentication, which is only OK for a listener nobody else can reach.
+type LocalProxyOptions struct {
+	// If either is set, clients must present these credentials: via Proxy-Authorization (Basic) to
+	// the HTTP proxy, and via username/password authentication (RFC 1929) to the SOCKS5 proxy
+	Username string
+	Password string
+
+	// If non-empty, TCP connections from any other address are refused. Connections over Unix
+	// sockets are always accepted, since the socket's file permissions govern who can make them.
+	AllowedClients []netip.Prefix
+
+	// If non-nil, decides which destinations go through Broflake, which go direct, and which are
+	// blocked. If nil, everything goes through Broflake.
+	SplitTunnel *SplitTunnel
+}
+
+func (o *LocalProxyOptions) authRequired() bool {
+	return o.Username != "" || o.Password != ""
+}
+
+// authorized returns true if username and password match the configured credentials
+func (o *LocalProxyOptions) authorized(username, password string) bool {
+	u := subtle.ConstantTimeCompare([]byte(username), []byte(o.Username))
+	p := subtle.ConstantTimeCompare([]byte(password), []byte(o.Password))
+	return u&p == 1
+}
+
+// allowed returns true if a connection from addr may be served
+func (o *LocalProxyOptions) allowed(addr net.Addr) bool {
+	if len(o.AllowedClients) == 0 {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return false
+	}
+
+	for _, p := range o.AllowedClients {
+		if p.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// proxyListener is a net.Listener which silently closes connections from clients which aren't
+// allowed by its LocalProxyOptions, and which registers the rest with its LocalProxy
+type proxyListener struct {
+	net.Listener
+	p *LocalProxy
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if !l.p.opt.allowed(c.RemoteAddr()) {
+			l.p.log.Warn("refused a connection from a client which isn't allowed", "remoteAddr", c.RemoteAddr())
+			c.Close()
+			continue
+		}
+
+		return l.p.track(c), nil
+	}
+}
+
+// trackedConn is a net.Conn which unregisters itself from its LocalProxy when it's closed
+type trackedConn struct {
+	net.Conn
+	p    *LocalProxy
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.p.untrack(c) })
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes the connection if the listener it came from supports that, and otherwise
+// closes it
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Close()
+}
+
+// LocalProxy serves an HTTP proxy (supporting CONNECT and plain HTTP requests) and a SOCKS5 proxy,
+// which tunnel the user's traffic to the egress server over a ReliableStreamLayer, usually a
+// QUICLayer. It serves on listeners supplied by the caller, so it can be served on TCP, on Unix
+// sockets, or behind an embedding application's own listener.
+type LocalProxy struct {
+	opt    *LocalProxyOptions
+	srv    *http.Server
+	socks  *SOCKS5Server
+	direct *http.Transport // For plain HTTP requests which the split tunnel sends direct
+	log    common.Logger
+	mx     sync.Mutex
+	conns  map[*trackedConn]struct{} // Includes connections hijacked for CONNECT, which srv forgets
+	done   bool
+}
+
+// routeKey is the context key for the Route of an HTTP proxy request
+type routeKey struct{}
+
+func NewLocalProxy(layer ReliableStreamLayer, opt *LocalProxyOptions) *LocalProxy {
+	if opt == nil {
+		opt = &LocalProxyOptions{}
+	}
+
+	direct := http.DefaultTransport.(*http.Transport).Clone()
+	direct.Proxy = nil
+
+	p := &LocalProxy{
+		opt:    opt,
+		socks:  NewSOCKS5Server(layer, opt),
+		direct: direct,
+		log:    common.NewLogger("component", "localproxy"),
+		conns:  make(map[*trackedConn]struct{}),
+	}
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Verbose = common.LogLevelEnabled(common.LevelDebug)
+	proxy.ConnectDialWithReq = func(r *http.Request, network, addr string) (net.Conn, error) {
+		return dialRoute(r.Context(), layer, routeFrom(r.Context()), addr)
+	}
+	proxy.Tr = CreateHTTPTransport(layer)
+
+	proxy.OnRequest().DoFunc(
+		func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			route := routeFrom(r.Context())
+			p.log.Debug("HTTP proxy just saw a request", "method", r.Method, "host", r.Host, "route", route)
+
+			if route == RouteDirect {
+				ctx.RoundTripper = goproxy.RoundTripperFunc(
+					func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+						return p.direct.RoundTrip(r)
+					},
+				)
+			}
+			return r, nil
+		},
+	)
+
+	p.srv = &http.Server{Handler: p.authenticate(p.splitTunnel(proxy))}
+	return p
+}
+
+// splitTunnel wraps an HTTP proxy handler to route each request according to our SplitTunnel,
+// refusing blocked destinations and recording the route of the rest in the request's context
+func (p *LocalProxy) splitTunnel(h http.Handler) http.Handler {
+	if p.opt.SplitTunnel == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if r.URL.Host != "" {
+			host = r.URL.Host
+		}
+
+		route := p.opt.SplitTunnel.routeAddr(r.Context(), host)
+		if route == RouteBlock {
+			p.log.Debug("HTTP proxy request blocked by split tunneling rules", "host", host)
+			http.Error(w, ErrRouteBlocked.Error(), http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, route)))
+	})
+}
+
+// routeFrom returns the Route recorded in ctx by splitTunnel, or RouteProxy if there isn't one
+func routeFrom(ctx context.Context) Route {
+	if route, ok := ctx.Value(routeKey{}).(Route); ok {
+		return route
+	}
+
+	return RouteProxy
+}
+
+// authenticate wraps an HTTP proxy handler to demand credentials, if we have any
+func (p *LocalProxy) authenticate(h http.Handler) http.Handler {
+	if !p.opt.authRequired() {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := parseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+		if !ok || !p.opt.authorized(username, password) {
+			p.log.Debug("HTTP proxy request without valid credentials", "remoteAddr", r.RemoteAddr)
+			w.Header().Set("Proxy-Authenticate", `Basic realm="broflake"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		// Our credentials are for us, not for the destination
+		r.Header.Del("Proxy-Authorization")
+		h.ServeHTTP(w, r)
+	})
+}
+
+// parseProxyAuthorization parses the value of a Proxy-Authorization header for Basic auth
+func parseProxyAuthorization(v string) (username, password string, ok bool) {
+	// http.Request knows how to parse this from an Authorization header
+	r := &http.Request{Header: http.Header{"Authorization": {v}}}
+	return r.BasicAuth()
+}
+
+// ServeHTTPProxy serves the HTTP proxy on l until l fails or the LocalProxy is closed. It always
+// returns a non-nil error; after Close, it returns net.ErrClosed.
+func (p *LocalProxy) ServeHTTPProxy(l net.Listener) error {
+	p.mx.Lock()
+	done := p.done
+	p.mx.Unlock()
+
+	if done {
+		return net.ErrClosed
+	}
+
+	p.log.Info("serving HTTP proxy", "addr", l.Addr())
+
+	err := p.srv.Serve(proxyListener{Listener: l, p: p})
+	if errors.Is(err, http.ErrServerClosed) {
+		return net.ErrClosed
+	}
+
+	return err
+}
+
+// ServeSOCKS5 serves the SOCKS5 proxy on l until l fails or the LocalProxy is closed. It always
+// returns a non-nil error; after Close, it returns net.ErrClosed.
+func (p *LocalProxy) ServeSOCKS5(l net.Listener) error {
+	return p.socks.Serve(l)
+}
+
+// Close stops serving on every listener, closing them and every connection being proxied
+func (p *LocalProxy) Close() error {
+	p.mx.Lock()
+	if p.done {
+		p.mx.Unlock()
+		return nil
+	}
+	p.done = true
+
+	conns := make([]*trackedConn, 0, len(p.conns))
+	for c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.mx.Unlock()
+
+	// Closing conns untracks them, so we mustn't hold the lock while we do it
+	for _, c := range conns {
+		c.Close()
+	}
+
+	p.direct.CloseIdleConnections()
+	return errors.Join(p.srv.Close(), p.socks.Close())
+}
+
+func (p *LocalProxy) track(c net.Conn) net.Conn {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	tc := &trackedConn{Conn: c, p: p}
+	if p.done {
+		c.Close()
+	} else {
+		p.conns[tc] = struct{}{}
+	}
+
+	return tc
+}
+
+func (p *LocalProxy) untrack(c *trackedConn) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	delete(p.conns, c)
+}
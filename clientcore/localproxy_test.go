@@ -0,0 +1,275 @@
+//go:build !wasm
+
+package clientcore
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/broflake/egress"
+)
+
+// startLocalProxy serves a LocalProxy backed by an egress stand-in on loopback, returning the
+// addresses of its HTTP and SOCKS5 proxies
+func startLocalProxy(t *testing.T, opt *LocalProxyOptions) (p *LocalProxy, httpAddr, socksAddr string) {
+	return startLocalProxyWithEgress(t, nil, opt)
+}
+
+// startLocalProxyWithEgress is startLocalProxy with an egress stand-in configured by egOpt
+func startLocalProxyWithEgress(t *testing.T, egOpt *egress.ForwarderOptions, opt *LocalProxyOptions) (p *LocalProxy, httpAddr, socksAddr string) {
+	p = NewLocalProxy(startEgress(t, egOpt), opt)
+
+	var addrs []string
+	for _, serve := range []func(net.Listener) error{p.ServeHTTPProxy, p.ServeSOCKS5} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- serve(l) }()
+
+		t.Cleanup(func() {
+			p.Close()
+			if err := <-done; !errors.Is(err, net.ErrClosed) {
+				t.Errorf("serve returned %v, expected net.ErrClosed", err)
+			}
+		})
+
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	return p, addrs[0], addrs[1]
+}
+
+// get fetches target through the proxy at proxyURL, returning the status code and body
+func get(t *testing.T, proxyURL *url.URL, target string) (int, string) {
+	t.Helper()
+
+	tr := &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	defer tr.CloseIdleConnections()
+
+	res, err := (&http.Client{Transport: tr, Timeout: 10 * time.Second}).Get(target)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer res.Body.Close()
+
+	b, _ := io.ReadAll(res.Body)
+	return res.StatusCode, string(b)
+}
+
+// socks5Login performs the SOCKS5 handshake with username/password authentication, returning the
+// conn and the authentication status
+func socks5Login(t *testing.T, proxy, username, password string) (net.Conn, byte) {
+	t.Helper()
+
+	c, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	c.Write([]byte{socks5Version, 1, socks5MethodPassword})
+
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(c, method); err != nil {
+		t.Fatal(err)
+	}
+
+	if method[1] != socks5MethodPassword {
+		t.Fatalf("expected username/password auth, got method %v", method[1])
+	}
+
+	req := []byte{socks5PasswordVersion, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	c.Write(req)
+
+	status := make([]byte, 2)
+	if _, err := io.ReadFull(c, status); err != nil {
+		t.Fatal(err)
+	}
+
+	return c, status[1]
+}
+
+func TestLocalProxyHTTPAuth(t *testing.T) {
+	_, proxy, _ := startLocalProxy(t, &LocalProxyOptions{Username: "nelson", Password: "hunter2"})
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Our credentials mustn't leak to the destination
+		if r.Header.Get("Proxy-Authorization") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		io.WriteString(w, "NELSON WUZ HERE")
+	}))
+	defer origin.Close()
+
+	tlsOrigin := httptest.NewTLSServer(origin.Config.Handler)
+	defer tlsOrigin.Close()
+
+	for _, target := range []string{origin.URL, tlsOrigin.URL} {
+		for name, user := range map[string]*url.Userinfo{
+			"none":  nil,
+			"wrong": url.UserPassword("nelson", "hunter3"),
+			"right": url.UserPassword("nelson", "hunter2"),
+		} {
+			status, body := get(t, &url.URL{Scheme: "http", Host: proxy, User: user}, target)
+
+			switch {
+			case name == "right" && (status != http.StatusOK || body != "NELSON WUZ HERE"):
+				t.Fatalf("%v with valid credentials: got %v %q", target, status, body)
+			case name != "right" && status == http.StatusOK:
+				t.Fatalf("%v with %v credentials: expected to be refused", target, name)
+			}
+		}
+	}
+
+	// Check the challenge, which clients need to know how to authenticate
+	res, err := http.Post("http://"+proxy, "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusProxyAuthRequired || res.Header.Get("Proxy-Authenticate") == "" {
+		t.Fatalf("expected a 407 with a Proxy-Authenticate challenge, got %v %v", res.StatusCode, res.Header)
+	}
+}
+
+func TestLocalProxySOCKS5Auth(t *testing.T) {
+	_, _, proxy := startLocalProxy(t, &LocalProxyOptions{Username: "nelson", Password: "hunter2"})
+	dst := startBanner(t, "")
+
+	// A client which doesn't offer username/password auth is turned away
+	if _, status := socks5Dial(t, proxy, []byte{socks5MethodNoAuth}, socks5CmdConnect, socks5AddrIPv4, dst.IP.To4(), dst.Port); status != socks5MethodNoAcceptable {
+		t.Fatalf("expected no acceptable auth methods, got %v", status)
+	}
+
+	if _, status := socks5Login(t, proxy, "nelson", "hunter3"); status != socks5PasswordFailed {
+		t.Fatalf("expected bad credentials to fail, got %v", status)
+	}
+
+	c, status := socks5Login(t, proxy, "nelson", "hunter2")
+	if status != socks5PasswordOK {
+		t.Fatalf("expected good credentials to succeed, got %v", status)
+	}
+
+	req := append([]byte{socks5Version, socks5CmdConnect, 0x00, socks5AddrIPv4}, dst.IP.To4()...)
+	req = append(req, byte(dst.Port>>8), byte(dst.Port))
+	c.Write(req)
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(c, reply); err != nil || reply[1] != socks5ReplySucceeded {
+		t.Fatalf("CONNECT after authenticating failed: %v, %v", reply, err)
+	}
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "NELSON WUZ HERE")
+	}))
+	defer origin.Close()
+
+	// Go's HTTP client knows RFC 1929 too
+	u := &url.URL{Scheme: "socks5", Host: proxy, User: url.UserPassword("nelson", "hunter2")}
+	if status, body := get(t, u, origin.URL); status != http.StatusOK || body != "NELSON WUZ HERE" {
+		t.Fatalf("got %v %q through an authenticated SOCKS5 proxy", status, body)
+	}
+}
+
+func TestLocalProxyAllowedClients(t *testing.T) {
+	opt := &LocalProxyOptions{AllowedClients: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}}
+	p, httpProxy, socksProxy := startLocalProxy(t, opt)
+
+	// We're connecting from 127.0.0.1, which isn't allowed, so both proxies hang up on us
+	for _, addr := range []string{httpProxy, socksProxy} {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(10 * time.Second))
+
+		io.WriteString(c, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+		if n, err := c.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("read %v bytes from %v, expected it to hang up", n, addr)
+		}
+	}
+
+	// The allowlist doesn't apply to Unix sockets
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.ServeHTTPProxy(l)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "NELSON WUZ HERE")
+	}))
+	defer origin.Close()
+
+	tr := &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: "unix"}),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	res, err := (&http.Client{Transport: tr, Timeout: 10 * time.Second}).Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if b, _ := io.ReadAll(res.Body); string(b) != "NELSON WUZ HERE" {
+		t.Fatalf("unexpected body %q over a Unix socket", b)
+	}
+}
+
+func TestLocalProxyClose(t *testing.T) {
+	p, proxy, _ := startLocalProxy(t, nil)
+	dst := startBanner(t, "")
+
+	c, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	io.WriteString(c, "CONNECT "+dst.String()+" HTTP/1.1\r\nHost: "+dst.String()+"\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v, %v", res, err)
+	}
+
+	p.Close()
+
+	// Closing the proxy closes the tunnels it's serving, which the HTTP server has forgotten about
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected a read error from a closed proxy")
+	}
+
+	if err := p.ServeHTTPProxy(nil); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected ServeHTTPProxy on a closed proxy to fail with net.ErrClosed, got %v", err)
+	}
+}
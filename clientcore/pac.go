@@ -0,0 +1,88 @@
+// pac.go generates proxy auto-config (PAC) files which point browsers at a LocalProxy
+package clientcore
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PACFile returns a proxy auto-config file which sends a browser's traffic to the HTTP proxy at
+// httpAddr, falling back to the SOCKS5 proxy at socksAddr. Either may be "", but not both. If st is
+// non-nil, destinations which it routes direct skip the proxy altogether. PAC files can't look up
+// countries or IPv6 CIDRs, so once a rule which uses them is reached, everything goes to the proxy,
+// which applies the rest of the rules itself.
+func PACFile(httpAddr, socksAddr string, st *SplitTunnel) string {
+	var proxies []string
+	if httpAddr != "" {
+		proxies = append(proxies, "PROXY "+httpAddr)
+	}
+	if socksAddr != "" {
+		// In PAC files, "SOCKS" means SOCKS4, which our SOCKS5 proxy doesn't speak
+		proxies = append(proxies, "SOCKS5 "+socksAddr)
+	}
+	proxy := strconv.Quote(strings.Join(proxies, "; "))
+
+	result := func(r Route) string {
+		if r == RouteDirect {
+			return `"DIRECT"`
+		}
+
+		// Blocked destinations go to the proxy, which refuses them
+		return proxy
+	}
+
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("  host = host.toLowerCase();\n")
+	b.WriteString("  var ip = /^[0-9.]+$/.test(host) || host.indexOf(\":\") >= 0;\n")
+
+	var rules *SplitTunnelRules
+	if st != nil {
+		rules = st.load()
+	}
+
+	if rules == nil {
+		fmt.Fprintf(&b, "  return %v;\n}\n", proxy)
+		return b.String()
+	}
+
+	for i, r := range rules.Rules {
+		var conds []string
+
+		for _, d := range r.Domains {
+			conds = append(conds, fmt.Sprintf("(!ip && (host == %q || dnsDomainIs(host, %q)))", d, "."+d))
+		}
+
+		opaque := len(r.Countries) > 0
+		for _, p := range r.CIDRs {
+			if !p.Addr().Is4() {
+				opaque = true
+				continue
+			}
+
+			mask := net.IP(net.CIDRMask(p.Bits(), 32)).String()
+			cond := fmt.Sprintf("isInNet(host, %q, %q)", p.Addr(), mask)
+
+			// isInNet resolves names, which we only do if the rules say so
+			if !rules.Resolve {
+				cond = "(ip && " + cond + ")"
+			}
+			conds = append(conds, cond)
+		}
+
+		fmt.Fprintf(&b, "  // rules[%v]: %v\n", i, r.Route)
+		if len(conds) > 0 {
+			fmt.Fprintf(&b, "  if (%v) return %v;\n", strings.Join(conds, " ||\n      "), result(r.Route))
+		}
+
+		if opaque {
+			fmt.Fprintf(&b, "  return %v;\n}\n", proxy)
+			return b.String()
+		}
+	}
+
+	fmt.Fprintf(&b, "  return %v;\n}\n", result(rules.Default))
+	return b.String()
+}
@@ -0,0 +1,55 @@
+//go:build !wasm
+
+package clientcore
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPACFile(t *testing.T) {
+	const proxy = `"PROXY 127.0.0.1:1080; SOCKS5 127.0.0.1:1081"`
+
+	// Without rules, everything goes to the proxy
+	pac := PACFile("127.0.0.1:1080", "127.0.0.1:1081", nil)
+	if !strings.Contains(pac, "return "+proxy+";\n}") {
+		t.Fatalf("unexpected PAC file without rules:\n%v", pac)
+	}
+
+	st := NewSplitTunnel(mustParseSplitTunnelRules(t, `{
+		"default": "direct",
+		"rules": [
+			{"route": "block", "domains": ["ads.example.cn"]},
+			{"route": "direct", "domains": ["example.cn"], "cidrs": ["192.168.0.0/16"]},
+			{"route": "direct", "countries": ["CN"]},
+			{"route": "direct", "domains": ["unreachable.example"]}
+		]
+	}`), nil)
+
+	pac = PACFile("127.0.0.1:1080", "", st)
+
+	for _, want := range []string{
+		// Blocked destinations go to the proxy, which refuses them
+		`(!ip && (host == "ads.example.cn" || dnsDomainIs(host, ".ads.example.cn")))) return "PROXY 127.0.0.1:1080";`,
+		`(!ip && (host == "example.cn" || dnsDomainIs(host, ".example.cn")))`,
+
+		// We don't resolve names unless the rules say so
+		`(ip && isInNet(host, "192.168.0.0", "255.255.0.0"))) return "DIRECT";`,
+	} {
+		if !strings.Contains(pac, want) {
+			t.Fatalf("PAC file doesn't contain %v:\n%v", want, pac)
+		}
+	}
+
+	// The country rule hands everything after it to the proxy, including the default route
+	if strings.Contains(pac, "unreachable.example") || !strings.HasSuffix(pac, "  return \"PROXY 127.0.0.1:1080\";\n}\n") {
+		t.Fatalf("expected the PAC file to end at the country rule:\n%v", pac)
+	}
+
+	st.Update(mustParseSplitTunnelRules(t, `{"default": "direct", "resolve": true, "rules": [{"route": "proxy", "cidrs": ["10.0.0.0/8"]}]}`))
+	pac = PACFile("127.0.0.1:1080", "", st)
+
+	if !strings.Contains(pac, `if (isInNet(host, "10.0.0.0", "255.0.0.0")) return "PROXY 127.0.0.1:1080";`) || !strings.HasSuffix(pac, "return \"DIRECT\";\n}\n") {
+		t.Fatalf("unexpected PAC file with resolution:\n%v", pac)
+	}
+}
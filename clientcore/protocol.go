@@ -3,15 +3,18 @@ package clientcore
 
 import (
 	"context"
+	"fmt"
 	"math"
 	"math/rand"
 	"sync"
+	"time"
 
 	"github.com/getlantern/broflake/common"
 )
 
 const (
 	workerBufferSz = 4096
+	fsmHistorySz   = 32
 )
 
 // WorkerFSM implements a Mealy machine: https://en.wikipedia.org/wiki/Mealy_machine
@@ -20,19 +23,31 @@ const (
 type WorkerFSM struct {
 	com          *ipcChan
 	currentState int
-	nextInput    []interface{}
 	state        []FSMstate
+	obs          *fsmObserver
 	ctx          context.Context
 	cancel       context.CancelFunc
 	wg           *sync.WaitGroup
+	cleanup      []func()
+	reporters    []func(ws *WorkerStats)
+	log          common.Logger
+	tel          *fsmTelemetry
 }
 
-// Construct a new WorkerFSM
+// Construct a new WorkerFSM. The state definitions are validated here, and an invalid definition
+// is a programming error, so we panic.
 func NewWorkerFSM(wg *sync.WaitGroup, states []FSMstate) *WorkerFSM {
+	if err := validateFSM(states); err != nil {
+		panic(err)
+	}
+
 	fsm := WorkerFSM{
 		com:   newIpcChan(workerBufferSz),
 		state: states,
+		obs:   newFSMObserver(fsmHistorySz),
 		wg:    wg,
+		log:   common.NewLogger("component", "worker"),
+		tel:   &fsmTelemetry{},
 	}
 
 	return &fsm
@@ -43,22 +58,48 @@ func (fsm *WorkerFSM) Start() {
 	if fsm.wg != nil {
 		fsm.wg.Add(1)
 	}
+
+	fsm.ctx, fsm.cancel = context.WithCancel(context.Background())
+	ctx := fsm.ctx
+
 	go func() {
 		defer func() {
 			if fsm.wg != nil {
 				fsm.wg.Done()
 			}
 		}()
-		common.Debug("Starting WorkerFSM...")
-		fsm.ctx, fsm.cancel = context.WithCancel(context.Background())
+		fsm.log.Debug("starting WorkerFSM")
+		fsm.obs.enter(fsm.currentState, fsm.state[fsm.currentState].Name)
 
 		for {
 			select {
-			case <-fsm.ctx.Done():
-				common.Debug("End of last state, stopping WorkerFSM...")
+			case <-ctx.Done():
+				fsm.log.Debug("end of last state, stopping WorkerFSM")
+
+				// Release whatever the last state left open, and start over from state 0 next time
+				fsm.release()
+				fsm.tel.stop(fsm.currentState)
+				fsm.currentState = 0
 				return
 			default:
-				fsm.currentState, fsm.nextInput = fsm.state[fsm.currentState](fsm.ctx, fsm.com, fsm.nextInput)
+				// Each state logs with the worker's fields plus its own name; see LoggerFrom
+				from := fsm.state[fsm.currentState]
+				began := time.Now()
+				stateCtx, span := fsm.tel.enter(ctx, fsm.currentState, from.Name)
+				stateCtx = common.WithLogger(stateCtx, fsm.log.With("state", from.Name))
+				next, reason := from.Run(stateCtx, fsm.com)
+
+				// State 0 doesn't expect to inherit anything, so release whatever the failed state left open
+				if !from.permits(next) {
+					fsm.log.Error("illegal transition, resetting", "from", from.Name, "to", next, "reason", reason)
+					reason = fmt.Sprintf("illegal transition to %v: %v", next, reason)
+					next = 0
+					fsm.release()
+				}
+
+				fsm.tel.leave(span, fsm.currentState, from.Name, next, fsm.state[next].Name, reason, time.Since(began))
+				fsm.obs.transition(fsm.currentState, from.Name, next, fsm.state[next].Name, reason)
+				fsm.currentState = next
 			}
 		}
 	}()
@@ -66,14 +107,237 @@ func (fsm *WorkerFSM) Start() {
 
 // Stop this WorkerFSM (takes effect upon returning from the currently executing state)
 func (fsm *WorkerFSM) Stop() {
-	fsm.cancel()
+	if fsm.cancel != nil {
+		fsm.cancel()
+	}
 }
 
-// FSMstate encapsulates logic for one state in a WorkerFSM. An FSMstate must return an int
-// corresponding to the next state and a list of any inputs to propagate to the next state.
-// TODO: a state's number simply corresponds to its index in WorkerFSM.state, but we perform no
-// sanity checking of state indices.
-type FSMstate func(ctx context.Context, com *ipcChan, input []interface{}) (int, []interface{})
+// onStop registers a func which is called from the WorkerFSM's goroutine after it has stopped, or
+// been reset by an illegal transition, to release any connections held over from the last state it
+// executed. Must be called before Start.
+func (fsm *WorkerFSM) onStop(f func()) {
+	fsm.cleanup = append(fsm.cleanup, f)
+}
+
+// release calls the funcs registered with onStop
+func (fsm *WorkerFSM) release() {
+	for _, f := range fsm.cleanup {
+		f()
+	}
+}
+
+// setLogger replaces this WorkerFSM's Logger. Must be called before Start.
+func (fsm *WorkerFSM) setLogger(l common.Logger) {
+	fsm.log = l
+}
+
+// traceAttempts declares that this WorkerFSM makes connection attempts, which begin in state
+// 'first' and succeed in state 'connected'. Each attempt is traced as a span named 'name'; see
+// fsmTelemetry. Must be called before Start.
+func (fsm *WorkerFSM) traceAttempts(name string, first, connected int) {
+	fsm.tel.attempt = name
+	fsm.tel.first = first
+	fsm.tel.connected = connected
+}
+
+// onStats registers a func which adds worker-specific details to this WorkerFSM's WorkerStats.
+// It's called from whichever goroutine requests the stats, so it must be safe for concurrent use.
+// Must be called before Start.
+func (fsm *WorkerFSM) onStats(f func(ws *WorkerStats)) {
+	fsm.reporters = append(fsm.reporters, f)
+}
+
+// stats returns a snapshot of this WorkerFSM's state and traffic
+func (fsm *WorkerFSM) stats(now time.Time) WorkerStats {
+	idx, name, since := fsm.State()
+	chunks, bytes := fsm.com.dropped()
+
+	ws := WorkerStats{
+		State:         idx,
+		StateName:     name,
+		Since:         since,
+		TimeInState:   now.Sub(since),
+		BytesIn:       fsm.com.traffic.in.Load(),
+		BytesOut:      fsm.com.traffic.out.Load(),
+		DroppedChunks: chunks,
+		DroppedBytes:  bytes,
+	}
+
+	for _, f := range fsm.reporters {
+		f(&ws)
+	}
+
+	return ws
+}
+
+// State returns the index and name of the state this WorkerFSM is currently executing, along with
+// the time at which it entered that state
+func (fsm *WorkerFSM) State() (idx int, name string, since time.Time) {
+	return fsm.obs.current()
+}
+
+// History returns this WorkerFSM's most recent transitions, oldest first
+func (fsm *WorkerFSM) History() []FSMTransition {
+	return fsm.obs.history()
+}
+
+// OnTransition registers a hook which is called synchronously, from the WorkerFSM's goroutine,
+// every time this WorkerFSM changes state (including self transitions). Hooks must not block.
+func (fsm *WorkerFSM) OnTransition(hook func(t FSMTransition)) {
+	fsm.obs.addHook(hook)
+}
+
+// FSMstate encapsulates logic for one state in a WorkerFSM. Run must return the index of the next
+// state and a short human readable reason for the transition. Next lists the indices of the states
+// that Run is permitted to return; a state which may repeat itself must list its own index.
+type FSMstate struct {
+	Name string
+	Next []int
+	Run  func(ctx context.Context, com *ipcChan) (next int, reason string)
+}
+
+func (s FSMstate) permits(next int) bool {
+	for _, n := range s.Next {
+		if n == next {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateFSM checks that a WorkerFSM definition is well formed: it must have at least one state,
+// every state must have a unique name and a Run func, and every transition must target a state
+// which exists
+func validateFSM(states []FSMstate) error {
+	if len(states) == 0 {
+		return fmt.Errorf("invalid FSM: no states")
+	}
+
+	names := make(map[string]int)
+
+	for i, s := range states {
+		if s.Name == "" {
+			return fmt.Errorf("invalid FSM: state %v has no name", i)
+		}
+
+		if j, ok := names[s.Name]; ok {
+			return fmt.Errorf("invalid FSM: states %v and %v are both named '%v'", j, i, s.Name)
+		}
+		names[s.Name] = i
+
+		if s.Run == nil {
+			return fmt.Errorf("invalid FSM: state %v (%v) has no Run func", i, s.Name)
+		}
+
+		if len(s.Next) == 0 {
+			return fmt.Errorf("invalid FSM: state %v (%v) has no transitions", i, s.Name)
+		}
+
+		for _, n := range s.Next {
+			if n < 0 || n >= len(states) {
+				return fmt.Errorf("invalid FSM: state %v (%v) transitions to nonexistent state %v", i, s.Name, n)
+			}
+		}
+	}
+
+	return nil
+}
+
+// FSMTransition describes one state change in a WorkerFSM. Duration is the time spent in From.
+type FSMTransition struct {
+	From     int
+	FromName string
+	To       int
+	ToName   string
+	Reason   string
+	At       time.Time
+	Duration time.Duration
+}
+
+// fsmObserver records a WorkerFSM's current state and a bounded ring buffer of its recent
+// transitions, and it dispatches transitions to any registered hooks
+type fsmObserver struct {
+	mx        sync.RWMutex
+	ring      []FSMTransition
+	next      int
+	full      bool
+	state     int
+	stateName string
+	since     time.Time
+	hooks     []func(t FSMTransition)
+}
+
+func newFSMObserver(sz int) *fsmObserver {
+	return &fsmObserver{ring: make([]FSMTransition, sz)}
+}
+
+func (o *fsmObserver) enter(state int, name string) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	o.state = state
+	o.stateName = name
+	o.since = time.Now()
+}
+
+func (o *fsmObserver) transition(from int, fromName string, to int, toName string, reason string) {
+	now := time.Now()
+
+	o.mx.Lock()
+	t := FSMTransition{
+		From:     from,
+		FromName: fromName,
+		To:       to,
+		ToName:   toName,
+		Reason:   reason,
+		At:       now,
+		Duration: now.Sub(o.since),
+	}
+
+	o.ring[o.next] = t
+	o.next = (o.next + 1) % len(o.ring)
+	if o.next == 0 {
+		o.full = true
+	}
+
+	o.state = to
+	o.stateName = toName
+	o.since = now
+	hooks := o.hooks
+	o.mx.Unlock()
+
+	for _, h := range hooks {
+		h(t)
+	}
+}
+
+func (o *fsmObserver) current() (int, string, time.Time) {
+	o.mx.RLock()
+	defer o.mx.RUnlock()
+	return o.state, o.stateName, o.since
+}
+
+func (o *fsmObserver) history() []FSMTransition {
+	o.mx.RLock()
+	defer o.mx.RUnlock()
+
+	if !o.full {
+		h := make([]FSMTransition, o.next)
+		copy(h, o.ring[:o.next])
+		return h
+	}
+
+	h := make([]FSMTransition, 0, len(o.ring))
+	h = append(h, o.ring[o.next:]...)
+	h = append(h, o.ring[:o.next]...)
+	return h
+}
+
+func (o *fsmObserver) addHook(hook func(t FSMTransition)) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	o.hooks = append(o.hooks, hook)
+}
 
 // STUNCache implements the operations which support our strategy for evading STUN server blocking
 // in-country. That is: populate the cache with the largest set of currently known STUN servers and
@@ -0,0 +1,69 @@
+package clientcore
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerFSMIllegalTransition(t *testing.T) {
+	var wg sync.WaitGroup
+	var runs int
+	var open bool
+	released := make(chan struct{}, 1)
+	restarted := make(chan struct{})
+
+	fsm := NewWorkerFSM(&wg, []FSMstate{
+		{
+			Name: "dial",
+			Next: []int{1},
+			Run: func(ctx context.Context, com *ipcChan) (int, string) {
+				runs++
+				if runs == 2 {
+					close(restarted)
+				}
+				if runs > 1 {
+					<-ctx.Done()
+					return 1, "stopped"
+				}
+
+				open = true
+				return 1, "connected"
+			},
+		},
+		{
+			Name: "proxy",
+			Next: []int{0},
+			Run: func(ctx context.Context, com *ipcChan) (int, string) {
+				// A state which goes wrong and returns a transition it isn't allowed to make
+				return 1, "confused"
+			},
+		},
+	})
+
+	fsm.onStop(func() {
+		if open {
+			open = false
+			released <- struct{}{}
+		}
+	})
+
+	fsm.Start()
+	defer func() {
+		fsm.Stop()
+		wg.Wait()
+	}()
+
+	select {
+	case <-restarted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the illegal transition to reset us to state 0")
+	}
+
+	select {
+	case <-released:
+	default:
+		t.Error("expected what the failed state left open to be released before we reset")
+	}
+}
@@ -4,45 +4,121 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
-	"net/url"
 	"sync"
 	"time"
 
 	"github.com/quic-go/quic-go"
 
 	"github.com/getlantern/broflake/common"
+	"github.com/getlantern/broflake/otel"
 )
 
 type ReliableStreamLayer interface {
 	DialContext(ctx context.Context) (net.Conn, error)
 }
 
+// CreateHTTPTransport returns an http.Transport which reaches every destination through the egress
+// server at the other end of c, via DialEgress
 func CreateHTTPTransport(c ReliableStreamLayer) *http.Transport {
 	return &http.Transport{
-		Proxy: func(req *http.Request) (*url.URL, error) {
-			return url.Parse("http://i.do.nothing")
-		},
-		Dial: func(network, addr string) (net.Conn, error) {
-			return c.DialContext(context.Background())
-		},
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return c.DialContext(ctx)
+			return DialEgress(ctx, c, addr)
 		},
 	}
 }
 
+// ErrEgressRefused is returned by DialEgress when the egress server won't connect to a destination.
+// The egress server's reason is a common.ErrTargetStatus, which is wrapped too.
+var ErrEgressRefused = errors.New("egress server refused the connection")
+
+// DialEgress opens a stream on c and asks the egress server at its other end to connect it to addr,
+// a host:port. The returned net.Conn is a raw connection to addr.
+func DialEgress(ctx context.Context, c ReliableStreamLayer, addr string) (net.Conn, error) {
+	conn, err := c.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dialTarget(ctx, conn, common.TargetHeader{Type: common.StreamTCP, Addr: addr}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// dialTarget sends h on conn, a fresh stream to the egress server, and waits for the egress server
+// to accept it
+func dialTarget(ctx context.Context, conn net.Conn, h common.TargetHeader) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if err := h.Write(conn); err != nil {
+		return err
+	}
+
+	err := common.ReadTargetStatus(conn)
+
+	var status common.ErrTargetStatus
+	if errors.As(err, &status) {
+		return fmt.Errorf("%w: %w", ErrEgressRefused, err)
+	}
+
+	return err
+}
+
+// ErrEgressGoingAway means the egress server is shutting down, and we must move to a new QUIC
+// connection
+var ErrEgressGoingAway = errors.New("egress server is going away")
+
+// goAwayTimeout is how long we wait for the egress server to tell us why it opened a stream
+const goAwayTimeout = 5 * time.Second
+
+// readGoAway reads the message on stream, which the egress server opened to us. The only message
+// the egress server sends is common.GoAway.
+func readGoAway(stream quic.Stream) error {
+	defer stream.CancelRead(0)
+	defer stream.Close()
+
+	stream.SetReadDeadline(time.Now().Add(goAwayTimeout))
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(stream, b); err != nil {
+		return err
+	}
+
+	if b[0] != common.GoAway {
+		return fmt.Errorf("unexpected message from egress server: %#x", b[0])
+	}
+
+	return ErrEgressGoingAway
+}
+
 type QUICLayerOptions struct {
 	ServerName         string
 	InsecureSkipVerify bool
 	CA                 *x509.CertPool
+	Impairment         *common.ImpairmentProfile // If non-nil, impair the path to the egress server
 }
 
 func NewQUICLayer(bfconn *BroflakeConn, qopt *QUICLayerOptions) (*QUICLayer, error) {
+	var conn net.PacketConn = bfconn
+	var impaired *common.ImpairedPacketConn
+	if qopt.Impairment != nil {
+		impaired = common.NewImpairedPacketConn(bfconn, qopt.Impairment)
+		conn = impaired
+	}
+
 	q := &QUICLayer{
-		bfconn: bfconn,
-		t:      &quic.Transport{Conn: bfconn},
+		bfconn:   bfconn,
+		impaired: impaired,
+		t:        &quic.Transport{Conn: conn},
 		tlsConfig: &tls.Config{
 			ServerName:         qopt.ServerName,
 			InsecureSkipVerify: qopt.InsecureSkipVerify,
@@ -51,6 +127,15 @@ func NewQUICLayer(bfconn *BroflakeConn, qopt *QUICLayerOptions) (*QUICLayer, err
 		},
 		eventualConn: newEventualConn(),
 		dialTimeout:  8 * time.Second,
+		log:          common.NewLogger("component", "quic", "server", qopt.ServerName),
+	}
+
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	q.status.since = time.Now()
+
+	// Let the Broflake instance which owns bfconn report on us
+	if bfconn.engine != nil {
+		bfconn.engine.quic.Store(q)
 	}
 
 	return q, nil
@@ -58,6 +143,7 @@ func NewQUICLayer(bfconn *BroflakeConn, qopt *QUICLayerOptions) (*QUICLayer, err
 
 type QUICLayer struct {
 	bfconn       *BroflakeConn
+	impaired     *common.ImpairedPacketConn
 	t            *quic.Transport
 	tlsConfig    *tls.Config
 	eventualConn *eventualConn
@@ -65,18 +151,36 @@ type QUICLayer struct {
 	ctx          context.Context
 	cancel       context.CancelFunc
 	dialTimeout  time.Duration
+	status       quicStatus
+	log          common.Logger
+}
+
+// quicStatus tracks the state of a QUICLayer's connection for reporting
+type quicStatus struct {
+	mx        sync.Mutex
+	connected bool
+	since     time.Time
+	dials     uint64
+	failures  uint64
+	lastErr   error
+}
+
+func (s *quicStatus) update(f func(s *quicStatus)) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	f(s)
 }
 
 // DialAndMaintainQUICConnection attempts to create and maintain an e2e QUIC connection by dialing
 // the other end, detecting if that connection breaks, and redialing. Forever.
 func (c *QUICLayer) DialAndMaintainQUICConnection() {
-	c.ctx, c.cancel = context.WithCancel(context.Background())
+	var established bool
 
 	// State 1 of 2: Keep dialing until we acquire a connection
 	for {
 		select {
 		case <-c.ctx.Done():
-			common.Debugf("Cancelling QUIC dialer!")
+			c.log.Debug("cancelling QUIC dialer")
 			return
 		default:
 			// Do nothing
@@ -100,19 +204,49 @@ func (c *QUICLayer) DialAndMaintainQUICConnection() {
 
 		select {
 		case err := <-connErr:
-			common.Debugf("QUIC dial failed (%v), retrying...", err)
+			c.log.Warn("QUIC dial failed, retrying", "err", err)
+			c.status.update(func(s *quicStatus) {
+				s.dials++
+				s.failures++
+				s.lastErr = err
+			})
+			c.publish(ErrorEvent{Source: "quic", Err: err})
+			otel.RecordQUICDial(err, established)
 		case conn := <-connEstablished:
 			c.mx.Lock()
 			c.eventualConn.set(conn)
 			c.mx.Unlock()
-			common.Debug("QUIC connection established, ready to proxy!")
+			c.log.Info("QUIC connection established, ready to proxy")
+			c.status.update(func(s *quicStatus) {
+				s.dials++
+				s.connected = true
+				s.since = time.Now()
+			})
+			c.publish(QUICConnectionEvent{Up: true})
+			otel.RecordQUICDial(nil, established)
+			established = true
 
-			// State 2 of 2: Connection established, block until we detect a half open or a ctx cancel
-			_, err := conn.AcceptStream(c.ctx)
-			if err != nil {
-				common.Debugf("QUIC connection error (%v), closing!", err)
+			// State 2 of 2: Connection established, block until we detect a half open, the egress
+			// server asks us to go away, or a ctx cancel
+			stream, err := conn.AcceptStream(c.ctx)
+			if err == nil {
+				err = readGoAway(stream)
+			}
+
+			if errors.Is(err, ErrEgressGoingAway) {
+				// The streams in flight may finish, and the egress server closes the connection when
+				// they have, but new streams need a new connection
+				c.log.Info("egress server is going away, redialing")
+			} else if err != nil {
+				c.log.Warn("QUIC connection error, closing", "err", err)
 				conn.CloseWithError(42069, "")
 			}
+			c.status.update(func(s *quicStatus) {
+				s.connected = false
+				s.since = time.Now()
+				s.lastErr = err
+			})
+			c.publish(QUICConnectionEvent{Up: false, Err: err})
 
 			// If we've hit this path, either our QUIC connection has broken or the caller wants to
 			// destroy this QUICLayer, so we iterate the loop to proceed. If there's a process that's
@@ -125,11 +259,45 @@ func (c *QUICLayer) DialAndMaintainQUICConnection() {
 	}
 }
 
-// Close a QUICLayer which was previously opened via a call to DialAndMaintainQUICConnection.
+// Close a QUICLayer which was previously opened via a call to DialAndMaintainQUICConnection. This
+// also closes the QUIC transport, so a closed QUICLayer can't be reused.
 func (c *QUICLayer) Close() {
-	if c.cancel != nil {
-		c.cancel()
+	c.cancel()
+	c.t.Close()
+
+	if c.bfconn.engine != nil {
+		c.bfconn.engine.quic.CompareAndSwap(c, nil)
+	}
+
+	if c.impaired != nil {
+		c.impaired.Stop()
+	}
+}
+
+// publish an event to the event stream of the Broflake instance which owns our BroflakeConn
+func (c *QUICLayer) publish(e Event) {
+	if c.bfconn.engine != nil {
+		c.bfconn.engine.events.publish(e)
+	}
+}
+
+// stats returns a snapshot of this QUICLayer's connection status
+func (c *QUICLayer) stats() QUICStats {
+	c.status.mx.Lock()
+	defer c.status.mx.Unlock()
+
+	s := QUICStats{
+		Connected: c.status.connected,
+		Since:     c.status.since,
+		Dials:     c.status.dials,
+		Failures:  c.status.failures,
 	}
+
+	if c.status.lastErr != nil {
+		s.LastError = c.status.lastErr.Error()
+	}
+
+	return s
 }
 
 func (c *QUICLayer) DialContext(ctx context.Context) (net.Conn, error) {
@@ -151,6 +319,91 @@ func (c *QUICLayer) DialContext(ctx context.Context) (net.Conn, error) {
 // QUICLayer is a ReliableStreamLayer
 var _ ReliableStreamLayer = &QUICLayer{}
 
+// DialUDP asks the egress server to relay UDP between us and addr, a host:port; see common/udp.go.
+// Each Write on the returned net.Conn sends one datagram, and each Read receives one. Like UDP,
+// datagrams may be lost, and datagrams too large for the path fail to send. The flow ends when the
+// net.Conn is closed or our QUIC connection breaks.
+func (c *QUICLayer) DialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	c.mx.RLock()
+	waiter := c.eventualConn
+	c.mx.RUnlock()
+
+	qconn, err := waiter.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := qconn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The egress server may send datagrams as soon as it accepts, so we listen before we ask
+	flow, err := waiter.mux.Register(stream.StreamID())
+	if err != nil {
+		stream.CancelRead(0)
+		stream.Close()
+		return nil, err
+	}
+
+	conn := &udpConn{flow: flow, stream: stream, addr: addr}
+
+	if err := dialTarget(ctx, common.QUICStreamNetConn{Stream: stream}, common.TargetHeader{Type: common.StreamUDP, Addr: addr}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The flow lasts as long as the stream, which carries nothing else
+	go func() {
+		io.Copy(io.Discard, stream)
+		flow.Close()
+	}()
+
+	return conn, nil
+}
+
+// udpConn is a UDP flow as a net.Conn
+type udpConn struct {
+	flow   *common.DatagramFlow
+	stream quic.Stream
+	addr   string
+}
+
+func (c *udpConn) Read(p []byte) (int, error) {
+	return c.flow.Read(p)
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	return c.flow.Write(p)
+}
+
+func (c *udpConn) Close() error {
+	c.flow.Close()
+	c.stream.CancelRead(0)
+	return c.stream.Close()
+}
+
+func (c *udpConn) LocalAddr() net.Addr {
+	return common.DebugAddr("UDP flow")
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return common.DebugAddr(c.addr)
+}
+
+func (c *udpConn) SetDeadline(t time.Time) error {
+	return c.flow.SetReadDeadline(t)
+}
+
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	return c.flow.SetReadDeadline(t)
+}
+
+// SetWriteDeadline does nothing, since writes never block
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
 func newEventualConn() *eventualConn {
 	return &eventualConn{
 		ready: make(chan struct{}, 0),
@@ -159,6 +412,7 @@ func newEventualConn() *eventualConn {
 
 type eventualConn struct {
 	conn  quic.Connection
+	mux   *common.DatagramMux
 	ready chan struct{}
 }
 
@@ -173,5 +427,6 @@ func (w *eventualConn) get(ctx context.Context) (quic.Connection, error) {
 
 func (w *eventualConn) set(conn quic.Connection) {
 	w.conn = conn
+	w.mux = common.NewDatagramMux(conn)
 	close(w.ready)
 }
@@ -2,7 +2,9 @@
 package clientcore
 
 import (
+	"context"
 	"sync"
+	"time"
 
 	"github.com/getlantern/broflake/common"
 )
@@ -12,11 +14,13 @@ import (
 // upstream tableRouter, in managing a WorkerTable consisting of workers which handle egress traffic,
 // decides how to best utilize those connections (ie, in serial, in parallel, 1:1, multipath, etc.)
 type TableRouter interface {
-	Init()
+	Init(ctx context.Context, wg *sync.WaitGroup)
 
 	onBus(msg IPCMsg)
 
 	onWorker(msg IPCMsg, workerIdx workerID)
+
+	observe(f func(msg IPCMsg, workerIdx workerID))
 }
 
 // A baseRouter implements basic router functionality
@@ -25,30 +29,86 @@ type baseRouter struct {
 	table      *WorkerTable
 	busHook    func(r *baseRouter, msg IPCMsg)
 	workerHook func(r *baseRouter, msg IPCMsg, workerIdx workerID)
+	observers  []func(msg IPCMsg, workerIdx workerID)
+	ctx        context.Context
 }
 
+// Init starts the router's goroutines, which run until ctx is cancelled; wg, if non-nil, tracks them
 func (r *baseRouter) Init(
+	ctx context.Context,
+	wg *sync.WaitGroup,
 	listen chan IPCMsg,
 	onBus func(msg IPCMsg),
 	onWorker func(msg IPCMsg,
 		workerIdx workerID),
 ) {
+	r.ctx = ctx
+
+	if wg != nil {
+		wg.Add(len(r.table.slot) + 1)
+	}
+
+	done := func() {
+		if wg != nil {
+			wg.Done()
+		}
+	}
+
 	for i := range r.table.slot {
 		go func(i int) {
+			defer done()
 			for {
-				msg := <-r.table.slot[i].com.tx
-				onWorker(msg, workerID(i))
+				select {
+				case msg := <-r.table.slot[i].com.tx:
+					countChunk(&r.table.slot[i].com.traffic.in, msg)
+					for _, f := range r.observers {
+						f(msg, workerID(i))
+					}
+					onWorker(msg, workerID(i))
+				case <-ctx.Done():
+					return
+				}
 			}
 		}(i)
 	}
 
 	go func() {
+		defer done()
 		for {
-			onBus(<-listen)
+			select {
+			case msg := <-listen:
+				onBus(msg)
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 }
 
+// observe registers a func which is called with every msg the router receives from a worker,
+// before the router handles it. Observers must not block. Must be called before Init.
+func (r *baseRouter) observe(f func(msg IPCMsg, workerIdx workerID)) {
+	r.observers = append(r.observers, f)
+}
+
+// send sends msg on c, giving up if the router is shut down first. Returns true if msg was sent.
+func (r *baseRouter) send(c chan IPCMsg, msg IPCMsg) bool {
+	select {
+	case c <- msg:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+// sendToWorker sends msg to the worker at peerIdx, counting the bytes it carries
+func (r *baseRouter) sendToWorker(msg IPCMsg, peerIdx workerID) {
+	com := r.table.slot[peerIdx].com
+	if r.send(com.rx, msg) {
+		countChunk(&com.traffic.out, msg)
+	}
+}
+
 func (r *baseRouter) onBus(msg IPCMsg) {
 	r.busHook(r, msg)
 }
@@ -62,8 +122,8 @@ type upstreamRouter struct {
 	baseRouter
 }
 
-func (r *upstreamRouter) Init() {
-	r.baseRouter.Init(r.bus.tx, r.onBus, r.onWorker)
+func (r *upstreamRouter) Init(ctx context.Context, wg *sync.WaitGroup) {
+	r.baseRouter.Init(ctx, wg, r.bus.tx, r.onBus, r.onWorker)
 }
 
 func (r *upstreamRouter) onBus(msg IPCMsg) {
@@ -80,11 +140,11 @@ func (r *upstreamRouter) onWorker(msg IPCMsg, workerIdx workerID) {
 }
 
 func (r *upstreamRouter) toBus(msg IPCMsg) {
-	r.bus.rx <- msg
+	r.send(r.bus.rx, msg)
 }
 
 func (r *upstreamRouter) toWorker(msg IPCMsg, peerIdx workerID) {
-	r.table.slot[peerIdx].com.rx <- msg
+	r.sendToWorker(msg, peerIdx)
 }
 
 // A downstreamRouter parameterizes a baseRouter to send on tx and receive on rx
@@ -92,8 +152,8 @@ type downstreamRouter struct {
 	baseRouter
 }
 
-func (r *downstreamRouter) Init() {
-	r.baseRouter.Init(r.bus.rx, r.onBus, r.onWorker)
+func (r *downstreamRouter) Init(ctx context.Context, wg *sync.WaitGroup) {
+	r.baseRouter.Init(ctx, wg, r.bus.rx, r.onBus, r.onWorker)
 }
 
 func (r *downstreamRouter) onBus(msg IPCMsg) {
@@ -108,11 +168,11 @@ func (r *downstreamRouter) onWorker(msg IPCMsg, workerIdx workerID) {
 }
 
 func (r *downstreamRouter) toBus(msg IPCMsg) {
-	r.bus.tx <- msg
+	r.send(r.bus.tx, msg)
 }
 
 func (r *downstreamRouter) toWorker(msg IPCMsg) {
-	r.table.slot[msg.Wid].com.rx <- msg
+	r.sendToWorker(msg, msg.Wid)
 }
 
 func (r *downstreamRouter) toAllWorkers(msg IPCMsg) {
@@ -213,6 +273,19 @@ func (r *producerSerialRouter) route(wid workerID) (bool, workerID) {
 	return route != NoRoute, route
 }
 
+// routes returns a copy of the consumer -> producer forwarding index
+func (r *producerSerialRouter) routes() map[workerID]workerID {
+	r.RLock()
+	defer r.RUnlock()
+	m := make(map[workerID]workerID, len(r.forwardIdx))
+
+	for c, p := range r.forwardIdx {
+		m[c] = p
+	}
+
+	return m
+}
+
 func (r *producerSerialRouter) backRoute(wid workerID) (bool, workerID) {
 	r.RLock()
 	defer r.RUnlock()
@@ -430,3 +503,67 @@ func (t WorkerTable) Stop() {
 func (t WorkerTable) Size() int {
 	return t.size
 }
+
+// Register a hook which is called every time any of this table's workers changes state
+func (t WorkerTable) OnTransition(hook func(workerIdx int, tr FSMTransition)) {
+	for i := range t.slot {
+		idx := i
+		t.slot[i].OnTransition(func(tr FSMTransition) { hook(idx, tr) })
+	}
+}
+
+// Return the most recent transitions for the worker at workerIdx, oldest first
+func (t WorkerTable) History(workerIdx int) []FSMTransition {
+	if workerIdx < 0 || workerIdx >= len(t.slot) {
+		return nil
+	}
+
+	return t.slot[workerIdx].History()
+}
+
+// Give each of this table's workers a Logger derived from l which includes its index; must be
+// called before the table is started
+func (t WorkerTable) setLogger(l common.Logger) {
+	for i := range t.slot {
+		t.slot[i].setLogger(l.With("worker", i))
+	}
+}
+
+// Enable telemetry for each of this table's workers, which report under the name 'table'; must be
+// called before the table is started
+func (t WorkerTable) instrument(table string) {
+	for i := range t.slot {
+		t.slot[i].tel.table = table
+		t.slot[i].tel.workerIdx = i
+	}
+}
+
+// Return a snapshot of each of this table's workers
+func (t WorkerTable) stats(now time.Time) []WorkerStats {
+	s := make([]WorkerStats, len(t.slot))
+
+	for i := range t.slot {
+		s[i] = t.slot[i].stats(now)
+	}
+
+	return s
+}
+
+// Apply a flow policy to all of this table's workers; must be called before the table is started
+func (t WorkerTable) setFlowPolicy(policy FlowPolicy, blockTimeout time.Duration) {
+	for i := range t.slot {
+		t.slot[i].com.setFlowPolicy(policy, blockTimeout)
+	}
+}
+
+// Return the cumulative number of chunks and bytes dropped by each of this table's workers
+func (t WorkerTable) dropped() (chunks, bytes []uint64) {
+	chunks = make([]uint64, len(t.slot))
+	bytes = make([]uint64, len(t.slot))
+
+	for i := range t.slot {
+		chunks[i], bytes[i] = t.slot[i].com.dropped()
+	}
+
+	return chunks, bytes
+}
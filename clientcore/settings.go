@@ -2,10 +2,15 @@ package clientcore
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
+	"log/slog"
 	"math/rand"
 	"net/http"
+	"sync"
 	"time"
+
+	"github.com/pion/webrtc/v3"
 )
 
 type WebRTCOptions struct {
@@ -20,6 +25,9 @@ type WebRTCOptions struct {
 	HttpClient     *http.Client
 	Patience       time.Duration
 	ErrorBackoff   time.Duration
+	Clock          Clock
+	API            *webrtc.API // If nil, RTCPeerConnections are constructed with pion's default API
+	stunGen        uint64      // Bumped each time an update changes STUNBatch or STUNBatchSize
 }
 
 func NewDefaultWebRTCOptions() *WebRTCOptions {
@@ -35,40 +43,162 @@ func NewDefaultWebRTCOptions() *WebRTCOptions {
 		HttpClient:     &http.Client{},
 		Patience:       500 * time.Millisecond,
 		ErrorBackoff:   5 * time.Second,
+		Clock:          realClock{},
+		API:            nil,
 	}
 }
 
+func (o *WebRTCOptions) newPeerConnection(config webrtc.Configuration) (*webrtc.PeerConnection, error) {
+	if o.API != nil {
+		return o.API.NewPeerConnection(config)
+	}
+
+	return webrtc.NewPeerConnection(config)
+}
+
+// The transports over which a widget may relay its clients' QUIC to the egress server. Over a
+// WebSocket, a packet lost on its way to or from the egress server holds up the packets behind it;
+// over the others, which carry packets as datagrams, it doesn't.
+const (
+	EgressTransportWebSocket    = "websocket"    // Addr is a ws:// or wss:// URL
+	EgressTransportQUIC         = "quic"         // Plain UDP, for native widgets; Addr is a udp:// URL
+	EgressTransportWebTransport = "webtransport" // For browsers which support it; Addr is an https:// URL
+)
+
 type EgressOptions struct {
 	Addr           string
 	Endpoint       string
 	ConnectTimeout time.Duration
 	ErrorBackoff   time.Duration
+	Token          string      // If set, we present this to the egress server, which may require it
+	Tag            string      // Reported to the egress server, which labels our traffic with it; defaults to WebRTCOptions.Tag
+	ClientVersion  string      // The embedding application's version, which the egress server labels our traffic with
+	Transport      string      // One of the EgressTransport constants; "" means EgressTransportWebSocket
+	TLSConfig      *tls.Config // For WebTransport outside of browsers; nil means the system's defaults
+}
+
+// datagram returns true if o's transport carries packets as datagrams, rather than as messages on
+// a WebSocket. Each needs its own egress consumer.
+func (o *EgressOptions) datagram() bool {
+	return o.Transport == EgressTransportQUIC || o.Transport == EgressTransportWebTransport
+}
+
+func (o *EgressOptions) validate() error {
+	switch o.Transport {
+	case "", EgressTransportWebSocket, EgressTransportQUIC, EgressTransportWebTransport:
+		return nil
+	}
+
+	return fmt.Errorf("invalid egress transport '%v'", o.Transport)
 }
 
 func NewDefaultEgressOptions() *EgressOptions {
 	return &EgressOptions{
 		Addr:           "ws://localhost:8000",
 		Endpoint:       "/ws",
-		ConnectTimeout: 5 * time.Second,
+		ConnectTimeout: 15 * time.Second,
 		ErrorBackoff:   5 * time.Second,
 	}
 }
 
+// liveOptions holds the options shared by a table's workers, which may be updated while they run.
+// Workers load their options each time they reset to state 0, so an update reaches each worker the
+// next time it begins a new connection. An update which requires connections to be torn down also
+// closes the reconnect channel handed out with the previous options.
+type liveOptions[T any] struct {
+	mx        sync.Mutex
+	cur       *T
+	version   uint64
+	reconnect chan struct{}
+}
+
+func newLiveOptions[T any](o *T) *liveOptions[T] {
+	return &liveOptions[T]{cur: o, reconnect: make(chan struct{})}
+}
+
+// load returns the current options, their version, and a channel which is closed when an update
+// requires a worker using these options to reconnect
+func (l *liveOptions[T]) load() (*T, uint64, <-chan struct{}) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	return l.cur, l.version, l.reconnect
+}
+
+// updatedSince returns true if the options have been updated since the given version was loaded
+func (l *liveOptions[T]) updatedSince(version uint64) bool {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	return l.version != version
+}
+
+// update replaces the current options with o. The previous options are passed to merge, which
+// fills in any fields o should inherit from them and reports whether connections using the
+// previous options must be torn down.
+func (l *liveOptions[T]) update(o *T, merge func(prev, next *T) (reconnect bool)) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if merge(l.cur, o) {
+		close(l.reconnect)
+		l.reconnect = make(chan struct{})
+	}
+
+	l.cur = o
+	l.version++
+}
+
+// liveTag is the tag from the current WebRTCOptions, for loggers which should follow updates to it
+type liveTag struct {
+	o *liveOptions[WebRTCOptions]
+}
+
+func (t liveTag) String() string {
+	o, _, _ := t.o.load()
+	return o.Tag
+}
+
+func (t liveTag) LogValue() slog.Value {
+	return slog.StringValue(t.String())
+}
+
 type BroflakeOptions struct {
-	ClientType  string
-	CTableSize  int
-	PTableSize  int
-	BusBufferSz int
-	Netstated   string
+	ClientType       string
+	CTableSize       int
+	PTableSize       int
+	BusBufferSz      int
+	Netstated        string
+	FlowPolicy       FlowPolicy
+	FlowBlockTimeout time.Duration
 }
 
 func NewDefaultBroflakeOptions() *BroflakeOptions {
 	return &BroflakeOptions{
-		ClientType:  "desktop",
-		CTableSize:  5,
-		PTableSize:  5,
-		BusBufferSz: 4096,
-		Netstated:   "",
+		ClientType:       "desktop",
+		CTableSize:       5,
+		PTableSize:       5,
+		BusBufferSz:      4096,
+		Netstated:        "",
+		FlowPolicy:       FlowPolicyBlock,
+		FlowBlockTimeout: 50 * time.Millisecond,
+	}
+}
+
+// NewStaticSTUNBatchFunc returns a STUNBatch func which selects a random batch from srvs, which
+// must be STUN URLs, eg "stun:stun.l.google.com:19302"
+func NewStaticSTUNBatchFunc(srvs []string) func(size uint32) (batch []string, err error) {
+	return func(size uint32) (batch []string, err error) {
+		candidates := make([]string, len(srvs))
+		copy(candidates, srvs)
+
+		rand.Shuffle(len(candidates), func(i, j int) {
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		})
+
+		if int(size) < len(candidates) {
+			candidates = candidates[:size]
+		}
+
+		return candidates, nil
 	}
 }
 
@@ -0,0 +1,72 @@
+package sim
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a manually advanced clock which satisfies clientcore.Clock. Timers created by After
+// fire only when a call to Advance moves the clock past their deadline, so the timeouts and
+// backoffs which govern a WorkerFSM can be triggered deterministically. A timer created with a
+// duration <= 0 fires immediately.
+type Clock struct {
+	mx     sync.Mutex
+	now    time.Time
+	timers []*timer
+}
+
+type timer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.now
+}
+
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	t := &timer{deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t.c
+	}
+
+	c.timers = append(c.timers, t)
+	return t.c
+}
+
+// Advance moves the clock forward by d, firing every timer whose deadline has been reached
+func (c *Clock) Advance(d time.Duration) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+
+	for _, t := range c.timers {
+		if !t.deadline.After(c.now) {
+			t.c <- c.now
+			continue
+		}
+		pending = append(pending, t)
+	}
+
+	c.timers = pending
+}
+
+// Pending returns the number of timers which have not yet fired. Since a caller may abandon the
+// channel returned by After, this counts timers that nobody is waiting on.
+func (c *Clock) Pending() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return len(c.timers)
+}
@@ -0,0 +1,146 @@
+//go:build !wasm
+
+package sim
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/logging"
+	"github.com/pion/transport/v2/vnet"
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// Addresses are drawn from the documentation ranges (RFC 5737), so nothing in a simulation can
+// ever be confused with a real host
+const (
+	stunIP   = "192.0.2.1"
+	stunPort = 3478
+)
+
+var (
+	// NATEasy is a full cone NAT, which any peer can traverse with the help of a STUN server
+	NATEasy = &vnet.NATType{
+		MappingBehavior:   vnet.EndpointIndependent,
+		FilteringBehavior: vnet.EndpointIndependent,
+	}
+
+	// NATSymmetric is a symmetric NAT; two peers behind NATSymmetric can't traverse without a relay
+	NATSymmetric = &vnet.NATType{
+		MappingBehavior:   vnet.EndpointAddrPortDependent,
+		FilteringBehavior: vnet.EndpointAddrPortDependent,
+	}
+)
+
+// Network is a virtual internet: a WAN router hosting a STUN server, and one LAN per peer, each
+// of which sits behind its own NAT. Nothing in a Network touches the host's network stack.
+type Network struct {
+	wan   *vnet.Router
+	stun  *turn.Server
+	peers []*vnet.Net
+}
+
+// NewNetwork constructs and starts a Network with one LAN per NAT type in nats
+func NewNetwork(nats ...*vnet.NATType) (*Network, error) {
+	lf := logging.NewDefaultLoggerFactory()
+
+	wan, err := vnet.NewRouter(&vnet.RouterConfig{CIDR: "0.0.0.0/0", LoggerFactory: lf})
+	if err != nil {
+		return nil, err
+	}
+
+	wanNet, err := vnet.NewNet(&vnet.NetConfig{StaticIP: stunIP})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := wan.AddNet(wanNet); err != nil {
+		return nil, err
+	}
+
+	n := &Network{wan: wan}
+
+	for i, nat := range nats {
+		lan, err := vnet.NewRouter(&vnet.RouterConfig{
+			StaticIPs:     []string{fmt.Sprintf("198.51.100.%v", i+1)},
+			CIDR:          fmt.Sprintf("10.0.%v.0/24", i),
+			NATType:       nat,
+			LoggerFactory: lf,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		peer, err := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{fmt.Sprintf("10.0.%v.2", i)}})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := lan.AddNet(peer); err != nil {
+			return nil, err
+		}
+
+		if err := wan.AddRouter(lan); err != nil {
+			return nil, err
+		}
+
+		n.peers = append(n.peers, peer)
+	}
+
+	if err := wan.Start(); err != nil {
+		return nil, err
+	}
+
+	pc, err := wanNet.ListenPacket("udp4", fmt.Sprintf("%v:%v", stunIP, stunPort))
+	if err != nil {
+		wan.Stop()
+		return nil, err
+	}
+
+	// A TURN server answers STUN binding requests, which is all we need it for
+	n.stun, err = turn.NewServer(turn.ServerConfig{
+		AuthHandler: func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			return nil, false
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn: pc,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+					RelayAddress: net.ParseIP(stunIP),
+					Address:      "0.0.0.0",
+					Net:          wanNet,
+				},
+			},
+		},
+		Realm:         "broflake.sim",
+		LoggerFactory: lf,
+	})
+	if err != nil {
+		wan.Stop()
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// API returns a pion API which constructs RTCPeerConnections on the LAN for peer i
+func (n *Network) API(i int) *webrtc.API {
+	se := webrtc.SettingEngine{}
+	se.SetNet(n.peers[i])
+	se.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	se.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	return webrtc.NewAPI(webrtc.WithSettingEngine(se))
+}
+
+// STUNBatch satisfies the STUNBatch field of clientcore.WebRTCOptions, always returning the
+// Network's STUN server
+func (n *Network) STUNBatch(size uint32) ([]string, error) {
+	return []string{fmt.Sprintf("stun:%v:%v", stunIP, stunPort)}, nil
+}
+
+func (n *Network) Close() error {
+	n.stun.Close()
+	return n.wan.Stop()
+}
@@ -0,0 +1,56 @@
+package sim
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/broflake/common"
+	"github.com/getlantern/broflake/freddie"
+)
+
+// Signaling is an in-process Freddie serving on an ephemeral loopback port
+type Signaling struct {
+	*freddie.Freddie
+	URL string
+}
+
+// NewSignaling starts a Freddie on 127.0.0.1 with the given consumer and message TTLs
+func NewSignaling(ctx context.Context, consumerTTL, msgTTL time.Duration) (*Signaling, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := freddie.New(ctx, l.Addr().String())
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	f.ConsumerTTL = consumerTTL
+	f.MsgTTL = msgTTL
+
+	go f.Serve(l)
+	return &Signaling{Freddie: f, URL: fmt.Sprintf("http://%v", l.Addr())}, nil
+}
+
+func (s *Signaling) Close() error {
+	return s.Shutdown()
+}
+
+// VersionClient returns an http.Client which advertises the given Broflake protocol version to
+// Freddie, regardless of the version the caller attempts to send
+func VersionClient(version string) *http.Client {
+	return &http.Client{Transport: versionTransport(version)}
+}
+
+type versionTransport string
+
+func (v versionTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set(common.VersionHeader, string(v))
+	return http.DefaultTransport.RoundTrip(r)
+}
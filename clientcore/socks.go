@@ -0,0 +1,399 @@
+// socks.go implements a SOCKS5 proxy server (RFC 1928) for native clients, which proxies each
+// connection through the egress server on its own stream
+package clientcore
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getlantern/broflake/common"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodPassword     = 0x02
+	socks5MethodNoAcceptable = 0xff
+
+	// Username/password authentication (RFC 1929) has its own version number
+	socks5PasswordVersion = 0x01
+	socks5PasswordOK      = 0x00
+	socks5PasswordFailed  = 0x01
+
+	socks5CmdConnect      = 0x01
+	socks5CmdBind         = 0x02
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded           = 0x00
+	socks5ReplyGeneralFailure      = 0x01
+	socks5ReplyNotAllowed          = 0x02
+	socks5ReplyHostUnreachable     = 0x04
+	socks5ReplyConnRefused         = 0x05
+	socks5ReplyCmdNotSupported     = 0x07
+	socks5ReplyAddrTypeUnsupported = 0x08
+
+	// socks5HandshakeTimeout bounds the negotiation which precedes proxying
+	socks5HandshakeTimeout = 30 * time.Second
+)
+
+var errSOCKS5AddrType = errors.New("unsupported address type")
+
+// SOCKS5Server is a SOCKS5 proxy which tunnels CONNECT requests through a ReliableStreamLayer,
+// opening a stream to the egress server for each. If the layer is a UDPLayer, like QUICLayer, UDP
+// ASSOCIATE is supported too (see socks_udp.go). BIND isn't. Most embedders will want a LocalProxy,
+// which serves one of these alongside an HTTP proxy.
+type SOCKS5Server struct {
+	layer ReliableStreamLayer
+	opt   *LocalProxyOptions
+	log   common.Logger
+	mx    sync.Mutex
+	l     net.Listener
+	conns map[net.Conn]struct{}
+	done  bool
+}
+
+func NewSOCKS5Server(layer ReliableStreamLayer, opt *LocalProxyOptions) *SOCKS5Server {
+	if opt == nil {
+		opt = &LocalProxyOptions{}
+	}
+
+	return &SOCKS5Server{
+		layer: layer,
+		opt:   opt,
+		log:   common.NewLogger("component", "socks5"),
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts SOCKS5 connections on l until l fails or the server is closed. It always returns a
+// non-nil error; after Close, it returns net.ErrClosed.
+func (s *SOCKS5Server) Serve(l net.Listener) error {
+	s.mx.Lock()
+	if s.done {
+		s.mx.Unlock()
+		return net.ErrClosed
+	}
+	s.l = l
+	s.mx.Unlock()
+
+	s.log.Info("serving SOCKS5", "addr", l.Addr())
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.mx.Lock()
+			defer s.mx.Unlock()
+			if s.done {
+				return net.ErrClosed
+			}
+			return err
+		}
+
+		if !s.opt.allowed(c.RemoteAddr()) {
+			s.log.Warn("refused a connection from a client which isn't allowed", "remoteAddr", c.RemoteAddr())
+			c.Close()
+			continue
+		}
+
+		if !s.track(c) {
+			c.Close()
+			return net.ErrClosed
+		}
+
+		go func() {
+			defer s.untrack(c)
+			s.handle(c)
+		}()
+	}
+}
+
+// Close stops the server and closes every connection it's proxying
+func (s *SOCKS5Server) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.done {
+		return nil
+	}
+	s.done = true
+
+	var err error
+	if s.l != nil {
+		err = s.l.Close()
+	}
+
+	for c := range s.conns {
+		c.Close()
+	}
+
+	return err
+}
+
+func (s *SOCKS5Server) track(c net.Conn) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.done {
+		return false
+	}
+
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *SOCKS5Server) untrack(c net.Conn) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.conns, c)
+	c.Close()
+}
+
+func (s *SOCKS5Server) handle(c net.Conn) {
+	log := s.log.With("remoteAddr", c.RemoteAddr())
+	c.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+
+	if err := s.negotiate(c); err != nil {
+		log.Debug("SOCKS5 negotiation failed", "err", err)
+		return
+	}
+
+	cmd, addr, err := readSOCKS5Request(c)
+	if err != nil {
+		log.Debug("bad SOCKS5 request", "err", err)
+		if errors.Is(err, errSOCKS5AddrType) {
+			writeSOCKS5Reply(c, socks5ReplyAddrTypeUnsupported)
+		}
+		return
+	}
+
+	log = log.With("addr", addr)
+
+	if cmd == socks5CmdUDPAssociate {
+		s.associate(c, log)
+		return
+	}
+
+	if cmd != socks5CmdConnect {
+		log.Debug("unsupported SOCKS5 command", "cmd", cmd)
+		writeSOCKS5Reply(c, socks5ReplyCmdNotSupported)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), socks5HandshakeTimeout)
+	defer cancel()
+
+	route := s.opt.SplitTunnel.routeAddr(ctx, addr)
+	log = log.With("route", route)
+
+	upstream, err := dialRoute(ctx, s.layer, route, addr)
+	if err != nil {
+		log.Debug("couldn't reach SOCKS5 destination", "err", err)
+		reply := byte(socks5ReplyGeneralFailure)
+		switch {
+		case errors.Is(err, ErrRouteBlocked), errors.Is(err, common.ErrTargetStatus(common.TargetNotAllowed)):
+			reply = socks5ReplyNotAllowed
+		case errors.Is(err, common.ErrTargetStatus(common.TargetRefused)):
+			reply = socks5ReplyConnRefused
+		case errors.Is(err, common.ErrTargetStatus(common.TargetTimeout)), errors.Is(err, ErrEgressRefused):
+			reply = socks5ReplyHostUnreachable
+		}
+		writeSOCKS5Reply(c, reply)
+		return
+	}
+	defer upstream.Close()
+
+	if err := writeSOCKS5Reply(c, socks5ReplySucceeded); err != nil {
+		return
+	}
+
+	c.SetDeadline(time.Time{})
+	log.Debug("proxying SOCKS5 connection")
+	splice(c, upstream)
+}
+
+// negotiate reads the client's greeting and selects an authentication method
+func (s *SOCKS5Server) negotiate(c net.Conn) error {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return err
+	}
+
+	if hdr[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version %v", hdr[0])
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return err
+	}
+
+	want := byte(socks5MethodNoAuth)
+	if s.opt.authRequired() {
+		want = socks5MethodPassword
+	}
+
+	for _, m := range methods {
+		if m != want {
+			continue
+		}
+
+		if _, err := c.Write([]byte{socks5Version, want}); err != nil {
+			return err
+		}
+
+		if want == socks5MethodPassword {
+			return s.authenticate(c)
+		}
+		return nil
+	}
+
+	c.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+	return fmt.Errorf("no acceptable auth method in %v", methods)
+}
+
+// authenticate runs the username/password subnegotiation described in RFC 1929
+func (s *SOCKS5Server) authenticate(c net.Conn) error {
+	ver := make([]byte, 1)
+	if _, err := io.ReadFull(c, ver); err != nil {
+		return err
+	}
+
+	if ver[0] != socks5PasswordVersion {
+		return fmt.Errorf("unsupported username/password auth version %v", ver[0])
+	}
+
+	var creds [2]string
+	for i := range creds {
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(c, n); err != nil {
+			return err
+		}
+
+		b := make([]byte, n[0])
+		if _, err := io.ReadFull(c, b); err != nil {
+			return err
+		}
+		creds[i] = string(b)
+	}
+
+	if !s.opt.authorized(creds[0], creds[1]) {
+		c.Write([]byte{socks5PasswordVersion, socks5PasswordFailed})
+		return fmt.Errorf("bad credentials for user '%v'", creds[0])
+	}
+
+	_, err := c.Write([]byte{socks5PasswordVersion, socks5PasswordOK})
+	return err
+}
+
+// readSOCKS5Request reads a request, returning its command and destination as a host:port string
+func readSOCKS5Request(r io.Reader) (cmd byte, addr string, err error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, "", err
+	}
+
+	if hdr[0] != socks5Version {
+		return 0, "", fmt.Errorf("unsupported SOCKS version %v", hdr[0])
+	}
+
+	addr, err = readSOCKS5Addr(r, hdr[3])
+	if err != nil {
+		return 0, "", err
+	}
+
+	return hdr[1], addr, nil
+}
+
+// readSOCKS5Addr reads an address of type atyp, returning it as a host:port string
+func readSOCKS5Addr(r io.Reader, atyp byte) (string, error) {
+	var host string
+
+	switch atyp {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", err
+		}
+
+		domain := make([]byte, n[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("%w %v", errSOCKS5AddrType, atyp)
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeSOCKS5Reply writes a reply with the given status. We don't disclose the address we're
+// connecting from, which is the egress server's, so the bound address is always 0.0.0.0:0.
+func writeSOCKS5Reply(w io.Writer, status byte) error {
+	return writeSOCKS5ReplyAddr(w, status, "0.0.0.0:0")
+}
+
+// writeSOCKS5ReplyAddr writes a reply with the given status and bound address, a host:port
+func writeSOCKS5ReplyAddr(w io.Writer, status byte, bound string) error {
+	_, err := w.Write(appendSOCKS5Addr([]byte{socks5Version, status, 0x00}, bound))
+	return err
+}
+
+// splice copies between a and b in both directions until both sides are done. When one side
+// finishes sending, we half-close the other, which may still have more to send. If either direction
+// fails, closing both conns unblocks the other.
+func splice(a, b net.Conn) {
+	errc := make(chan error, 2)
+
+	cp := func(dst, src net.Conn) {
+		_, err := io.Copy(dst, src)
+		closeWrite(dst)
+		errc <- err
+	}
+
+	go cp(a, b)
+	go cp(b, a)
+
+	if err := <-errc; err != nil {
+		a.Close()
+		b.Close()
+	}
+	<-errc
+}
+
+// closeWrite half-closes c, or closes it if it can't be half-closed
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+
+	c.Close()
+}
@@ -0,0 +1,415 @@
+//go:build !wasm
+
+package clientcore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/getlantern/broflake/egress"
+)
+
+// tcpStreamLayer is a ReliableStreamLayer whose streams are TCP connections to a stand-in for the
+// egress server
+type tcpStreamLayer struct {
+	addr string
+}
+
+func (l tcpStreamLayer) DialContext(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", l.addr)
+}
+
+// startEgress serves an egress.Forwarder on loopback, as a stand-in for the egress server, and
+// returns a ReliableStreamLayer which reaches it
+func startEgress(t *testing.T, opt *egress.ForwarderOptions) tcpStreamLayer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go egress.NewForwarder(opt).Serve(l)
+	return tcpStreamLayer{addr: l.Addr().String()}
+}
+
+// udpStreamLayer is a tcpStreamLayer which relays UDP too, sending it straight to its destination
+// as the egress server would
+type udpStreamLayer struct {
+	tcpStreamLayer
+}
+
+func (l udpStreamLayer) DialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "udp", addr)
+}
+
+// startSOCKS5 serves a SOCKS5Server backed by an egress stand-in, returning its address
+func startSOCKS5(t *testing.T) (string, *SOCKS5Server) {
+	return serveSOCKS5(t, startEgress(t, nil))
+}
+
+// serveSOCKS5 serves a SOCKS5Server backed by layer, returning its address
+func serveSOCKS5(t *testing.T, layer ReliableStreamLayer) (string, *SOCKS5Server) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewSOCKS5Server(layer, nil)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Serve returned %v, expected net.ErrClosed", err)
+		}
+	})
+
+	return l.Addr().String(), s
+}
+
+// startBanner serves TCP connections which are greeted with banner and then echoed
+func startBanner(t *testing.T, banner string) *net.TCPAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+				io.WriteString(c, banner)
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr)
+}
+
+// socks5Dial performs the SOCKS5 handshake for cmd to a destination encoded as atyp and dst,
+// returning the conn and the reply status
+func socks5Dial(t *testing.T, proxy string, methods []byte, cmd, atyp byte, dst []byte, port int) (net.Conn, byte) {
+	t.Helper()
+
+	c, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	c.Write(append([]byte{socks5Version, byte(len(methods))}, methods...))
+
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(c, method); err != nil {
+		t.Fatal(err)
+	}
+
+	if method[1] == socks5MethodNoAcceptable {
+		return c, method[1]
+	}
+
+	req := append([]byte{socks5Version, cmd, 0x00, atyp}, dst...)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	c.Write(req)
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	return c, reply[1]
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	const banner = "SSH-2.0-OpenSSH_9.6\r\n"
+	proxy, _ := startSOCKS5(t)
+	dst := startBanner(t, banner)
+
+	domain := []byte("localhost")
+	targets := map[string][]byte{
+		"ipv4":   dst.IP.To4(),
+		"domain": append([]byte{byte(len(domain))}, domain...),
+	}
+
+	for name, addr := range targets {
+		t.Run(name, func(t *testing.T) {
+			atyp := byte(socks5AddrIPv4)
+			if name == "domain" {
+				atyp = socks5AddrDomain
+			}
+
+			c, status := socks5Dial(t, proxy, []byte{socks5MethodNoAuth}, socks5CmdConnect, atyp, addr, dst.Port)
+			if status != socks5ReplySucceeded {
+				t.Fatalf("CONNECT failed with status %v", status)
+			}
+
+			// The destination speaks first, and what it says mustn't get lost in the CONNECT handshake
+			b := make([]byte, len(banner))
+			if _, err := io.ReadFull(c, b); err != nil || string(b) != banner {
+				t.Fatalf("read %q, %v, expected the banner", b, err)
+			}
+
+			msg := []byte("NELSON WUZ HERE")
+			c.Write(msg)
+
+			b = make([]byte, len(msg))
+			if _, err := io.ReadFull(c, b); err != nil || !bytes.Equal(b, msg) {
+				t.Fatalf("read %q, %v, expected an echo", b, err)
+			}
+		})
+	}
+}
+
+// A client which has finished sending may still be waiting on its destination's reply
+func TestSOCKS5HalfClose(t *testing.T) {
+	proxy, _ := startSOCKS5(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Our destination only replies once it's read everything we have to send
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		b, _ := io.ReadAll(c)
+		c.Write(bytes.ToUpper(b))
+	}()
+
+	dst := l.Addr().(*net.TCPAddr)
+	c, status := socks5Dial(t, proxy, []byte{socks5MethodNoAuth}, socks5CmdConnect, socks5AddrIPv4, dst.IP.To4(), dst.Port)
+	if status != socks5ReplySucceeded {
+		t.Fatalf("CONNECT failed with status %v", status)
+	}
+
+	io.WriteString(c, "nelson wuz here")
+	c.(*net.TCPConn).CloseWrite()
+
+	if b, err := io.ReadAll(c); err != nil || string(b) != "NELSON WUZ HERE" {
+		t.Fatalf("read %q, %v, expected the reply to our half-closed request", b, err)
+	}
+}
+
+func TestSOCKS5Errors(t *testing.T) {
+	proxy, _ := startSOCKS5(t)
+	dst := startBanner(t, "")
+	ip := dst.IP.To4()
+
+	if _, status := socks5Dial(t, proxy, []byte{0x02}, socks5CmdConnect, socks5AddrIPv4, ip, dst.Port); status != socks5MethodNoAcceptable {
+		t.Fatalf("expected no acceptable auth methods, got %v", status)
+	}
+
+	for _, cmd := range []byte{socks5CmdBind, socks5CmdUDPAssociate} {
+		if _, status := socks5Dial(t, proxy, []byte{socks5MethodNoAuth}, cmd, socks5AddrIPv4, ip, dst.Port); status != socks5ReplyCmdNotSupported {
+			t.Fatalf("expected command %v to be unsupported, got %v", cmd, status)
+		}
+	}
+
+	// Nothing listens on port 1, so the egress server's connection is refused
+	if _, status := socks5Dial(t, proxy, []byte{socks5MethodNoAuth}, socks5CmdConnect, socks5AddrIPv4, ip, 1); status != socks5ReplyConnRefused {
+		t.Fatalf("expected connection refused, got %v", status)
+	}
+
+	if _, status := socks5Dial(t, proxy, []byte{socks5MethodNoAuth}, socks5CmdConnect, 0x05, ip, dst.Port); status != socks5ReplyAddrTypeUnsupported {
+		t.Fatalf("expected address type unsupported, got %v", status)
+	}
+}
+
+// startUDPEcho serves a UDP echo server on loopback
+func startUDPEcho(t *testing.T) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		b := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(b[:n], addr)
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// socks5Associate makes a UDP association with the SOCKS5 proxy, returning the TCP connection
+// which holds it open, the address of its relay, and a UDP socket to send to the relay from
+func socks5Associate(t *testing.T, proxy string) (net.Conn, *net.UDPAddr, *net.UDPConn) {
+	t.Helper()
+
+	c, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	c.Write([]byte{socks5Version, 1, socks5MethodNoAuth})
+	io.ReadFull(c, make([]byte, 2))
+
+	// We don't know which port we'll send from, so we leave the address unspecified
+	c.Write([]byte{socks5Version, socks5CmdUDPAssociate, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(c, reply); err != nil || reply[1] != socks5ReplySucceeded {
+		t.Fatalf("UDP ASSOCIATE failed: %v %v", reply[1], err)
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:]))}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	return c, relay, conn
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	proxy, _ := serveSOCKS5(t, udpStreamLayer{startEgress(t, nil)})
+	echo := startUDPEcho(t)
+	c, relay, conn := socks5Associate(t, proxy)
+
+	// A fragment is dropped, and the datagram after it is relayed to the echo server and back
+	hdr := appendSOCKS5Addr([]byte{0x00, 0x00, 0x00}, echo.String())
+	fragment := append([]byte{0x00, 0x00, 0x01}, hdr[3:]...)
+	conn.WriteTo(append(fragment, "fragment"...), relay)
+	conn.WriteTo(append(hdr, "NELSON WUZ HERE"...), relay)
+
+	b := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, payload, err := parseSOCKS5Datagram(b[:n])
+	if err != nil || addr != echo.String() || string(payload) != "NELSON WUZ HERE" {
+		t.Fatalf("got %q from %v (%v), expected our datagram back from %v", payload, addr, err, echo)
+	}
+
+	// Closing the TCP connection ends the association
+	c.Close()
+	time.Sleep(100 * time.Millisecond)
+	conn.WriteTo(append(hdr, "too late"...), relay)
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := conn.ReadFrom(b); err == nil {
+		t.Fatal("expected nothing to be relayed once the association ended")
+	}
+}
+
+// stallingUDPLayer is a udpStreamLayer which never reaches one destination
+type stallingUDPLayer struct {
+	udpStreamLayer
+	stall string
+}
+
+func (l stallingUDPLayer) DialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	if addr == l.stall {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	return l.udpStreamLayer.DialUDP(ctx, addr)
+}
+
+func TestSOCKS5UDPSlowDestination(t *testing.T) {
+	const stall = "192.0.2.1:53"
+	proxy, _ := serveSOCKS5(t, stallingUDPLayer{udpStreamLayer{startEgress(t, nil)}, stall})
+	echo := startUDPEcho(t)
+	_, relay, conn := socks5Associate(t, proxy)
+
+	// While we wait on a destination which doesn't answer, others are still relayed
+	conn.WriteTo(append(appendSOCKS5Addr([]byte{0x00, 0x00, 0x00}, stall), "hello?"...), relay)
+	conn.WriteTo(append(appendSOCKS5Addr([]byte{0x00, 0x00, 0x00}, echo.String()), "NELSON WUZ HERE"...), relay)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("expected an echo while another destination stalled: %v", err)
+	}
+
+	if addr, payload, err := parseSOCKS5Datagram(b[:n]); err != nil || addr != echo.String() || string(payload) != "NELSON WUZ HERE" {
+		t.Fatalf("got %q from %v (%v), expected our datagram back from %v", payload, addr, err, echo)
+	}
+}
+
+func TestSOCKS5Close(t *testing.T) {
+	proxy, s := startSOCKS5(t)
+	dst := startBanner(t, "")
+
+	c, status := socks5Dial(t, proxy, []byte{socks5MethodNoAuth}, socks5CmdConnect, socks5AddrIPv4, dst.IP.To4(), dst.Port)
+	if status != socks5ReplySucceeded {
+		t.Fatalf("CONNECT failed with status %v", status)
+	}
+
+	s.Close()
+
+	// Closing the server closes the connections it's proxying
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected a read error from a closed server")
+	}
+
+	if err := s.Serve(nil); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected Serve on a closed server to fail with net.ErrClosed, got %v", err)
+	}
+}
+
+// Go's HTTP client speaks SOCKS5 too
+func TestSOCKS5HTTPClient(t *testing.T) {
+	proxy, _ := startSOCKS5(t)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "NELSON WUZ HERE")
+	}))
+	defer origin.Close()
+
+	u, err := url.Parse("socks5://" + proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &http.Transport{Proxy: http.ProxyURL(u)}
+	defer tr.CloseIdleConnections()
+
+	res, err := (&http.Client{Transport: tr, Timeout: 10 * time.Second}).Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if b, _ := io.ReadAll(res.Body); string(b) != "NELSON WUZ HERE" {
+		t.Fatalf("unexpected body %q", b)
+	}
+}
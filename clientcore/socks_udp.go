@@ -0,0 +1,296 @@
+// socks_udp.go implements SOCKS5 UDP ASSOCIATE (RFC 1928, section 7), relaying the datagrams a
+// client sends to each destination over its own UDP flow through the egress server
+package clientcore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getlantern/broflake/common"
+)
+
+const (
+	// socks5MaxUDPFlows bounds the destinations a client may reach over one association
+	socks5MaxUDPFlows = 64
+
+	// socks5UDPDialTimeout bounds how long we wait for a flow to a new destination
+	socks5UDPDialTimeout = 10 * time.Second
+
+	// socks5UDPQueueLen bounds the datagrams we hold for a destination while we dial it
+	socks5UDPQueueLen = 16
+
+	socks5MaxDatagram = 65535
+)
+
+// UDPLayer is a ReliableStreamLayer which can also relay UDP through the egress server, like
+// QUICLayer. A SOCKS5Server backed by one supports UDP ASSOCIATE.
+type UDPLayer interface {
+	ReliableStreamLayer
+	DialUDP(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// QUICLayer is a UDPLayer
+var _ UDPLayer = &QUICLayer{}
+
+// udpAssociation relays datagrams between a SOCKS5 client and its destinations. We only relay for
+// the host which made the association, and once we've heard from it, only for the port it sent
+// from. Flows to new destinations are dialed in the background, so one slow destination doesn't
+// hold up the others.
+type udpAssociation struct {
+	s        *SOCKS5Server
+	layer    UDPLayer
+	pconn    net.PacketConn
+	clientIP net.IP
+	log      common.Logger
+	ctx      context.Context // Cancelled when the association is closed
+	cancel   context.CancelFunc
+	mx       sync.Mutex
+	client   net.Addr
+	flows    map[string]net.Conn // By destination
+	dialing  map[string][][]byte // Datagrams queued for each destination we're dialing
+	closed   bool
+}
+
+// associate serves a UDP ASSOCIATE request received over c. The association lasts as long as c.
+func (s *SOCKS5Server) associate(c net.Conn, log common.Logger) {
+	layer, ok := s.layer.(UDPLayer)
+	if !ok {
+		log.Debug("can't relay UDP over this stream layer")
+		writeSOCKS5Reply(c, socks5ReplyCmdNotSupported)
+		return
+	}
+
+	// We relay on the interface the client reached us on
+	localHost, _, _ := net.SplitHostPort(c.LocalAddr().String())
+	clientHost, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+
+	pconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(localHost)})
+	if err != nil {
+		log.Warn("couldn't open a UDP relay", "err", err)
+		writeSOCKS5Reply(c, socks5ReplyGeneralFailure)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &udpAssociation{
+		s:        s,
+		layer:    layer,
+		pconn:    pconn,
+		clientIP: net.ParseIP(clientHost),
+		log:      log.With("relay", pconn.LocalAddr()),
+		ctx:      ctx,
+		cancel:   cancel,
+		flows:    make(map[string]net.Conn),
+		dialing:  make(map[string][][]byte),
+	}
+	defer a.close()
+
+	if err := writeSOCKS5ReplyAddr(c, socks5ReplySucceeded, pconn.LocalAddr().String()); err != nil {
+		return
+	}
+
+	c.SetDeadline(time.Time{})
+	a.log.Debug("relaying SOCKS5 UDP")
+	go a.relay()
+
+	// The client sends nothing more over c, which it closes to end the association
+	io.Copy(io.Discard, c)
+}
+
+// relay sends the client's datagrams on to their destinations until the association is closed
+func (a *udpAssociation) relay() {
+	b := make([]byte, socks5MaxDatagram)
+
+	for {
+		n, from, err := a.pconn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+
+		if !a.fromClient(from) {
+			continue
+		}
+
+		addr, payload, err := parseSOCKS5Datagram(b[:n])
+		if err != nil {
+			a.log.Debug("dropped a SOCKS5 datagram", "err", err)
+			continue
+		}
+
+		a.send(addr, payload)
+	}
+}
+
+// fromClient returns true if a datagram from addr came from our client
+func (a *udpAssociation) fromClient(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || !udpAddr.IP.Equal(a.clientIP) {
+		return false
+	}
+
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	if a.client == nil {
+		a.client = addr
+	}
+
+	return a.client.String() == addr.String()
+}
+
+// send sends payload to addr over our flow to it. If we don't have one yet, we queue payload and
+// start dialing one. Like UDP, we don't promise delivery, so a datagram we can't send is simply lost.
+func (a *udpAssociation) send(addr string, payload []byte) {
+	a.mx.Lock()
+	f, ok := a.flows[addr]
+	queue, dialing := a.dialing[addr]
+
+	switch {
+	case ok:
+	case dialing:
+		if len(queue) < socks5UDPQueueLen {
+			a.dialing[addr] = append(queue, bytes.Clone(payload))
+		}
+	case len(a.flows)+len(a.dialing) >= socks5MaxUDPFlows:
+		a.log.Debug("too many SOCKS5 UDP destinations", "addr", addr)
+	default:
+		a.dialing[addr] = [][]byte{bytes.Clone(payload)}
+		go a.dial(addr)
+	}
+	a.mx.Unlock()
+
+	if f != nil {
+		f.Write(payload)
+	}
+}
+
+// dial opens a flow to addr, sends it the datagrams we queued while we waited, and then relays its
+// replies until it ends
+func (a *udpAssociation) dial(addr string) {
+	ctx, cancel := context.WithTimeout(a.ctx, socks5UDPDialTimeout)
+	defer cancel()
+
+	route := a.s.opt.SplitTunnel.routeAddr(ctx, addr)
+	f, err := dialUDPRoute(ctx, a.layer, route, addr)
+
+	a.mx.Lock()
+	queue := a.dialing[addr]
+	delete(a.dialing, addr)
+
+	if err != nil {
+		a.mx.Unlock()
+		a.log.Debug("couldn't reach SOCKS5 UDP destination", "addr", addr, "route", route, "err", err)
+		return
+	}
+
+	if a.closed {
+		a.mx.Unlock()
+		f.Close()
+		return
+	}
+
+	// We flush the queue before we let send use the flow, so our datagrams leave in order
+	a.flows[addr] = f
+	for _, payload := range queue {
+		f.Write(payload)
+	}
+	a.mx.Unlock()
+
+	a.reply(addr, f)
+}
+
+// reply sends the datagrams we receive from addr over f back to the client, until f ends
+func (a *udpAssociation) reply(addr string, f net.Conn) {
+	defer func() {
+		a.mx.Lock()
+		delete(a.flows, addr)
+		a.mx.Unlock()
+		f.Close()
+	}()
+
+	hdr := appendSOCKS5Addr([]byte{0x00, 0x00, 0x00}, addr)
+	b := make([]byte, socks5MaxDatagram)
+
+	for {
+		n, err := f.Read(b)
+		if err != nil {
+			return
+		}
+
+		a.mx.Lock()
+		client := a.client
+		a.mx.Unlock()
+
+		a.pconn.WriteTo(append(hdr[:len(hdr):len(hdr)], b[:n]...), client)
+	}
+}
+
+func (a *udpAssociation) close() {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	a.closed = true
+	a.cancel()
+	a.pconn.Close()
+	for _, f := range a.flows {
+		f.Close()
+	}
+}
+
+// dialUDPRoute opens a UDP flow to addr by route
+func dialUDPRoute(ctx context.Context, layer UDPLayer, route Route, addr string) (net.Conn, error) {
+	switch route {
+	case RouteDirect:
+		var d net.Dialer
+		return d.DialContext(ctx, "udp", addr)
+	case RouteBlock:
+		return nil, ErrRouteBlocked
+	default:
+		return layer.DialUDP(ctx, addr)
+	}
+}
+
+// parseSOCKS5Datagram parses the header of a datagram the client sent to our relay, returning its
+// destination and payload. We don't reassemble fragments, which RFC 1928 allows us to drop.
+func parseSOCKS5Datagram(b []byte) (addr string, payload []byte, err error) {
+	r := bytes.NewReader(b)
+
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return "", nil, err
+	}
+
+	if hdr[2] != 0 {
+		return "", nil, errors.New("fragmented datagrams aren't supported")
+	}
+
+	addr, err = readSOCKS5Addr(r, hdr[3])
+	if err != nil {
+		return "", nil, err
+	}
+
+	return addr, b[len(b)-r.Len():], nil
+}
+
+// appendSOCKS5Addr appends addr, a host:port, to b in the form SOCKS5 messages carry addresses
+func appendSOCKS5Addr(b []byte, addr string) []byte {
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+
+	if ip := net.ParseIP(host); ip == nil {
+		b = append(append(b, socks5AddrDomain, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, socks5AddrIPv4), ip4...)
+	} else {
+		b = append(append(b, socks5AddrIPv6), ip.To16()...)
+	}
+
+	return binary.BigEndian.AppendUint16(b, uint16(p))
+}
@@ -0,0 +1,332 @@
+// splittunnel.go implements the rules which decide whether a LocalProxy sends a destination through
+// Broflake, connects to it directly, or refuses to connect to it at all
+package clientcore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/broflake/common"
+)
+
+const (
+	RouteProxy Route = iota
+	RouteDirect
+	RouteBlock
+)
+
+// Route describes how a LocalProxy reaches a destination
+// RouteProxy: through Broflake, via the egress server
+// RouteDirect: directly, from the user's own network
+// RouteBlock: not at all
+type Route int
+
+func (r Route) String() string {
+	switch r {
+	case RouteProxy:
+		return "proxy"
+	case RouteDirect:
+		return "direct"
+	case RouteBlock:
+		return "block"
+	default:
+		return "invalid"
+	}
+}
+
+// ParseRoute parses the name of a Route: "proxy", "direct" or "block"
+func ParseRoute(s string) (Route, error) {
+	switch s {
+	case "proxy":
+		return RouteProxy, nil
+	case "direct":
+		return RouteDirect, nil
+	case "block":
+		return RouteBlock, nil
+	default:
+		return RouteProxy, fmt.Errorf("invalid route '%v'", s)
+	}
+}
+
+func (r Route) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Route) UnmarshalText(b []byte) error {
+	var err error
+	*r, err = ParseRoute(string(b))
+	return err
+}
+
+// ErrRouteBlocked is returned when dialing a destination which the split tunneling rules block
+var ErrRouteBlocked = errors.New("destination blocked by split tunneling rules")
+
+// CountryLookup finds the ISO 3166 country code for an IP address, returning "" if it doesn't know.
+// github.com/getlantern/geo's Lookup is a CountryLookup.
+type CountryLookup interface {
+	CountryCode(ip net.IP) string
+}
+
+// SplitTunnelRule routes destinations which match any of its domains, CIDRs or countries
+type SplitTunnelRule struct {
+	Route     Route          `json:"route"`
+	Domains   []string       `json:"domains"`   // Matches the domain and its subdomains
+	CIDRs     []netip.Prefix `json:"cidrs"`     // Matches destination IPs
+	Countries []string       `json:"countries"` // Matches destination IPs located in these countries
+}
+
+// SplitTunnelRules is an ordered list of rules. The first rule to match a destination decides its
+// route; destinations which match no rule take the default route.
+type SplitTunnelRules struct {
+	Default Route             `json:"default"`
+	Rules   []SplitTunnelRule `json:"rules"`
+
+	// CIDR and country rules can only match a destination given by name if we resolve it. Resolving
+	// uses the local DNS resolver, which reveals the name to anyone watching the user's network, so
+	// it's off unless asked for.
+	Resolve bool `json:"resolve"`
+}
+
+// ParseSplitTunnelRules parses rules from JSON, like:
+//
+//	{
+//	  "default": "proxy",
+//	  "resolve": false,
+//	  "rules": [
+//	    {"route": "block", "domains": ["ads.example.com"]},
+//	    {"route": "direct", "domains": ["example.cn"], "cidrs": ["192.168.0.0/16"], "countries": ["CN"]}
+//	  ]
+//	}
+func ParseSplitTunnelRules(b []byte) (*SplitTunnelRules, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	rules := &SplitTunnelRules{}
+	if err := dec.Decode(rules); err != nil {
+		return nil, err
+	}
+
+	for i := range rules.Rules {
+		r := &rules.Rules[i]
+
+		for j, d := range r.Domains {
+			d = strings.Trim(strings.ToLower(d), ".")
+			if d == "" {
+				return nil, fmt.Errorf("rules[%v]: empty domain", i)
+			}
+			r.Domains[j] = d
+		}
+
+		for j, p := range r.CIDRs {
+			r.CIDRs[j] = p.Masked()
+		}
+
+		for j, c := range r.Countries {
+			if len(c) != 2 {
+				return nil, fmt.Errorf("rules[%v]: '%v' isn't an ISO 3166 country code", i, c)
+			}
+			r.Countries[j] = strings.ToUpper(c)
+		}
+	}
+
+	return rules, nil
+}
+
+// LoadSplitTunnelRules parses the rules in a JSON file
+func LoadSplitTunnelRules(path string) (*SplitTunnelRules, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := ParseSplitTunnelRules(b)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	return rules, nil
+}
+
+func (r *SplitTunnelRule) matchDomain(name string) bool {
+	for _, d := range r.Domains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *SplitTunnelRule) matchAddr(addr netip.Addr, geo CountryLookup) bool {
+	for _, p := range r.CIDRs {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	if len(r.Countries) == 0 || geo == nil {
+		return false
+	}
+
+	cc := geo.CountryCode(addr.AsSlice())
+	for _, c := range r.Countries {
+		if cc == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SplitTunnel routes destinations according to a set of SplitTunnelRules, which may be replaced
+// while it's in use. A nil *SplitTunnel routes everything through Broflake.
+type SplitTunnel struct {
+	geo      CountryLookup
+	resolver *net.Resolver
+	log      common.Logger
+	mx       sync.Mutex
+	rules    *SplitTunnelRules
+}
+
+// NewSplitTunnel returns a SplitTunnel for rules. geo may be nil, in which case country rules never
+// match.
+func NewSplitTunnel(rules *SplitTunnelRules, geo CountryLookup) *SplitTunnel {
+	return &SplitTunnel{
+		geo:      geo,
+		resolver: net.DefaultResolver,
+		log:      common.NewLogger("component", "splittunnel"),
+		rules:    rules,
+	}
+}
+
+// Update replaces the rules. Connections which are already established keep their routes.
+func (st *SplitTunnel) Update(rules *SplitTunnelRules) {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	st.rules = rules
+}
+
+func (st *SplitTunnel) load() *SplitTunnelRules {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	return st.rules
+}
+
+// Route returns the route for host, a domain name or an IP address
+func (st *SplitTunnel) Route(ctx context.Context, host string) Route {
+	if st == nil {
+		return RouteProxy
+	}
+
+	rules := st.load()
+	name := strings.Trim(strings.ToLower(host), ".")
+
+	// An IP address matches address rules as-is. A name matches them by resolving it, if we may.
+	var addrs []netip.Addr
+	isIP, resolved := false, false
+
+	if addr, err := netip.ParseAddr(name); err == nil {
+		addrs = []netip.Addr{addr.Unmap()}
+		isIP, resolved = true, true
+	}
+
+	for _, r := range rules.Rules {
+		if !isIP && r.matchDomain(name) {
+			return r.Route
+		}
+
+		if len(r.CIDRs) == 0 && len(r.Countries) == 0 {
+			continue
+		}
+
+		if !resolved && rules.Resolve {
+			resolved = true
+
+			var err error
+			addrs, err = st.resolver.LookupNetIP(ctx, "ip", name)
+			if err != nil {
+				st.log.Debug("couldn't resolve destination for split tunneling", "host", name, "err", err)
+			}
+		}
+
+		for _, addr := range addrs {
+			if r.matchAddr(addr.Unmap(), st.geo) {
+				return r.Route
+			}
+		}
+	}
+
+	return rules.Default
+}
+
+// routeAddr returns the route for addr, a host:port
+func (st *SplitTunnel) routeAddr(ctx context.Context, addr string) Route {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	return st.Route(ctx, host)
+}
+
+// Watch reloads the rules from the file at path whenever it changes, checking every interval, until
+// ctx is done. If the file stops parsing, we keep the rules we have. The first check always reloads,
+// so we can't miss a change made between loading the rules and calling Watch.
+func (st *SplitTunnel) Watch(ctx context.Context, path string, interval time.Duration) {
+	var lastMod time.Time
+	var lastSize int64
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			st.log.Warn("can't check split tunneling rules", "path", path, "err", err)
+			continue
+		}
+
+		if fi.ModTime().Equal(lastMod) && fi.Size() == lastSize {
+			continue
+		}
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+
+		rules, err := LoadSplitTunnelRules(path)
+		if err != nil {
+			st.log.Error("can't reload split tunneling rules, keeping the old ones", "err", err)
+			continue
+		}
+
+		st.Update(rules)
+		st.log.Info("reloaded split tunneling rules", "path", path, "rules", len(rules.Rules))
+	}
+}
+
+// dialRoute connects to addr, a host:port, by route: through the egress server at the other end of
+// layer, directly, or not at all
+func dialRoute(ctx context.Context, layer ReliableStreamLayer, route Route, addr string) (net.Conn, error) {
+	switch route {
+	case RouteDirect:
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	case RouteBlock:
+		return nil, ErrRouteBlocked
+	default:
+		return DialEgress(ctx, layer, addr)
+	}
+}
@@ -0,0 +1,241 @@
+//go:build !wasm
+
+package clientcore
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/broflake/egress"
+)
+
+// fakeCountries is a CountryLookup which knows the country of a few addresses
+type fakeCountries map[string]string
+
+func (f fakeCountries) CountryCode(ip net.IP) string {
+	return f[ip.String()]
+}
+
+func mustParseSplitTunnelRules(t *testing.T, s string) *SplitTunnelRules {
+	t.Helper()
+
+	rules, err := ParseSplitTunnelRules([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rules
+}
+
+func TestParseSplitTunnelRules(t *testing.T) {
+	rules := mustParseSplitTunnelRules(t, `{
+		"default": "direct",
+		"rules": [{"route": "block", "domains": [".Ads.Example.COM."], "cidrs": ["10.1.2.3/8"], "countries": ["cn"]}]
+	}`)
+
+	r := rules.Rules[0]
+	if rules.Default != RouteDirect || r.Route != RouteBlock {
+		t.Fatalf("unexpected routes %v, %v", rules.Default, r.Route)
+	}
+
+	if r.Domains[0] != "ads.example.com" || r.CIDRs[0].String() != "10.0.0.0/8" || r.Countries[0] != "CN" {
+		t.Fatalf("rule wasn't normalized: %+v", r)
+	}
+
+	// The zero value routes everything through Broflake
+	if rules := mustParseSplitTunnelRules(t, `{}`); rules.Default != RouteProxy {
+		t.Fatalf("expected the default route to be proxy, got %v", rules.Default)
+	}
+
+	for _, bad := range []string{
+		`{"default": "sideways"}`,
+		`{"rules": [{"route": "direct", "domain": ["example.com"]}]}`,
+		`{"rules": [{"route": "direct", "domains": ["."]}]}`,
+		`{"rules": [{"route": "direct", "cidrs": ["10.0.0.0/33"]}]}`,
+		`{"rules": [{"route": "direct", "countries": ["CHN"]}]}`,
+	} {
+		if _, err := ParseSplitTunnelRules([]byte(bad)); err == nil {
+			t.Fatalf("expected %v not to parse", bad)
+		}
+	}
+}
+
+func TestSplitTunnelRoute(t *testing.T) {
+	rules := mustParseSplitTunnelRules(t, `{
+		"default": "proxy",
+		"rules": [
+			{"route": "block", "domains": ["ads.example.cn"]},
+			{"route": "direct", "domains": ["example.cn"], "cidrs": ["192.168.0.0/16", "127.0.0.0/8"]},
+			{"route": "direct", "countries": ["CN"]}
+		]
+	}`)
+
+	st := NewSplitTunnel(rules, fakeCountries{"203.0.113.1": "CN", "::ffff:203.0.113.2": "US"})
+
+	tests := []struct {
+		host string
+		want Route
+	}{
+		{"ads.example.cn", RouteBlock},
+		{"tracker.ads.example.cn", RouteBlock},
+		{"example.cn", RouteDirect},
+		{"WWW.Example.CN.", RouteDirect},
+		{"notexample.cn", RouteProxy},
+		{"192.168.1.1", RouteDirect},
+		{"::ffff:192.168.1.1", RouteDirect},
+		{"203.0.113.1", RouteDirect},
+		{"203.0.113.2", RouteProxy},
+		{"example.com", RouteProxy},
+
+		// We don't resolve names unless asked to
+		{"localhost", RouteProxy},
+	}
+
+	for _, tt := range tests {
+		if got := st.Route(context.Background(), tt.host); got != tt.want {
+			t.Errorf("Route(%v) = %v, expected %v", tt.host, got, tt.want)
+		}
+	}
+
+	rules.Resolve = true
+	if got := st.Route(context.Background(), "localhost"); got != RouteDirect {
+		t.Errorf("Route(localhost) = %v after resolving, expected direct", got)
+	}
+
+	// Resolving a name for an address rule doesn't stop it matching a later domain rule
+	st.Update(mustParseSplitTunnelRules(t, `{
+		"resolve": true,
+		"rules": [
+			{"route": "direct", "cidrs": ["10.0.0.0/8"]},
+			{"route": "block", "domains": ["localhost"]}
+		]
+	}`))
+
+	if got := st.Route(context.Background(), "localhost"); got != RouteBlock {
+		t.Errorf("Route(localhost) = %v, expected block", got)
+	}
+
+	var nilST *SplitTunnel
+	if got := nilST.Route(context.Background(), "example.cn"); got != RouteProxy {
+		t.Errorf("a nil SplitTunnel routed example.cn %v, expected proxy", got)
+	}
+}
+
+func TestSplitTunnelWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"default": "proxy"}`)
+	rules, err := LoadSplitTunnelRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := NewSplitTunnel(rules, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go st.Watch(ctx, path, 10*time.Millisecond)
+
+	await := func(want Route) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for st.Route(ctx, "example.com") != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("rules weren't reloaded, expected example.com to route %v", want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	write(`{"default": "direct"}`)
+	await(RouteDirect)
+
+	// A broken file leaves the rules we had in place
+	write(`{"default": "nowhere"}`)
+	time.Sleep(100 * time.Millisecond)
+	await(RouteDirect)
+
+	write(`{"default": "block"}`)
+	await(RouteBlock)
+}
+
+// refusingEgress configures an egress stand-in which refuses to connect anywhere, so only direct
+// routes work
+var refusingEgress = &egress.ForwarderOptions{
+	Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, syscall.ECONNREFUSED
+	},
+}
+
+func TestLocalProxySplitTunnel(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "NELSON WUZ HERE")
+	}))
+	defer origin.Close()
+
+	tlsOrigin := httptest.NewTLSServer(origin.Config.Handler)
+	defer tlsOrigin.Close()
+
+	// The origins and the banner are on 127.0.0.1, which we reach directly as localhost, or by IP
+	// through the egress server, which won't connect
+	rules := mustParseSplitTunnelRules(t, `{
+		"rules": [
+			{"route": "direct", "domains": ["localhost"]},
+			{"route": "block", "domains": ["block.test"]}
+		]
+	}`)
+
+	st := NewSplitTunnel(rules, nil)
+	_, httpProxy, socksProxy := startLocalProxyWithEgress(t, refusingEgress, &LocalProxyOptions{SplitTunnel: st})
+
+	for _, origin := range []string{origin.URL, tlsOrigin.URL} {
+		u, _ := url.Parse(origin)
+		_, port, _ := net.SplitHostPort(u.Host)
+
+		for host, want := range map[string]int{"localhost": http.StatusOK, "block.test": http.StatusForbidden, "127.0.0.1": 0} {
+			target := u.Scheme + "://" + net.JoinHostPort(host, port)
+			status, _ := get(t, &url.URL{Scheme: "http", Host: httpProxy}, target)
+
+			// For HTTPS, a refused CONNECT is an error rather than a status
+			if u.Scheme == "https" && want == http.StatusForbidden {
+				want = 0
+			}
+
+			if (want == 0 && status == http.StatusOK) || (want != 0 && status != want) {
+				t.Errorf("%v via HTTP proxy: got %v, expected %v", target, status, want)
+			}
+		}
+	}
+
+	dst := startBanner(t, "")
+	for host, want := range map[string]byte{
+		"localhost":  socks5ReplySucceeded,
+		"block.test": socks5ReplyNotAllowed,
+		"127.0.0.1":  socks5ReplyConnRefused,
+	} {
+		_, status := socks5Dial(t, socksProxy, []byte{socks5MethodNoAuth}, socks5CmdConnect, socks5AddrDomain, append([]byte{byte(len(host))}, host...), dst.Port)
+		if status != want {
+			t.Errorf("%v via SOCKS5: got %v, expected %v", host, status, want)
+		}
+	}
+
+	// New rules apply to new connections
+	st.Update(mustParseSplitTunnelRules(t, `{"rules": [{"route": "direct", "cidrs": ["127.0.0.0/8"]}]}`))
+	if _, status := socks5Dial(t, socksProxy, []byte{socks5MethodNoAuth}, socks5CmdConnect, socks5AddrIPv4, dst.IP.To4(), dst.Port); status != socks5ReplySucceeded {
+		t.Errorf("%v via SOCKS5: got %v, expected a direct connection", dst, status)
+	}
+}
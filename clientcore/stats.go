@@ -0,0 +1,133 @@
+// stats.go provides point-in-time snapshots of a Broflake instance's runtime state, for triage
+package clientcore
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// Stats is a snapshot of a Broflake instance's runtime state. It's safe to marshal as JSON.
+type Stats struct {
+	At         time.Time       `json:"at"`
+	Goroutines int             `json:"goroutines"`
+	Consumers  []WorkerStats   `json:"consumerTable"`
+	Producers  []WorkerStats   `json:"producerTable"`
+	Connected  []ConsumerStats `json:"connectedConsumers"`
+	Routes     map[int]int     `json:"routes,omitempty"` // Consumer idx -> producer idx, -1 if unrouted
+	QUIC       *QUICStats      `json:"quic,omitempty"`   // Only present while a QUICLayer is open
+}
+
+// WorkerStats describes one slot in a WorkerTable. Bytes in are bytes the worker received from its
+// connection and passed to the bus; bytes out are bytes the bus passed to the worker.
+type WorkerStats struct {
+	State         int                   `json:"state"`
+	StateName     string                `json:"stateName"`
+	Since         time.Time             `json:"since"`
+	TimeInState   time.Duration         `json:"timeInState"`
+	BytesIn       uint64                `json:"bytesIn"`
+	BytesOut      uint64                `json:"bytesOut"`
+	DroppedChunks uint64                `json:"droppedChunks"`
+	DroppedBytes  uint64                `json:"droppedBytes"`
+	PathAssertion *common.PathAssertion `json:"pathAssertion,omitempty"` // Producer table only
+	STUNCacheSize *int                  `json:"stunCacheSize,omitempty"` // WebRTC consumers only
+}
+
+// ConsumerStats describes a consumer connected to a worker in the consumer table
+type ConsumerStats struct {
+	WorkerIdx int    `json:"workerIdx"`
+	Addr      net.IP `json:"addr"`
+	Tag       string `json:"tag"`
+}
+
+// QUICStats describes the state of a QUICLayer's connection to the egress server
+type QUICStats struct {
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since"`
+	Dials     uint64    `json:"dials"`
+	Failures  uint64    `json:"failures"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// Stats returns a snapshot of this engine's runtime state
+func (b *BroflakeEngine) Stats() Stats {
+	now := time.Now()
+
+	s := Stats{
+		At:         now,
+		Goroutines: runtime.NumGoroutine(),
+		Consumers:  b.cTable.stats(now),
+		Producers:  b.pTable.stats(now),
+		Connected:  b.consumers.stats(),
+	}
+
+	for i := range s.Producers {
+		pa := b.paths.get(i)
+		s.Producers[i].PathAssertion = &pa
+	}
+
+	if rt, ok := b.pRouter.(routeTable); ok {
+		s.Routes = make(map[int]int)
+		for c, p := range rt.routes() {
+			s.Routes[int(c)] = int(p)
+		}
+	}
+
+	if q := b.quic.Load(); q != nil {
+		qs := q.stats()
+		s.QUIC = &qs
+	}
+
+	return s
+}
+
+// A routeTable is a TableRouter which can report the consumer -> producer mapping it's routing with
+type routeTable interface {
+	routes() map[workerID]workerID
+}
+
+// safePathMap records the most recent path assertion from each worker in a producer table
+type safePathMap struct {
+	mu sync.RWMutex
+	v  map[int]common.PathAssertion
+}
+
+func newSafePathMap() *safePathMap {
+	return &safePathMap{v: make(map[int]common.PathAssertion)}
+}
+
+// set records pa for workerIdx, returning true if it differs from the worker's previous assertion
+func (m *safePathMap) set(workerIdx int, pa common.PathAssertion) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	changed := !m.v[workerIdx].Equal(pa)
+	m.v[workerIdx] = pa
+	return changed
+}
+
+func (m *safePathMap) get(workerIdx int) common.PathAssertion {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.v[workerIdx]
+}
+
+// trafficStats counts the chunk bytes which pass between a worker and its router
+type trafficStats struct {
+	in  atomic.Uint64
+	out atomic.Uint64
+}
+
+func countChunk(c *atomic.Uint64, msg IPCMsg) {
+	if msg.IpcType != ChunkIPC {
+		return
+	}
+
+	if b, ok := msg.Data.([]byte); ok {
+		c.Add(uint64(len(b)))
+	}
+}
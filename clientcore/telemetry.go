@@ -0,0 +1,102 @@
+// telemetry.go connects WorkerFSMs to OpenTelemetry (see the otel package)
+package clientcore
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/getlantern/broflake/otel"
+)
+
+// fsmTelemetry records a WorkerFSM's metrics and traces its connection attempts. A connection
+// attempt begins each time the WorkerFSM enters its 'first' state, and it's traced as one span with
+// a child span for each state it passes through. The attempt succeeds when the WorkerFSM reaches
+// its 'connected' state, and it fails when the WorkerFSM returns to 'first' or any state before it.
+// While the WorkerFSM is in its 'connected' state, its slot counts as active.
+type fsmTelemetry struct {
+	table     string // Telemetry is disabled until the WorkerFSM's table is instrumented
+	workerIdx int
+	attempt   string // Span name for a connection attempt; "" if the WorkerFSM doesn't make them
+	first     int
+	connected int
+	ctx       context.Context // Carries span
+	span      otel.Span       // The connection attempt in progress, if any
+}
+
+// enter is called before the WorkerFSM runs 'state'. It returns a context derived from ctx for the
+// state to run with, along with the state's span, which is nil if the state isn't traced.
+func (t *fsmTelemetry) enter(ctx context.Context, state int, name string) (context.Context, otel.Span) {
+	if t.table == "" || t.attempt == "" || state < t.first || state >= t.connected {
+		return ctx, nil
+	}
+
+	if state == t.first {
+		t.ctx, t.span = otel.StartSpan(
+			ctx,
+			t.attempt,
+			attribute.String("table", t.table),
+			attribute.Int("worker", t.workerIdx),
+		)
+	}
+
+	if t.span == nil {
+		return ctx, nil
+	}
+
+	return otel.StartSpan(t.ctx, name)
+}
+
+// leave is called after the WorkerFSM has run 'state' for duration 'd', with the span returned by
+// enter
+func (t *fsmTelemetry) leave(span otel.Span, state int, name string, next int, nextName, reason string, d time.Duration) {
+	if t.table == "" {
+		return
+	}
+
+	otel.RecordStateDuration(t.table, name, nextName, d)
+
+	if t.attempt == "" {
+		return
+	}
+
+	failed := next <= t.first
+
+	if span != nil {
+		span.SetAttributes(attribute.String("next", nextName), attribute.String("reason", reason))
+		if failed {
+			span.SetError(reason)
+		}
+		span.End()
+	}
+
+	if t.span != nil && (failed || next == t.connected) {
+		if failed {
+			t.span.SetError(reason)
+		}
+		t.span.End()
+		t.ctx, t.span = nil, nil
+	}
+
+	if next == t.connected && state != t.connected {
+		otel.AddActiveSlots(t.table, 1)
+	}
+
+	if state == t.connected && next != t.connected {
+		otel.AddActiveSlots(t.table, -1)
+	}
+}
+
+// stop is called after the WorkerFSM has stopped in 'state', to close out any attempt in progress
+func (t *fsmTelemetry) stop(state int) {
+	if t.span != nil {
+		t.span.SetError("stopped")
+		t.span.End()
+		t.ctx, t.span = nil, nil
+	}
+
+	if t.table != "" && t.attempt != "" && state == t.connected {
+		otel.AddActiveSlots(t.table, -1)
+	}
+}
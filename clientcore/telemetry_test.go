@@ -0,0 +1,112 @@
+//go:build !wasm
+
+package clientcore
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	gotel "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/getlantern/broflake/otel"
+)
+
+func TestFSMTelemetryTracesAttempts(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	prev := gotel.GetTracerProvider()
+	gotel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer gotel.SetTracerProvider(prev)
+
+	var wg sync.WaitGroup
+	var dials int
+	var headers []http.Header
+	connected := make(chan struct{})
+
+	fsm := NewWorkerFSM(&wg, []FSMstate{
+		{
+			Name: "new",
+			Next: []int{1},
+			Run: func(ctx context.Context, com *ipcChan) (int, string) {
+				return 1, "ready"
+			},
+		},
+		{
+			Name: "dial",
+			Next: []int{0, 2},
+			Run: func(ctx context.Context, com *ipcChan) (int, string) {
+				h := http.Header{}
+				otel.InjectTraceHeaders(ctx, h)
+				headers = append(headers, h)
+
+				dials++
+				if dials == 1 {
+					return 0, "unreachable"
+				}
+				return 2, "connected"
+			},
+		},
+		{
+			Name: "proxy",
+			Next: []int{0},
+			Run: func(ctx context.Context, com *ipcChan) (int, string) {
+				close(connected)
+				<-ctx.Done()
+				return 0, "stopped"
+			},
+		},
+	})
+
+	fsm.traceAttempts("test_attempt", 1, 2)
+	table := NewWorkerTable([]WorkerFSM{*fsm})
+	table.instrument("producer")
+	table.Start()
+	<-connected
+	table.Stop()
+	wg.Wait()
+
+	for i, h := range headers {
+		if h.Get("traceparent") == "" {
+			t.Fatalf("dial %v sent no trace context", i)
+		}
+	}
+
+	// Two attempts, each with one traced state: the failed one, then the successful one
+	spans := recorder.Ended()
+	if len(spans) != 4 {
+		t.Fatalf("recorded %v spans, expected 4", len(spans))
+	}
+
+	for i, name := range []string{"dial", "test_attempt", "dial", "test_attempt"} {
+		if spans[i].Name() != name {
+			t.Fatalf("span %v is %v, expected %v", i, spans[i].Name(), name)
+		}
+	}
+
+	for _, pair := range [][2]int{{0, 1}, {2, 3}} {
+		state, attempt := spans[pair[0]], spans[pair[1]]
+		if state.Parent().SpanID() != attempt.SpanContext().SpanID() {
+			t.Fatalf("state span %v isn't a child of its attempt", pair[0])
+		}
+	}
+
+	if spans[1].SpanContext().TraceID() == spans[3].SpanContext().TraceID() {
+		t.Fatal("expected each attempt to begin a new trace")
+	}
+
+	if spans[0].Status().Code != codes.Error || spans[1].Status().Code != codes.Error {
+		t.Fatal("expected the first attempt to fail")
+	}
+
+	if spans[1].Status().Description != "unreachable" {
+		t.Fatalf("unexpected status %+v", spans[1].Status())
+	}
+
+	if spans[2].Status().Code == codes.Error || spans[3].Status().Code == codes.Error {
+		t.Fatal("expected the second attempt to succeed")
+	}
+}
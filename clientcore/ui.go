@@ -2,7 +2,9 @@
 package clientcore
 
 import (
+	"context"
 	"net"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -10,6 +12,7 @@ import (
 
 	"github.com/getlantern/broflake/common"
 	netstatecl "github.com/getlantern/broflake/netstate/client"
+	"github.com/getlantern/broflake/otel"
 )
 
 const (
@@ -51,7 +54,25 @@ func (c *safeConsumerMap) slice() [][]string {
 	return s
 }
 
-var connectedConsumers = safeConsumerMap{v: make(map[workerID]common.ConsumerInfo)}
+// Return the currently connected consumers
+func (c *safeConsumerMap) stats() []ConsumerStats {
+	s := []ConsumerStats{}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for wid, cinfo := range c.v {
+		if !cinfo.Nil() {
+			s = append(s, ConsumerStats{WorkerIdx: int(wid), Addr: cinfo.Addr, Tag: cinfo.Tag})
+		}
+	}
+
+	sort.Slice(s, func(i, j int) bool { return s[i].WorkerIdx < s[j].WorkerIdx })
+	return s
+}
+
+func newSafeConsumerMap() *safeConsumerMap {
+	return &safeConsumerMap{v: make(map[workerID]common.ConsumerInfo)}
+}
 
 type UI interface {
 	Init(bf *BroflakeEngine)
@@ -71,16 +92,33 @@ type UI interface {
 	OnDownstreamThroughput(bytesPerSec int)
 
 	OnConsumerConnectionChange(state int, workerIdx int, addr net.IP)
+
+	OnChunkDrops(table string, workerIdx int, chunks int, bytes int)
 }
 
-func DownstreamUIHandler(ui UIImpl, netstated, tag string) func(msg IPCMsg) {
+// DownstreamUIHandler returns a bus observer which reports downstream throughput. Its reporting
+// goroutine runs until ctx is cancelled; wg, if non-nil, tracks it.
+func DownstreamUIHandler(ctx context.Context, wg *sync.WaitGroup, ui UIImpl, netstated string) func(msg IPCMsg) {
 	var bytesPerSec int64
 	var tick uint
 	tickMs := time.Duration(1000 / uiRefreshHz)
 
+	if wg != nil {
+		wg.Add(1)
+	}
+
 	go func() {
+		if wg != nil {
+			defer wg.Done()
+		}
+
 		for {
-			<-time.After(tickMs * time.Millisecond)
+			select {
+			case <-time.After(tickMs * time.Millisecond):
+			case <-ctx.Done():
+				return
+			}
+
 			ui.OnDownstreamThroughput(int(atomic.LoadInt64(&bytesPerSec)))
 			if tick%uiRefreshHz == 0 {
 				atomic.SwapInt64(&bytesPerSec, 0)
@@ -95,13 +133,72 @@ func DownstreamUIHandler(ui UIImpl, netstated, tag string) func(msg IPCMsg) {
 			size := len(msg.Data.([]byte))
 			atomic.AddInt64(&bytesPerSec, int64(size))
 			ui.OnDownstreamChunk(size, int(msg.Wid))
+			otel.RecordBytes("downstream", int64(size))
 		}
 	}
 }
 
-func UpstreamUIHandler(ui UIImpl, netstated, tag string) func(msg IPCMsg) {
+// FlowUIHandler samples the dropped chunk counters for each worker in the consumer and producer
+// tables once per second. For each worker which dropped chunks since the last sample, it fires a
+// UI event and records the delta in OTel. Sampling stops when ctx is cancelled; wg, if non-nil,
+// tracks the sampling goroutine.
+func FlowUIHandler(ctx context.Context, wg *sync.WaitGroup, ui UIImpl, cTable, pTable *WorkerTable) {
+	tables := map[string]*WorkerTable{"consumer": cTable, "producer": pTable}
+	lastChunks := make(map[string][]uint64)
+	lastBytes := make(map[string][]uint64)
+
+	for name, t := range tables {
+		lastChunks[name] = make([]uint64, t.Size())
+		lastBytes[name] = make([]uint64, t.Size())
+	}
+
+	if wg != nil {
+		wg.Add(1)
+	}
+
+	go func() {
+		if wg != nil {
+			defer wg.Done()
+		}
+
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			for name, t := range tables {
+				chunks, bytes := t.dropped()
+
+				for i := range chunks {
+					dChunks := chunks[i] - lastChunks[name][i]
+					dBytes := bytes[i] - lastBytes[name][i]
+
+					if dChunks == 0 {
+						continue
+					}
+
+					lastChunks[name][i] = chunks[i]
+					lastBytes[name][i] = bytes[i]
+					ui.OnChunkDrops(name, i, int(dChunks), int(dBytes))
+					otel.RecordChunkDrops(name, i, int64(dChunks), int64(dBytes))
+				}
+			}
+		}
+	}()
+}
+
+func UpstreamUIHandler(ui UIImpl, netstated string) func(msg IPCMsg) {
+	connectedConsumers := ui.BroflakeEngine.consumers
+
 	return func(msg IPCMsg) {
 		switch msg.IpcType {
+		case ChunkIPC:
+			otel.RecordBytes("upstream", int64(len(msg.Data.([]byte))))
 		case ConsumerInfoIPC:
 			ci := msg.Data.(common.ConsumerInfo)
 
@@ -123,7 +220,7 @@ func UpstreamUIHandler(ui UIImpl, netstated, tag string) func(msg IPCMsg) {
 				inst := &netstatecl.Instruction{
 					Op:   netstatecl.OpConsumerState,
 					Args: netstatecl.EncodeArgsOpConsumerState(args),
-					Tag:  tag,
+					Tag:  ui.BroflakeEngine.tag(),
 				}
 
 				// Send it to netstated!
@@ -133,7 +230,8 @@ func UpstreamUIHandler(ui UIImpl, netstated, tag string) func(msg IPCMsg) {
 				)
 
 				if err != nil {
-					common.Debugf("Netstate client Exec error: %v", err)
+					ui.BroflakeEngine.log.Warn("netstate client exec error", "err", err)
+					ui.BroflakeEngine.events.publish(ErrorEvent{Source: "netstate", Err: err})
 				}
 			}
 		}
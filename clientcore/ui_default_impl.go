@@ -41,9 +41,19 @@ func (ui UIImpl) OnDownstreamChunk(size int, workerIdx int) {
 }
 
 func (ui UIImpl) OnDownstreamThroughput(bytesPerSec int) {
-	// TODO: do something?
+	if ui.BroflakeEngine.throughput.Swap(int64(bytesPerSec)) != int64(bytesPerSec) {
+		ui.BroflakeEngine.events.publish(ThroughputEvent{BytesPerSec: bytesPerSec})
+	}
 }
 
 func (ui UIImpl) OnConsumerConnectionChange(state int, workerIdx int, addr net.IP) {
-	// TODO: do something?
+	ui.BroflakeEngine.events.publish(
+		ConsumerConnectionEvent{WorkerIdx: workerIdx, Addr: addr, Connected: state == 1},
+	)
+}
+
+func (ui UIImpl) OnChunkDrops(table string, workerIdx int, chunks int, bytes int) {
+	ui.BroflakeEngine.events.publish(
+		ChunkDropEvent{Table: table, WorkerIdx: workerIdx, Chunks: chunks, Bytes: bytes},
+	)
 }
@@ -4,6 +4,7 @@
 package clientcore
 
 import (
+	"encoding/json"
 	"net"
 	"strings"
 	"syscall/js"
@@ -40,6 +41,12 @@ func (ui *UIImpl) Init(bf *BroflakeEngine) {
 		"debug",
 		js.FuncOf(func(this js.Value, args []js.Value) interface{} { ui.Debug(); return nil }),
 	)
+
+	// 'stats' returns a snapshot of this Broflake instance's runtime state (see stats.go)
+	js.Global().Get(ui.ID).Set(
+		"stats",
+		js.FuncOf(func(this js.Value, args []js.Value) interface{} { return ui.Stats() }),
+	)
 }
 
 func (ui UIImpl) Start() {
@@ -54,6 +61,16 @@ func (ui UIImpl) Debug() {
 	ui.BroflakeEngine.debug()
 }
 
+func (ui UIImpl) Stats() js.Value {
+	b, err := json.Marshal(ui.BroflakeEngine.Stats())
+	if err != nil {
+		ui.BroflakeEngine.log.Error("error encoding stats", "err", err)
+		return js.Null()
+	}
+
+	return js.Global().Get("JSON").Call("parse", string(b))
+}
+
 func (ui UIImpl) fireEvent(eventName string, detail map[string]interface{}) {
 	options := map[string]interface{}{"detail": js.ValueOf(detail)}
 
@@ -101,3 +118,12 @@ func (ui UIImpl) OnConsumerConnectionChange(state int, workerIdx int, addr net.I
 	detail := map[string]interface{}{"state": state, "workerIdx": workerIdx, "addr": addrString}
 	ui.fireEvent("consumerConnectionChange", detail)
 }
+
+// 'chunkDrops' fires at most once per second per connection slot, when that slot has discarded
+// chunks because it couldn't keep up with the data rate. 'table' is "consumer" or "producer";
+// 'workerIdx' is the 0-indexed ID of the connection slot; 'chunks' and 'bytes' count the chunks
+// and bytes dropped since the last 'chunkDrops' event for this slot
+func (ui UIImpl) OnChunkDrops(table string, workerIdx int, chunks int, bytes int) {
+	detail := map[string]interface{}{"table": table, "workerIdx": workerIdx, "chunks": chunks, "bytes": bytes}
+	ui.fireEvent("chunkDrops", detail)
+}
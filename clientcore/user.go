@@ -19,11 +19,14 @@ import (
 
 type BroflakeConn struct {
 	net.PacketConn
-	writeChan          chan IPCMsg
+	com                *ipcChan
 	readChan           chan IPCMsg
 	addr               common.DebugAddr
 	readDeadline       time.Time
 	updateReadDeadline chan time.Time
+	closed             chan struct{}
+	closeOnce          *sync.Once
+	engine             *BroflakeEngine
 }
 
 func (c BroflakeConn) LocalAddr() net.Addr {
@@ -33,45 +36,60 @@ func (c BroflakeConn) LocalAddr() net.Addr {
 func (c BroflakeConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	for {
 		var ctx context.Context
+		var cancel context.CancelFunc
 
 		// If the deadline is zero value, never expire; otherwise obey the deadline
 		if c.readDeadline.IsZero() {
-			ctx, _ = context.WithCancel(context.Background())
+			ctx, cancel = context.WithCancel(context.Background())
 		} else {
-			ctx, _ = context.WithDeadline(context.Background(), c.readDeadline)
+			ctx, cancel = context.WithDeadline(context.Background(), c.readDeadline)
 		}
 
 		select {
 		case msg := <-c.readChan:
 			// The read completed, let's return some bytes!
+			cancel()
 			payload := msg.Data.([]byte)
 			copy(p, payload)
 			return len(payload), common.DebugAddr("DEBUG NELSON WUZ HERE"), nil
 		case <-ctx.Done():
 			// We're past our deadline, so let's return failure!
+			cancel()
 			return 0, common.DebugAddr("DEBUG NELSON WUZ HERE"), ctx.Err()
 		case d := <-c.updateReadDeadline:
 			// Someone updated the read deadline, so let's iterate to respect the new deadline
+			cancel()
 			c.readDeadline = d
+		case <-c.closed:
+			cancel()
+			return 0, common.DebugAddr("DEBUG NELSON WUZ HERE"), net.ErrClosed
 		}
 	}
 }
 
 func (c BroflakeConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	// TODO: This copy seems necessary to avoid a data race
-	b := make([]byte, len(p))
-	copy(b, p)
-
 	select {
-	case c.writeChan <- IPCMsg{IpcType: ChunkIPC, Data: b}:
-		// Do nothing, message sent
+	case <-c.closed:
+		return 0, net.ErrClosed
 	default:
-		// Drop the chunk if we can't keep up with the data rate
 	}
 
+	// TODO: This copy seems necessary to avoid a data race
+	b := make([]byte, len(p))
+	copy(b, p)
+
+	// If we can't keep up with the data rate, the chunk is dropped and counted; QUIC will recover
+	c.com.sendChunk(context.Background(), IPCMsg{IpcType: ChunkIPC, Data: b})
 	return len(b), nil
 }
 
+// Close unblocks any pending ReadFrom and fails all subsequent reads and writes. It doesn't stop
+// the user stream worker, which belongs to the Broflake instance.
+func (c BroflakeConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
 // XXX: A note about deadlines: as of quic-go 0.34, the QUIC dialer didn't seem to care about read
 // or write deadlines, and it was happy to use a net.PacketConn which didn't properly implement them.
 // But when we bumped to quic-go 0.40, it emerged that the dialer wouldn't work unless we added
@@ -84,22 +102,28 @@ func (c BroflakeConn) SetReadDeadline(t time.Time) error {
 
 func NewProducerUserStream(wg *sync.WaitGroup) (*BroflakeConn, *WorkerFSM) {
 	worker := NewWorkerFSM(wg, []FSMstate{
-		FSMstate(func(ctx context.Context, com *ipcChan, input []interface{}) (int, []interface{}) {
-			// State 0
-			// (no input data)
-			common.Debugf("User stream producer state 0...")
-			// TODO: check for a non-nil path assertion to alert the UI that we're ready to proxy?
-			select {}
-		}),
+		{
+			Name: "idle",
+			Next: []int{0},
+			Run: func(ctx context.Context, com *ipcChan) (int, string) {
+				// State 0
+				common.LoggerFrom(ctx).Debug("user stream ready")
+				// TODO: check for a non-nil path assertion to alert the UI that we're ready to proxy?
+				<-ctx.Done()
+				return 0, "stopped"
+			},
+		},
 	})
 
 	bfconn := BroflakeConn{
 		PacketConn:         &net.UDPConn{},
-		writeChan:          worker.com.tx,
+		com:                worker.com,
 		readChan:           worker.com.rx,
 		addr:               common.DebugAddr(uuid.NewString()),
 		readDeadline:       time.Time{},
 		updateReadDeadline: make(chan time.Time, 512),
+		closed:             make(chan struct{}),
+		closeOnce:          &sync.Once{},
 	}
 
 	return &bfconn, worker
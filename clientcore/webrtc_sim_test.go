@@ -0,0 +1,283 @@
+//go:build !wasm
+
+package clientcore
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/v2/vnet"
+
+	"github.com/getlantern/broflake/clientcore/sim"
+	"github.com/getlantern/broflake/common"
+)
+
+const simTimeout = 30 * time.Second
+
+// simWorker runs a WorkerFSM outside of a Broflake engine, standing in for its router: it answers
+// connectivity checks with a (*, 1) path assertion, collects chunks, and records transitions
+type simWorker struct {
+	fsm         *WorkerFSM
+	transitions chan FSMTransition
+	chunks      chan []byte
+}
+
+func startSimWorker(t *testing.T, fsm *WorkerFSM) *simWorker {
+	w := &simWorker{
+		fsm:         fsm,
+		transitions: make(chan FSMTransition, 1024),
+		chunks:      make(chan []byte, 1024),
+	}
+
+	fsm.OnTransition(func(tr FSMTransition) {
+		select {
+		case w.transitions <- tr:
+		default:
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case msg := <-fsm.com.tx:
+				switch msg.IpcType {
+				case ConnectivityCheckIPC:
+					allowAll := []common.Endpoint{{Host: "*", Distance: 1}}
+					fsm.com.rx <- IPCMsg{IpcType: PathAssertionIPC, Data: common.PathAssertion{Allow: allowAll}}
+				case ChunkIPC:
+					w.chunks <- msg.Data.([]byte)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	fsm.Start()
+	t.Cleanup(func() {
+		fsm.Stop()
+		close(done)
+	})
+
+	return w
+}
+
+// await blocks until the worker makes a transition satisfying match, failing the test on timeout
+func (w *simWorker) await(t *testing.T, match func(tr FSMTransition) bool) FSMTransition {
+	t.Helper()
+	timeout := time.After(simTimeout)
+
+	for {
+		select {
+		case tr := <-w.transitions:
+			if match(tr) {
+				return tr
+			}
+		case <-timeout:
+			t.Fatalf("timed out awaiting transition; history: %+v", w.fsm.History())
+		}
+	}
+}
+
+func from(state int, reason string) func(tr FSMTransition) bool {
+	return func(tr FSMTransition) bool {
+		return tr.From == state && (reason == "" || tr.Reason == reason)
+	}
+}
+
+func to(state int) func(tr FSMTransition) bool {
+	return func(tr FSMTransition) bool {
+		return tr.To == state
+	}
+}
+
+// advanceUntil repeatedly advances clock by d until the worker makes a transition satisfying match
+func (w *simWorker) advanceUntil(t *testing.T, clock *sim.Clock, d time.Duration, match func(tr FSMTransition) bool) FSMTransition {
+	t.Helper()
+	timeout := time.After(simTimeout)
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+
+	for {
+		select {
+		case tr := <-w.transitions:
+			if match(tr) {
+				return tr
+			}
+		case <-tick.C:
+			clock.Advance(d)
+		case <-timeout:
+			t.Fatalf("timed out awaiting transition; history: %+v", w.fsm.History())
+		}
+	}
+}
+
+type simEnv struct {
+	net   *sim.Network
+	sig   *sim.Signaling
+	clock *sim.Clock
+}
+
+func newSimEnv(t *testing.T, consumerTTL, msgTTL time.Duration, nats ...*vnet.NATType) *simEnv {
+	n, err := sim.NewNetwork(nats...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.Close() })
+
+	sig, err := sim.NewSignaling(context.Background(), consumerTTL, msgTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sig.Close() })
+
+	return &simEnv{net: n, sig: sig, clock: sim.NewClock(time.Unix(0, 0))}
+}
+
+func (e *simEnv) options(peer int) *WebRTCOptions {
+	o := NewDefaultWebRTCOptions()
+	o.DiscoverySrv = e.sig.URL
+	o.STUNBatch = e.net.STUNBatch
+	o.API = e.net.API(peer)
+	o.Clock = e.clock
+	o.Patience = 0
+	return o
+}
+
+// handshake runs a consumer and a producer until both are in their proxy states
+func handshake(t *testing.T, e *simEnv) (consumer, producer *simWorker) {
+	producer = startSimWorker(t, NewProducerWebRTC(e.options(0), nil))
+	consumer = startSimWorker(t, NewConsumerWebRTC(e.options(1), nil))
+
+	consumer.await(t, to(consumerStateProxy))
+	producer.await(t, to(producerStateProxy))
+	return consumer, producer
+}
+
+func TestSimHandshake(t *testing.T) {
+	e := newSimEnv(t, 2*time.Second, 2*time.Second, sim.NATEasy, sim.NATEasy)
+	consumer, producer := handshake(t, e)
+
+	// The datachannel is unreliable, so keep sending until a chunk makes it across
+	chunk := []byte("NELSON WUZ HERE")
+	timeout := time.After(simTimeout)
+
+	for {
+		consumer.fsm.com.rx <- IPCMsg{IpcType: ChunkIPC, Data: chunk}
+
+		select {
+		case b := <-producer.chunks:
+			if !bytes.Equal(b, chunk) {
+				t.Fatalf("producer received %q, expected %q", b, chunk)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("timed out awaiting chunk")
+		}
+	}
+}
+
+func TestSimNATFailure(t *testing.T) {
+	e := newSimEnv(t, 2*time.Second, 2*time.Second, sim.NATSymmetric, sim.NATSymmetric)
+	startSimWorker(t, NewProducerWebRTC(e.options(0), nil))
+	consumer := startSimWorker(t, NewConsumerWebRTC(e.options(1), nil))
+
+	consumer.await(t, to(consumerStateAwaitConnection))
+
+	opts := e.options(1)
+	tr := consumer.advanceUntil(t, e.clock, opts.NATFailTimeout, from(consumerStateAwaitConnection, ""))
+	if tr.To != consumerStateNew || tr.Reason != "NAT failure" {
+		t.Fatalf("unexpected transition after NAT timeout: %+v", tr)
+	}
+}
+
+func TestSimSignalingTimeout(t *testing.T) {
+	t.Run("producer", func(t *testing.T) {
+		e := newSimEnv(t, 200*time.Millisecond, 200*time.Millisecond, sim.NATEasy)
+		producer := startSimWorker(t, NewProducerWebRTC(e.options(0), nil))
+		producer.await(t, from(producerStateSignalGenesis, "no offer"))
+	})
+
+	t.Run("consumer", func(t *testing.T) {
+		e := newSimEnv(t, 200*time.Millisecond, 200*time.Millisecond, sim.NATEasy)
+		consumer := startSimWorker(t, NewConsumerWebRTC(e.options(0), nil))
+		consumer.await(t, from(consumerStateDiscover, "no genesis messages"))
+	})
+}
+
+func TestSimVersionMismatch(t *testing.T) {
+	t.Run("producer", func(t *testing.T) {
+		e := newSimEnv(t, 200*time.Millisecond, 200*time.Millisecond, sim.NATEasy)
+		o := e.options(0)
+		o.HttpClient = sim.VersionClient("v99.0.0")
+		producer := startSimWorker(t, NewProducerWebRTC(o, nil))
+		producer.advanceUntil(t, e.clock, o.ErrorBackoff, from(producerStateSignalGenesis, "bad protocol version"))
+	})
+
+	t.Run("consumer", func(t *testing.T) {
+		e := newSimEnv(t, 200*time.Millisecond, 200*time.Millisecond, sim.NATEasy)
+		o := e.options(0)
+		o.HttpClient = sim.VersionClient("v99.0.0")
+		consumer := startSimWorker(t, NewConsumerWebRTC(o, nil))
+		consumer.advanceUntil(t, e.clock, o.ErrorBackoff, from(consumerStateDiscover, "bad protocol version"))
+	})
+}
+
+func TestSimDatachannelClose(t *testing.T) {
+	e := newSimEnv(t, 2*time.Second, 2*time.Second, sim.NATEasy, sim.NATEasy)
+	consumer, producer := handshake(t, e)
+
+	// Stopping the producer closes its RTCPeerConnection out from under the consumer
+	producer.fsm.Stop()
+
+	tr := consumer.await(t, from(consumerStateProxy, ""))
+	if tr.To != consumerStateNew {
+		t.Fatalf("unexpected transition after datachannel close: %+v", tr)
+	}
+}
+
+func TestSimUpdateOptions(t *testing.T) {
+	e := newSimEnv(t, 2*time.Second, 2*time.Second, sim.NATEasy, sim.NATEasy)
+	b := NewBroflakeEngine(nil, nil, nil, nil, "", "")
+
+	var batches atomic.Int32
+	countBatches := func(size uint32) ([]string, error) {
+		batches.Add(1)
+		return e.net.STUNBatch(size)
+	}
+
+	// Start the consumer with options which can't work...
+	o := e.options(1)
+	o.HttpClient = sim.VersionClient("v99.0.0")
+	o.STUNBatch = countBatches
+	b.UpdateWebRTCOptions(o)
+
+	startSimWorker(t, NewProducerWebRTC(e.options(0), nil))
+	consumer := startSimWorker(t, newConsumerWebRTC(b.rtcOpt, nil))
+	consumer.advanceUntil(t, e.clock, o.ErrorBackoff, from(consumerStateDiscover, "bad protocol version"))
+
+	// ...then fix them. The consumer picks them up at its next reset, along with the new STUNBatch.
+	o = e.options(1)
+	o.STUNBatch = countBatches
+	b.UpdateWebRTCOptions(o)
+	consumer.advanceUntil(t, e.clock, o.ErrorBackoff, from(consumerStateDiscover, "options updated"))
+	consumer.await(t, to(consumerStateProxy))
+
+	if n := batches.Load(); n != 2 {
+		t.Fatalf("STUN cache populated %v times, expected 2", n)
+	}
+
+	// Updates which omit STUNBatch and leave STUNBatchSize alone keep the STUN cache
+	o = e.options(1)
+	o.STUNBatch = nil
+	b.UpdateWebRTCOptions(o)
+
+	if rtcOpt, _, _ := b.rtcOpt.load(); rtcOpt.STUNBatch == nil || rtcOpt.stunGen != 2 {
+		t.Fatalf("unexpected options after update: %+v", rtcOpt)
+	}
+}
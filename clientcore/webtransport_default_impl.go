@@ -0,0 +1,67 @@
+//go:build !wasm
+
+// webtransport_default_impl.go implements WebTransport egress connections for non-wasm build targets
+package clientcore
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// webtransportEgressConn relays chunks to the egress server in a WebTransport session's datagrams
+type webtransportEgressConn struct {
+	d *webtransport.Dialer
+	s *webtransport.Session
+}
+
+func dialEgressWebTransport(ctx context.Context, options *EgressOptions) (egressDatagramConn, error) {
+	tlsConfig := &tls.Config{}
+	if options.TLSConfig != nil {
+		tlsConfig = options.TLSConfig.Clone()
+	}
+	tlsConfig.NextProtos = []string{http3.NextProtoH3}
+
+	d := &webtransport.Dialer{
+		TLSClientConfig: tlsConfig,
+		QUICConfig: &quic.Config{
+			EnableDatagrams: true,
+			MaxIdleTimeout:  common.QUICCfg.MaxIdleTimeout,
+			KeepAlivePeriod: common.QUICCfg.KeepAlivePeriod,
+		},
+	}
+
+	_, s, err := d.Dial(ctx, egressSessionURL(options), nil)
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+
+	return &webtransportEgressConn{d: d, s: s}, nil
+}
+
+func (c *webtransportEgressConn) readChunk() ([]byte, error) {
+	return c.s.ReceiveDatagram(c.s.Context())
+}
+
+func (c *webtransportEgressConn) writeChunk(b []byte) error {
+	// Like a chunk too large for any other path, a chunk too large for a datagram is lost
+	err := c.s.SendDatagram(b)
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		return nil
+	}
+
+	return err
+}
+
+func (c *webtransportEgressConn) close(reason string) {
+	c.s.CloseWithError(0, reason)
+	c.d.Close()
+}
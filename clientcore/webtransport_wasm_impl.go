@@ -0,0 +1,111 @@
+//go:build wasm
+
+// webtransport_wasm_impl.go implements WebTransport egress connections for wasm build targets,
+// using the browser's WebTransport API
+package clientcore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall/js"
+)
+
+// ignore is a JavaScript callback which does nothing
+var ignore = js.FuncOf(func(this js.Value, args []js.Value) interface{} { return nil })
+
+// jsWebTransportEgressConn relays chunks to the egress server in a browser's WebTransport
+// session's datagrams
+type jsWebTransportEgressConn struct {
+	wt     js.Value
+	reader js.Value
+	writer js.Value
+}
+
+func dialEgressWebTransport(ctx context.Context, options *EgressOptions) (egressDatagramConn, error) {
+	ctor := js.Global().Get("WebTransport")
+	if ctor.IsUndefined() {
+		return nil, errors.New("this browser doesn't support WebTransport")
+	}
+
+	wt := ctor.New(egressSessionURL(options))
+	if _, err := await(ctx, wt.Get("ready")); err != nil {
+		wt.Call("close")
+		return nil, err
+	}
+
+	datagrams := wt.Get("datagrams")
+	return &jsWebTransportEgressConn{
+		wt:     wt,
+		reader: datagrams.Get("readable").Call("getReader"),
+		writer: datagrams.Get("writable").Call("getWriter"),
+	}, nil
+}
+
+func (c *jsWebTransportEgressConn) readChunk() ([]byte, error) {
+	res, err := await(context.Background(), c.reader.Call("read"))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Get("done").Bool() {
+		return nil, io.EOF
+	}
+
+	v := res.Get("value")
+	b := make([]byte, v.Get("byteLength").Int())
+	js.CopyBytesToGo(b, v)
+	return b, nil
+}
+
+func (c *jsWebTransportEgressConn) writeChunk(b []byte) error {
+	a := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(a, b)
+
+	// The browser may drop our datagram anyway, so we don't wait to hear whether it was sent
+	c.writer.Call("write", a).Call("catch", ignore)
+	return nil
+}
+
+func (c *jsWebTransportEgressConn) close(reason string) {
+	c.wt.Call("close", map[string]interface{}{"closeCode": 0, "reason": reason})
+}
+
+// await the settlement of promise, returning what it resolved to, or an error if it was rejected
+// or ctx was done first
+func await(ctx context.Context, promise js.Value) (js.Value, error) {
+	type result struct {
+		v   js.Value
+		err error
+	}
+
+	settled := make(chan result, 1)
+	resolve := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		settled <- result{v: args[0]}
+		return nil
+	})
+	reject := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		settled <- result{err: js.Error{Value: args[0]}}
+		return nil
+	})
+
+	release := func() {
+		resolve.Release()
+		reject.Release()
+	}
+
+	promise.Call("then", resolve, reject)
+
+	select {
+	case r := <-settled:
+		release()
+		return r.v, r.err
+	case <-ctx.Done():
+		// The promise may yet call us back, so we mustn't release our callbacks until it has
+		go func() {
+			<-settled
+			release()
+		}()
+		return js.Undefined(), ctx.Err()
+	}
+}
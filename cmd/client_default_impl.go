@@ -4,78 +4,99 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 
+	"github.com/getlantern/telemetry"
+
 	"github.com/getlantern/broflake/clientcore"
 	"github.com/getlantern/broflake/common"
+	"github.com/getlantern/broflake/config"
 )
 
 var (
 	clientType = "desktop" // Must be "desktop" or "widget"
+	logger     = common.NewLogger("component", "client")
 )
 
 func main() {
-	pprof := os.Getenv("PPROF")
-	freddie := os.Getenv("FREDDIE")
-	egress := os.Getenv("EGRESS")
-	netstated := os.Getenv("NETSTATED")
-	tag := os.Getenv("TAG")
-	ca := os.Getenv("CA")
-	serverName := os.Getenv("SERVER_NAME")
-	proxyPort := os.Getenv("PORT")
-	if proxyPort == "" {
-		proxyPort = "1080"
-	}
+	cfg := defaultConfig(clientType)
+	config.Init("client", cfg)
 
-	common.Debugf("Welcome to Broflake %v", common.Version)
-	common.Debugf("clientType: %v", clientType)
-	common.Debugf("freddie: %v", freddie)
-	common.Debugf("egress: %v", egress)
-	common.Debugf("netstated: %v", netstated)
-	common.Debugf("tag: %v", tag)
-	common.Debugf("pprof: %v", pprof)
-	common.Debugf("ca: %v", ca)
-	common.Debugf("serverName: %v", serverName)
-	common.Debugf("proxyPort: %v", proxyPort)
-
-	bfOpt := clientcore.NewDefaultBroflakeOptions()
-	bfOpt.ClientType = clientType
-	bfOpt.Netstated = netstated
-
-	if clientType == "widget" {
-		bfOpt.CTableSize = 5
-		bfOpt.PTableSize = 5
+	if err := cfg.Log.Apply(); err != nil {
+		log.Fatal(err)
 	}
 
-	rtcOpt := clientcore.NewDefaultWebRTCOptions()
-	rtcOpt.Tag = tag
-
-	if freddie != "" {
-		rtcOpt.DiscoverySrv = freddie
+	logger.Info(
+		"Welcome to Broflake",
+		"version", common.Version,
+		"clientType", cfg.Broflake.ClientType,
+		"freddie", cfg.WebRTC.DiscoverySrv,
+		"egress", cfg.Egress.Addr,
+		"netstated", cfg.Broflake.Netstated,
+		"tag", cfg.WebRTC.Tag,
+		"pprof", cfg.Debug.PProf,
+		"stats", cfg.Debug.Stats,
+		"ca", cfg.QUIC.CA,
+		"serverName", cfg.QUIC.ServerName,
+		"impair", cfg.QUIC.Impair,
+		"proxyHost", cfg.Proxy.Host,
+		"proxyPort", cfg.Proxy.Port,
+		"socksPort", cfg.Proxy.SOCKSPort,
+		"proxyUnix", cfg.Proxy.Unix,
+		"socksUnix", cfg.Proxy.SOCKSUnix,
+		"proxyAuth", cfg.Proxy.Username != "" || cfg.Proxy.Password != "",
+		"allowedClients", cfg.Proxy.AllowedClients,
+		"controlPort", cfg.Proxy.ControlPort,
+	)
+
+	// The OTel exporters are configured with the standard OTEL_* environment variables
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		ctx := context.Background()
+		defer telemetry.EnableOTELTracing(ctx)(ctx)
+		defer telemetry.EnableOTELMetrics(ctx)(ctx)
 	}
 
-	egOpt := clientcore.NewDefaultEgressOptions()
-
-	if egress != "" {
-		egOpt.Addr = egress
+	bfOpt, rtcOpt, egOpt := cfg.options()
+	client, err := clientcore.NewClient(context.Background(), bfOpt, rtcOpt, egOpt)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	bfconn, _, err := clientcore.NewBroflake(bfOpt, rtcOpt, egOpt)
-	if err != nil {
+	if err := client.Start(); err != nil {
 		log.Fatal(err)
 	}
 
-	if pprof != "" {
+	if cfg.Debug.PProf != 0 {
+		go func() {
+			addr := fmt.Sprintf("localhost:%v", cfg.Debug.PProf)
+			logger.Error("pprof server stopped", "err", http.ListenAndServe(addr, nil))
+		}()
+	}
+
+	// If a stats port has been configured, serve runtime stats as JSON on localhost:<port>/stats
+	if cfg.Debug.Stats != 0 {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.Encode(client.Engine().Stats())
+		})
+
 		go func() {
-			common.Debug(http.ListenAndServe("localhost:"+pprof, nil))
+			addr := fmt.Sprintf("localhost:%v", cfg.Debug.Stats)
+			logger.Error("stats server stopped", "err", http.ListenAndServe(addr, mux))
 		}()
 	}
 
-	if clientType == "desktop" {
-		runLocalProxy(proxyPort, bfconn, ca, serverName)
+	if cfg.Broflake.ClientType == "desktop" {
+		runLocalProxy(cfg, client)
 	}
 
 	select {}
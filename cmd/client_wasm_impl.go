@@ -5,13 +5,19 @@ package main
 
 import (
 	"syscall/js"
+	"time"
 
 	"github.com/getlantern/broflake/clientcore"
 	"github.com/getlantern/broflake/common"
+	"github.com/getlantern/broflake/otel"
 )
 
+const telemetryInterval = 60 * time.Second
+
+var logger = common.NewLogger("component", "client")
+
 func main() {
-	common.Debugf("wasm client started...")
+	logger.Info("wasm client started", "version", common.Version)
 
 	// A constructor is exposed to JS. Some (but not all) defaults are forcibly overridden by passing
 	// args. You *must* pass valid values for all of these args:
@@ -28,19 +34,28 @@ func main() {
 	//    WebRTCOptions.Tag
 	//    EgressOptions.Addr
 	//    EgressOptions.Endpoint
+	//    [OTLP endpoint]
+	//    [EgressOptions.Token]
+	//    [EgressOptions.Transport]
+	//    [EgressOptions.ClientVersion]
 	// )
 	//
+	// The last four args are optional. If the OTLP endpoint is present and non-empty, metrics and
+	// traces are exported to the OTLP/HTTP collector at that URL. If the token is present, we present
+	// it to the egress server. If the transport is "webtransport", we reach the egress server over
+	// the browser's WebTransport API, and the egress server's address must be an https:// URL. The
+	// client version is the embedding page's own version, which the egress server labels our traffic with.
+	//
 	// Returns a reference to a Broflake JS API impl (defined in ui_wasm_impl.go)
 	js.Global().Set(
 		"newBroflake",
 		js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-			bfOpt := clientcore.BroflakeOptions{
-				ClientType:  args[0].String(),
-				CTableSize:  args[1].Int(),
-				PTableSize:  args[2].Int(),
-				BusBufferSz: args[3].Int(),
-				Netstated:   args[4].String(),
-			}
+			bfOpt := clientcore.NewDefaultBroflakeOptions()
+			bfOpt.ClientType = args[0].String()
+			bfOpt.CTableSize = args[1].Int()
+			bfOpt.PTableSize = args[2].Int()
+			bfOpt.BusBufferSz = args[3].Int()
+			bfOpt.Netstated = args[4].String()
 
 			rtcOpt := clientcore.NewDefaultWebRTCOptions()
 			rtcOpt.DiscoverySrv = args[5].String()
@@ -51,14 +66,27 @@ func main() {
 			egOpt := clientcore.NewDefaultEgressOptions()
 			egOpt.Addr = args[9].String()
 			egOpt.Endpoint = args[10].String()
+			if len(args) > 12 {
+				egOpt.Token = args[12].String()
+			}
+			if len(args) > 13 {
+				egOpt.Transport = args[13].String()
+			}
+			if len(args) > 14 {
+				egOpt.ClientVersion = args[14].String()
+			}
+
+			if len(args) > 11 && args[11].String() != "" {
+				otel.ConfigureExporter(args[11].String(), telemetryInterval)
+			}
 
-			_, ui, err := clientcore.NewBroflake(&bfOpt, rtcOpt, egOpt)
+			_, ui, err := clientcore.NewBroflake(bfOpt, rtcOpt, egOpt)
 			if err != nil {
-				common.Debugf("newBroflake error: %v", err)
+				logger.Error("newBroflake error", "err", err)
 				return nil
 			}
 
-			common.Debugf("Built new Broflake API: %v", ui.ID)
+			logger.Info("built new Broflake API", "id", ui.ID)
 			return js.Global().Get(ui.ID)
 		}),
 	)
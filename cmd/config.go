@@ -0,0 +1,281 @@
+//go:build !wasm
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/getlantern/broflake/clientcore"
+	"github.com/getlantern/broflake/config"
+)
+
+// clientConfig is the config for the native client. Its sections correspond to clientcore's
+// BroflakeOptions, WebRTCOptions, EgressOptions and QUICLayerOptions, plus the local proxy.
+type clientConfig struct {
+	Broflake struct {
+		ClientType       string          `json:"clientType" env:"CLIENT_TYPE"` // "desktop" or "widget"
+		CTableSize       int             `json:"cTableSize" env:"CTABLE_SIZE"`
+		PTableSize       int             `json:"pTableSize" env:"PTABLE_SIZE"`
+		BusBufferSz      int             `json:"busBufferSz" env:"BUS_BUFFER_SZ"`
+		Netstated        string          `json:"netstated" env:"NETSTATED"`
+		FlowPolicy       string          `json:"flowPolicy" env:"FLOW_POLICY"` // "drop" or "block"
+		FlowBlockTimeout config.Duration `json:"flowBlockTimeout" env:"FLOW_BLOCK_TIMEOUT"`
+	} `json:"broflake"`
+
+	WebRTC struct {
+		DiscoverySrv   string          `json:"discoverySrv" env:"FREDDIE"`
+		Endpoint       string          `json:"endpoint" env:"FREDDIE_ENDPOINT"`
+		GenesisAddr    string          `json:"genesisAddr" env:"GENESIS_ADDR"`
+		NATFailTimeout config.Duration `json:"natFailTimeout" env:"NAT_FAIL_TIMEOUT"`
+		ICEFailTimeout config.Duration `json:"iceFailTimeout" env:"ICE_FAIL_TIMEOUT"`
+		STUNBatchSize  uint32          `json:"stunBatchSize" env:"STUN_BATCH_SIZE"`
+		STUNServers    []string        `json:"stunServers" env:"STUN_SERVERS"` // If empty, fetch a public list
+		Tag            string          `json:"tag" env:"TAG"`
+		Patience       config.Duration `json:"patience" env:"PATIENCE"`
+		ErrorBackoff   config.Duration `json:"errorBackoff" env:"WEBRTC_ERROR_BACKOFF"`
+	} `json:"webrtc"`
+
+	Egress struct {
+		Addr           string          `json:"addr" env:"EGRESS"`
+		Endpoint       string          `json:"endpoint" env:"EGRESS_ENDPOINT"`
+		ConnectTimeout config.Duration `json:"connectTimeout" env:"EGRESS_CONNECT_TIMEOUT"`
+		ErrorBackoff   config.Duration `json:"errorBackoff" env:"EGRESS_ERROR_BACKOFF"`
+		Token          string          `json:"token" env:"EGRESS_TOKEN" secret:"true"` // For widgets, if the egress server requires one
+		Transport      string          `json:"transport" env:"EGRESS_TRANSPORT"`
+		ClientVersion  string          `json:"clientVersion" env:"CLIENT_VERSION"` // Our app's version, which the egress server labels our traffic with
+	} `json:"egress"`
+
+	QUIC struct {
+		ServerName string `json:"serverName" env:"SERVER_NAME"`
+		CA         string `json:"ca" env:"CA"`         // If empty, we use insecure TLS!
+		Impair     string `json:"impair" env:"IMPAIR"` // Path to an impairment profile
+	} `json:"quic"`
+
+	Proxy struct {
+		Host           string   `json:"host" env:"PROXY_HOST"`                       // Interface for the TCP listeners
+		Port           int      `json:"port" env:"PORT"`                             // HTTP proxy; 0 to disable
+		SOCKSPort      int      `json:"socksPort" env:"SOCKS_PORT"`                  // SOCKS5; 0 to disable
+		Unix           string   `json:"unix" env:"PROXY_UNIX"`                       // Also serve the HTTP proxy on this Unix socket
+		SOCKSUnix      string   `json:"socksUnix" env:"SOCKS_UNIX"`                  // Also serve SOCKS5 on this Unix socket
+		Username       string   `json:"username" env:"PROXY_USERNAME"`               // If set, require credentials
+		Password       string   `json:"password" env:"PROXY_PASSWORD" secret:"true"` // If set, require credentials
+		AllowedClients []string `json:"allowedClients" env:"PROXY_ALLOWED_CLIENTS"`  // IPs or CIDRs; if empty, allow all
+		Rules          string   `json:"rules" env:"PROXY_RULES"`                     // Split tunneling rules file, reloaded when it changes
+		GeoDB          string   `json:"geoDB" env:"PROXY_GEODB"`                     // MaxMind country database (.mmdb) for country rules
+		ControlPort    int      `json:"controlPort" env:"CONTROL_PORT"`              // Control API and PAC file on localhost; 0 to disable
+	} `json:"proxy"`
+
+	Debug struct {
+		PProf int `json:"pprof" env:"PPROF"` // Serve pprof on localhost at this port; 0 to disable
+		Stats int `json:"stats" env:"STATS"` // Serve /stats on localhost at this port; 0 to disable
+	} `json:"debug"`
+
+	Log config.Log `json:"log"`
+}
+
+func defaultConfig(clientType string) *clientConfig {
+	bfOpt := clientcore.NewDefaultBroflakeOptions()
+	rtcOpt := clientcore.NewDefaultWebRTCOptions()
+	egOpt := clientcore.NewDefaultEgressOptions()
+
+	c := &clientConfig{Log: config.DefaultLog()}
+
+	c.Broflake.ClientType = clientType
+	c.Broflake.CTableSize = bfOpt.CTableSize
+	c.Broflake.PTableSize = bfOpt.PTableSize
+	c.Broflake.BusBufferSz = bfOpt.BusBufferSz
+	c.Broflake.Netstated = bfOpt.Netstated
+	c.Broflake.FlowPolicy = bfOpt.FlowPolicy.String()
+	c.Broflake.FlowBlockTimeout = config.Duration(bfOpt.FlowBlockTimeout)
+
+	if clientType == "widget" {
+		c.Broflake.CTableSize = 5
+		c.Broflake.PTableSize = 5
+	}
+
+	c.WebRTC.DiscoverySrv = rtcOpt.DiscoverySrv
+	c.WebRTC.Endpoint = rtcOpt.Endpoint
+	c.WebRTC.GenesisAddr = rtcOpt.GenesisAddr
+	c.WebRTC.NATFailTimeout = config.Duration(rtcOpt.NATFailTimeout)
+	c.WebRTC.ICEFailTimeout = config.Duration(rtcOpt.ICEFailTimeout)
+	c.WebRTC.STUNBatchSize = rtcOpt.STUNBatchSize
+	c.WebRTC.Tag = rtcOpt.Tag
+	c.WebRTC.Patience = config.Duration(rtcOpt.Patience)
+	c.WebRTC.ErrorBackoff = config.Duration(rtcOpt.ErrorBackoff)
+
+	c.Egress.Addr = egOpt.Addr
+	c.Egress.Endpoint = egOpt.Endpoint
+	c.Egress.ConnectTimeout = config.Duration(egOpt.ConnectTimeout)
+	c.Egress.ErrorBackoff = config.Duration(egOpt.ErrorBackoff)
+	c.Egress.Transport = clientcore.EgressTransportWebSocket
+
+	c.Proxy.Host = "127.0.0.1"
+	c.Proxy.Port = 1080
+	c.Proxy.SOCKSPort = 1081
+	c.Proxy.ControlPort = 1082
+	return c
+}
+
+func (c *clientConfig) Validate() error {
+	errs := []error{
+		config.OneOf("broflake.clientType", c.Broflake.ClientType, "desktop", "widget"),
+		config.Positive("broflake.cTableSize", c.Broflake.CTableSize),
+		config.Positive("broflake.pTableSize", c.Broflake.PTableSize),
+		config.Positive("broflake.busBufferSz", c.Broflake.BusBufferSz),
+		config.OneOf("broflake.flowPolicy", c.Broflake.FlowPolicy, "drop", "block"),
+		config.URL("webrtc.discoverySrv", c.WebRTC.DiscoverySrv, "http", "https"),
+		config.Positive("webrtc.natFailTimeout", c.WebRTC.NATFailTimeout),
+		config.Positive("webrtc.iceFailTimeout", c.WebRTC.ICEFailTimeout),
+		config.Positive("webrtc.stunBatchSize", c.WebRTC.STUNBatchSize),
+		config.Positive("webrtc.patience", c.WebRTC.Patience),
+		config.Positive("webrtc.errorBackoff", c.WebRTC.ErrorBackoff),
+		config.OneOf("egress.transport", c.Egress.Transport, clientcore.EgressTransportWebSocket, clientcore.EgressTransportQUIC, clientcore.EgressTransportWebTransport),
+		c.validateEgressAddr(),
+		config.Positive("egress.connectTimeout", c.Egress.ConnectTimeout),
+		config.Positive("egress.errorBackoff", c.Egress.ErrorBackoff),
+		config.File("quic.ca", c.QUIC.CA),
+		config.File("quic.impair", c.QUIC.Impair),
+		config.File("proxy.geoDB", c.Proxy.GeoDB),
+		config.Port("proxy.port", c.Proxy.Port, true),
+		config.Port("proxy.socksPort", c.Proxy.SOCKSPort, true),
+		config.Port("proxy.controlPort", c.Proxy.ControlPort, true),
+		config.Port("debug.pprof", c.Debug.PProf, true),
+		config.Port("debug.stats", c.Debug.Stats, true),
+		c.Log.Validate(),
+	}
+
+	if c.Proxy.SOCKSPort != 0 && c.Proxy.SOCKSPort == c.Proxy.Port {
+		errs = append(errs, fmt.Errorf("proxy.socksPort: %v is already the HTTP proxy port", c.Proxy.SOCKSPort))
+	}
+
+	if c.Proxy.ControlPort != 0 && (c.Proxy.ControlPort == c.Proxy.Port || c.Proxy.ControlPort == c.Proxy.SOCKSPort) {
+		errs = append(errs, fmt.Errorf("proxy.controlPort: %v is already a proxy port", c.Proxy.ControlPort))
+	}
+
+	if c.Proxy.ControlPort != 0 && c.Proxy.Port == 0 && c.Proxy.SOCKSPort == 0 {
+		errs = append(errs, fmt.Errorf("proxy.controlPort: the PAC file needs a TCP proxy port"))
+	}
+
+	if c.Proxy.Unix != "" && c.Proxy.Unix == c.Proxy.SOCKSUnix {
+		errs = append(errs, fmt.Errorf("proxy.socksUnix: %v is already the HTTP proxy socket", c.Proxy.SOCKSUnix))
+	}
+
+	if (c.Proxy.Port != 0 || c.Proxy.SOCKSPort != 0) && c.Proxy.Host == "" {
+		errs = append(errs, fmt.Errorf("proxy.host: must be set to serve on TCP"))
+	}
+
+	if _, err := parseAllowedClients(c.Proxy.AllowedClients); err != nil {
+		errs = append(errs, fmt.Errorf("proxy.allowedClients: %v", err))
+	}
+
+	if c.Proxy.Rules != "" {
+		if _, err := clientcore.LoadSplitTunnelRules(c.Proxy.Rules); err != nil {
+			errs = append(errs, fmt.Errorf("proxy.rules: %v", err))
+		}
+	}
+
+	if c.Broflake.FlowPolicy == "block" {
+		errs = append(errs, config.Positive("broflake.flowBlockTimeout", c.Broflake.FlowBlockTimeout))
+	}
+
+	if c.Broflake.Netstated != "" {
+		errs = append(errs, config.URL("broflake.netstated", c.Broflake.Netstated, "http", "https"))
+	}
+
+	for i, s := range c.WebRTC.STUNServers {
+		if len(s) < 6 || s[:5] != "stun:" {
+			errs = append(errs, fmt.Errorf("webrtc.stunServers[%v]: '%v' isn't a stun: URL", i, s))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateEgressAddr checks that c.Egress.Addr is a URL which c.Egress.Transport can reach
+func (c *clientConfig) validateEgressAddr() error {
+	switch c.Egress.Transport {
+	case clientcore.EgressTransportQUIC:
+		return config.URL("egress.addr", c.Egress.Addr, "udp")
+	case clientcore.EgressTransportWebTransport:
+		return config.URL("egress.addr", c.Egress.Addr, "https")
+	}
+
+	return config.URL("egress.addr", c.Egress.Addr, "ws", "wss", "http", "https")
+}
+
+// options returns the clientcore options described by c. It assumes c is valid.
+func (c *clientConfig) options() (*clientcore.BroflakeOptions, *clientcore.WebRTCOptions, *clientcore.EgressOptions) {
+	bfOpt := clientcore.NewDefaultBroflakeOptions()
+	bfOpt.ClientType = c.Broflake.ClientType
+	bfOpt.CTableSize = c.Broflake.CTableSize
+	bfOpt.PTableSize = c.Broflake.PTableSize
+	bfOpt.BusBufferSz = c.Broflake.BusBufferSz
+	bfOpt.Netstated = c.Broflake.Netstated
+	bfOpt.FlowPolicy, _ = clientcore.ParseFlowPolicy(c.Broflake.FlowPolicy)
+	bfOpt.FlowBlockTimeout = time.Duration(c.Broflake.FlowBlockTimeout)
+
+	rtcOpt := clientcore.NewDefaultWebRTCOptions()
+	rtcOpt.DiscoverySrv = c.WebRTC.DiscoverySrv
+	rtcOpt.Endpoint = c.WebRTC.Endpoint
+	rtcOpt.GenesisAddr = c.WebRTC.GenesisAddr
+	rtcOpt.NATFailTimeout = time.Duration(c.WebRTC.NATFailTimeout)
+	rtcOpt.ICEFailTimeout = time.Duration(c.WebRTC.ICEFailTimeout)
+	rtcOpt.STUNBatchSize = c.WebRTC.STUNBatchSize
+	rtcOpt.Tag = c.WebRTC.Tag
+	rtcOpt.Patience = time.Duration(c.WebRTC.Patience)
+	rtcOpt.ErrorBackoff = time.Duration(c.WebRTC.ErrorBackoff)
+
+	if len(c.WebRTC.STUNServers) > 0 {
+		rtcOpt.STUNBatch = clientcore.NewStaticSTUNBatchFunc(c.WebRTC.STUNServers)
+	}
+
+	egOpt := clientcore.NewDefaultEgressOptions()
+	egOpt.Addr = c.Egress.Addr
+	egOpt.Endpoint = c.Egress.Endpoint
+	egOpt.ConnectTimeout = time.Duration(c.Egress.ConnectTimeout)
+	egOpt.ErrorBackoff = time.Duration(c.Egress.ErrorBackoff)
+	egOpt.Token = c.Egress.Token
+	egOpt.Transport = c.Egress.Transport
+	egOpt.ClientVersion = c.Egress.ClientVersion
+
+	return bfOpt, rtcOpt, egOpt
+}
+
+// proxyOptions returns the LocalProxyOptions described by c. It assumes c is valid.
+func (c *clientConfig) proxyOptions() *clientcore.LocalProxyOptions {
+	allowed, _ := parseAllowedClients(c.Proxy.AllowedClients)
+
+	return &clientcore.LocalProxyOptions{
+		Username:       c.Proxy.Username,
+		Password:       c.Proxy.Password,
+		AllowedClients: allowed,
+	}
+}
+
+// parseAllowedClients parses a list of IP addresses and CIDR prefixes
+func parseAllowedClients(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for _, s := range list {
+		if strings.Contains(s, "/") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+
+	return prefixes, nil
+}
@@ -1,32 +1,37 @@
+//go:build !wasm
+
 package main
 
 import (
+	"context"
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
-	"github.com/elazarl/goproxy"
+	"github.com/getlantern/geo"
 
 	"github.com/getlantern/broflake/clientcore"
 	"github.com/getlantern/broflake/common"
 )
 
-const (
-	ip = "127.0.0.1"
-)
+// rulesPollInterval is how often we check the split tunneling rules file for changes
+const rulesPollInterval = 5 * time.Second
+
+// runLocalProxy serves the local HTTP and SOCKS5 proxies on the TCP ports and Unix sockets named in
+// cfg, and the control API for client. The proxies share one QUIC connection to the egress server.
+func runLocalProxy(cfg *clientConfig, client *clientcore.Client) {
+	ca, sn, impair := cfg.QUIC.CA, cfg.QUIC.ServerName, cfg.QUIC.Impair
 
-func runLocalProxy(port string, bfconn *clientcore.BroflakeConn, ca, sn string) {
 	// TODO: this is just to prevent a race with client boot processes, it's not worth getting too
 	// fancy with an event-driven solution because the local proxy is all mocked functionality anyway
 	<-time.After(2 * time.Second)
-	proxy := goproxy.NewProxyHttpServer()
-	proxy.Verbose = true
-	// This tells goproxy to wrap the dial function in a chained CONNECT request
-	proxy.ConnectDial = proxy.NewConnectDialToProxy("http://i.do.nothing")
-
 	// If a certfile has been specified in 'ca', we'll specify that certfile as a root CA and
 	// properly verify the cert chain. If not, we'll use insecure TLS!
 	certPool := x509.NewCertPool()
@@ -40,36 +45,201 @@ func runLocalProxy(port string, bfconn *clientcore.BroflakeConn, ca, sn string)
 		certPool.AppendCertsFromPEM(pem)
 	} else {
 		insecureSkipVerify = true
-		common.Debugf("!!! WARNING !!! No root CA cert specified, using insecure TLS!")
+		logger.Warn("!!! WARNING !!! No root CA cert specified, using insecure TLS!")
+	}
+
+	// If an impairment profile has been specified in 'impair', we'll subject everything we send
+	// toward the egress server to the network conditions it describes
+	var impairment *common.ImpairmentProfile
+
+	if impair != "" {
+		var err error
+		impairment, err = common.LoadImpairmentProfile(impair)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger.Warn("!!! WARNING !!! Impairing the egress path", "profile", fmt.Sprintf("%+v", *impairment))
 	}
 
 	ql, err := clientcore.NewQUICLayer(
-		bfconn,
-		&clientcore.QUICLayerOptions{ServerName: sn, InsecureSkipVerify: insecureSkipVerify, CA: certPool},
+		client.Conn(),
+		&clientcore.QUICLayerOptions{
+			ServerName:         sn,
+			InsecureSkipVerify: insecureSkipVerify,
+			CA:                 certPool,
+			Impairment:         impairment,
+		},
 	)
 	if err != nil {
-		common.Debugf("Cannot start local HTTP proxy: failed to create QUIC layer: %v", err)
+		logger.Error("cannot start local proxy: failed to create QUIC layer", "err", err)
 		return
 	}
 
 	go ql.DialAndMaintainQUICConnection()
-	proxy.Tr = clientcore.CreateHTTPTransport(ql)
 
-	proxy.OnRequest().DoFunc(
-		func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-			common.Debug("HTTP proxy just saw a request:")
-			common.Debug(r)
-			return r, nil
-		},
-	)
+	if cfg.Proxy.Username == "" && cfg.Proxy.Password == "" && cfg.Proxy.Host != "127.0.0.1" && cfg.Proxy.Host != "localhost" {
+		logger.Warn("!!! WARNING !!! Serving the local proxy beyond localhost without credentials", "host", cfg.Proxy.Host)
+	}
+
+	opt := cfg.proxyOptions()
+
+	// If split tunneling rules have been specified in 'rules', we'll route according to them,
+	// reloading them whenever they change. Otherwise, everything goes through Broflake.
+	if cfg.Proxy.Rules != "" {
+		opt.SplitTunnel, err = newSplitTunnel(cfg.Proxy.Rules, cfg.Proxy.GeoDB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger.Info("split tunneling", "rules", cfg.Proxy.Rules, "geoDB", cfg.Proxy.GeoDB)
+	}
+
+	proxy := clientcore.NewLocalProxy(ql, opt)
+
+	listeners := []struct {
+		name    string
+		network string
+		addr    string
+		serve   func(net.Listener) error
+	}{
+		{"HTTP proxy", "tcp", tcpAddr(cfg.Proxy.Host, cfg.Proxy.Port), proxy.ServeHTTPProxy},
+		{"HTTP proxy", "unix", cfg.Proxy.Unix, proxy.ServeHTTPProxy},
+		{"SOCKS5 proxy", "tcp", tcpAddr(cfg.Proxy.Host, cfg.Proxy.SOCKSPort), proxy.ServeSOCKS5},
+		{"SOCKS5 proxy", "unix", cfg.Proxy.SOCKSUnix, proxy.ServeSOCKS5},
+	}
+
+	for _, l := range listeners {
+		if l.addr == "" {
+			continue
+		}
+
+		ll, err := listen(l.network, l.addr)
+		if err != nil {
+			logger.Error("can't start "+l.name, "addr", l.addr, "err", err)
+			continue
+		}
+
+		go func() {
+			logger.Error(l.name+" stopped", "err", l.serve(ll))
+		}()
+	}
+
+	if cfg.Proxy.ControlPort != 0 {
+		go runControlAPI(cfg, client, opt.SplitTunnel)
+	}
+}
+
+// runControlAPI serves the control API and PAC file on localhost
+func runControlAPI(cfg *clientConfig, client *clientcore.Client, st *clientcore.SplitTunnel) {
+	// Browsers can't reach an unspecified address, so the PAC file points them at localhost
+	host := cfg.Proxy.Host
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
 
-	addr := fmt.Sprintf("%v:%v", ip, port)
+	h := clientcore.NewControlHandler(client, &clientcore.ControlOptions{
+		HTTPProxy:   tcpAddr(host, cfg.Proxy.Port),
+		SOCKSProxy:  tcpAddr(host, cfg.Proxy.SOCKSPort),
+		SplitTunnel: st,
+		Username:    cfg.Proxy.Username,
+		Password:    cfg.Proxy.Password,
+	})
 
-	go func() {
-		common.Debugf("Starting HTTP CONNECT proxy on %v...", addr)
-		err := http.ListenAndServe(addr, proxy)
+	addr := fmt.Sprintf("localhost:%v", cfg.Proxy.ControlPort)
+	logger.Info("serving control API", "pac", "http://"+addr+"/proxy.pac")
+	logger.Error("control API stopped", "err", http.ListenAndServe(addr, h))
+}
+
+// newSplitTunnel loads the split tunneling rules at rulesPath and watches them for changes. If
+// geoDB names a MaxMind database, country rules look up destinations in it.
+func newSplitTunnel(rulesPath, geoDB string) (*clientcore.SplitTunnel, error) {
+	rules, err := clientcore.LoadSplitTunnelRules(rulesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var countries clientcore.CountryLookup
+	if geoDB != "" {
+		l, err := geo.FromFile(geoDB)
 		if err != nil {
-			common.Debugf("HTTP CONNECT proxy error: %v", err)
+			return nil, err
+		}
+		countries = l
+	}
+
+	st := clientcore.NewSplitTunnel(rules, countries)
+	go st.Watch(context.Background(), rulesPath, rulesPollInterval)
+	return st, nil
+}
+
+// tcpAddr returns host:port, or "" if port is 0
+func tcpAddr(host string, port int) string {
+	if port == 0 {
+		return ""
+	}
+
+	return net.JoinHostPort(host, fmt.Sprint(port))
+}
+
+// listen is net.Listen, but a Unix socket left behind by a previous run is replaced, and only our
+// own user may connect to the new one
+func listen(network, addr string) (net.Listener, error) {
+	if network != "unix" {
+		return net.Listen(network, addr)
+	}
+
+	// A socket which something still answers on isn't left behind, so we leave it alone
+	if fi, err := os.Lstat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.DialTimeout(network, addr, time.Second); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%v is already being served", addr)
 		}
-	}()
+		os.Remove(addr)
+	}
+
+	// We create the socket in a directory only we may enter, so that nobody can connect to it before
+	// we've restricted it to our own user, and then move it into place
+	dir, err := os.MkdirTemp(filepath.Dir(addr), ".broflake-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.Listen(network, tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	// The socket won't be at tmp when we close it
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	if err := os.Rename(tmp, addr); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return &unixListener{Listener: l, addr: &net.UnixAddr{Name: addr, Net: network}}, nil
+}
+
+// unixListener is a Unix socket listener whose socket was moved to addr after it was created
+type unixListener struct {
+	net.Listener
+	addr *net.UnixAddr
+	once sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Close the listener and remove its socket
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() { os.Remove(l.addr.Name) })
+	return err
 }
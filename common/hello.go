@@ -0,0 +1,69 @@
+package common
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// A widget which relays QUIC to an egress server over plain UDP has no handshake in which to
+// present its version and tag, as it would in a WebSocket URL, so it first sends a hello: Hello
+// followed by those parameters as a URL query string. The egress server answers with Hello
+// followed by an HTTP status code, like "200", and only accepts QUIC from widgets it has admitted.
+// QUIC packets always have their fixed bit (0x40) set, so a hello can't be mistaken for one.
+//
+// Hellos travel in the clear, so they never carry a token. An egress server which authenticates
+// widgets instead challenges a hello with a 401 followed by a space and a nonce (see
+// NewHelloChallenge), and the widget proves it holds a token by saying hello again with the nonce
+// in the "nonce" parameter, and the claims and proof returned by TokenProof in "claims" and
+// "proof".
+const Hello byte = 0x00
+
+// NewHello returns a hello presenting q
+func NewHello(q url.Values) []byte {
+	return append([]byte{Hello}, q.Encode()...)
+}
+
+// ParseHello returns the parameters presented in a hello, and false if b isn't a valid one
+func ParseHello(b []byte) (url.Values, bool) {
+	if len(b) == 0 || b[0] != Hello {
+		return nil, false
+	}
+
+	q, err := url.ParseQuery(string(b[1:]))
+	return q, err == nil
+}
+
+// NewHelloReply returns an egress server's reply to a hello
+func NewHelloReply(status int) []byte {
+	return append([]byte{Hello}, strconv.Itoa(status)...)
+}
+
+// NewHelloChallenge returns an egress server's reply to a hello which must prove it holds a token
+// by answering nonce
+func NewHelloChallenge(nonce string) []byte {
+	return append(NewHelloReply(http.StatusUnauthorized), " "+nonce...)
+}
+
+// ParseHelloReply returns the status in an egress server's reply to a hello, and false if b isn't
+// a valid reply
+func ParseHelloReply(b []byte) (int, bool) {
+	if len(b) == 0 || b[0] != Hello {
+		return 0, false
+	}
+
+	s, _, _ := strings.Cut(string(b[1:]), " ")
+	status, err := strconv.Atoi(s)
+	return status, err == nil
+}
+
+// ParseHelloChallenge returns the nonce in an egress server's challenge, and false if b isn't one
+func ParseHelloChallenge(b []byte) (string, bool) {
+	if status, ok := ParseHelloReply(b); !ok || status != http.StatusUnauthorized {
+		return "", false
+	}
+
+	_, nonce, ok := strings.Cut(string(b[1:]), " ")
+	return nonce, ok && nonce != ""
+}
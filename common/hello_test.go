@@ -0,0 +1,42 @@
+package common
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestHello(t *testing.T) {
+	hello := NewHello(url.Values{"version": {Version}, "tag": {"widget-1"}})
+	if hello[0]&0x40 != 0 {
+		t.Errorf("a hello could be mistaken for a QUIC packet: %#x", hello[0])
+	}
+
+	q, ok := ParseHello(hello)
+	if !ok || q.Get("version") != Version || q.Get("tag") != "widget-1" {
+		t.Errorf("got %v %v, expected our parameters back", q, ok)
+	}
+
+	if status, ok := ParseHelloReply(NewHelloReply(401)); !ok || status != 401 {
+		t.Errorf("got %v %v, expected 401", status, ok)
+	}
+
+	if _, ok := ParseHelloChallenge(NewHelloReply(401)); ok {
+		t.Error("expected a plain 401 not to parse as a challenge")
+	}
+
+	challenge := NewHelloChallenge("abc")
+	if status, ok := ParseHelloReply(challenge); !ok || status != 401 {
+		t.Errorf("got %v %v, expected a challenge to be a 401", status, ok)
+	}
+	if nonce, ok := ParseHelloChallenge(challenge); !ok || nonce != "abc" {
+		t.Errorf("got %q %v, expected our nonce back", nonce, ok)
+	}
+
+	// QUIC packets aren't hellos
+	if _, ok := ParseHello([]byte{0xc0, 0, 0, 0, 1}); ok {
+		t.Error("expected a QUIC long header packet not to parse as a hello")
+	}
+	if _, ok := ParseHelloReply(NewHello(nil)); ok {
+		t.Error("expected a hello without a status not to parse as a reply")
+	}
+}
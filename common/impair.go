@@ -0,0 +1,323 @@
+package common
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// minReorderDelay is the least amount of extra delay applied to a reordered packet, such that
+// reordering still happens on a profile with no latency
+const minReorderDelay = 5 * time.Millisecond
+
+// DefaultImpairmentQueue is how long packets may wait behind a bandwidth cap when a profile doesn't
+// say otherwise
+const DefaultImpairmentQueue = 200 * time.Millisecond
+
+// ImpairmentProfile describes the network conditions imposed by an ImpairedPacketConn. Loss,
+// Reorder and Duplicate are probabilities in [0, 1]. Bandwidth is in bytes per second, and 0 means
+// unlimited. Like a router at a real bottleneck, we drop packets which would wait behind the
+// bandwidth cap for longer than Queue, and 0 means DefaultImpairmentQueue. A Seed of 0 seeds the
+// profile's PRNG from the clock.
+type ImpairmentProfile struct {
+	Latency   time.Duration
+	Jitter    time.Duration
+	Loss      float64
+	Reorder   float64
+	Duplicate float64
+	Bandwidth int
+	Queue     time.Duration
+	Seed      int64
+}
+
+// UnmarshalJSON accepts durations as strings parsed by time.ParseDuration, eg "150ms"
+func (p *ImpairmentProfile) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Latency   string  `json:"latency"`
+		Jitter    string  `json:"jitter"`
+		Loss      float64 `json:"loss"`
+		Reorder   float64 `json:"reorder"`
+		Duplicate float64 `json:"duplicate"`
+		Bandwidth int     `json:"bandwidth"`
+		Queue     string  `json:"queue"`
+		Seed      int64   `json:"seed"`
+	}
+
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	var err error
+	var latency, jitter, queue time.Duration
+
+	if raw.Latency != "" {
+		if latency, err = time.ParseDuration(raw.Latency); err != nil {
+			return fmt.Errorf("invalid latency: %v", err)
+		}
+	}
+
+	if raw.Jitter != "" {
+		if jitter, err = time.ParseDuration(raw.Jitter); err != nil {
+			return fmt.Errorf("invalid jitter: %v", err)
+		}
+	}
+
+	if raw.Queue != "" {
+		if queue, err = time.ParseDuration(raw.Queue); err != nil {
+			return fmt.Errorf("invalid queue: %v", err)
+		}
+	}
+
+	*p = ImpairmentProfile{
+		Latency:   latency,
+		Jitter:    jitter,
+		Loss:      raw.Loss,
+		Reorder:   raw.Reorder,
+		Duplicate: raw.Duplicate,
+		Bandwidth: raw.Bandwidth,
+		Queue:     queue,
+		Seed:      raw.Seed,
+	}
+
+	return p.Validate()
+}
+
+func (p *ImpairmentProfile) Validate() error {
+	if p.Latency < 0 || p.Jitter < 0 {
+		return fmt.Errorf("latency and jitter must not be negative")
+	}
+
+	for name, v := range map[string]float64{"loss": p.Loss, "reorder": p.Reorder, "duplicate": p.Duplicate} {
+		if v < 0 || v > 1 {
+			return fmt.Errorf("%v must be in [0, 1], got %v", name, v)
+		}
+	}
+
+	if p.Bandwidth < 0 {
+		return fmt.Errorf("bandwidth must not be negative")
+	}
+
+	if p.Queue < 0 {
+		return fmt.Errorf("queue must not be negative")
+	}
+
+	return nil
+}
+
+// LoadImpairmentProfile reads an ImpairmentProfile from a JSON file, eg:
+// {"latency": "150ms", "jitter": "30ms", "loss": 0.02, "bandwidth": 250000, "queue": "100ms"}
+func LoadImpairmentProfile(path string) (*ImpairmentProfile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ImpairmentProfile{}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("invalid impairment profile %v: %v", path, err)
+	}
+
+	return p, nil
+}
+
+// ImpairedPacketConn wraps a net.PacketConn, imposing the conditions described by an
+// ImpairmentProfile on every packet written to it. Reads are passed through untouched, so to
+// impair both directions of a path, wrap the PacketConn at each end.
+type ImpairedPacketConn struct {
+	net.PacketConn
+	profile       ImpairmentProfile
+	rng           *rand.Rand
+	mx            sync.Mutex
+	queue         packetQueue
+	seq           uint64
+	nextDeparture time.Time
+	wake          chan struct{}
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+func NewImpairedPacketConn(conn net.PacketConn, profile *ImpairmentProfile) *ImpairedPacketConn {
+	seed := profile.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	c := &ImpairedPacketConn{
+		PacketConn: conn,
+		profile:    *profile,
+		rng:        rand.New(rand.NewSource(seed)),
+		wake:       make(chan struct{}, 1),
+		closed:     make(chan struct{}),
+	}
+
+	go c.send()
+	return c
+}
+
+func (c *ImpairedPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.rng.Float64() < c.profile.Loss {
+		return len(p), nil
+	}
+
+	// The bandwidth cap serializes packets onto the wire, and once they'd queue for too long, we drop
+	// them; latency and jitter are applied on top
+	now := time.Now()
+	departure := now
+	if c.profile.Bandwidth > 0 {
+		if c.nextDeparture.After(departure) {
+			departure = c.nextDeparture
+		}
+
+		queue := c.profile.Queue
+		if queue == 0 {
+			queue = DefaultImpairmentQueue
+		}
+		if departure.Sub(now) > queue {
+			return len(p), nil
+		}
+
+		departure = departure.Add(time.Duration(len(p)) * time.Second / time.Duration(c.profile.Bandwidth))
+		c.nextDeparture = departure
+	}
+
+	deliverAt := departure.Add(c.profile.Latency)
+	if c.profile.Jitter > 0 {
+		deliverAt = deliverAt.Add(time.Duration(c.rng.Int63n(int64(2*c.profile.Jitter))) - c.profile.Jitter)
+	}
+
+	if c.rng.Float64() < c.profile.Reorder {
+		extra := c.profile.Latency
+		if extra < minReorderDelay {
+			extra = minReorderDelay
+		}
+		deliverAt = deliverAt.Add(extra)
+	}
+
+	b := make([]byte, len(p))
+	copy(b, p)
+	c.push(&impairedPacket{b: b, addr: addr, deliverAt: deliverAt})
+
+	if c.rng.Float64() < c.profile.Duplicate {
+		c.push(&impairedPacket{b: b, addr: addr, deliverAt: deliverAt})
+	}
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+
+	return len(p), nil
+}
+
+// Stop discards any packets which are still in flight and fails all subsequent writes, but leaves
+// the underlying PacketConn open
+func (c *ImpairedPacketConn) Stop() {
+	c.closeOnce.Do(func() { close(c.closed) })
+}
+
+// Close stops the ImpairedPacketConn and closes the underlying PacketConn
+func (c *ImpairedPacketConn) Close() error {
+	c.Stop()
+	return c.PacketConn.Close()
+}
+
+func (c *ImpairedPacketConn) push(pkt *impairedPacket) {
+	pkt.seq = c.seq
+	c.seq++
+	heap.Push(&c.queue, pkt)
+}
+
+func (c *ImpairedPacketConn) send() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		c.mx.Lock()
+		var pkt *impairedPacket
+		var wait time.Duration
+
+		if len(c.queue) > 0 {
+			wait = time.Until(c.queue[0].deliverAt)
+			if wait <= 0 {
+				pkt = heap.Pop(&c.queue).(*impairedPacket)
+			}
+		}
+		c.mx.Unlock()
+
+		if pkt != nil {
+			if _, err := c.PacketConn.WriteTo(pkt.b, pkt.addr); err != nil {
+				Debugf("Impaired write error: %v", err)
+			}
+			continue
+		}
+
+		var due <-chan time.Time
+		if wait > 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+			due = timer.C
+		}
+
+		select {
+		case <-due:
+		case <-c.wake:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+type impairedPacket struct {
+	b         []byte
+	addr      net.Addr
+	deliverAt time.Time
+	seq       uint64
+}
+
+// packetQueue is a heap of packets ordered by delivery time, with ties broken by write order
+type packetQueue []*impairedPacket
+
+func (q packetQueue) Len() int {
+	return len(q)
+}
+
+func (q packetQueue) Less(i, j int) bool {
+	if q[i].deliverAt.Equal(q[j].deliverAt) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].deliverAt.Before(q[j].deliverAt)
+}
+
+func (q packetQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *packetQueue) Push(x any) {
+	*q = append(*q, x.(*impairedPacket))
+}
+
+func (q *packetQueue) Pop() any {
+	old := *q
+	pkt := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return pkt
+}
@@ -0,0 +1,192 @@
+package common
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// capturePacketConn is a net.PacketConn which records every write
+type capturePacketConn struct {
+	net.PacketConn
+	writes chan []byte
+}
+
+func newCapturePacketConn() *capturePacketConn {
+	return &capturePacketConn{writes: make(chan []byte, 1024)}
+}
+
+func (c *capturePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.writes <- p
+	return len(p), nil
+}
+
+func (c *capturePacketConn) Close() error {
+	return nil
+}
+
+// collect returns everything written to c until it has been quiet for idle
+func (c *capturePacketConn) collect(idle time.Duration) [][]byte {
+	var got [][]byte
+	for {
+		select {
+		case b := <-c.writes:
+			got = append(got, b)
+		case <-time.After(idle):
+			return got
+		}
+	}
+}
+
+func writeN(t *testing.T, c net.PacketConn, n int, size int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		b := make([]byte, size)
+		b[0] = byte(i)
+		if _, err := c.WriteTo(b, DebugAddr("test")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestImpairedPacketConnLoss(t *testing.T) {
+	sink := newCapturePacketConn()
+	c := NewImpairedPacketConn(sink, &ImpairmentProfile{Loss: 1, Seed: 1})
+	defer c.Close()
+
+	writeN(t, c, 100, 1)
+	if got := sink.collect(50 * time.Millisecond); len(got) != 0 {
+		t.Fatalf("expected every packet to be lost, %v were delivered", len(got))
+	}
+}
+
+func TestImpairedPacketConnDuplicate(t *testing.T) {
+	sink := newCapturePacketConn()
+	c := NewImpairedPacketConn(sink, &ImpairmentProfile{Duplicate: 1, Seed: 1})
+	defer c.Close()
+
+	writeN(t, c, 10, 1)
+	got := sink.collect(50 * time.Millisecond)
+	if len(got) != 20 {
+		t.Fatalf("expected 20 packets, got %v", len(got))
+	}
+
+	for i := 0; i < len(got); i += 2 {
+		if got[i][0] != got[i+1][0] {
+			t.Fatalf("expected duplicates to be adjacent, got %v then %v", got[i][0], got[i+1][0])
+		}
+	}
+}
+
+func TestImpairedPacketConnLatency(t *testing.T) {
+	const latency = 100 * time.Millisecond
+
+	sink := newCapturePacketConn()
+	c := NewImpairedPacketConn(sink, &ImpairmentProfile{Latency: latency, Jitter: 10 * time.Millisecond, Seed: 1})
+	defer c.Close()
+
+	start := time.Now()
+	writeN(t, c, 1, 1)
+	<-sink.writes
+
+	if elapsed := time.Since(start); elapsed < latency-10*time.Millisecond {
+		t.Fatalf("packet was delivered after %v, expected at least %v", elapsed, latency-10*time.Millisecond)
+	}
+}
+
+func TestImpairedPacketConnReorder(t *testing.T) {
+	sink := newCapturePacketConn()
+	c := NewImpairedPacketConn(sink, &ImpairmentProfile{Reorder: 0.5, Seed: 1})
+	defer c.Close()
+
+	writeN(t, c, 100, 1)
+	got := sink.collect(100 * time.Millisecond)
+	if len(got) != 100 {
+		t.Fatalf("expected 100 packets, got %v", len(got))
+	}
+
+	var reordered bool
+	for i := 1; i < len(got); i++ {
+		if got[i][0] < got[i-1][0] {
+			reordered = true
+		}
+	}
+
+	if !reordered {
+		t.Fatal("expected packets to be delivered out of order")
+	}
+}
+
+func TestImpairedPacketConnBandwidth(t *testing.T) {
+	// 10 packets of 1000 bytes at 20000 bytes/sec should take half a second to cross the wire
+	sink := newCapturePacketConn()
+	c := NewImpairedPacketConn(sink, &ImpairmentProfile{Bandwidth: 20000, Queue: time.Second, Seed: 1})
+	defer c.Close()
+
+	start := time.Now()
+	writeN(t, c, 10, 1000)
+	for i := 0; i < 10; i++ {
+		<-sink.writes
+	}
+
+	if elapsed := time.Since(start); elapsed < 450*time.Millisecond {
+		t.Fatalf("10KB crossed a 20KB/s link in %v", elapsed)
+	}
+}
+
+func TestImpairedPacketConnQueue(t *testing.T) {
+	// Offered 100KB at once, a 20KB/s link which queues for at most 100ms delivers ~2KB of it
+	sink := newCapturePacketConn()
+	c := NewImpairedPacketConn(sink, &ImpairmentProfile{Bandwidth: 20000, Queue: 100 * time.Millisecond, Seed: 1})
+	defer c.Close()
+
+	writeN(t, c, 100, 1000)
+	got := sink.collect(200 * time.Millisecond)
+	if len(got) == 0 || len(got) > 3 {
+		t.Fatalf("%v of 100 packets crossed an overloaded link, expected the rest to be dropped", len(got))
+	}
+}
+
+func TestImpairedPacketConnStop(t *testing.T) {
+	sink := newCapturePacketConn()
+	c := NewImpairedPacketConn(sink, &ImpairmentProfile{Latency: time.Hour, Seed: 1})
+
+	writeN(t, c, 1, 1)
+	c.Stop()
+
+	if _, err := c.WriteTo([]byte{0}, DebugAddr("test")); err != net.ErrClosed {
+		t.Fatalf("expected net.ErrClosed after Stop, got %v", err)
+	}
+}
+
+func TestLoadImpairmentProfile(t *testing.T) {
+	dir := t.TempDir()
+
+	good := filepath.Join(dir, "good.json")
+	os.WriteFile(good, []byte(`{"latency": "150ms", "jitter": "30ms", "loss": 0.02, "bandwidth": 250000, "queue": "100ms"}`), 0644)
+
+	p, err := LoadImpairmentProfile(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ImpairmentProfile{Latency: 150 * time.Millisecond, Jitter: 30 * time.Millisecond, Loss: 0.02, Bandwidth: 250000, Queue: 100 * time.Millisecond}
+	if *p != expected {
+		t.Fatalf("got %+v, expected %+v", *p, expected)
+	}
+
+	for name, profile := range map[string]string{
+		"bad_duration.json": `{"latency": "soon"}`,
+		"bad_loss.json":     `{"loss": 1.5}`,
+		"bad_json.json":     `{`,
+	} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(profile), 0644)
+
+		if _, err := LoadImpairmentProfile(path); err == nil {
+			t.Fatalf("expected an error loading %v", name)
+		}
+	}
+}
@@ -1,35 +1,263 @@
 package common
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"strings"
 	"sync"
 )
 
+// Log levels, in increasing order of severity. These are the log/slog levels.
+const (
+	LevelDebug = slog.LevelDebug
+	LevelInfo  = slog.LevelInfo
+	LevelWarn  = slog.LevelWarn
+	LevelError = slog.LevelError
+)
+
+// Level is the severity of a log message
+type Level = slog.Level
+
+// Logger is a leveled logger with structured fields. Fields are given as alternating keys and
+// values, as with log/slog: l.Info("accepted a connection", "addr", addr, "total", n).
+type Logger interface {
+	Debug(msg string, fields ...any)
+	Info(msg string, fields ...any)
+	Warn(msg string, fields ...any)
+	Error(msg string, fields ...any)
+
+	// With returns a Logger which includes the given fields with every message
+	With(fields ...any) Logger
+}
+
 var (
-	debugLogger = log.New(os.Stderr, "", log.LstdFlags)
-	logMx       sync.RWMutex
+	logLevel = new(slog.LevelVar)
+	logger   Logger
+	logMx    sync.RWMutex
 )
 
-// Override the Logger used by broflake for debug messages
-func SetDebugLogger(l *log.Logger) {
+func init() {
+	logLevel.Set(LevelInfo)
+	logger = NewSlogLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+}
+
+// SetLogger overrides the Logger used by broflake. Loggers returned by NewLogger, including those
+// created before the call to SetLogger, write to the new Logger.
+func SetLogger(l Logger) {
 	logMx.Lock()
 	defer logMx.Unlock()
-	debugLogger = l
+	logger = l
 }
 
-// Log a debug level message
-func Debugf(format string, args ...interface{}) {
+// SetLogLevel sets the minimum level logged by the default Logger and by a *log.Logger installed
+// with SetDebugLogger. A Logger installed with SetLogger does its own filtering.
+func SetLogLevel(level Level) {
+	logLevel.Set(level)
+}
+
+// ConfigureLogging installs a slog Logger which writes to stderr at the given level, in the given
+// format ("text" or "json"). An empty level means "info" and an empty format means "text". It's
+// meant for our binaries, which take both from the environment.
+func ConfigureLogging(level, format string) error {
+	if level != "" {
+		l, err := ParseLogLevel(level)
+		if err != nil {
+			return err
+		}
+		SetLogLevel(l)
+	}
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+
+	switch format {
+	case "", "text":
+		SetLogger(NewSlogLogger(slog.New(slog.NewTextHandler(os.Stderr, opts))))
+	case "json":
+		SetLogger(NewSlogLogger(slog.New(slog.NewJSONHandler(os.Stderr, opts))))
+	default:
+		return fmt.Errorf("invalid log format '%v'", format)
+	}
+
+	return nil
+}
+
+// LogLevelEnabled returns true if messages at the given level are logged by the default Logger
+func LogLevelEnabled(level Level) bool {
+	return level >= logLevel.Level()
+}
+
+// ParseLogLevel parses a level name: "debug", "info", "warn" or "error"
+func ParseLogLevel(s string) (Level, error) {
+	var level Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("invalid log level '%v'", s)
+	}
+
+	return level, nil
+}
+
+func currentLogger() Logger {
 	logMx.RLock()
-	l := debugLogger
-	logMx.RUnlock()
-	l.Printf(format+"\n", args...)
+	defer logMx.RUnlock()
+	return logger
+}
+
+// NewLogger returns a Logger for a component, which includes the given fields with every message.
+// By convention, the first field is "component". The returned Logger always writes to whichever
+// Logger was most recently installed with SetLogger.
+func NewLogger(fields ...any) Logger {
+	return boundLogger{fields: fields}
 }
 
-// Log a debug level message
+// boundLogger defers to the current global Logger at call time, prepending its fields
+type boundLogger struct {
+	fields []any
+}
+
+func (l boundLogger) args(fields []any) []any {
+	if len(l.fields) == 0 {
+		return fields
+	}
+
+	all := make([]any, 0, len(l.fields)+len(fields))
+	all = append(all, l.fields...)
+	return append(all, fields...)
+}
+
+func (l boundLogger) Debug(msg string, fields ...any) {
+	currentLogger().Debug(msg, l.args(fields)...)
+}
+
+func (l boundLogger) Info(msg string, fields ...any) {
+	currentLogger().Info(msg, l.args(fields)...)
+}
+
+func (l boundLogger) Warn(msg string, fields ...any) {
+	currentLogger().Warn(msg, l.args(fields)...)
+}
+
+func (l boundLogger) Error(msg string, fields ...any) {
+	currentLogger().Error(msg, l.args(fields)...)
+}
+
+func (l boundLogger) With(fields ...any) Logger {
+	return boundLogger{fields: l.args(fields)}
+}
+
+// NewSlogLogger adapts a *slog.Logger to the Logger interface
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s slogLogger) Debug(msg string, fields ...any) {
+	s.l.Debug(msg, fields...)
+}
+
+func (s slogLogger) Info(msg string, fields ...any) {
+	s.l.Info(msg, fields...)
+}
+
+func (s slogLogger) Warn(msg string, fields ...any) {
+	s.l.Warn(msg, fields...)
+}
+
+func (s slogLogger) Error(msg string, fields ...any) {
+	s.l.Error(msg, fields...)
+}
+
+func (s slogLogger) With(fields ...any) Logger {
+	return slogLogger{s.l.With(fields...)}
+}
+
+// stdLogger adapts a *log.Logger to the Logger interface, formatting fields as key=value pairs
+type stdLogger struct {
+	l      *log.Logger
+	fields []any
+}
+
+func (s stdLogger) log(level Level, msg string, fields []any) {
+	if level < logLevel.Level() {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteString(" ")
+	b.WriteString(msg)
+
+	all := append(append([]any{}, s.fields...), fields...)
+	for i := 0; i < len(all); i += 2 {
+		if i+1 < len(all) {
+			fmt.Fprintf(&b, " %v=%v", all[i], all[i+1])
+		} else {
+			fmt.Fprintf(&b, " !BADKEY=%v", all[i])
+		}
+	}
+
+	s.l.Println(b.String())
+}
+
+func (s stdLogger) Debug(msg string, fields ...any) {
+	s.log(LevelDebug, msg, fields)
+}
+
+func (s stdLogger) Info(msg string, fields ...any) {
+	s.log(LevelInfo, msg, fields)
+}
+
+func (s stdLogger) Warn(msg string, fields ...any) {
+	s.log(LevelWarn, msg, fields)
+}
+
+func (s stdLogger) Error(msg string, fields ...any) {
+	s.log(LevelError, msg, fields)
+}
+
+func (s stdLogger) With(fields ...any) Logger {
+	return stdLogger{l: s.l, fields: append(append([]any{}, s.fields...), fields...)}
+}
+
+// Override the Logger used by broflake with a *log.Logger. This is a compatibility shim; new code
+// should use SetLogger. As before we had log levels, the *log.Logger receives debug messages, but
+// callers may raise the level afterwards with SetLogLevel.
+func SetDebugLogger(l *log.Logger) {
+	SetLogger(stdLogger{l: l})
+	SetLogLevel(LevelDebug)
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx which carries l
+func WithLogger(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// LoggerFrom returns the Logger carried by ctx, or the global Logger if ctx doesn't carry one
+func LoggerFrom(ctx context.Context) Logger {
+	if l, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return l
+	}
+
+	return NewLogger()
+}
+
+// Log a debug level message.
+//
+// Deprecated: use a Logger.
+func Debugf(format string, args ...interface{}) {
+	currentLogger().Debug(fmt.Sprintf(format, args...))
+}
+
+// Log a debug level message.
+//
+// Deprecated: use a Logger.
 func Debug(msg interface{}) {
-	logMx.RLock()
-	l := debugLogger
-	logMx.RUnlock()
-	l.Println(msg)
+	currentLogger().Debug(fmt.Sprint(msg))
 }
@@ -0,0 +1,85 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestLoggerFollowsSetLogger(t *testing.T) {
+	defer SetLogger(currentLogger())
+	defer SetLogLevel(logLevel.Level())
+
+	// Loggers created before the call to SetLogger must write to the new Logger
+	l := NewLogger("component", "test").With("worker", 3)
+
+	var buf bytes.Buffer
+	SetDebugLogger(log.New(&buf, "", 0))
+	SetLogLevel(LevelInfo)
+
+	l.Debug("hidden")
+	l.Info("shown", "session", "abc")
+
+	got := buf.String()
+	if strings.Contains(got, "hidden") {
+		t.Fatalf("a debug message was logged at info level: %q", got)
+	}
+
+	if want := "INFO shown component=test worker=3 session=abc\n"; got != want {
+		t.Fatalf("got %q, expected %q", got, want)
+	}
+}
+
+func TestSetDebugLogger(t *testing.T) {
+	defer SetLogger(currentLogger())
+	defer SetLogLevel(logLevel.Level())
+
+	// Callers which installed a *log.Logger to see debug output still see it
+	SetLogLevel(LevelInfo)
+	var buf bytes.Buffer
+	SetDebugLogger(log.New(&buf, "", 0))
+
+	Debugf("legacy %v", 1)
+	if want := "DEBUG legacy 1\n"; buf.String() != want {
+		t.Fatalf("got %q, expected %q", buf.String(), want)
+	}
+}
+
+func TestLoggerFrom(t *testing.T) {
+	defer SetLogger(currentLogger())
+	defer SetLogLevel(logLevel.Level())
+
+	var buf bytes.Buffer
+	SetDebugLogger(log.New(&buf, "", 0))
+	SetLogLevel(LevelDebug)
+
+	LoggerFrom(context.Background()).Debug("bare")
+	LoggerFrom(WithLogger(context.Background(), NewLogger("state", "proxy"))).Warn("carried")
+
+	if want := "DEBUG bare\nWARN carried state=proxy\n"; buf.String() != want {
+		t.Fatalf("got %q, expected %q", buf.String(), want)
+	}
+}
+
+func TestConfigureLogging(t *testing.T) {
+	defer SetLogger(currentLogger())
+	defer SetLogLevel(logLevel.Level())
+
+	if err := ConfigureLogging("warn", "json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if LogLevelEnabled(LevelInfo) || !LogLevelEnabled(LevelWarn) {
+		t.Fatal("expected LOG_LEVEL=warn to disable info and enable warn")
+	}
+
+	if err := ConfigureLogging("chatty", ""); err == nil {
+		t.Fatal("expected an error for an invalid level")
+	}
+
+	if err := ConfigureLogging("", "xml"); err == nil {
+		t.Fatal("expected an error for an invalid format")
+	}
+}
@@ -17,8 +17,24 @@ var QUICCfg = quic.Config{
 	MaxIncomingUniStreams: int64(2 << 16),
 	MaxIdleTimeout:        16 * time.Second,
 	KeepAlivePeriod:       8 * time.Second,
+	EnableDatagrams:       true, // For proxying UDP; see udp.go
+
+	// Our packets travel inside other protocols' messages, which are too small for QUIC's usual
+	// initial packets when they're WebTransport datagrams sent by a browser which hasn't yet
+	// discovered its path MTU. So we stick to the smallest packets QUIC allows.
+	InitialPacketSize: 1200,
 }
 
+// An egress server which is shutting down asks each client to move to a new QUIC connection by
+// opening a stream to it and sending GoAway. While it drains, it refuses new streams with
+// StreamGoingAway, and once the streams in flight have finished, it closes its connections with
+// QUICGoingAway.
+const (
+	GoAway          byte                      = 0x01
+	StreamGoingAway quic.StreamErrorCode      = 0x01
+	QUICGoingAway   quic.ApplicationErrorCode = 0x01
+)
+
 type DebugAddr string
 
 func (a DebugAddr) Network() string {
@@ -55,6 +71,11 @@ func (c QUICStreamNetConn) Close() error {
 	return c.Stream.Close()
 }
 
+// CloseWrite finishes our side of the stream, leaving the peer free to keep sending
+func (c QUICStreamNetConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
 func IsPublicAddr(addr net.IP) bool {
 	return !addr.IsPrivate() && !addr.IsUnspecified() && !addr.IsLoopback()
 }
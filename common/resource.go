@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net"
+	"slices"
 
 	"github.com/pion/webrtc/v3"
 )
@@ -41,6 +42,11 @@ func (pa PathAssertion) Nil() bool {
 	return len(pa.Allow) == 0 && len(pa.Deny) == 0
 }
 
+// Equal returns true if pa and other allow and deny the same endpoints, in the same order
+func (pa PathAssertion) Equal(other PathAssertion) bool {
+	return slices.Equal(pa.Allow, other.Allow) && slices.Equal(pa.Deny, other.Deny)
+}
+
 // TODO: ConsumerInfo is the downstream router's counterpart to PathAssertion. It's meant to describe
 // useful information about a downstream connectivity situation. Like PathAssertion, a Nil()
 // ConsumerInfo indicates no connectivity. ConsumerInfo lives here both to keep things consistent
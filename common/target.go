@@ -0,0 +1,149 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Each stream a client opens to an egress server begins with a target header naming where the
+// stream should go, to which the egress server replies with a single TargetStatus byte:
+//
+//	version  1 byte  targetHeaderVersion
+//	type     1 byte  a StreamType
+//	length   2 bytes the length of addr, big endian
+//	addr     length bytes, a host:port
+//
+// The version byte is never printable, so egress servers can tell native streams apart from the
+// HTTP requests which older clients send.
+const (
+	targetHeaderVersion = 0x01
+	maxTargetAddrLen    = 1024
+)
+
+const (
+	StreamTCP StreamType = iota + 1
+	StreamUDP
+)
+
+// StreamType says what a stream carries
+// StreamTCP: the bytes of a TCP connection
+// StreamUDP: nothing, while the flow's datagrams travel as QUIC datagrams; see udp.go
+type StreamType byte
+
+func (t StreamType) String() string {
+	switch t {
+	case StreamTCP:
+		return "tcp"
+	case StreamUDP:
+		return "udp"
+	default:
+		return fmt.Sprintf("StreamType(%v)", byte(t))
+	}
+}
+
+const (
+	TargetOK TargetStatus = iota
+	TargetFailed
+	TargetBadRequest
+	TargetNotAllowed
+	TargetUnreachable
+	TargetRefused
+	TargetTimeout
+)
+
+// TargetStatus is an egress server's reply to a target header
+type TargetStatus byte
+
+func (s TargetStatus) String() string {
+	switch s {
+	case TargetOK:
+		return "ok"
+	case TargetFailed:
+		return "failed"
+	case TargetBadRequest:
+		return "bad request"
+	case TargetNotAllowed:
+		return "not allowed"
+	case TargetUnreachable:
+		return "unreachable"
+	case TargetRefused:
+		return "connection refused"
+	case TargetTimeout:
+		return "timed out"
+	default:
+		return fmt.Sprintf("TargetStatus(%v)", byte(s))
+	}
+}
+
+// TargetHeader names the destination of a stream
+type TargetHeader struct {
+	Type StreamType
+	Addr string
+}
+
+// Write the header to w
+func (h TargetHeader) Write(w io.Writer) error {
+	if len(h.Addr) > maxTargetAddrLen {
+		return fmt.Errorf("target address is %v bytes, the most we allow is %v", len(h.Addr), maxTargetAddrLen)
+	}
+
+	b := make([]byte, 4, 4+len(h.Addr))
+	b[0] = targetHeaderVersion
+	b[1] = byte(h.Type)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(h.Addr)))
+	_, err := w.Write(append(b, h.Addr...))
+	return err
+}
+
+// IsTargetHeader returns true if a stream which begins with b begins with a target header
+func IsTargetHeader(b byte) bool {
+	return b == targetHeaderVersion
+}
+
+// ReadTargetHeader reads a target header from r
+func ReadTargetHeader(r *bufio.Reader) (TargetHeader, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return TargetHeader{}, err
+	}
+
+	if b[0] != targetHeaderVersion {
+		return TargetHeader{}, fmt.Errorf("unsupported target header version %v", b[0])
+	}
+
+	n := binary.BigEndian.Uint16(b[2:])
+	if n == 0 || n > maxTargetAddrLen {
+		return TargetHeader{}, fmt.Errorf("bad target address length %v", n)
+	}
+
+	addr := make([]byte, n)
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return TargetHeader{}, err
+	}
+
+	return TargetHeader{Type: StreamType(b[1]), Addr: string(addr)}, nil
+}
+
+// ErrTargetStatus is the error for a TargetStatus other than TargetOK
+type ErrTargetStatus TargetStatus
+
+func (e ErrTargetStatus) Error() string {
+	return TargetStatus(e).String()
+}
+
+// ReadTargetStatus reads an egress server's reply to a target header, returning an ErrTargetStatus
+// if it isn't TargetOK
+func ReadTargetStatus(r io.Reader) error {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+
+	if s := TargetStatus(b[0]); s != TargetOK {
+		return ErrTargetStatus(s)
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Widgets authenticate to egress servers with tokens of the form <payload>.<signature>, where the
+// payload is the base64url encoded JSON of a tokenClaims, and the signature is the base64url
+// encoded HMAC-SHA256 of the encoded payload. Browsers can't set headers on WebSockets, so widgets
+// present their tokens in a subprotocol, which is TokenSubprotocolPrefix followed by the token.
+const TokenSubprotocolPrefix = "bf-token."
+
+var (
+	ErrTokenInvalid = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+type tokenClaims struct {
+	Subject string `json:"sub"`
+	Expires int64  `json:"exp"` // Unix seconds
+}
+
+// TokenSubprotocol returns the WebSocket subprotocol which presents token
+func TokenSubprotocol(token string) string {
+	return TokenSubprotocolPrefix + token
+}
+
+// SignToken returns a token for subject which expires at expires, signed with key
+func SignToken(key []byte, subject string, expires time.Time) string {
+	b, _ := json.Marshal(tokenClaims{Subject: subject, Expires: expires.Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(key, payload))
+}
+
+// VerifyToken checks that token was signed with key and hasn't expired as of now, returning its
+// subject
+func VerifyToken(key []byte, token string, now time.Time) (string, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", ErrTokenInvalid
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, tokenMAC(key, payload)) {
+		return "", ErrTokenInvalid
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", ErrTokenInvalid
+	}
+
+	var claims tokenClaims
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return "", ErrTokenInvalid
+	}
+
+	if !now.Before(time.Unix(claims.Expires, 0)) {
+		return "", ErrTokenExpired
+	}
+
+	return claims.Subject, nil
+}
+
+// TokenProof returns what a widget which can't keep its token private presents to prove it holds
+// token: the token's claims, which aren't secret, and proof, the HMAC-SHA256 of nonce keyed with
+// the token's signature. Only the holder of the token, or of the key which signed it, can make a
+// proof, and a proof is only good for the nonce it answers.
+func TokenProof(token, nonce string) (claims, proof string, err error) {
+	claims, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", "", ErrTokenInvalid
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return "", "", ErrTokenInvalid
+	}
+
+	return claims, base64.RawURLEncoding.EncodeToString(proofMAC(mac, nonce)), nil
+}
+
+// VerifyTokenProof checks that proof answers nonce with a token made of claims, which was signed
+// with key and hasn't expired as of now, returning its subject
+func VerifyTokenProof(key []byte, claims, nonce, proof string, now time.Time) (string, error) {
+	mac, err := base64.RawURLEncoding.DecodeString(proof)
+	if err != nil {
+		return "", ErrTokenInvalid
+	}
+
+	sig := tokenMAC(key, claims)
+	if !hmac.Equal(mac, proofMAC(sig, nonce)) {
+		return "", ErrTokenInvalid
+	}
+
+	return VerifyToken(key, claims+"."+base64.RawURLEncoding.EncodeToString(sig), now)
+}
+
+func proofMAC(sig []byte, nonce string) []byte {
+	h := hmac.New(sha256.New, sig)
+	h.Write([]byte(nonce))
+	return h.Sum(nil)
+}
+
+func tokenMAC(key []byte, payload string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(payload))
+	return h.Sum(nil)
+}
@@ -0,0 +1,75 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	key := []byte("NELSON WUZ HERE NELSON WUZ HERE!")
+	now := time.Now()
+	token := SignToken(key, "widget-1", now.Add(time.Minute))
+
+	if sub, err := VerifyToken(key, token, now); err != nil || sub != "widget-1" {
+		t.Fatalf("VerifyToken = %v, %v, expected widget-1", sub, err)
+	}
+
+	if _, err := VerifyToken(key, token, now.Add(time.Minute)); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("expected the token to have expired, got %v", err)
+	}
+
+	if _, err := VerifyToken([]byte("some other key"), token, now); !errors.Is(err, ErrTokenInvalid) {
+		t.Errorf("expected a token signed with another key to be invalid, got %v", err)
+	}
+
+	// Extending the expiry breaks the signature
+	later, _, _ := strings.Cut(SignToken(key, "widget-1", now.Add(time.Hour)), ".")
+	_, sig, _ := strings.Cut(token, ".")
+	if _, err := VerifyToken(key, later+"."+sig, now); !errors.Is(err, ErrTokenInvalid) {
+		t.Errorf("expected a forged token to be invalid, got %v", err)
+	}
+
+	for _, bad := range []string{"", "NELSON", "a.b", token + "x"} {
+		if _, err := VerifyToken(key, bad, now); !errors.Is(err, ErrTokenInvalid) {
+			t.Errorf("expected %q to be invalid, got %v", bad, err)
+		}
+	}
+}
+
+func TestTokenProof(t *testing.T) {
+	key := []byte("NELSON WUZ HERE NELSON WUZ HERE!")
+	now := time.Now()
+	token := SignToken(key, "widget-1", now.Add(time.Minute))
+
+	claims, proof, err := TokenProof(token, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The proof doesn't give the token away
+	if strings.Contains(claims+proof, strings.SplitN(token, ".", 2)[1]) {
+		t.Error("expected the proof not to reveal the token's signature")
+	}
+
+	if sub, err := VerifyTokenProof(key, claims, "nonce-1", proof, now); err != nil || sub != "widget-1" {
+		t.Fatalf("VerifyTokenProof = %v, %v, expected widget-1", sub, err)
+	}
+
+	if _, err := VerifyTokenProof(key, claims, "nonce-2", proof, now); !errors.Is(err, ErrTokenInvalid) {
+		t.Errorf("expected a proof for another nonce to be invalid, got %v", err)
+	}
+
+	if _, err := VerifyTokenProof([]byte("some other key"), claims, "nonce-1", proof, now); !errors.Is(err, ErrTokenInvalid) {
+		t.Errorf("expected a proof of a token signed with another key to be invalid, got %v", err)
+	}
+
+	if _, err := VerifyTokenProof(key, claims, "nonce-1", proof, now.Add(time.Minute)); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("expected the token to have expired, got %v", err)
+	}
+
+	if _, _, err := TokenProof("NELSON", "nonce-1"); !errors.Is(err, ErrTokenInvalid) {
+		t.Errorf("expected a malformed token to be invalid, got %v", err)
+	}
+}
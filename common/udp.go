@@ -0,0 +1,276 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// We proxy UDP over QUIC in the style of MASQUE CONNECT-UDP (RFC 9298). For each UDP flow, the
+// client opens a stream which begins with a target header of type StreamUDP (see target.go), or,
+// for compatibility, an HTTP/1.1 CONNECT-UDP upgrade request naming the flow's destination. Once
+// the egress server accepts, the flow's UDP payloads travel in QUIC datagrams (RFC 9221), each
+// prefixed with the stream's quarter stream ID and a context ID of 0, as in HTTP Datagrams
+// (RFC 9297). The flow lives as long as its stream.
+const (
+	ConnectUDPProtocol = "connect-udp"
+	connectUDPPath     = "/.well-known/masque/udp/"
+
+	// datagramQueueLen is how many datagrams a flow buffers for its reader before dropping them
+	datagramQueueLen = 256
+)
+
+// NewConnectUDPRequest returns a request to open a UDP flow to addr, a host:port
+func NewConnectUDPRequest(addr string) (*http.Request, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: connectUDPPath + host + "/" + port + "/", RawPath: connectUDPPath + url.PathEscape(host) + "/" + port + "/"},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Host:       "broflake",
+		Header: http.Header{
+			"Connection":       {"Upgrade"},
+			"Upgrade":          {ConnectUDPProtocol},
+			"Capsule-Protocol": {"?1"},
+		},
+	}, nil
+}
+
+// ParseConnectUDPRequest returns the host:port which a CONNECT-UDP request wants to reach
+func ParseConnectUDPRequest(r *http.Request) (string, error) {
+	if r.Method != http.MethodGet || !strings.EqualFold(r.Header.Get("Upgrade"), ConnectUDPProtocol) {
+		return "", fmt.Errorf("not a %v request", ConnectUDPProtocol)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, connectUDPPath), "/")
+	if !strings.HasPrefix(r.URL.Path, connectUDPPath) || len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] != "" {
+		return "", fmt.Errorf("bad %v path '%v'", ConnectUDPProtocol, r.URL.Path)
+	}
+
+	return net.JoinHostPort(parts[0], parts[1]), nil
+}
+
+// DatagramConn is the part of a quic.Connection which a DatagramMux needs
+type DatagramConn interface {
+	SendDatagram(payload []byte) error
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+	Context() context.Context
+}
+
+// DatagramMux demultiplexes the QUIC datagrams received on a connection into DatagramFlows, by
+// quarter stream ID. Datagrams for flows we don't know are dropped.
+type DatagramMux struct {
+	conn  DatagramConn
+	mx    sync.Mutex
+	flows map[uint64]*DatagramFlow
+	done  bool
+}
+
+// NewDatagramMux starts demultiplexing conn's datagrams. It stops when conn is closed.
+func NewDatagramMux(conn DatagramConn) *DatagramMux {
+	m := &DatagramMux{conn: conn, flows: make(map[uint64]*DatagramFlow)}
+	go m.receive()
+	return m
+}
+
+func (m *DatagramMux) receive() {
+	for {
+		b, err := m.conn.ReceiveDatagram(m.conn.Context())
+		if err != nil {
+			m.close()
+			return
+		}
+
+		id, n, err := quicvarint.Parse(b)
+		if err != nil {
+			continue
+		}
+
+		// We only use context ID 0, which carries UDP payloads
+		ctxID, nn, err := quicvarint.Parse(b[n:])
+		if err != nil || ctxID != 0 {
+			continue
+		}
+
+		m.mx.Lock()
+		f := m.flows[id]
+		m.mx.Unlock()
+
+		if f != nil {
+			f.deliver(b[n+nn:])
+		}
+	}
+}
+
+// close closes every flow when our connection is gone
+func (m *DatagramMux) close() {
+	m.mx.Lock()
+	m.done = true
+	flows := m.flows
+	m.flows = make(map[uint64]*DatagramFlow)
+	m.mx.Unlock()
+
+	for _, f := range flows {
+		f.Close()
+	}
+}
+
+// Register a flow for the stream with the given ID
+func (m *DatagramMux) Register(id quic.StreamID) (*DatagramFlow, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if m.done {
+		return nil, net.ErrClosed
+	}
+
+	qid := uint64(id) / 4
+	if _, ok := m.flows[qid]; ok {
+		return nil, fmt.Errorf("stream %v already has a flow", id)
+	}
+
+	f := &DatagramFlow{
+		m:      m,
+		id:     qid,
+		prefix: quicvarint.Append(quicvarint.Append(nil, qid), 0),
+		rx:     make(chan []byte, datagramQueueLen),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	m.flows[qid] = f
+	return f, nil
+}
+
+func (m *DatagramMux) unregister(f *DatagramFlow) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if m.flows[f.id] == f {
+		delete(m.flows, f.id)
+	}
+}
+
+// DatagramFlow sends and receives the UDP payloads of one flow. Like a UDP socket, it delivers
+// whole datagrams or nothing: reads truncate datagrams which don't fit, and datagrams which arrive
+// faster than they're read are dropped.
+type DatagramFlow struct {
+	m            *DatagramMux
+	id           uint64
+	prefix       []byte
+	rx           chan []byte
+	wake         chan struct{}
+	done         chan struct{}
+	once         sync.Once
+	mx           sync.Mutex
+	readDeadline time.Time
+}
+
+func (f *DatagramFlow) deliver(b []byte) {
+	select {
+	case f.rx <- b:
+	default:
+	}
+}
+
+// Read the next datagram into p
+func (f *DatagramFlow) Read(p []byte) (int, error) {
+	for {
+		n, retry, err := f.read(p)
+		if !retry {
+			return n, err
+		}
+	}
+}
+
+// read waits for the next datagram until the current read deadline. If the deadline changes while
+// we wait, we return retry, so Read can start over with the new one.
+func (f *DatagramFlow) read(p []byte) (n int, retry bool, err error) {
+	f.mx.Lock()
+	deadline := f.readDeadline
+	f.mx.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, false, os.ErrDeadlineExceeded
+		}
+
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case b := <-f.rx:
+		return copy(p, b), false, nil
+	case <-f.done:
+		return 0, false, net.ErrClosed
+	case <-timeout:
+		return 0, false, os.ErrDeadlineExceeded
+	case <-f.wake:
+		return 0, true, nil
+	}
+}
+
+// Write p as one datagram. Datagrams too large for the path fail with a quic.DatagramTooLargeError.
+func (f *DatagramFlow) Write(p []byte) (int, error) {
+	select {
+	case <-f.done:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	b := make([]byte, 0, len(f.prefix)+len(p))
+	b = append(append(b, f.prefix...), p...)
+
+	if err := f.m.conn.SendDatagram(b); err != nil {
+		var tooLarge *quic.DatagramTooLargeError
+		if errors.As(err, &tooLarge) {
+			return 0, err
+		}
+		return 0, fmt.Errorf("can't send datagram: %w", err)
+	}
+
+	return len(p), nil
+}
+
+// SetReadDeadline sets the deadline for Read, as for a net.Conn
+func (f *DatagramFlow) SetReadDeadline(t time.Time) error {
+	f.mx.Lock()
+	f.readDeadline = t
+	f.mx.Unlock()
+
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Close the flow, unblocking any Read
+func (f *DatagramFlow) Close() error {
+	f.once.Do(func() {
+		close(f.done)
+		f.m.unregister(f)
+	})
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// pipeDatagramConn is one end of an in-memory DatagramConn pair
+type pipeDatagramConn struct {
+	rx     chan []byte
+	peer   *pipeDatagramConn
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newPipeDatagramConns() (*pipeDatagramConn, *pipeDatagramConn) {
+	a := &pipeDatagramConn{rx: make(chan []byte, 16)}
+	b := &pipeDatagramConn{rx: make(chan []byte, 16), peer: a}
+	a.peer = b
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	return a, b
+}
+
+func (c *pipeDatagramConn) SendDatagram(p []byte) error {
+	c.peer.rx <- append([]byte(nil), p...)
+	return nil
+}
+
+func (c *pipeDatagramConn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case b := <-c.rx:
+		return b, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *pipeDatagramConn) Context() context.Context {
+	return c.ctx
+}
+
+func TestConnectUDPRequest(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:53", "[::1]:443", "example.com:9"} {
+		req, err := NewConnectUDPRequest(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ParseConnectUDPRequest(req)
+		if err != nil || got != addr {
+			t.Errorf("round tripped %v as %v (err: %v)", addr, got, err)
+		}
+	}
+
+	req, _ := NewConnectUDPRequest("example.com:9")
+	for _, path := range []string{"/.well-known/masque/udp/example.com/", "/.well-known/masque/udp//9/", "/masque/example.com/9/"} {
+		req.URL.Path = path
+		if _, err := ParseConnectUDPRequest(req); err == nil {
+			t.Errorf("expected %v not to parse", path)
+		}
+	}
+}
+
+func TestDatagramMux(t *testing.T) {
+	a, b := newPipeDatagramConns()
+	ma, mb := NewDatagramMux(a), NewDatagramMux(b)
+
+	// Stream 4 has the quarter stream ID 1, which needs a prefix
+	fa, err := ma.Register(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fb, err := mb.Register(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ma.Register(4); err == nil {
+		t.Fatal("expected a second flow for stream 4 to fail")
+	}
+
+	// Datagrams for other flows don't reach ours
+	other, _ := ma.Register(8)
+	other.Write([]byte("nope"))
+
+	if _, err := fa.Write([]byte("NELSON WUZ HERE")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads truncate like UDP
+	p := make([]byte, 6)
+	n, err := fb.Read(p)
+	if err != nil || string(p[:n]) != "NELSON" {
+		t.Fatalf("read %q (err: %v), expected the first 6 bytes of our datagram", p[:n], err)
+	}
+
+	fb.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := fb.Read(p); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the read to time out, got %v", err)
+	}
+
+	// Changing the deadline wakes a blocked reader
+	fb.SetReadDeadline(time.Time{})
+	done := make(chan error)
+	go func() {
+		_, err := fb.Read(p)
+		done <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	fb.SetReadDeadline(time.Now())
+	if err := <-done; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the read to time out, got %v", err)
+	}
+
+	// Losing the connection closes every flow
+	b.cancel()
+	fb.SetReadDeadline(time.Time{})
+	if _, err := fb.Read(p); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected the flow to close with the connection, got %v", err)
+	}
+
+	if _, err := mb.Register(12); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected registering on a closed mux to fail, got %v", err)
+	}
+
+	// A flow's stream ID is free again once it's closed
+	fa.Close()
+	if _, err := ma.Register(4); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,346 @@
+// Package config loads and validates the configuration for broflake's binaries. Each binary
+// defines its own config struct, which is populated from three sources, each overriding the last:
+// the struct's defaults, a JSON config file, and environment variables. Fields are overridden by
+// the environment variable named in their `env` struct tag. Fields tagged `secret:"true"` are
+// masked wherever the config is printed.
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// Validator is a config struct which can check itself for errors
+type Validator interface {
+	Validate() error
+}
+
+// Duration is a time.Duration which is written as a string, eg "150ms", in config files and
+// environment variables
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// Load populates cfg, which must be a pointer to a struct holding default values, from the JSON
+// config file at path (if path isn't empty) and then from the environment, and validates it. Fields
+// in the config file which don't exist in cfg are an error, so typos don't go unnoticed.
+func Load(cfg Validator, path string) error {
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(cfg); err != nil {
+			return fmt.Errorf("invalid config file %v: %v", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return err
+	}
+
+	return cfg.Validate()
+}
+
+// Init loads the config for a binary called name, calling Load with the config file named by the
+// -config flag or the CONFIG environment variable. If the -print-config flag is set, it writes the
+// resolved config to stdout as JSON, with its secrets redacted, and exits. If the config is invalid,
+// it explains why and exits.
+func Init(name string, cfg Validator) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	path := fs.String("config", os.Getenv("CONFIG"), "path to a JSON config file")
+	print := fs.Bool("print-config", false, "print the resolved config as JSON and exit")
+	fs.Parse(os.Args[1:])
+
+	if err := Load(cfg, *path); err != nil {
+		fmt.Fprintf(os.Stderr, "%v: invalid config:\n%v\n", name, err)
+		os.Exit(2)
+	}
+
+	if *print {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(Redact(cfg))
+		os.Exit(0)
+	}
+}
+
+// redacted replaces the value of a secret which has been set
+const redacted = "REDACTED"
+
+// Redact returns a copy of cfg, a config struct or a pointer to one, in which every string or list
+// of strings tagged `secret:"true"` which has been set is replaced with "REDACTED". cfg is unchanged.
+func Redact(cfg any) any {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return cfg
+	}
+
+	c := reflect.New(v.Type())
+	c.Elem().Set(v)
+	redact(c.Elem())
+	return c.Interface()
+}
+
+// redact masks the secrets in the struct v, descending into nested structs. Lists are replaced
+// rather than masked in place, since v shares them with the config it was copied from.
+func redact(v reflect.Value) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fv := v.Field(i)
+
+		if !f.IsExported() {
+			continue
+		}
+
+		if f.Tag.Get("secret") != "true" {
+			if fv.Kind() == reflect.Struct {
+				redact(fv)
+			}
+			continue
+		}
+
+		switch {
+		case fv.Kind() == reflect.String && fv.Len() > 0:
+			fv.SetString(redacted)
+		case fv.Kind() == reflect.Slice && fv.Len() > 0 && fv.Type().Elem().Kind() == reflect.String:
+			masked := reflect.MakeSlice(fv.Type(), fv.Len(), fv.Len())
+			for j := 0; j < fv.Len(); j++ {
+				masked.Index(j).SetString(redacted)
+			}
+			fv.Set(masked)
+		}
+	}
+}
+
+// applyEnv overrides each field of the struct v which has an `env` tag naming a set environment
+// variable, descending into nested structs
+func applyEnv(v reflect.Value) error {
+	var errs []error
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fv := v.Field(i)
+
+		if !f.IsExported() {
+			continue
+		}
+
+		name, ok := f.Tag.Lookup("env")
+		if !ok {
+			if fv.Kind() == reflect.Struct {
+				errs = append(errs, applyEnv(fv))
+			}
+			continue
+		}
+
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		if err := setField(fv, s); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// setField parses s into v according to v's type
+func setField(v reflect.Value, s string) error {
+	if v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid bool '%v'", s)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer '%v'", s)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid unsigned integer '%v'", s)
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number '%v'", s)
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %v", v.Type())
+		}
+
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+
+	return nil
+}
+
+// Log configures logging for any of our binaries
+type Log struct {
+	Level  string `json:"level" env:"LOG_LEVEL"`   // "debug", "info", "warn" or "error"
+	Format string `json:"format" env:"LOG_FORMAT"` // "text" or "json"
+}
+
+func DefaultLog() Log {
+	return Log{Level: "info", Format: "text"}
+}
+
+func (l Log) Validate() error {
+	var errs []error
+
+	if _, err := common.ParseLogLevel(l.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %v", err))
+	}
+
+	return errors.Join(append(errs, OneOf("log.format", l.Format, "text", "json"))...)
+}
+
+// Apply installs a Logger as described by l
+func (l Log) Apply() error {
+	return common.ConfigureLogging(l.Level, l.Format)
+}
+
+// TLS names a certificate and private key in PEM files. Either both or neither must be set.
+type TLS struct {
+	Cert string `json:"cert" env:"TLS_CERT"`
+	Key  string `json:"key" env:"TLS_KEY"`
+}
+
+// Enabled returns true if a certificate and key are configured
+func (t TLS) Enabled() bool {
+	return t.Cert != "" && t.Key != ""
+}
+
+func (t TLS) Validate() error {
+	if (t.Cert == "") != (t.Key == "") {
+		return fmt.Errorf("tls: cert and key must be set together")
+	}
+
+	return errors.Join(File("tls.cert", t.Cert), File("tls.key", t.Key))
+}
+
+// Validation helpers. Each returns nil if the value is OK, or an error naming the field otherwise,
+// so that a Validate method can collect every problem with errors.Join.
+
+// Port checks that p is a valid TCP or UDP port. If optional is true, 0 (meaning "disabled") is OK.
+func Port(field string, p int, optional bool) error {
+	if (optional && p == 0) || (p > 0 && p <= 65535) {
+		return nil
+	}
+
+	return fmt.Errorf("%v: invalid port %v", field, p)
+}
+
+// Positive checks that n is greater than 0
+func Positive[T int | uint32 | Duration](field string, n T) error {
+	if n > 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%v: must be greater than 0, not %v", field, n)
+}
+
+// URL checks that s is an absolute URL with one of the given schemes
+func URL(field, s string, schemes ...string) error {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("%v: invalid URL '%v'", field, s)
+	}
+
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%v: URL scheme must be one of %v, not '%v'", field, schemes, u.Scheme)
+}
+
+// File checks that path, if it isn't empty, names a readable file
+func File(field, path string) error {
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("%v: %v", field, err)
+	}
+
+	return f.Close()
+}
+
+// OneOf checks that s is one of the given options
+func OneOf(field, s string, options ...string) error {
+	for _, o := range options {
+		if s == o {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%v: must be one of %v, not '%v'", field, options, s)
+}
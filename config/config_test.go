@@ -0,0 +1,126 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Port    int      `json:"port" env:"TEST_PORT"`
+	Name    string   `json:"name" env:"TEST_NAME"`
+	Timeout Duration `json:"timeout" env:"TEST_TIMEOUT"`
+	Servers []string `json:"servers" env:"TEST_SERVERS"`
+	Nested  struct {
+		Enabled bool `json:"enabled" env:"TEST_ENABLED"`
+	} `json:"nested"`
+	Log Log `json:"log"`
+}
+
+func (c *testConfig) Validate() error {
+	return errors.Join(
+		Port("port", c.Port, false),
+		Positive("timeout", c.Timeout),
+		c.Log.Validate(),
+	)
+}
+
+func writeConfig(t *testing.T, s string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(s), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, `{"port": 9000, "name": "file", "timeout": "2s", "nested": {"enabled": true}}`)
+	t.Setenv("TEST_NAME", "env")
+	t.Setenv("TEST_SERVERS", "stun:a:3478, stun:b:3478,")
+
+	cfg := &testConfig{Port: 80, Name: "default", Timeout: Duration(time.Second), Log: DefaultLog()}
+	if err := Load(cfg, path); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Port != 9000 || cfg.Name != "env" || time.Duration(cfg.Timeout) != 2*time.Second {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+
+	if !cfg.Nested.Enabled || cfg.Log.Level != "info" {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+
+	if fmt.Sprint(cfg.Servers) != "[stun:a:3478 stun:b:3478]" {
+		t.Fatalf("unexpected servers %v", cfg.Servers)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	cfg := &testConfig{Port: 80, Timeout: Duration(time.Second), Log: DefaultLog()}
+	if err := Load(cfg, writeConfig(t, `{"prot": 9000}`)); err == nil {
+		t.Fatal("expected an error for an unknown field")
+	}
+
+	t.Setenv("TEST_TIMEOUT", "soon")
+	if err := Load(cfg, ""); err == nil || !strings.Contains(err.Error(), "TEST_TIMEOUT") {
+		t.Fatalf("expected an error naming TEST_TIMEOUT, got %v", err)
+	}
+
+	// Every validation error is reported, not just the first
+	t.Setenv("TEST_TIMEOUT", "0s")
+	t.Setenv("TEST_PORT", "70000")
+	t.Setenv("LOG_FORMAT", "xml")
+
+	err := Load(cfg, "")
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+
+	for _, field := range []string{"port", "timeout", "log.format"} {
+		if !strings.Contains(err.Error(), field+":") {
+			t.Fatalf("expected an error for %v, got %v", field, err)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	type secrets struct {
+		Password string   `json:"password" secret:"true"`
+		Unset    string   `json:"unset" secret:"true"`
+		Keys     []string `json:"keys" secret:"true"`
+		Nested   struct {
+			Token string `json:"token" secret:"true"`
+			Name  string `json:"name"`
+		} `json:"nested"`
+	}
+
+	cfg := &secrets{Password: "hunter2", Keys: []string{"k1", "k2"}}
+	cfg.Nested.Token = "t0ken"
+	cfg.Nested.Name = "widget"
+
+	b, err := json.Marshal(Redact(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{"hunter2", "k1", "k2", "t0ken"} {
+		if strings.Contains(string(b), secret) {
+			t.Errorf("%v leaked into %s", secret, b)
+		}
+	}
+
+	// Secrets which were never set stay empty, and everything else is left as it is
+	if !strings.Contains(string(b), `"unset":""`) || !strings.Contains(string(b), `"name":"widget"`) {
+		t.Errorf("unexpected redacted config %s", b)
+	}
+
+	if cfg.Password != "hunter2" || cfg.Keys[0] != "k1" || cfg.Nested.Token != "t0ken" {
+		t.Errorf("Redact modified the original config %+v", cfg)
+	}
+}
@@ -0,0 +1,295 @@
+//go:build !wasm
+
+// e2e_test.go runs a complete Broflake deployment in a single process: Freddie, an egress server,
+// a widget and a desktop client, proxying requests from the desktop's local HTTP proxy to a test
+// origin. Signaling and egress traffic run on loopback, while WebRTC runs over a virtual network
+// with its own STUN server, so the test never touches the internet.
+package e2e
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/broflake/clientcore"
+	"github.com/getlantern/broflake/clientcore/sim"
+	"github.com/getlantern/broflake/common"
+	"github.com/getlantern/broflake/egress"
+)
+
+const (
+	// e2eTimeout bounds the whole chain: NAT traversal, QUIC handshake and the proxied request
+	e2eTimeout = 60 * time.Second
+
+	widgetPeer  = 0
+	desktopPeer = 1
+)
+
+// e2eKey signs the token which the widget presents to the egress server
+var e2eKey = []byte("NELSON WUZ HERE NELSON WUZ HERE!")
+
+// startEgress starts an egress server on an ephemeral loopback port, which authenticates widgets
+// and forwards the streams it receives over QUIC exactly as egress/cmd does, and returns its
+// address for widgets which use transport
+func startEgress(t *testing.T, impairment *common.ImpairmentProfile, transport string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ll, err := egress.NewListenerWithOptions(context.Background(), l, "", "", &egress.ListenerOptions{
+		Impairment: impairment,
+		Auth:       &egress.TokenAuthenticator{Keys: [][]byte{e2eKey}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ll.Close() })
+
+	go egress.NewForwarder(nil).Serve(ll)
+
+	if transport != clientcore.EgressTransportQUIC && transport != clientcore.EgressTransportWebTransport {
+		return fmt.Sprintf("ws://%v", l.Addr())
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if transport == clientcore.EgressTransportQUIC {
+		go ll.ServeQUIC(conn)
+		return fmt.Sprintf("udp://%v", conn.LocalAddr())
+	}
+
+	go ll.ServeWebTransport(conn)
+	return fmt.Sprintf("https://%v", conn.LocalAddr())
+}
+
+// newQUICLayer dials egress over bfconn just as cmd does
+func newQUICLayer(t *testing.T, bfconn *clientcore.BroflakeConn, impairment *common.ImpairmentProfile) *clientcore.QUICLayer {
+	ql, err := clientcore.NewQUICLayer(
+		bfconn,
+		&clientcore.QUICLayerOptions{InsecureSkipVerify: true, Impairment: impairment},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go ql.DialAndMaintainQUICConnection()
+	t.Cleanup(ql.Close)
+	return ql
+}
+
+// startDesktopProxy wires a local HTTP proxy and a SOCKS5 proxy to ql just as cmd's runLocalProxy
+// does, serves them on ephemeral loopback ports, and returns their URLs
+func startDesktopProxy(t *testing.T, ql *clientcore.QUICLayer) []*url.URL {
+	proxy := clientcore.NewLocalProxy(ql, nil)
+	t.Cleanup(func() { proxy.Close() })
+
+	var urls []*url.URL
+	for _, scheme := range []string{"http", "socks5"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if scheme == "http" {
+			go proxy.ServeHTTPProxy(l)
+		} else {
+			go proxy.ServeSOCKS5(l)
+		}
+
+		urls = append(urls, &url.URL{Scheme: scheme, Host: l.Addr().String()})
+	}
+
+	return urls
+}
+
+func newClient(t *testing.T, clientType string, n *sim.Network, peer int, freddie, egressAddr, transport string) (*clientcore.BroflakeConn, *clientcore.UIImpl) {
+	bfOpt := clientcore.NewDefaultBroflakeOptions()
+	bfOpt.ClientType = clientType
+	bfOpt.CTableSize = 2
+	bfOpt.PTableSize = 2
+
+	rtcOpt := clientcore.NewDefaultWebRTCOptions()
+	rtcOpt.DiscoverySrv = freddie
+	rtcOpt.STUNBatch = n.STUNBatch
+	rtcOpt.API = n.API(peer)
+
+	egOpt := clientcore.NewDefaultEgressOptions()
+	egOpt.Addr = egressAddr
+	egOpt.Token = common.SignToken(e2eKey, clientType, time.Now().Add(e2eTimeout))
+	egOpt.ErrorBackoff = 500 * time.Millisecond
+	egOpt.Transport = transport
+	if transport == clientcore.EgressTransportWebTransport {
+		egOpt.Endpoint = "/wt"
+		egOpt.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	bfconn, ui, err := clientcore.NewBroflake(bfOpt, rtcOpt, egOpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ui.Stop)
+
+	return bfconn, ui
+}
+
+// fetchThroughChain runs the full chain, with the widget relaying to the egress server over
+// transport, and the path between the desktop client and the egress server subject to impairment
+// in both directions, and fetches a test origin through it
+func fetchThroughChain(t *testing.T, impairment *common.ImpairmentProfile, transport string) {
+	const body = "NELSON WUZ HERE"
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(origin.Close)
+
+	n, err := sim.NewNetwork(sim.NATEasy, sim.NATEasy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.Close() })
+
+	sig, err := sim.NewSignaling(context.Background(), 2*time.Second, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sig.Close() })
+
+	egressAddr := startEgress(t, impairment, transport)
+	newClient(t, "widget", n, widgetPeer, sig.URL, egressAddr, transport)
+	bfconn, ui := newClient(t, "desktop", n, desktopPeer, sig.URL, "", "")
+
+	// Until the desktop has found a widget and dialed egress over QUIC, requests will fail
+	deadline := time.Now().Add(e2eTimeout)
+
+	ql := newQUICLayer(t, bfconn, impairment)
+	for _, proxyURL := range startDesktopProxy(t, ql) {
+		fetchThroughProxy(t, proxyURL, origin.URL, body, deadline)
+
+		if q := ui.BroflakeEngine.Stats().QUIC; q == nil || !q.Connected {
+			t.Fatalf("got QUIC stats %+v after a successful fetch, expected a connection", q)
+		}
+	}
+
+	echoThroughChain(t, ql, deadline)
+}
+
+// echoThroughChain sends datagrams to a UDP echo server via CONNECT-UDP, retrying until deadline,
+// since datagrams may be lost on the way there or back
+func echoThroughChain(t *testing.T, ql *clientcore.QUICLayer, deadline time.Time) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+
+	go func() {
+		b := make([]byte, 2048)
+		for {
+			n, addr, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(b[:n], addr)
+		}
+	}()
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	conn, err := ql.DialUDP(ctx, echo.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("can't open a UDP flow through the Broflake chain: %v", err)
+	}
+	defer conn.Close()
+
+	b := make([]byte, 2048)
+	for i := 0; ; i++ {
+		msg := fmt.Sprintf("NELSON WUZ HERE %v", i)
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				break
+			}
+
+			// A reply to an earlier datagram may arrive late, which is fine
+			if strings.HasPrefix(string(b[:n]), "NELSON WUZ HERE ") {
+				return
+			}
+			t.Fatalf("UDP echo server returned %q", b[:n])
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("timed out echoing UDP through the Broflake chain")
+		}
+	}
+}
+
+// fetchThroughProxy fetches originURL through the proxy at proxyURL, retrying until deadline, and
+// checks that it returns body
+func fetchThroughProxy(t *testing.T, proxyURL *url.URL, originURL, body string, deadline time.Time) {
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	t.Cleanup(tr.CloseIdleConnections)
+	client := &http.Client{Transport: tr, Timeout: 10 * time.Second}
+
+	for {
+		res, err := client.Get(originURL)
+		if err == nil {
+			b, err := io.ReadAll(res.Body)
+			res.Body.Close()
+
+			if err == nil && res.StatusCode == http.StatusOK {
+				if string(b) != body {
+					t.Fatalf("origin returned %q, expected %q", b, body)
+				}
+				return
+			}
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out fetching %v through the Broflake chain via %v (last error: %v)", originURL, proxyURL.Scheme, err)
+		}
+
+		<-time.After(500 * time.Millisecond)
+	}
+}
+
+func TestE2E(t *testing.T) {
+	fetchThroughChain(t, nil, clientcore.EgressTransportWebSocket)
+}
+
+func TestE2ENativeQUIC(t *testing.T) {
+	fetchThroughChain(t, nil, clientcore.EgressTransportQUIC)
+}
+
+func TestE2EWebTransport(t *testing.T) {
+	fetchThroughChain(t, nil, clientcore.EgressTransportWebTransport)
+}
+
+// TestE2EImpaired checks that QUIC, with the idle timeout and keepalive in common.QUICCfg, holds
+// up over a Broflake path which looks like a poor censored network
+func TestE2EImpaired(t *testing.T) {
+	impairment, err := common.LoadImpairmentProfile("testdata/censored.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetchThroughChain(t, impairment, clientcore.EgressTransportWebSocket)
+}
@@ -0,0 +1,123 @@
+package egress
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// otherTag labels the metrics of a widget which reported a tag we weren't configured with
+const otherTag = "other"
+
+// The transports which widgets carry QUIC to us over, as we label their traffic
+const (
+	transportWebSocket    = "websocket"
+	transportQUIC         = "quic"
+	transportWebTransport = "webtransport"
+)
+
+// connStats accounts for a widget's connection. Its metrics are labeled with its transport, and the
+// tag and client version which the widget reported in its handshake.
+type connStats struct {
+	start     time.Time
+	ingress   atomic.Uint64 // Bytes received from the widget
+	egress    atomic.Uint64 // Bytes sent to the widget
+	quicConns atomic.Uint64
+	streams   atomic.Uint64
+	attrs     metric.MeasurementOption
+	m         *instruments
+}
+
+func newConnStats(r *http.Request, transport string, labels *labelAllowlist, m *instruments) *connStats {
+	s := &connStats{start: time.Now(), attrs: metric.WithAttributeSet(widgetLabels(r, transport, labels)), m: m}
+	m.widgets.Add(context.Background(), 1, s.attrs)
+	return s
+}
+
+// labelAllowlist holds the tags and client versions which we label widgets' metrics with. A nil
+// *labelAllowlist allows none.
+type labelAllowlist struct {
+	tags     map[string]bool
+	versions map[string]bool
+}
+
+func newLabelAllowlist(tags, versions []string) *labelAllowlist {
+	a := &labelAllowlist{tags: make(map[string]bool), versions: make(map[string]bool)}
+	for _, tag := range tags {
+		a.tags[tag] = true
+	}
+	for _, v := range versions {
+		a.versions[v] = true
+	}
+
+	return a
+}
+
+// bound returns v if it's in allowed, otherTag if it isn't, or "" if v is empty
+func bound(v string, allowed map[string]bool) string {
+	if v != "" && !allowed[v] {
+		return otherTag
+	}
+
+	return v
+}
+
+// widgetLabels returns a widget's transport, and the tag and client version which it reported in
+// its handshake. Browsers can't set headers on WebSockets or WebTransport sessions, so widgets send
+// them in query parameters. Widgets are free to report anything, so to bound our metric series, a
+// tag or version which labels doesn't allow is labeled otherTag.
+func widgetLabels(r *http.Request, transport string, labels *labelAllowlist) attribute.Set {
+	if labels == nil {
+		labels = &labelAllowlist{}
+	}
+
+	q := r.URL.Query()
+	return attribute.NewSet(
+		attribute.String("transport", transport),
+		attribute.String("tag", bound(q.Get("tag"), labels.tags)),
+		attribute.String("version", bound(q.Get("clientVersion"), labels.versions)),
+	)
+}
+
+func (s *connStats) addIngress(n int) {
+	s.ingress.Add(uint64(n))
+	s.m.ingressBytes.Add(context.Background(), int64(n), s.attrs)
+}
+
+func (s *connStats) addEgress(n int) {
+	s.egress.Add(uint64(n))
+	s.m.egressBytes.Add(context.Background(), int64(n), s.attrs)
+}
+
+func (s *connStats) addQUICConn() {
+	s.quicConns.Add(1)
+}
+
+func (s *connStats) addStream() {
+	s.streams.Add(1)
+	s.m.quicStreamsTotal.Add(context.Background(), 1, s.attrs)
+}
+
+// closeQUICConn records the number of streams a widget opened over one of its QUIC connections
+func (s *connStats) closeQUICConn(streams uint64) {
+	s.m.quicConnStreams.Record(context.Background(), int64(streams), s.attrs)
+}
+
+// close records the connection's duration, and returns a summary of it for logging
+func (s *connStats) close() []any {
+	d := time.Since(s.start)
+	s.m.widgets.Add(context.Background(), -1, s.attrs)
+	s.m.connDuration.Record(context.Background(), d.Seconds(), s.attrs)
+
+	return []any{
+		"ingressBytes", s.ingress.Load(),
+		"egressBytes", s.egress.Load(),
+		"quicConns", s.quicConns.Load(),
+		"streams", s.streams.Load(),
+		"duration", d.Round(time.Millisecond),
+	}
+}
@@ -0,0 +1,132 @@
+package egress
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// testInstruments returns instruments which report to reader, if it's non-nil
+func testInstruments(t testing.TB, reader sdkmetric.Reader) *instruments {
+	var opts []sdkmetric.Option
+	if reader != nil {
+		opts = append(opts, sdkmetric.WithReader(reader))
+	}
+
+	m, err := newInstruments(sdkmetric.NewMeterProvider(opts...).Meter("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestWidgetLabels(t *testing.T) {
+	labels := newLabelAllowlist([]string{"partner"}, []string{"7.6.1"})
+
+	for _, tc := range []struct {
+		tag, version         string
+		wantTag, wantVersion string
+	}{
+		{"partner", "7.6.1", "partner", "7.6.1"},
+		{strings.Repeat("x", 100), "7.6.1-" + strings.Repeat("x", 100), otherTag, otherTag},
+		{"", "", "", ""},
+	} {
+		q := url.Values{"tag": {tc.tag}, "version": {common.Version}, "clientVersion": {tc.version}}
+		r := httptest.NewRequest("GET", "/ws?"+q.Encode(), nil)
+		set := widgetLabels(r, transportWebSocket, labels)
+
+		if tag, _ := set.Value("tag"); tag.AsString() != tc.wantTag {
+			t.Errorf("tag %q: got %q, expected %q", tc.tag, tag.AsString(), tc.wantTag)
+		}
+
+		if v, _ := set.Value("version"); v.AsString() != tc.wantVersion {
+			t.Errorf("version %q: got %q, expected %q", tc.version, v.AsString(), tc.wantVersion)
+		}
+	}
+}
+
+func TestConnAccounting(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	m := testInstruments(t, reader)
+
+	// Echo each packet back to the widget
+	stats := make(chan *connStats, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		q := websocketPacketConn{w: c, log: logger, stats: newConnStats(r, transportWebSocket, newLabelAllowlist([]string{"partner-1"}, nil), m), m: m}
+		stats <- q.stats
+
+		b := make([]byte, 1500)
+		for {
+			n, _, err := q.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			q.WriteTo(b[:n], nil)
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	u := "ws" + strings.TrimPrefix(srv.URL, "http") + "?" + url.Values{"tag": {"partner-1"}, "version": {common.Version}}.Encode()
+	c, _, err := websocket.Dial(ctx, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.CloseNow()
+
+	msg := bytes.Repeat([]byte("x"), 100)
+	for i := 0; i < 3; i++ {
+		c.Write(ctx, websocket.MessageBinary, msg)
+		if _, b, err := c.Read(ctx); err != nil || !bytes.Equal(b, msg) {
+			t.Fatalf("echo failed: %v", err)
+		}
+	}
+
+	s := <-stats
+	if s.ingress.Load() != 300 || s.egress.Load() != 300 {
+		t.Errorf("counted %v bytes in and %v out, expected 300 each way", s.ingress.Load(), s.egress.Load())
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(ctx, &rm); err != nil {
+		t.Fatal(err)
+	}
+
+	totals := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			sum, ok := m.Data.(metricdata.Sum[int64])
+			if !ok || !sum.IsMonotonic {
+				continue
+			}
+
+			for _, dp := range sum.DataPoints {
+				if tag, _ := dp.Attributes.Value("tag"); tag.AsString() == "partner-1" {
+					totals[m.Name] += dp.Value
+				}
+			}
+		}
+	}
+
+	if totals["ingress-bytes"] != 300 || totals["egress-bytes"] != 300 {
+		t.Errorf("exported %v, expected 300 bytes each way labeled with our tag", totals)
+	}
+}
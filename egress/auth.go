@@ -0,0 +1,109 @@
+package egress
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/semver"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// ErrNoToken is returned by a TokenAuthenticator when a widget doesn't present a token
+var ErrNoToken = errors.New("no token")
+
+// Authenticator decides whether a widget may connect to us, given its WebSocket handshake request.
+// It returns the widget's identity, which may be empty if the widget is anonymous. A native widget's
+// hello is presented as a request with its parameters in the query, and only a TokenAuthenticator
+// can check its answer to the nonce we challenged it with.
+type Authenticator interface {
+	Authenticate(r *http.Request) (identity string, err error)
+}
+
+// AuthenticatorFunc is a func which is an Authenticator
+type AuthenticatorFunc func(r *http.Request) (string, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (string, error) {
+	return f(r)
+}
+
+// TokenAuthenticator accepts widgets which present an unexpired token signed with any of Keys (see
+// common.SignToken). More than one key lets us rotate them. Widgets may present their token in a
+// subprotocol made by common.TokenSubprotocol, or in the "token" query parameter. Native widgets,
+// whose hellos travel in the clear, instead answer the nonce we challenged them with (see
+// common.TokenProof). A widget's identity is its token's subject.
+type TokenAuthenticator struct {
+	Keys [][]byte
+}
+
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (string, error) {
+	nonce, challenged := challengeFrom(r.Context())
+	token, _ := widgetToken(r)
+	if token == "" && !challenged {
+		return "", ErrNoToken
+	}
+
+	q := r.URL.Query()
+	now := time.Now()
+
+	var err error
+	for _, key := range a.Keys {
+		var subject string
+		if challenged {
+			subject, err = common.VerifyTokenProof(key, q.Get("claims"), nonce, q.Get("proof"), now)
+		} else {
+			subject, err = common.VerifyToken(key, token, now)
+		}
+		if err == nil {
+			return subject, nil
+		}
+	}
+
+	return "", err
+}
+
+type challengeKey struct{}
+
+// withChallenge returns a copy of ctx for a widget which must answer nonce, which we challenged it
+// with, rather than present its token
+func withChallenge(ctx context.Context, nonce string) context.Context {
+	return context.WithValue(ctx, challengeKey{}, nonce)
+}
+
+// challengeFrom returns the nonce a widget must answer, and false if it must present its token
+func challengeFrom(ctx context.Context) (string, bool) {
+	nonce, ok := ctx.Value(challengeKey{}).(string)
+	return nonce, ok
+}
+
+// widgetToken returns the token presented in r, and the subprotocol which presented it, if one did
+func widgetToken(r *http.Request) (token, subprotocol string) {
+	for _, h := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(h, ",") {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, common.TokenSubprotocolPrefix) {
+				return strings.TrimPrefix(p, common.TokenSubprotocolPrefix), p
+			}
+		}
+	}
+
+	return r.URL.Query().Get("token"), ""
+}
+
+// Validate the Broflake protocol version, just as Freddie does. Browsers can't set headers on
+// WebSockets, so widgets may send the version in the "version" query parameter instead.
+func isValidProtocolVersion(r *http.Request) bool {
+	return semver.Major(widgetVersion(r)) == semver.Major(common.Version)
+}
+
+// widgetVersion returns the Broflake protocol version which a widget reported in its handshake
+func widgetVersion(r *http.Request) string {
+	if v := r.Header.Get(common.VersionHeader); v != "" {
+		return v
+	}
+
+	return r.URL.Query().Get("version")
+}
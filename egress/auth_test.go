@@ -0,0 +1,105 @@
+package egress
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// startListener serves a Listener on loopback, returning it and the URL of its WebSocket endpoint
+func startListener(t *testing.T, opt *ListenerOptions) (*Listener, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ll, err := NewListenerWithOptions(context.Background(), l, "", "", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ll.Close() })
+
+	return ll, "ws://" + l.Addr().String() + "/ws"
+}
+
+func TestListenerAuth(t *testing.T) {
+	key := []byte("NELSON WUZ HERE NELSON WUZ HERE!")
+	token := common.SignToken(key, "widget-1", time.Now().Add(time.Minute))
+	expired := common.SignToken(key, "widget-1", time.Now().Add(-time.Minute))
+
+	_, ws := startListener(t, &ListenerOptions{
+		Auth:           &TokenAuthenticator{Keys: [][]byte{[]byte("an old key which we're rotating out"), key}},
+		AllowedOrigins: []string{"widget.example.com"},
+	})
+
+	withQuery := func(q url.Values) string {
+		return ws + "?" + q.Encode()
+	}
+
+	tests := []struct {
+		name   string
+		url    string
+		opt    *websocket.DialOptions
+		status int
+	}{
+		{"no version", ws, &websocket.DialOptions{Subprotocols: []string{common.TokenSubprotocol(token)}}, http.StatusTeapot},
+		{"old version", withQuery(url.Values{"version": {"v999.0.0"}}), nil, http.StatusTeapot},
+		{"no token", withQuery(url.Values{"version": {common.Version}}), nil, http.StatusUnauthorized},
+		{"expired token", withQuery(url.Values{"version": {common.Version}, "token": {expired}}), nil, http.StatusUnauthorized},
+		{"bad token", withQuery(url.Values{"version": {common.Version}, "token": {token + "x"}}), nil, http.StatusUnauthorized},
+		{"token in query", withQuery(url.Values{"version": {common.Version}, "token": {token}}), nil, http.StatusSwitchingProtocols},
+		{
+			"token in subprotocol",
+			ws,
+			&websocket.DialOptions{
+				HTTPHeader:   http.Header{common.VersionHeader: {common.Version}},
+				Subprotocols: []string{common.TokenSubprotocol(token)},
+			},
+			http.StatusSwitchingProtocols,
+		},
+		{
+			"allowed origin",
+			withQuery(url.Values{"version": {common.Version}, "token": {token}}),
+			&websocket.DialOptions{HTTPHeader: http.Header{"Origin": {"https://widget.example.com"}}},
+			http.StatusSwitchingProtocols,
+		},
+		{
+			"forbidden origin",
+			withQuery(url.Values{"version": {common.Version}, "token": {token}}),
+			&websocket.DialOptions{HTTPHeader: http.Header{"Origin": {"https://evil.example.com"}}},
+			http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		c, res, err := websocket.Dial(ctx, tt.url, tt.opt)
+		cancel()
+
+		if res == nil {
+			t.Errorf("%v: no response (err: %v)", tt.name, err)
+			continue
+		}
+
+		if res.StatusCode != tt.status {
+			t.Errorf("%v: got %v, expected %v (err: %v)", tt.name, res.StatusCode, tt.status, err)
+		}
+
+		if c == nil {
+			continue
+		}
+
+		// Browsers require us to accept the subprotocol which carried the token
+		if tt.opt != nil && len(tt.opt.Subprotocols) > 0 && c.Subprotocol() != tt.opt.Subprotocols[0] {
+			t.Errorf("%v: negotiated subprotocol %q", tt.name, c.Subprotocol())
+		}
+		c.Close(websocket.StatusNormalClosure, "")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/getlantern/broflake/config"
+	"github.com/getlantern/broflake/egress"
+)
+
+type egressConfig struct {
+	Port             int             `json:"port" env:"PORT"`
+	QUICPort         int             `json:"quicPort" env:"QUIC_PORT"`                 // UDP port for native widgets' QUIC; 0 to disable
+	WebTransportPort int             `json:"webTransportPort" env:"WEBTRANSPORT_PORT"` // UDP port for browsers' WebTransport; 0 to disable
+	TLS              config.TLS      `json:"tls"`
+	DialTimeout      config.Duration `json:"dialTimeout" env:"DIAL_TIMEOUT"`
+	IdleTimeout      config.Duration `json:"idleTimeout" env:"IDLE_TIMEOUT"`   // Drop widgets which send nothing for this long
+	DrainTimeout     config.Duration `json:"drainTimeout" env:"DRAIN_TIMEOUT"` // On SIGTERM, how long to let open streams finish
+	Policy           policyConfig    `json:"policy"`
+	Auth             authConfig      `json:"auth"`
+	Limits           limitsConfig    `json:"limits"`
+	Impair           string          `json:"impair" env:"IMPAIR"`                  // Path to an impairment profile; see common/impair.go
+	Tags             []string        `json:"tags" env:"TAGS"`                      // Tags to label widgets' metrics with; any other tag is labeled "other"
+	ClientVersions   []string        `json:"clientVersions" env:"CLIENT_VERSIONS"` // Likewise for the app versions widgets report
+	Log              config.Log      `json:"log"`
+}
+
+// policyConfig configures the destinations widgets may reach through us. We always deny
+// egress.DefaultDenyCIDRs, unless they're allowed here.
+type policyConfig struct {
+	DenyCIDRs  []string `json:"denyCIDRs" env:"POLICY_DENY_CIDRS"`   // IPs or CIDRs to deny, besides the defaults
+	AllowCIDRs []string `json:"allowCIDRs" env:"POLICY_ALLOW_CIDRS"` // IPs or CIDRs to allow, despite the above
+	AllowPorts []string `json:"allowPorts" env:"POLICY_ALLOW_PORTS"` // Ports or ranges like "8000-8999"; if empty, allow all
+	DenyPorts  []string `json:"denyPorts" env:"POLICY_DENY_PORTS"`   // Ports or ranges to deny
+}
+
+// authConfig configures which widgets may connect to us
+type authConfig struct {
+	Keys           []string `json:"keys" env:"AUTH_KEYS" secret:"true"`        // Secrets which widget tokens may be signed with; if empty, any widget may connect
+	AllowedOrigins []string `json:"allowedOrigins" env:"AUTH_ALLOWED_ORIGINS"` // Origin patterns like "*.example.com"; if empty, any
+}
+
+// limitsConfig configures the bandwidth widgets may use, counting bytes in both directions. A
+// widget's identity is its token's subject, or its IP address if we don't require tokens. Zero
+// means unlimited.
+type limitsConfig struct {
+	ConnRate      int64           `json:"connRate" env:"LIMIT_CONN_RATE"`           // Bytes per second on each WebSocket
+	IdentityRate  int64           `json:"identityRate" env:"LIMIT_IDENTITY_RATE"`   // Bytes per second across each identity's WebSockets
+	ConnQuota     int64           `json:"connQuota" env:"LIMIT_CONN_QUOTA"`         // Bytes per quota window on each WebSocket
+	IdentityQuota int64           `json:"identityQuota" env:"LIMIT_IDENTITY_QUOTA"` // Bytes per quota window across each identity's WebSockets
+	QuotaWindow   config.Duration `json:"quotaWindow" env:"LIMIT_QUOTA_WINDOW"`
+}
+
+func (c limitsConfig) validate() error {
+	var errs []error
+	for field, n := range map[string]int64{
+		"limits.connRate":      c.ConnRate,
+		"limits.identityRate":  c.IdentityRate,
+		"limits.connQuota":     c.ConnQuota,
+		"limits.identityQuota": c.IdentityQuota,
+	} {
+		if n < 0 {
+			errs = append(errs, fmt.Errorf("%v: must not be negative, not %v", field, n))
+		}
+	}
+
+	return errors.Join(append(errs, config.Positive("limits.quotaWindow", c.QuotaWindow))...)
+}
+
+// limits returns the egress.Limits which c describes, or nil if c is unlimited
+func (c limitsConfig) limits() *egress.Limits {
+	if c.ConnRate == 0 && c.IdentityRate == 0 && c.ConnQuota == 0 && c.IdentityQuota == 0 {
+		return nil
+	}
+
+	return &egress.Limits{
+		ConnRate:      c.ConnRate,
+		IdentityRate:  c.IdentityRate,
+		ConnQuota:     c.ConnQuota,
+		IdentityQuota: c.IdentityQuota,
+		QuotaWindow:   time.Duration(c.QuotaWindow),
+	}
+}
+
+// minAuthKeyLen is the shortest secret we accept for signing tokens
+const minAuthKeyLen = 32
+
+func (c authConfig) validate() error {
+	for i, k := range c.Keys {
+		if len(k) < minAuthKeyLen {
+			return fmt.Errorf("auth.keys[%v]: must be at least %v bytes", i, minAuthKeyLen)
+		}
+	}
+
+	return nil
+}
+
+// listenerOptions returns the egress.ListenerOptions which c describes
+func (c authConfig) listenerOptions() *egress.ListenerOptions {
+	opt := &egress.ListenerOptions{AllowedOrigins: c.AllowedOrigins}
+
+	if len(c.Keys) > 0 {
+		auth := &egress.TokenAuthenticator{}
+		for _, k := range c.Keys {
+			auth.Keys = append(auth.Keys, []byte(k))
+		}
+		opt.Auth = auth
+	}
+
+	return opt
+}
+
+func defaultConfig() *egressConfig {
+	return &egressConfig{
+		Port:         8000,
+		DialTimeout:  config.Duration(egress.DefaultDialTimeout),
+		IdleTimeout:  config.Duration(egress.DefaultIdleTimeout),
+		DrainTimeout: config.Duration(30 * time.Second),
+		Limits:       limitsConfig{QuotaWindow: config.Duration(time.Hour)},
+		Log:          config.DefaultLog(),
+	}
+}
+
+func (c *egressConfig) Validate() error {
+	_, policyErr := c.Policy.policy()
+
+	return errors.Join(
+		config.Port("port", c.Port, false),
+		config.Port("quicPort", c.QUICPort, true),
+		config.Port("webTransportPort", c.WebTransportPort, true),
+		c.validateUDPPorts(),
+		c.TLS.Validate(),
+		config.Positive("dialTimeout", c.DialTimeout),
+		config.Positive("idleTimeout", c.IdleTimeout),
+		config.Positive("drainTimeout", c.DrainTimeout),
+		policyErr,
+		c.Auth.validate(),
+		c.Limits.validate(),
+		config.File("impair", c.Impair),
+		c.Log.Validate(),
+	)
+}
+
+// validateUDPPorts checks that native QUIC and WebTransport, which each need a UDP socket of their
+// own, aren't configured to share one
+func (c *egressConfig) validateUDPPorts() error {
+	if c.QUICPort != 0 && c.QUICPort == c.WebTransportPort {
+		return fmt.Errorf("webTransportPort: must differ from quicPort, not %v", c.WebTransportPort)
+	}
+
+	return nil
+}
+
+// policy returns the egress.Policy which c describes
+func (c policyConfig) policy() (*egress.Policy, error) {
+	p := egress.DefaultPolicy()
+	var errs []error
+
+	for _, list := range []struct {
+		field string
+		items []string
+		dst   *[]netip.Prefix
+	}{
+		{"policy.denyCIDRs", c.DenyCIDRs, &p.DenyCIDRs},
+		{"policy.allowCIDRs", c.AllowCIDRs, &p.AllowCIDRs},
+	} {
+		for _, s := range list.items {
+			prefix, err := parsePrefix(s)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%v: %v", list.field, err))
+				continue
+			}
+			*list.dst = append(*list.dst, prefix)
+		}
+	}
+
+	for _, list := range []struct {
+		field string
+		items []string
+		dst   *[]egress.PortRange
+	}{
+		{"policy.allowPorts", c.AllowPorts, &p.AllowPorts},
+		{"policy.denyPorts", c.DenyPorts, &p.DenyPorts},
+	} {
+		for _, s := range list.items {
+			r, err := egress.ParsePortRange(s)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%v: %v", list.field, err))
+				continue
+			}
+			*list.dst = append(*list.dst, r)
+		}
+	}
+
+	return p, errors.Join(errs...)
+}
+
+// parsePrefix parses an IP address or a CIDR prefix
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid CIDR '%v'", s)
+		}
+		return p.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP address '%v'", s)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -2,29 +2,33 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
-	"net/http"
 	"os"
-
-	"github.com/elazarl/goproxy"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/getlantern/broflake/common"
+	"github.com/getlantern/broflake/config"
 	"github.com/getlantern/broflake/egress"
 )
 
+var logger = common.NewLogger("component", "egress")
+
 func main() {
 	ctx := context.Background()
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8000"
-	}
 
-	certFile := os.Getenv("TLS_CERT")
-	keyFile := os.Getenv("TLS_KEY")
+	cfg := defaultConfig()
+	config.Init("egress", cfg)
+
+	if err := cfg.Log.Apply(); err != nil {
+		panic(err)
+	}
 
-	l, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
+	l, err := net.Listen("tcp", fmt.Sprintf(":%v", cfg.Port))
 	if err != nil {
 		panic(err)
 	}
@@ -34,52 +38,103 @@ func main() {
 
 	// XXX: in the process of delivering the cert and key to egress.NewListener, we suboptimally
 	// cast back and forth between []string and []byte... it's just a byproduct of the API
-	if certFile != "" && keyFile != "" {
-		cert, err := ioutil.ReadFile(certFile)
+	if cfg.TLS.Enabled() {
+		cert, err := ioutil.ReadFile(cfg.TLS.Cert)
 		if err != nil {
 			panic(err)
 		}
 		tlsCert = string(cert)
 
-		key, err := ioutil.ReadFile(keyFile)
+		key, err := ioutil.ReadFile(cfg.TLS.Key)
 		if err != nil {
 			panic(err)
 		}
 		tlsKey = string(key)
 	}
 
-	ll, err := egress.NewListener(ctx, l, tlsCert, tlsKey)
+	var impairment *common.ImpairmentProfile
+
+	if cfg.Impair != "" {
+		impairment, err = common.LoadImpairmentProfile(cfg.Impair)
+		if err != nil {
+			panic(err)
+		}
+		logger.Warn("!!! WARNING !!! Impairing all widget connections", "profile", fmt.Sprintf("%+v", *impairment))
+	}
+
+	lopt := cfg.Auth.listenerOptions()
+	lopt.Impairment = impairment
+	lopt.Limits = cfg.Limits.limits()
+	lopt.IdleTimeout = time.Duration(cfg.IdleTimeout)
+	lopt.Tags = cfg.Tags
+	lopt.ClientVersions = cfg.ClientVersions
+	if lopt.Auth == nil {
+		logger.Warn("!!! WARNING !!! No auth keys configured, any widget may connect")
+	}
+
+	ll, err := egress.NewListenerWithOptions(ctx, l, tlsCert, tlsKey, lopt)
 	if err != nil {
 		panic(err)
 	}
-	defer ll.Close()
-
-	// Instantiate our local HTTP CONNECT proxy
-	proxy := goproxy.NewProxyHttpServer()
-	proxy.Verbose = true
-	common.Debugf("Starting HTTP CONNECT proxy...")
-
-	proxy.OnRequest().DoFunc(
-		func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-			common.Debug("HTTP proxy just saw a request:")
-			// TODO: overriding the context is a hack to prevent "context canceled" errors when proxying
-			// HTTP (not HTTPS) requests. It's not yet clear why this is necessary -- it may be a quirk
-			// of elazarl/goproxy. See: https://github.com/getlantern/broflake/issues/47
-			r = r.WithContext(context.Background())
-			common.Debug(r)
-			return r, nil
-		},
-	)
-
-	proxy.OnResponse().DoFunc(
-		func(r *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
-			// TODO: log something interesting?
-			return r
-		},
-	)
-
-	err = http.Serve(ll, proxy)
-	if err != nil {
+
+	// Native widgets and browsers' WebTransport sessions reach us over UDP, if we're asked to listen
+	for _, ingress := range []struct {
+		name  string
+		port  int
+		serve func(net.PacketConn) error
+	}{
+		{"native QUIC", cfg.QUICPort, ll.ServeQUIC},
+		{"WebTransport", cfg.WebTransportPort, ll.ServeWebTransport},
+	} {
+		if ingress.port == 0 {
+			continue
+		}
+
+		conn, err := net.ListenPacket("udp", fmt.Sprintf(":%v", ingress.port))
+		if err != nil {
+			panic(err)
+		}
+
+		go func() {
+			if err := ingress.serve(conn); !errors.Is(err, net.ErrClosed) {
+				logger.Error("stopped serving "+ingress.name, "err", err)
+				ll.Close()
+			}
+		}()
+	}
+
+	policy, _ := cfg.Policy.policy()
+	fwd := egress.NewForwarder(&egress.ForwarderOptions{
+		DialTimeout: time.Duration(cfg.DialTimeout),
+		Policy:      policy,
+	})
+	logger.Info("forwarding streams", "denyCIDRs", len(policy.DenyCIDRs), "allowCIDRs", len(policy.AllowCIDRs))
+
+	// On SIGTERM, drain: Serve returns once we've closed ll, and we exit once the drain is done
+	sig, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-sig.Done()
+
+		logger.Info("shutting down", "drainTimeout", time.Duration(cfg.DrainTimeout))
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.DrainTimeout))
+		defer cancel()
+
+		if err := ll.Shutdown(ctx); err != nil {
+			logger.Warn("couldn't drain cleanly", "err", err)
+		}
+	}()
+
+	err = fwd.Serve(ll)
+	if !errors.Is(err, net.ErrClosed) {
 		panic(err)
 	}
+
+	// If ll closed by itself, there's nothing left to drain
+	stop()
+	<-drained
+	logger.Info("shut down")
 }
@@ -7,10 +7,12 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/big"
 	"net"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -19,15 +21,13 @@ import (
 	"github.com/quic-go/quic-go"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 
 	"github.com/getlantern/broflake/common"
 	"github.com/getlantern/telemetry"
 )
 
-// TODO: rate limiters and fancy settings and such:
-// https://github.com/nhooyr/websocket/blob/master/examples/echo/server.go
-
 const (
 	websocketKeepalive = 15 * time.Second
 )
@@ -39,95 +39,351 @@ var nClients uint64
 // nQUICStreams is the number of open QUIC streams (not to be confused with QUIC connections)
 var nQUICStreams uint64
 
-// nIngressBytes is the number of bytes received over all WebSocket connections since the last otel measurement callback
-var nIngressBytes uint64
-
-// Otel instruments
-var nClientsCounter metric.Int64UpDownCounter
+// instruments are a Listener's otel instruments. Each Listener has its own, since each has its own
+// meter provider.
+type instruments struct {
+	clients metric.Int64UpDownCounter
+	widgets metric.Int64UpDownCounter // Over any transport, labeled by it
+
+	// TODO: weirdly, we report the number of open QUIC conections to otel but we don't maintain an atomic value to log it?
+	quicConnections  metric.Int64UpDownCounter
+	quicStreams      metric.Int64UpDownCounter
+	rejectedWidgets  metric.Int64Counter
+	quotaExceeded    metric.Int64Counter
+	reapedWebsockets metric.Int64Counter
+	ingressBytes     metric.Int64Counter
+	egressBytes      metric.Int64Counter
+	quicStreamsTotal metric.Int64Counter
+	quicConnStreams  metric.Int64Histogram
+	connDuration     metric.Float64Histogram // Of widgets' connections over any transport
+}
 
-// TODO: weirdly, we report the number of open QUIC conections to otel but we don't maintain an atomic value to log it?
-var nQUICConnectionsCounter metric.Int64UpDownCounter
-var nQUICStreamsCounter metric.Int64UpDownCounter
-var nIngressBytesCounter metric.Int64ObservableUpDownCounter
+var logger = common.NewLogger("component", "egress")
 
 // webSocketPacketConn wraps a websocket.Conn as a net.PacketConn
 type websocketPacketConn struct {
 	net.PacketConn
 	w         *websocket.Conn
 	addr      net.Addr
-	keepalive time.Duration
+	keepalive *keepalive
 	tcpAddr   *net.TCPAddr
+	log       common.Logger
+	limit     *connLimit
+	stats     *connStats
+	m         *instruments
+	exceeded  atomic.Bool // Set once we've closed the connection for exceeding a quota
 }
 
-func (q websocketPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	// TODO: The channel and goroutine we fire off here are used to implement serverside keepalive.
-	// For as long as we're reading from this WebSocket, if we haven't received any readable data for
-	// a while, we send a ping. Keepalive is only desirable to prevent lots of disconnections
-	// and reconnections on idle WebSockets, and so it's worth asking whether the cycles added by this
-	// keepalive logic are worth the overhead we're saving in reduced discon/recon loops. Ultimately,
-	// we'd rather implement keepalive on the client side, but that's a much bigger lift. See:
-	// https://github.com/getlantern/broflake/issues/127
-	readDone := make(chan struct{})
-
-	go func() {
-		for {
-			select {
-			case <-time.After(q.keepalive):
-				common.Debugf("%v PING", q.addr)
-				q.w.Ping(context.Background())
-			case <-readDone:
-				return
-			}
-		}
-	}()
+func (q *websocketPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	if q.exceeded.Load() {
+		return 0, nil, net.ErrClosed
+	}
 
 	_, b, err := q.w.Read(context.Background())
-	readDone <- struct{}{}
+	q.keepalive.activity()
 	copy(p, b)
-	atomic.AddUint64(&nIngressBytes, uint64(len(b)))
+	q.stats.addIngress(len(b))
+
+	if err == nil {
+		if err = q.limit.use(len(b)); err != nil {
+			return 0, nil, q.limited(err)
+		}
+	}
+
 	return len(b), q.tcpAddr, err
 }
 
-func (q websocketPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+func (q *websocketPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if q.exceeded.Load() {
+		return 0, net.ErrClosed
+	}
+
+	if err := q.limit.use(len(p)); err != nil {
+		return 0, q.limited(err)
+	}
+
 	err = q.w.Write(context.Background(), websocket.MessageBinary, p)
+	if err == nil {
+		q.stats.addEgress(len(p))
+	}
+
 	return len(p), err
 }
 
-func (q websocketPacketConn) Close() error {
-	defer common.Debugf("Closed a WebSocket connection! (%v total)", atomic.AddUint64(&nClients, ^uint64(0)))
-	defer nClientsCounter.Add(context.Background(), -1)
+// limited handles an error from our connLimit, returning the error to report. The first time we
+// exceed a quota, we tell the widget why we're closing the connection, which is closed from then on.
+func (q *websocketPacketConn) limited(err error) error {
+	if !errors.Is(err, ErrQuotaExceeded) {
+		return err
+	}
+
+	if q.exceeded.Swap(true) {
+		return net.ErrClosed
+	}
+
+	q.log.Info("closing a WebSocket which exceeded its quota")
+	q.m.quotaExceeded.Add(context.Background(), 1)
+
+	// Close waits for the widget to acknowledge, which it can't do while we're blocking its reader
+	go q.w.Close(StatusQuotaExceeded, ErrQuotaExceeded.Error())
+	return err
+}
+
+func (q *websocketPacketConn) Close() error {
+	defer q.log.Debug("closed a WebSocket connection", append(q.stats.close(), "total", atomic.AddUint64(&nClients, ^uint64(0)))...)
+	defer q.m.clients.Add(context.Background(), -1)
+	q.limit.release()
+	q.keepalive.close()
 	return q.w.Close(websocket.StatusNormalClosure, "")
 }
 
-func (q websocketPacketConn) LocalAddr() net.Addr {
+func (q *websocketPacketConn) LocalAddr() net.Addr {
 	return q.addr
 }
 
-type proxyListener struct {
-	net.Listener
-	connections  chan net.Conn
-	tlsConfig    *tls.Config
-	addr         net.Addr
-	closeMetrics func(ctx context.Context) error
+// quicStream is a stream accepted from a widget's QUIC connection. Its datagrams are demultiplexed
+// by mux.
+type quicStream struct {
+	common.QUICStreamNetConn
+	mux  *common.DatagramMux
+	once sync.Once
 }
 
-func (l proxyListener) Accept() (net.Conn, error) {
-	conn := <-l.connections
-	return conn, nil
+// CloseWrite finishes our side of the stream
+func (s *quicStream) CloseWrite() error {
+	return s.Stream.Close()
 }
 
-func (l proxyListener) Addr() net.Addr {
+// Close both sides of the stream
+func (s *quicStream) Close() error {
+	var err error
+	s.once.Do(func() {
+		s.CancelRead(0)
+		err = s.QUICStreamNetConn.Close()
+	})
+
+	return err
+}
+
+// Listener accepts widgets' WebSockets, and the QUIC connections their clients make over them, and
+// yields the streams opened over those QUIC connections. Widgets may also relay QUIC to us over UDP
+// (see ServeQUIC) or WebTransport (see ServeWebTransport), whose streams Listener yields alongside.
+type Listener struct {
+	srv            *http.Server
+	connections    chan net.Conn
+	tlsConfig      *tls.Config
+	addr           net.Addr
+	closeMetrics   func(ctx context.Context) error
+	m              *instruments
+	impairment     *common.ImpairmentProfile
+	auth           Authenticator
+	allowedOrigins []string
+	limiter        *limiter
+	idleTimeout    time.Duration
+	labels         *labelAllowlist // The tags and client versions we label widgets' metrics with
+
+	mx        sync.Mutex
+	sessions  map[*session]struct{}
+	draining  atomic.Bool
+	streams   atomic.Int64 // Streams we've accepted which haven't been closed yet
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// drainPollInterval is how often Shutdown checks whether the streams in flight have finished
+const drainPollInterval = 50 * time.Millisecond
+
+// session is something we accept QUIC connections over, like a widget's WebSocket, and the QUIC
+// connections we've accepted over it. Native widgets share the UDP socket they relay QUIC to us
+// over, so they share its session.
+type session struct {
+	closeTransport func()
+	mx             sync.Mutex
+	conns          map[quic.Connection]struct{}
+}
+
+func (s *session) add(conn quic.Connection) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.conns[conn] = struct{}{}
+}
+
+func (s *session) remove(conn quic.Connection) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.conns, conn)
+}
+
+func (s *session) snapshot() []quic.Connection {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	conns := make([]quic.Connection, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// goAway asks the clients of our QUIC connections to move to new ones
+func (s *session) goAway() {
+	for _, conn := range s.snapshot() {
+		stream, err := conn.OpenStream()
+		if err != nil {
+			continue
+		}
+		stream.Write([]byte{common.GoAway})
+		stream.Close()
+	}
+}
+
+// close our QUIC connections and then what they were carried over
+func (s *session) close() {
+	for _, conn := range s.snapshot() {
+		conn.CloseWithError(common.QUICGoingAway, "shutting down")
+	}
+	s.closeTransport()
+}
+
+// ListenerOptions configures a Listener
+type ListenerOptions struct {
+	// If non-nil, every packet sent to a widget over WebSocket is subject to the network conditions
+	// this describes
+	Impairment *common.ImpairmentProfile
+
+	// If non-nil, only widgets which this authenticates may connect. Otherwise, anyone may.
+	Auth Authenticator
+
+	// If non-empty, browsers may only connect from pages whose origins match these patterns, like
+	// "*.example.com" (see websocket.AcceptOptions.OriginPatterns). Non-browser widgets don't send an
+	// origin, so this doesn't restrict them.
+	AllowedOrigins []string
+
+	// If non-nil, widgets' bandwidth is limited as this describes
+	Limits *Limits
+
+	// We close WebSockets, and forget native widgets, which we receive nothing from for this long.
+	// 0 means DefaultIdleTimeout.
+	IdleTimeout time.Duration
+
+	// The tags which we label widgets' metrics with. Widgets reporting any other tag are labeled
+	// "other", so they can't create unbounded metric series.
+	Tags []string
+
+	// The client versions which we label widgets' metrics with, as for Tags. These are the versions
+	// of the applications which embed widgets, rather than the Broflake protocol version.
+	ClientVersions []string
+}
+
+// Accept the next stream. Once the Listener is closed, Accept returns net.ErrClosed.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connections:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Addr() net.Addr {
 	return l.addr
 }
 
-func (l proxyListener) Close() error {
-	err := l.Listener.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	l.closeMetrics(ctx)
+// Close the Listener and every connection it's accepted right away
+func (l *Listener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		l.draining.Store(true)
+		err = l.srv.Close()
+
+		var wg sync.WaitGroup
+		for _, s := range l.snapshot() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.close()
+			}()
+		}
+		wg.Wait()
+
+		close(l.done)
+
+		// Nobody will accept the streams still queued for Accept
+		for len(l.connections) > 0 {
+			(<-l.connections).Close()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		l.closeMetrics(ctx)
+	})
+
 	return err
 }
 
+// Shutdown drains the Listener and then closes it. We stop accepting WebSockets, ask the client of
+// each QUIC connection to move to a new connection, and refuse new streams, while the streams
+// already open finish. Once they have, or when ctx is done, we close everything, returning ctx's
+// error if streams were still open.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.draining.Store(true)
+	err := l.srv.Shutdown(ctx)
+
+	sessions := l.snapshot()
+	for _, s := range sessions {
+		s.goAway()
+	}
+	logger.Info("draining", "sessions", len(sessions), "streams", l.streams.Load())
+
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+
+	for l.streams.Load() > 0 && ctx.Err() == nil {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+	}
+
+	if n := l.streams.Load(); n > 0 {
+		logger.Warn("ran out of time to drain, closing streams", "streams", n)
+		err = ctx.Err()
+	}
+
+	return errors.Join(err, l.Close())
+}
+
+// addSession registers a new session, which closeTransport closes, unless we're shutting down
+func (l *Listener) addSession(closeTransport func()) *session {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if l.draining.Load() {
+		return nil
+	}
+
+	s := &session{closeTransport: closeTransport, conns: make(map[quic.Connection]struct{})}
+	l.sessions[s] = struct{}{}
+	return s
+}
+
+func (l *Listener) removeSession(s *session) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	delete(l.sessions, s)
+}
+
+func (l *Listener) snapshot() []*session {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	sessions := make([]*session, 0, len(l.sessions))
+	for s := range l.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
 func generateTLSConfig() *tls.Config {
 	key, err := rsa.GenerateKey(rand.Reader, 1024)
 	if err != nil {
@@ -151,128 +407,325 @@ func generateTLSConfig() *tls.Config {
 	}
 }
 
-func (l proxyListener) handleWebsocket(w http.ResponseWriter, r *http.Request) {
-	// TODO: InsecureSkipVerify=true just disables origin checking, we need to instead add origin
-	// patterns as strings using AcceptOptions.OriginPattern
+// admit decides whether to accept a widget, given its handshake over transport. It returns the
+// widget's identity, if it authenticated, and the HTTP status to answer it with.
+func (l *Listener) admit(r *http.Request, transport string) (identity string, status int) {
+	if l.draining.Load() {
+		return "", http.StatusServiceUnavailable
+	}
+
+	if !isValidProtocolVersion(r) {
+		logger.Debug("refused a widget with the wrong protocol version", "remoteAddr", r.RemoteAddr, "transport", transport)
+		l.reject(transport, "version")
+		return "", http.StatusTeapot
+	}
+
+	if l.auth != nil {
+		var err error
+		if identity, err = l.auth.Authenticate(r); err != nil {
+			logger.Info("refused an unauthenticated widget", "remoteAddr", r.RemoteAddr, "transport", transport, "err", err)
+			l.reject(transport, "auth")
+			return "", http.StatusUnauthorized
+		}
+	}
+
+	return identity, http.StatusOK
+}
+
+// reject counts a widget we refused to accept
+func (l *Listener) reject(transport, reason string) {
+	attrs := metric.WithAttributes(attribute.String("reason", reason), attribute.String("transport", transport))
+	l.m.rejectedWidgets.Add(context.Background(), 1, attrs)
+}
+
+// refuse answers a widget's handshake with status, which admit returned
+func refuse(w http.ResponseWriter, status int) {
+	switch status {
+	case http.StatusTeapot:
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("418\n"))
+	case http.StatusServiceUnavailable:
+		http.Error(w, "shutting down", status)
+	default:
+		http.Error(w, "unauthorized", status)
+	}
+}
+
+func (l *Listener) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	identity, status := l.admit(r, transportWebSocket)
+	if status != http.StatusOK {
+		refuse(w, status)
+		return
+	}
+
+	// Browsers insist that we accept the subprotocol which carried a widget's token
+	var subprotocols []string
+	if _, p := widgetToken(r); p != "" {
+		subprotocols = []string{p}
+	}
+
 	// TODO: disabling compression is a workaround for a WebKit bug:
 	// https://github.com/getlantern/broflake/issues/45
 	c, err := websocket.Accept(
 		w,
 		r,
 		&websocket.AcceptOptions{
-			InsecureSkipVerify: true,
+			Subprotocols:       subprotocols,
+			InsecureSkipVerify: len(l.allowedOrigins) == 0, // Without an allowlist, any origin will do
+			OriginPatterns:     l.allowedOrigins,
 			CompressionMode:    websocket.CompressionDisabled,
 		},
 	)
+	if err != nil {
+		// Accept has already responded
+		logger.Debug("refused a WebSocket", "remoteAddr", r.RemoteAddr, "err", err)
+		l.reject(transportWebSocket, "handshake")
+		return
+	}
 
 	tcpAddr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
 	if err != nil {
-		common.Debugf("Error resolving TCPAddr: %v", err)
+		logger.Warn("error resolving TCPAddr", "err", err)
+		c.Close(websocket.StatusInternalError, "")
 		return
 	}
 
-	wspconn := websocketPacketConn{
+	// Anonymous widgets are limited by their IP address
+	if identity == "" {
+		identity = tcpAddr.IP.String()
+	}
+
+	// Refuse widgets while we're draining before we count them, since Close uncounts them
+	sess := l.addSession(func() { c.Close(websocket.StatusGoingAway, "shutting down") })
+	if sess == nil {
+		c.Close(websocket.StatusGoingAway, "shutting down")
+		return
+	}
+	defer l.removeSession(sess)
+
+	session := uuid.NewString()
+	connLog := logger.With("session", session, "remoteAddr", r.RemoteAddr, "identity", identity)
+
+	wspconn := &websocketPacketConn{
 		w:         c,
-		addr:      common.DebugAddr(fmt.Sprintf("WebSocket connection %v", uuid.NewString())),
-		keepalive: websocketKeepalive,
+		addr:      common.DebugAddr(fmt.Sprintf("WebSocket connection %v", session)),
 		tcpAddr:   tcpAddr,
+		log:       connLog,
+		limit:     l.limiter.acquire(identity),
+		stats:     newConnStats(r, transportWebSocket, l.labels, l.m),
+		keepalive: newKeepalive(c, websocketKeepalive, l.idleTimeout, l.m, connLog),
+		m:         l.m,
 	}
 
+	connLog.Debug("accepted a new WebSocket connection", "total", atomic.AddUint64(&nClients, 1))
+	l.m.clients.Add(context.Background(), 1)
 	defer wspconn.Close()
 
-	if err != nil {
-		return
+	var pconn net.PacketConn = wspconn
+	if l.impairment != nil {
+		// Closing the impaired conn would close wspconn twice, so we only stop it from sending
+		ipconn := common.NewImpairedPacketConn(wspconn, l.impairment)
+		defer ipconn.Stop()
+		pconn = ipconn
 	}
 
-	common.Debugf("Accepted a new WebSocket connection! (%v total)", atomic.AddUint64(&nClients, 1))
-	nClientsCounter.Add(context.Background(), 1)
-
-	listener, err := quic.Listen(wspconn, l.tlsConfig, &common.QUICCfg)
+	listener, err := quic.Listen(pconn, l.tlsConfig, &common.QUICCfg)
 	if err != nil {
-		common.Debugf("Error creating QUIC listener: %v", err)
+		connLog.Error("error creating QUIC listener", "err", err)
 		return
 	}
 
+	wdg := &widget{name: wspconn.addr.String(), addr: tcpAddr, stats: wspconn.stats, log: connLog}
+	err = l.serveQUIC(listener, sess, func(quic.Connection) *widget { return wdg })
+	connLog.Debug("QUIC listener error, closing", "err", err)
+}
+
+// widget is what we know of a widget whose QUIC connections we're accepting
+type widget struct {
+	name  string   // Names the widget's connection in the errors we send its clients
+	addr  net.Addr // The remote address of the streams we accept from the widget's clients
+	stats *connStats
+	log   common.Logger
+}
+
+// serveQUIC accepts QUIC connections from listener, and the streams opened over them, until
+// listener fails. widgetFor returns the widget which relayed a connection to us, or nil if we
+// don't know of one.
+func (l *Listener) serveQUIC(listener *quic.Listener, sess *session, widgetFor func(quic.Connection) *widget) error {
 	for {
 		conn, err := listener.Accept(context.Background())
 		if err != nil {
-			common.Debugf("%v QUIC listener error (%v), closing!", wspconn.addr, err)
 			listener.Close()
-			break
+			return err
 		}
 
-		nQUICConnectionsCounter.Add(context.Background(), 1)
-		common.Debugf("%v accepted a new QUIC connection!", wspconn.addr)
+		// A client which hasn't heard that we're shutting down may try to reconnect to us
+		if l.draining.Load() {
+			conn.CloseWithError(common.QUICGoingAway, "shutting down")
+			continue
+		}
 
-		go func() {
-			for {
-				stream, err := conn.AcceptStream(context.Background())
+		wdg := widgetFor(conn)
+		if wdg == nil {
+			conn.CloseWithError(quic.ApplicationErrorCode(42069), "unknown widget")
+			continue
+		}
 
-				if err != nil {
-					// We interpret an error while accepting a stream to indicate an unrecoverable error with
-					// the QUIC connection, and so we close the QUIC connection altogether
-					errString := fmt.Sprintf("%v stream error (%v), closing QUIC connection!", wspconn.addr, err)
-					common.Debugf("%v", errString)
-					conn.CloseWithError(quic.ApplicationErrorCode(42069), errString)
-					nQUICConnectionsCounter.Add(context.Background(), -1)
-					return
-				}
+		l.m.quicConnections.Add(context.Background(), 1)
+		wdg.stats.addQUICConn()
+		wdg.log.Debug("accepted a new QUIC connection")
+		sess.add(conn)
 
-				common.Debugf("Accepted a new QUIC stream! (%v total)", atomic.AddUint64(&nQUICStreams, 1))
-				nQUICStreamsCounter.Add(context.Background(), 1)
+		go l.serveStreams(conn, sess, wdg)
+	}
+}
+
+// serveStreams accepts the streams opened over conn, which wdg relayed to us, until conn fails
+func (l *Listener) serveStreams(conn quic.Connection, sess *session, wdg *widget) {
+	mux := common.NewDatagramMux(conn)
+	var streams uint64
+	defer sess.remove(conn)
+
+	for {
+		stream, err := conn.AcceptStream(context.Background())
 
-				l.connections <- common.QUICStreamNetConn{
-					Stream: stream,
-					OnClose: func() {
-						defer common.Debugf("Closed a QUIC stream! (%v total)", atomic.AddUint64(&nQUICStreams, ^uint64(0)))
-						nQUICStreamsCounter.Add(context.Background(), -1)
-					},
-					AddrLocal:  l.addr,
-					AddrRemote: tcpAddr,
-				}
-			}
-		}()
+		if err != nil {
+			// We interpret an error while accepting a stream to indicate an unrecoverable error with
+			// the QUIC connection, and so we close the QUIC connection altogether
+			errString := fmt.Sprintf("%v stream error (%v), closing QUIC connection!", wdg.name, err)
+			wdg.log.Debug("stream error, closing QUIC connection", "err", err, "streams", streams)
+			conn.CloseWithError(quic.ApplicationErrorCode(42069), errString)
+			l.m.quicConnections.Add(context.Background(), -1)
+			wdg.stats.closeQUICConn(streams)
+			return
+		}
+
+		// While we drain, we only let the streams already open finish
+		if l.draining.Load() {
+			stream.CancelRead(common.StreamGoingAway)
+			stream.CancelWrite(common.StreamGoingAway)
+			continue
+		}
+
+		streams++
+		wdg.stats.addStream()
+		l.streams.Add(1)
+		wdg.log.Debug("accepted a new QUIC stream", "total", atomic.AddUint64(&nQUICStreams, 1))
+		l.m.quicStreams.Add(context.Background(), 1)
+
+		qs := &quicStream{
+			QUICStreamNetConn: common.QUICStreamNetConn{
+				Stream: stream,
+				OnClose: func() {
+					defer wdg.log.Debug("closed a QUIC stream", "total", atomic.AddUint64(&nQUICStreams, ^uint64(0)))
+					l.m.quicStreams.Add(context.Background(), -1)
+					l.streams.Add(-1)
+				},
+				AddrLocal:  l.addr,
+				AddrRemote: wdg.addr,
+			},
+			mux: mux,
+		}
+
+		select {
+		case l.connections <- qs:
+		case <-l.done:
+			qs.Close()
+		}
 	}
 }
 
-func NewListener(ctx context.Context, ll net.Listener, certPEM, keyPEM string) (net.Listener, error) {
-	closeFuncMetric := telemetry.EnableOTELMetrics(ctx)
-	m := otel.Meter("github.com/getlantern/broflake/egress")
+// newInstruments creates our otel instruments with m
+func newInstruments(m metric.Meter) (*instruments, error) {
+	var i instruments
 	var err error
-	nClientsCounter, err = m.Int64UpDownCounter("concurrent-websockets")
+
+	i.clients, err = m.Int64UpDownCounter("concurrent-websockets")
 	if err != nil {
-		closeFuncMetric(ctx)
 		return nil, err
 	}
 
-	nQUICConnectionsCounter, err = m.Int64UpDownCounter("concurrent-quic-connections")
+	i.widgets, err = m.Int64UpDownCounter("concurrent-widgets")
 	if err != nil {
-		closeFuncMetric(ctx)
 		return nil, err
 	}
 
-	nQUICStreamsCounter, err = m.Int64UpDownCounter("concurrent-quic-streams")
+	i.quicConnections, err = m.Int64UpDownCounter("concurrent-quic-connections")
 	if err != nil {
-		closeFuncMetric(ctx)
 		return nil, err
 	}
 
-	nIngressBytesCounter, err = m.Int64ObservableUpDownCounter("ingress-bytes")
+	i.quicStreams, err = m.Int64UpDownCounter("concurrent-quic-streams")
 	if err != nil {
-		closeFuncMetric(ctx)
 		return nil, err
 	}
 
-	_, err = m.RegisterCallback(
-		func(ctx context.Context, o metric.Observer) error {
-			b := atomic.LoadUint64(&nIngressBytes)
-			o.ObserveInt64(nIngressBytesCounter, int64(b))
-			common.Debugf("Ingress bytes: %v", b)
-			atomic.StoreUint64(&nIngressBytes, uint64(0))
-			return nil
-		},
-		nIngressBytesCounter,
-	)
+	i.rejectedWidgets, err = m.Int64Counter("rejected-widgets")
+	if err != nil {
+		return nil, err
+	}
+
+	i.quotaExceeded, err = m.Int64Counter("quota-exceeded-websockets")
+	if err != nil {
+		return nil, err
+	}
+
+	i.reapedWebsockets, err = m.Int64Counter("reaped-websockets")
+	if err != nil {
+		return nil, err
+	}
+
+	i.ingressBytes, err = m.Int64Counter("ingress-bytes", metric.WithUnit("By"))
+	if err != nil {
+		return nil, err
+	}
+
+	i.egressBytes, err = m.Int64Counter("egress-bytes", metric.WithUnit("By"))
+	if err != nil {
+		return nil, err
+	}
+
+	i.quicStreamsTotal, err = m.Int64Counter("quic-streams")
+	if err != nil {
+		return nil, err
+	}
+
+	i.quicConnStreams, err = m.Int64Histogram("quic-connection-streams")
+	if err != nil {
+		return nil, err
+	}
+
+	i.connDuration, err = m.Float64Histogram("widget-connection-duration", metric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+func NewListener(ctx context.Context, ll net.Listener, certPEM, keyPEM string) (net.Listener, error) {
+	return NewImpairedListener(ctx, ll, certPEM, keyPEM, nil)
+}
+
+// NewImpairedListener is NewListener, but every packet sent to a widget over WebSocket is subject
+// to the network conditions described by impairment
+func NewImpairedListener(ctx context.Context, ll net.Listener, certPEM, keyPEM string, impairment *common.ImpairmentProfile) (net.Listener, error) {
+	l, err := NewListenerWithOptions(ctx, ll, certPEM, keyPEM, &ListenerOptions{Impairment: impairment})
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// NewListenerWithOptions is NewListener, configured by opt
+func NewListenerWithOptions(ctx context.Context, ll net.Listener, certPEM, keyPEM string, opt *ListenerOptions) (*Listener, error) {
+	if opt == nil {
+		opt = &ListenerOptions{}
+	}
+
+	closeFuncMetric := telemetry.EnableOTELMetrics(ctx)
+	m, err := newInstruments(otel.Meter("github.com/getlantern/broflake/egress"))
 	if err != nil {
 		closeFuncMetric(ctx)
 		return nil, err
@@ -286,35 +739,53 @@ func NewListener(ctx context.Context, ll net.Listener, certPEM, keyPEM string) (
 			return nil, fmt.Errorf("Unable to load cert/key from PEM for broflake: %v", err)
 		}
 
-		common.Debugf("Broflake using cert %v and key %v", certPEM, keyPEM)
+		logger.Info("using the configured cert and key")
 		tlsConfig = &tls.Config{
 			Certificates: []tls.Certificate{cert},
 			NextProtos:   []string{"broflake"},
 		}
 	} else {
-		common.Debugf("!!! WARNING !!! No certfile and/or keyfile specified, generating an insecure TLSConfig!")
+		logger.Warn("!!! WARNING !!! No certfile and/or keyfile specified, generating an insecure TLSConfig!")
 		tlsConfig = generateTLSConfig()
 	}
 
 	// We use this wrapped listener to enable our local HTTP proxy to listen for WebSocket connections
-	l := proxyListener{
-		Listener:     &net.TCPListener{},
-		connections:  make(chan net.Conn, 2048),
-		tlsConfig:    tlsConfig,
-		addr:         ll.Addr(),
-		closeMetrics: closeFuncMetric,
+	l := &Listener{
+		connections:    make(chan net.Conn, 2048),
+		tlsConfig:      tlsConfig,
+		addr:           ll.Addr(),
+		closeMetrics:   closeFuncMetric,
+		m:              m,
+		impairment:     opt.Impairment,
+		auth:           opt.Auth,
+		allowedOrigins: opt.AllowedOrigins,
+		limiter:        newLimiter(opt.Limits),
+		idleTimeout:    opt.IdleTimeout,
+		labels:         newLabelAllowlist(opt.Tags, opt.ClientVersions),
+		sessions:       make(map[*session]struct{}),
+		done:           make(chan struct{}),
+	}
+
+	if l.idleTimeout <= 0 {
+		l.idleTimeout = DefaultIdleTimeout
 	}
 
-	srv := &http.Server{
+	// Each listener gets its own mux, so that more than one can be served from a single process
+	mux := http.NewServeMux()
+	mux.Handle("/ws", otelhttp.NewHandler(http.HandlerFunc(l.handleWebsocket), "/ws"))
+
+	l.srv = &http.Server{
+		Handler:      mux,
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
 
-	http.Handle("/ws", otelhttp.NewHandler(http.HandlerFunc(l.handleWebsocket), "/ws"))
-	common.Debugf("Egress server listening for WebSocket connections on %v", ll.Addr())
+	logger.Info("egress server listening for WebSocket connections", "addr", ll.Addr())
 	go func() {
-		err := srv.Serve(ll)
-		panic(fmt.Sprintf("stopped listening and serving for some reason: %v", err))
+		if err := l.srv.Serve(ll); !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("stopped serving WebSockets", "err", err)
+			l.Close()
+		}
 	}()
 
 	return l, nil
@@ -0,0 +1,434 @@
+package egress
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// DefaultDialTimeout bounds how long a Forwarder waits to connect to a destination
+const DefaultDialTimeout = 10 * time.Second
+
+// DefaultHeaderTimeout bounds how long a Forwarder waits for a stream to say where it's going
+const DefaultHeaderTimeout = 30 * time.Second
+
+// hopHeaders are the headers which apply only to a single HTTP connection, so we don't forward them
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// ForwarderOptions configures a Forwarder
+type ForwarderOptions struct {
+	DialTimeout time.Duration
+
+	// We close streams which don't tell us their destination within this long. 0 means
+	// DefaultHeaderTimeout.
+	HeaderTimeout time.Duration
+
+	// Dial connects to destinations. If nil, we use a net.Dialer.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// If non-nil, we only connect to the destinations this allows. Any egress server reachable by
+	// widgets should have one, or they can reach anything its host can; see DefaultPolicy.
+	Policy *Policy
+}
+
+// Forwarder connects the streams accepted from a Listener to their destinations. Streams normally
+// begin with a common.TargetHeader, after which the Forwarder splices them to their destinations.
+// For older clients, it also understands streams which begin with an HTTP request: CONNECT and
+// CONNECT-UDP requests, and requests for http:// URLs, which it proxies itself.
+type Forwarder struct {
+	opt    *ForwarderOptions
+	tr     *http.Transport
+	log    common.Logger
+	denied metric.Int64Counter
+}
+
+// NewForwarder returns a Forwarder configured by opt, which may be nil
+func NewForwarder(opt *ForwarderOptions) *Forwarder {
+	o := ForwarderOptions{}
+	if opt != nil {
+		o = *opt
+	}
+
+	if o.DialTimeout == 0 {
+		o.DialTimeout = DefaultDialTimeout
+	}
+
+	if o.HeaderTimeout == 0 {
+		o.HeaderTimeout = DefaultHeaderTimeout
+	}
+
+	if o.Dial == nil {
+		var d net.Dialer
+		o.Dial = d.DialContext
+	}
+
+	f := &Forwarder{opt: &o, log: common.NewLogger("component", "forwarder")}
+
+	// Until telemetry is enabled, the global meter's instruments do nothing
+	f.denied, _ = otel.Meter("github.com/getlantern/broflake/egress").Int64Counter("denied-destinations")
+
+	f.tr = &http.Transport{
+		DialContext:         f.dial,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		DisableCompression:  true, // Clients ask for the encodings they want
+	}
+
+	return f
+}
+
+// dial connects to addr, if our policy allows it, giving up after our dial timeout
+func (f *Forwarder) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.opt.DialTimeout)
+	defer cancel()
+
+	if f.opt.Policy == nil {
+		return f.opt.Dial(ctx, network, addr)
+	}
+
+	addrs, err := f.opt.Policy.Resolve(ctx, addr)
+	if err != nil {
+		var denied *DeniedError
+		if errors.As(err, &denied) {
+			f.log.Info("denied a destination", "network", network, "addr", addr, "reason", denied.Reason)
+			f.denied.Add(context.Background(), 1, metric.WithAttributes(attribute.String("reason", denied.Reason)))
+		}
+		return nil, err
+	}
+
+	// We dial the addresses we checked, never the name, which might resolve differently next time
+	for _, a := range addrs {
+		var conn net.Conn
+		conn, err = f.opt.Dial(ctx, network, a.String())
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// Serve forwards the streams accepted from l until l is closed
+func (f *Forwarder) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go f.ServeConn(conn)
+	}
+}
+
+// ServeConn forwards a single stream, closing it when we're done
+func (f *Forwarder) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	// Until we know where the stream is going, it mustn't keep us waiting forever
+	conn.SetReadDeadline(time.Now().Add(f.opt.HeaderTimeout))
+
+	br := bufio.NewReader(conn)
+	b, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+
+	if common.IsTargetHeader(b[0]) {
+		f.serveNative(conn, br)
+	} else {
+		f.serveHTTP(conn, br)
+	}
+}
+
+// serveNative forwards a stream which begins with a target header
+func (f *Forwarder) serveNative(conn net.Conn, br *bufio.Reader) {
+	reply := func(s common.TargetStatus) error {
+		_, err := conn.Write([]byte{byte(s)})
+		return err
+	}
+
+	h, err := common.ReadTargetHeader(br)
+	if err != nil {
+		f.log.Debug("bad target header", "err", err)
+		reply(common.TargetBadRequest)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch h.Type {
+	case common.StreamTCP:
+		dst, err := f.dial(context.Background(), "tcp", h.Addr)
+		if err != nil {
+			f.log.Debug("can't dial destination", "addr", h.Addr, "err", err)
+			reply(targetStatus(err))
+			return
+		}
+		defer dst.Close()
+
+		if err := reply(common.TargetOK); err != nil {
+			return
+		}
+
+		splice(conn, br, dst)
+	case common.StreamUDP:
+		s, ok := conn.(*quicStream)
+		if !ok {
+			reply(common.TargetBadRequest)
+			return
+		}
+
+		udpConn, flow, err := f.dialUDP(s, h.Addr)
+		if err != nil {
+			reply(targetStatus(err))
+			return
+		}
+		defer udpConn.Close()
+		defer flow.Close()
+
+		if err := reply(common.TargetOK); err != nil {
+			return
+		}
+
+		relayUDP(udpConn, flow, br, h.Addr, f.log)
+	default:
+		f.log.Debug("unsupported stream type", "type", h.Type)
+		reply(common.TargetBadRequest)
+	}
+}
+
+// serveHTTP forwards a stream which begins with an HTTP request, as older clients send
+func (f *Forwarder) serveHTTP(conn net.Conn, br *bufio.Reader) {
+	for {
+		conn.SetReadDeadline(time.Now().Add(f.opt.HeaderTimeout))
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		switch {
+		case req.Method == http.MethodConnect:
+			f.serveConnect(conn, br, req)
+			return
+		case strings.EqualFold(req.Header.Get("Upgrade"), common.ConnectUDPProtocol):
+			f.serveConnectUDP(conn, br, req)
+			return
+		default:
+			if !f.serveRequest(conn, req) {
+				return
+			}
+		}
+	}
+}
+
+// serveConnect serves a CONNECT request
+func (f *Forwarder) serveConnect(conn net.Conn, br *bufio.Reader, req *http.Request) {
+	f.log.Debug("forwarding CONNECT request", "host", req.Host)
+
+	dst, err := f.dial(req.Context(), "tcp", req.Host)
+	if err != nil {
+		f.log.Debug("can't dial destination", "addr", req.Host, "err", err)
+		writeResponse(conn, httpStatus(err), nil)
+		return
+	}
+	defer dst.Close()
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+
+	splice(conn, br, dst)
+}
+
+// serveConnectUDP serves a CONNECT-UDP request
+func (f *Forwarder) serveConnectUDP(conn net.Conn, br *bufio.Reader, req *http.Request) {
+	addr, err := common.ParseConnectUDPRequest(req)
+	if err != nil {
+		f.log.Debug("bad CONNECT-UDP request", "err", err)
+		writeResponse(conn, http.StatusBadRequest, nil)
+		return
+	}
+
+	s, ok := conn.(*quicStream)
+	if !ok {
+		writeResponse(conn, http.StatusNotImplemented, nil)
+		return
+	}
+
+	udpConn, flow, err := f.dialUDP(s, addr)
+	if err != nil {
+		writeResponse(conn, httpStatus(err), nil)
+		return
+	}
+	defer udpConn.Close()
+	defer flow.Close()
+
+	h := http.Header{
+		"Connection":       {"Upgrade"},
+		"Upgrade":          {common.ConnectUDPProtocol},
+		"Capsule-Protocol": {"?1"},
+	}
+
+	if err := writeResponse(conn, http.StatusSwitchingProtocols, h); err != nil {
+		return
+	}
+
+	relayUDP(udpConn, flow, br, addr, f.log)
+}
+
+// serveRequest proxies a request for an http:// URL, returning false if the stream can't carry
+// another request afterwards
+func (f *Forwarder) serveRequest(conn net.Conn, req *http.Request) bool {
+	if req.URL.Host == "" {
+		writeResponse(conn, http.StatusBadRequest, nil)
+		return false
+	}
+
+	f.log.Debug("forwarding HTTP request", "method", req.Method, "host", req.URL.Host)
+
+	for _, h := range req.Header.Values("Connection") {
+		for _, name := range strings.Split(h, ",") {
+			req.Header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.RequestURI = ""
+
+	res, err := f.tr.RoundTrip(req)
+	if err != nil {
+		f.log.Debug("HTTP request failed", "host", req.URL.Host, "err", err)
+		writeResponse(conn, httpStatus(err), nil)
+		return false
+	}
+	defer res.Body.Close()
+
+	for _, h := range hopHeaders {
+		res.Header.Del(h)
+	}
+
+	if err := res.Write(conn); err != nil {
+		return false
+	}
+
+	return !req.Close && !res.Close
+}
+
+// dialUDP connects a UDP socket to addr and registers a flow for its datagrams on s's QUIC
+// connection. We register before replying, since the client may send datagrams as soon as it
+// hears from us.
+func (f *Forwarder) dialUDP(s *quicStream, addr string) (net.Conn, *common.DatagramFlow, error) {
+	udpConn, err := f.dial(context.Background(), "udp", addr)
+	if err != nil {
+		f.log.Debug("can't dial UDP destination", "addr", addr, "err", err)
+		return nil, nil, err
+	}
+
+	flow, err := s.mux.Register(s.StreamID())
+	if err != nil {
+		udpConn.Close()
+		return nil, nil, err
+	}
+
+	return udpConn, flow, nil
+}
+
+// splice copies between conn, whose reads come from r, and dst, until neither has anything more to
+// send, passing half-closes on. An error in either direction ends both.
+func splice(conn net.Conn, r io.Reader, dst net.Conn) {
+	errc := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(dst, r)
+		closeWrite(dst)
+		errc <- err
+	}()
+
+	go func() {
+		_, err := io.Copy(conn, dst)
+		closeWrite(conn)
+		errc <- err
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			break
+		}
+	}
+}
+
+// closeWrite half-closes c if it supports it
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+// writeResponse writes a response with no body
+func writeResponse(w io.Writer, status int, h http.Header) error {
+	if h == nil {
+		h = make(http.Header)
+	}
+
+	res := &http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     h,
+	}
+
+	return res.Write(w)
+}
+
+// targetStatus returns the TargetStatus for an error connecting to a destination
+func targetStatus(err error) common.TargetStatus {
+	var dnsErr *net.DNSError
+
+	switch {
+	case errors.Is(err, ErrDestinationDenied):
+		return common.TargetNotAllowed
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return common.TargetTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return common.TargetRefused
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return common.TargetUnreachable
+	default:
+		return common.TargetFailed
+	}
+}
+
+// httpStatus returns the HTTP status for an error connecting to a destination
+func httpStatus(err error) int {
+	switch targetStatus(err) {
+	case common.TargetNotAllowed:
+		return http.StatusForbidden
+	case common.TargetTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
@@ -0,0 +1,200 @@
+package egress
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// startForwarder serves a Forwarder on loopback, returning a function which opens streams to it
+func startForwarder(t *testing.T, opt *ForwarderOptions) func() net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go NewForwarder(opt).Serve(l)
+
+	return func() net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		return conn
+	}
+}
+
+// startEcho serves TCP connections which are echoed until the client finishes sending, and then
+// closed, returning the server's address
+func startEcho(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestForwarderNative(t *testing.T) {
+	dial := startForwarder(t, nil)
+	echo := startEcho(t)
+
+	conn := dial()
+	if err := (common.TargetHeader{Type: common.StreamTCP, Addr: echo}).Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := common.ReadTargetStatus(conn); err != nil {
+		t.Fatalf("expected the forwarder to connect, got %v", err)
+	}
+
+	// Half-closing our side passes through to the destination, which then closes its side
+	io.WriteString(conn, "NELSON WUZ HERE")
+	conn.(*net.TCPConn).CloseWrite()
+
+	b, err := io.ReadAll(conn)
+	if err != nil || string(b) != "NELSON WUZ HERE" {
+		t.Fatalf("read %q (err: %v), expected our echo", b, err)
+	}
+}
+
+func TestForwarderNativeErrors(t *testing.T) {
+	dial := startForwarder(t, &ForwarderOptions{
+		DialTimeout: 50 * time.Millisecond,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == "slow.test:80" {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	})
+
+	// A port nobody listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		h    common.TargetHeader
+		want common.TargetStatus
+	}{
+		{common.TargetHeader{Type: common.StreamTCP, Addr: closed}, common.TargetRefused},
+		{common.TargetHeader{Type: common.StreamTCP, Addr: "slow.test:80"}, common.TargetTimeout},
+		{common.TargetHeader{Type: common.StreamType(42), Addr: closed}, common.TargetBadRequest},
+
+		// UDP needs a QUIC connection to carry its datagrams
+		{common.TargetHeader{Type: common.StreamUDP, Addr: closed}, common.TargetBadRequest},
+	}
+
+	for _, tt := range tests {
+		conn := dial()
+		tt.h.Write(conn)
+
+		err := common.ReadTargetStatus(conn)
+		if !errors.Is(err, common.ErrTargetStatus(tt.want)) {
+			t.Errorf("%+v: got %v, expected %v", tt.h, err, tt.want)
+		}
+	}
+}
+
+func TestForwarderHeaderTimeout(t *testing.T) {
+	dial := startForwarder(t, &ForwarderOptions{HeaderTimeout: 50 * time.Millisecond})
+
+	// Streams which never say where they're going, or stop halfway, are closed
+	for _, b := range [][]byte{nil, {byte(common.StreamTCP)}} {
+		conn := dial()
+		conn.Write(b)
+
+		start := time.Now()
+		if _, err := io.ReadAll(conn); err != nil || time.Since(start) > 5*time.Second {
+			t.Fatalf("got %v after %v, expected an idle stream to be closed", err, time.Since(start))
+		}
+	}
+}
+
+func TestForwarderHTTPCompat(t *testing.T) {
+	dial := startForwarder(t, nil)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" {
+			t.Errorf("forwarded a hop-by-hop header")
+		}
+		io.WriteString(w, "NELSON WUZ HERE "+r.URL.Path)
+	}))
+	defer origin.Close()
+
+	// Older clients send requests for http:// URLs through us like any HTTP proxy, over one stream
+	tr := &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: "i.do.nothing"}),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(), nil
+		},
+	}
+	defer tr.CloseIdleConnections()
+
+	for _, path := range []string{"/a", "/b"} {
+		req, _ := http.NewRequest(http.MethodGet, origin.URL+path, nil)
+		req.Header.Set("Proxy-Connection", "keep-alive")
+
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if string(b) != "NELSON WUZ HERE "+path {
+			t.Fatalf("got %q for %v", b, path)
+		}
+	}
+
+	// They send CONNECT requests for everything else
+	echo := startEcho(t)
+	conn := dial()
+	io.WriteString(conn, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v %v", res, err)
+	}
+
+	io.WriteString(conn, "NELSON WUZ HERE")
+	conn.(*net.TCPConn).CloseWrite()
+	if b, err := io.ReadAll(br); err != nil || string(b) != "NELSON WUZ HERE" {
+		t.Fatalf("read %q (err: %v), expected our echo", b, err)
+	}
+}
@@ -0,0 +1,106 @@
+package egress
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// DefaultIdleTimeout is how long a widget's WebSocket may go without receiving anything before we
+// close it. A live QUIC connection sends keepalives far more often than this (see common.QUICCfg),
+// so a WebSocket this quiet has no QUIC connection left worth keeping it open for.
+const DefaultIdleTimeout = 2 * time.Minute
+
+// keepalive pings a widget's WebSocket when we haven't received anything over it for a while, and
+// closes it if it goes unanswered or if the WebSocket stays idle for too long. A single timer
+// serves the whole connection, and each read just records the time, since reads are hot.
+type keepalive struct {
+	w        *websocket.Conn
+	interval time.Duration // Ping when we've received nothing for this long
+	idle     time.Duration // Close when we've received nothing for this long
+	last     atomic.Int64  // Unix nanos of our last read
+	stop     chan struct{}
+	once     sync.Once
+	m        *instruments
+	log      common.Logger
+}
+
+// newKeepalive starts keeping w alive
+func newKeepalive(w *websocket.Conn, interval, idle time.Duration, m *instruments, log common.Logger) *keepalive {
+	k := &keepalive{w: w, interval: interval, idle: idle, stop: make(chan struct{}), m: m, log: log}
+	k.activity()
+	go k.run()
+	return k
+}
+
+// activity records that we've received something
+func (k *keepalive) activity() {
+	if k != nil {
+		k.last.Store(time.Now().UnixNano())
+	}
+}
+
+// close stops keeping the WebSocket alive
+func (k *keepalive) close() {
+	if k != nil {
+		k.once.Do(func() { close(k.stop) })
+	}
+}
+
+func (k *keepalive) run() {
+	t := time.NewTimer(k.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-k.stop:
+			return
+		}
+
+		quiet := time.Since(time.Unix(0, k.last.Load()))
+
+		if quiet >= k.idle {
+			k.reap("idle", quiet)
+			return
+		}
+
+		if quiet < k.interval {
+			t.Reset(k.interval - quiet)
+			continue
+		}
+
+		// Our reader receives the pong, so we mustn't wait for it any longer than we'd wait to ping
+		k.log.Debug("PING")
+		ctx, cancel := context.WithTimeout(context.Background(), k.interval)
+		err := k.w.Ping(ctx)
+		cancel()
+
+		select {
+		case <-k.stop:
+			return
+		default:
+		}
+
+		if err != nil {
+			k.reap("unresponsive", quiet)
+			return
+		}
+
+		t.Reset(k.interval)
+	}
+}
+
+// reap closes the WebSocket, which ends its reads and so its QUIC listener
+func (k *keepalive) reap(reason string, quiet time.Duration) {
+	k.log.Debug("closing a WebSocket", "reason", reason, "quiet", quiet.Round(time.Millisecond))
+	k.m.reapedWebsockets.Add(context.Background(), 1, metric.WithAttributes(attribute.String("reason", reason)))
+	k.w.Close(websocket.StatusGoingAway, reason)
+}
@@ -0,0 +1,191 @@
+package egress
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// websocketPair returns both ends of a WebSocket connection over loopback
+func websocketPair(t testing.TB) (server, client *websocket.Conn) {
+	accepted := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadLimit(-1)
+
+	server = <-accepted
+	t.Cleanup(func() {
+		client.CloseNow()
+		server.CloseNow()
+	})
+
+	return server, client
+}
+
+func TestKeepaliveReapsIdle(t *testing.T) {
+	server, client := websocketPair(t)
+
+	// The widget answers pings, but never sends anything
+	client.CloseRead(context.Background())
+
+	start := time.Now()
+	k := newKeepalive(server, 20*time.Millisecond, 200*time.Millisecond, testInstruments(t, nil), logger)
+	defer k.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, _, err := server.Read(ctx); ctx.Err() != nil || err == nil {
+		t.Fatalf("expected the idle WebSocket to be closed, got %v", err)
+	}
+
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("closed after only %v", d)
+	}
+}
+
+func TestKeepaliveActivity(t *testing.T) {
+	server, client := websocketPair(t)
+	k := newKeepalive(server, 20*time.Millisecond, 100*time.Millisecond, testInstruments(t, nil), logger)
+	defer k.close()
+
+	// The widget answers pings, and sends something more often than we'd reap it
+	client.CloseRead(context.Background())
+	go func() {
+		for i := 0; i < 20; i++ {
+			client.Write(context.Background(), websocket.MessageBinary, []byte("hi"))
+			time.Sleep(20 * time.Millisecond)
+		}
+		client.Close(websocket.StatusNormalClosure, "")
+	}()
+
+	// Everything we receive keeps the WebSocket alive, until the widget goes away
+	for i := 0; i < 20; i++ {
+		if _, _, err := server.Read(context.Background()); err != nil {
+			t.Fatalf("read %v failed: %v", i, err)
+		}
+		k.activity()
+	}
+}
+
+// legacyReadFrom is how websocketPacketConn.ReadFrom kept WebSockets alive before keepalive, with a
+// goroutine and a timer for every read. We keep it to benchmark against.
+func legacyReadFrom(w *websocket.Conn, interval time.Duration) ([]byte, error) {
+	readDone := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-time.After(interval):
+				w.Ping(context.Background())
+			case <-readDone:
+				return
+			}
+		}
+	}()
+
+	_, b, err := w.Read(context.Background())
+	readDone <- struct{}{}
+	return b, err
+}
+
+// BenchmarkReadFrom compares reading packets with the old per-read keepalive goroutine to reading
+// them with keepalive. Compare ns/op, allocs/op and goroutines, the most goroutines which reading
+// kept running at once, beyond those running before we began.
+func BenchmarkReadFrom(b *testing.B) {
+	m := testInstruments(b, nil)
+
+	read := map[string]func(server *websocket.Conn) func() error{
+		"per-read goroutine": func(server *websocket.Conn) func() error {
+			return func() error {
+				_, err := legacyReadFrom(server, websocketKeepalive)
+				return err
+			}
+		},
+		"keepalive": func(server *websocket.Conn) func() error {
+			q := websocketPacketConn{
+				w:         server,
+				log:       logger,
+				stats:     newConnStats(httptest.NewRequest("GET", "/ws", nil), transportWebSocket, nil, m),
+				keepalive: newKeepalive(server, websocketKeepalive, DefaultIdleTimeout, m, logger),
+				m:         m,
+			}
+			b.Cleanup(q.keepalive.close)
+
+			p := make([]byte, 1500)
+			return func() error {
+				_, _, err := q.ReadFrom(p)
+				return err
+			}
+		},
+	}
+
+	for _, name := range []string{"per-read goroutine", "keepalive"} {
+		b.Run(name, func(b *testing.B) {
+			server, client := websocketPair(b)
+			next := read[name](server)
+
+			go func() {
+				pkt := make([]byte, 1200)
+				for i := 0; i < b.N; i++ {
+					if client.Write(context.Background(), websocket.MessageBinary, pkt) != nil {
+						return
+					}
+				}
+			}()
+
+			// The writer above, and the sampler below, were running before we began
+			before := runtime.NumGoroutine() + 1
+			peak := make(chan int)
+			stop := make(chan struct{})
+			go func() {
+				t := time.NewTicker(100 * time.Microsecond)
+				defer t.Stop()
+
+				n := 0
+				for {
+					select {
+					case <-t.C:
+						n = max(n, runtime.NumGoroutine()-before)
+					case <-stop:
+						peak <- n
+						return
+					}
+				}
+			}()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := next(); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.StopTimer()
+			close(stop)
+			b.ReportMetric(float64(<-peak), "goroutines")
+		})
+	}
+}
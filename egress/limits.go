@@ -0,0 +1,302 @@
+package egress
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// StatusQuotaExceeded is the WebSocket close code we send to a widget which has used up a quota
+const StatusQuotaExceeded websocket.StatusCode = 4029
+
+// ErrQuotaExceeded is returned when a widget's connection has used up a quota
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// ErrRateLimited is returned when a widget's packet would exceed a rate limit, and so is dropped
+var ErrRateLimited = errors.New("rate limited")
+
+// minBurst is the smallest burst we allow a rate limit, so a single QUIC packet never has to wait
+// for tokens it could never accumulate
+const minBurst = 64 * 1024
+
+// Limits configures the bandwidth widgets may use. Bytes are counted in both directions. Rate
+// limits throttle a connection, while exceeding a quota closes it with StatusQuotaExceeded. An
+// identity is a widget's authenticated identity if it has one, or else its IP address. Zero means
+// unlimited.
+type Limits struct {
+	ConnRate      int64         // Bytes per second on each connection
+	IdentityRate  int64         // Bytes per second across all of an identity's connections
+	ConnQuota     int64         // Bytes per QuotaWindow on each connection
+	IdentityQuota int64         // Bytes per QuotaWindow across all of an identity's connections
+	QuotaWindow   time.Duration // The rolling window over which quotas are counted
+}
+
+// tokenBucket is a token bucket rate limiter which may go into debt, so any amount can be taken at
+// once, at the cost of waiting for the debt to be repaid
+type tokenBucket struct {
+	mx     sync.Mutex
+	rate   float64 // Tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	burst := float64(max(rate, minBurst))
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: now}
+}
+
+// take n tokens, returning how long to wait before using them
+func (b *tokenBucket) take(n int, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allow takes n tokens, unless we're in debt, in which case it returns false and takes none
+func (b *tokenBucket) allow(n int, now time.Time) bool {
+	return allowAll(n, now, b)
+}
+
+// allowAll takes n tokens from each of buckets, unless any of them is in debt, in which case it
+// returns false and takes none. Nil buckets are unlimited. Buckets are locked in the order given,
+// so callers sharing a bucket must pass it in the same position.
+func allowAll(n int, now time.Time, buckets ...*tokenBucket) bool {
+	ok := true
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+
+		b.mx.Lock()
+		defer b.mx.Unlock()
+
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		ok = ok && b.tokens >= 0
+	}
+
+	if !ok {
+		return false
+	}
+
+	for _, b := range buckets {
+		if b != nil {
+			b.tokens -= float64(n)
+		}
+	}
+
+	return true
+}
+
+// rollingQuota limits the bytes used in any window. It approximates a sliding window by counting
+// bytes in fixed windows, and weighting the previous window by how much of it the sliding window
+// still overlaps.
+type rollingQuota struct {
+	mx     sync.Mutex
+	limit  int64
+	window time.Duration
+	start  time.Time // Of the current fixed window
+	cur    int64
+	prev   int64
+}
+
+func newRollingQuota(limit int64, window time.Duration, now time.Time) *rollingQuota {
+	if limit <= 0 || window <= 0 {
+		return nil
+	}
+
+	return &rollingQuota{limit: limit, window: window, start: now}
+}
+
+// add n bytes, returning false if that exceeds the quota
+func (q *rollingQuota) add(n int, now time.Time) bool {
+	if q == nil {
+		return true
+	}
+
+	q.mx.Lock()
+	defer q.mx.Unlock()
+
+	switch elapsed := now.Sub(q.start); {
+	case elapsed >= 2*q.window:
+		q.start, q.prev, q.cur = now, 0, 0
+	case elapsed >= q.window:
+		q.start, q.prev, q.cur = q.start.Add(q.window), q.cur, 0
+	}
+
+	q.cur += int64(n)
+	overlap := 1 - float64(now.Sub(q.start))/float64(q.window)
+	return float64(q.prev)*overlap+float64(q.cur) <= float64(q.limit)
+}
+
+// identityLimit holds the limits shared by an identity's connections
+type identityLimit struct {
+	rate  *tokenBucket
+	quota *rollingQuota
+	conns int
+	evict *time.Timer // Forgets the identity once it's been idle for a quota window
+}
+
+// limiter applies Limits to a Listener's connections
+type limiter struct {
+	limits     Limits
+	mx         sync.Mutex
+	identities map[string]*identityLimit
+}
+
+// newLimiter returns a limiter for limits, or nil if limits is nil
+func newLimiter(limits *Limits) *limiter {
+	if limits == nil {
+		return nil
+	}
+
+	return &limiter{limits: *limits, identities: make(map[string]*identityLimit)}
+}
+
+// acquire the limits for a new connection by identity
+func (l *limiter) acquire(identity string) *connLimit {
+	if l == nil {
+		return nil
+	}
+
+	now := time.Now()
+
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	id, ok := l.identities[identity]
+	if !ok {
+		id = &identityLimit{
+			rate:  newTokenBucket(l.limits.IdentityRate, now),
+			quota: newRollingQuota(l.limits.IdentityQuota, l.limits.QuotaWindow, now),
+		}
+		l.identities[identity] = id
+	}
+	if id.evict != nil {
+		id.evict.Stop()
+		id.evict = nil
+	}
+	id.conns++
+
+	return &connLimit{
+		l:        l,
+		id:       id,
+		identity: identity,
+		rate:     newTokenBucket(l.limits.ConnRate, now),
+		quota:    newRollingQuota(l.limits.ConnQuota, l.limits.QuotaWindow, now),
+		done:     make(chan struct{}),
+	}
+}
+
+// idle arranges to forget an identity whose last connection has been released. Its limits outlive
+// its connections by a quota window, so reconnecting doesn't reset its quota. Call with l.mx held.
+func (l *limiter) idle(identity string, id *identityLimit) {
+	id.evict = time.AfterFunc(l.limits.QuotaWindow, func() {
+		l.mx.Lock()
+		defer l.mx.Unlock()
+
+		if id.conns == 0 && l.identities[identity] == id {
+			delete(l.identities, identity)
+		}
+	})
+}
+
+// connLimit applies Limits to one connection. A nil *connLimit is unlimited.
+type connLimit struct {
+	l        *limiter
+	id       *identityLimit
+	identity string
+	rate     *tokenBucket
+	quota    *rollingQuota
+	done     chan struct{}
+	once     sync.Once
+}
+
+// use accounts for n bytes sent or received, first waiting for as long as our rate limits require.
+// It returns ErrQuotaExceeded if that uses up a quota, or net.ErrClosed if we're released while
+// waiting.
+func (c *connLimit) use(n int) error {
+	if c == nil {
+		return nil
+	}
+
+	now := time.Now()
+	if !c.quota.add(n, now) || !c.id.quota.add(n, now) {
+		return ErrQuotaExceeded
+	}
+
+	if wait := max(c.rate.take(n, now), c.id.rate.take(n, now)); wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+		case <-c.done:
+			return net.ErrClosed
+		}
+	}
+
+	return nil
+}
+
+// allow accounts for n bytes at now like use, but rather than wait for our rate limits, it returns
+// ErrRateLimited if they're exceeded, so the caller may drop the packet. Widgets which share a
+// socket mustn't wait for each other. Dropped packets count against quotas, but not rate limits:
+// a packet is charged to the connection's and identity's rates only if both allow it, so one
+// limit can't spend the other's tokens on a packet it then drops.
+func (c *connLimit) allow(n int, now time.Time) error {
+	if c == nil {
+		return nil
+	}
+
+	if !c.quota.add(n, now) || !c.id.quota.add(n, now) {
+		return ErrQuotaExceeded
+	}
+
+	// The connection's bucket is its own, so it always goes first and its identity's second
+	if !allowAll(n, now, c.rate, c.id.rate) {
+		return ErrRateLimited
+	}
+
+	return nil
+}
+
+// release the connection's share of its identity's limits
+func (c *connLimit) release() {
+	if c == nil {
+		return
+	}
+
+	c.once.Do(func() {
+		close(c.done)
+
+		c.l.mx.Lock()
+		defer c.l.mx.Unlock()
+
+		c.id.conns--
+		if c.id.conns == 0 {
+			c.l.idle(c.identity, c.id)
+		}
+	})
+}
@@ -0,0 +1,203 @@
+package egress
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/getlantern/broflake/common"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(100*1024, now)
+
+	// The burst is free, and then we go into debt
+	if wait := b.take(100*1024, now); wait != 0 {
+		t.Errorf("expected the burst to be free, waited %v", wait)
+	}
+
+	if wait := b.take(50*1024, now); wait != 500*time.Millisecond {
+		t.Errorf("expected to wait 500ms, waited %v", wait)
+	}
+
+	// Tokens refill with time, but only up to the burst
+	if wait := b.take(50*1024, now.Add(time.Second)); wait != 0 {
+		t.Errorf("expected the debt to be repaid, waited %v", wait)
+	}
+
+	if wait := b.take(100*1024+1, now.Add(time.Hour)); wait == 0 {
+		t.Errorf("expected tokens to refill only up to the burst")
+	}
+
+	// Slow rates still allow a whole packet at once
+	if wait := newTokenBucket(10, now).take(1500, now); wait != 0 {
+		t.Errorf("expected a packet to fit in the minimum burst, waited %v", wait)
+	}
+}
+
+func TestRollingQuota(t *testing.T) {
+	now := time.Now()
+	q := newRollingQuota(1000, time.Minute, now)
+
+	if !q.add(1000, now) {
+		t.Fatal("expected the whole quota to be usable")
+	}
+
+	if q.add(1, now.Add(30*time.Second)) {
+		t.Error("expected the quota to be exceeded")
+	}
+
+	// Halfway into the next window, half of the last window still counts
+	if !q.add(400, now.Add(90*time.Second)) {
+		t.Error("expected the quota to have partly recovered")
+	}
+
+	if q.add(200, now.Add(90*time.Second)) {
+		t.Error("expected the quota to be exceeded again")
+	}
+
+	// After two windows, it's all forgotten
+	if !q.add(1000, now.Add(5*time.Minute)) {
+		t.Error("expected the quota to have recovered")
+	}
+}
+
+func TestLimiterIdentities(t *testing.T) {
+	l := newLimiter(&Limits{IdentityQuota: 1000, QuotaWindow: time.Hour})
+
+	a, b := l.acquire("widget-1"), l.acquire("widget-1")
+	if err := a.use(600); err != nil {
+		t.Fatal(err)
+	}
+
+	// An identity's connections share its quota, even across reconnections
+	b.release()
+	a.release()
+
+	if err := l.acquire("widget-1").use(600); err != ErrQuotaExceeded {
+		t.Errorf("got %v, expected the shared quota to be exceeded", err)
+	}
+
+	if err := l.acquire("widget-2").use(600); err != nil {
+		t.Errorf("expected another identity to have its own quota, got %v", err)
+	}
+
+	if newLimiter(nil).acquire("widget-1").use(1<<30) != nil {
+		t.Error("expected no limits to be unlimited")
+	}
+}
+
+func TestLimiterEviction(t *testing.T) {
+	l := newLimiter(&Limits{IdentityQuota: 1000, QuotaWindow: 50 * time.Millisecond})
+
+	identities := func() int {
+		l.mx.Lock()
+		defer l.mx.Unlock()
+		return len(l.identities)
+	}
+
+	// An identity with a connection is kept however long it lasts
+	a := l.acquire("widget-1")
+	a.release()
+	b := l.acquire("widget-1")
+	if a.id != b.id {
+		t.Error("expected reconnecting within the window to keep the identity")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := identities(); n != 1 {
+		t.Errorf("got %v identities, expected a connected identity to be kept", n)
+	}
+
+	b.release()
+	time.Sleep(100 * time.Millisecond)
+	if n := identities(); n != 0 {
+		t.Errorf("got %v identities, expected an idle identity to be forgotten", n)
+	}
+}
+
+func TestConnLimitAllow(t *testing.T) {
+	c := newLimiter(&Limits{ConnRate: minBurst, ConnQuota: 4 * minBurst, QuotaWindow: time.Hour}).acquire("widget-1")
+	now := time.Now()
+
+	// Rather than wait, we drop packets while we're in debt
+	if err := c.allow(minBurst+1, now); err != nil {
+		t.Fatalf("expected the burst to be allowed, got %v", err)
+	}
+
+	if err := c.allow(1, now); err != ErrRateLimited {
+		t.Errorf("got %v, expected to be rate limited", err)
+	}
+
+	if err := c.allow(1, now.Add(time.Second)); err != nil {
+		t.Errorf("expected the debt to be repaid, got %v", err)
+	}
+
+	// Dropped packets still count against quotas
+	for i := 0; i < 4; i++ {
+		c.allow(minBurst, now.Add(time.Second))
+	}
+
+	if err := c.allow(1, now.Add(time.Second)); err != ErrQuotaExceeded {
+		t.Errorf("got %v, expected the quota to be exceeded", err)
+	}
+}
+
+func TestConnLimitAllowBoth(t *testing.T) {
+	l := newLimiter(&Limits{ConnRate: minBurst, IdentityRate: minBurst})
+	a, b := l.acquire("widget-1"), l.acquire("widget-1")
+	now := time.Now()
+
+	if err := a.allow(minBurst+1, now); err != nil {
+		t.Fatalf("expected the burst to be allowed, got %v", err)
+	}
+
+	// b's own bucket would allow the packet, but its identity's is in debt, so neither is charged
+	if err := b.allow(minBurst, now); err != ErrRateLimited {
+		t.Errorf("got %v, expected to be rate limited by the identity", err)
+	}
+
+	if b.rate.tokens != minBurst {
+		t.Errorf("got %v tokens, expected a dropped packet not to spend the connection's", b.rate.tokens)
+	}
+
+	// Likewise, a connection in debt doesn't charge its identity
+	c := newLimiter(&Limits{ConnRate: minBurst, IdentityRate: 4 * minBurst}).acquire("widget-1")
+	now = time.Now()
+	c.allow(minBurst+1, now)
+	if err := c.allow(minBurst, now); err != ErrRateLimited {
+		t.Errorf("got %v, expected to be rate limited by the connection", err)
+	}
+
+	if c.id.rate.tokens != 3*minBurst-1 {
+		t.Errorf("got %v tokens, expected a dropped packet not to spend the identity's", c.id.rate.tokens)
+	}
+}
+
+func TestListenerQuota(t *testing.T) {
+	_, ws := startListener(t, &ListenerOptions{Limits: &Limits{ConnQuota: 4096, QuotaWindow: time.Hour}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c, _, err := websocket.Dial(ctx, ws, &websocket.DialOptions{HTTPHeader: http.Header{common.VersionHeader: {common.Version}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.CloseNow()
+
+	// The egress server counts our packets against the quota before QUIC gets to ignore them
+	for i := 0; i < 5; i++ {
+		if err := c.Write(ctx, websocket.MessageBinary, make([]byte, 1024)); err != nil {
+			break
+		}
+	}
+
+	if _, _, err := c.Read(ctx); websocket.CloseStatus(err) != StatusQuotaExceeded {
+		t.Errorf("got %v, expected close code %v", err, StatusQuotaExceeded)
+	}
+}
@@ -0,0 +1,349 @@
+package egress
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/quic-go/quic-go"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// nativeChallengeTTL is how long a widget has to answer the nonce we challenge its hello with
+const nativeChallengeTTL = 30 * time.Second
+
+// nativeReplyRate bounds the replies per second we send to addresses we haven't admitted. A source
+// address on plain UDP is easily spoofed, so if we answered every packet, we'd be a reflector.
+const nativeReplyRate = 100
+
+// nativePacketConn wraps the UDP socket which native widgets relay QUIC to us over. It answers
+// widgets' hellos (see common.Hello), and only passes our QUIC listener the packets of widgets
+// it's admitted, accounting for and limiting each widget by its address. Widgets share the socket,
+// so rather than make each other wait, a widget's packets are dropped while it's over its rate
+// limit.
+type nativePacketConn struct {
+	net.PacketConn
+	l       *Listener
+	mx      sync.Mutex
+	widgets map[string]*nativeWidget // By address
+	replies *tokenBucket             // Bounds our replies to addresses we haven't admitted
+	secret  []byte                   // Signs the nonces we challenge hellos with
+	done    chan struct{}
+	once    sync.Once
+}
+
+// nativeWidget is a native widget we've admitted
+type nativeWidget struct {
+	widget
+	limit *connLimit
+	last  atomic.Int64 // Unix nanos of the last packet we received from it
+}
+
+func newNativePacketConn(conn net.PacketConn, l *Listener) *nativePacketConn {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	return &nativePacketConn{
+		PacketConn: conn,
+		l:          l,
+		widgets:    make(map[string]*nativeWidget),
+		replies:    &tokenBucket{rate: nativeReplyRate, burst: nativeReplyRate, tokens: nativeReplyRate, last: time.Now()},
+		secret:     secret,
+		done:       make(chan struct{}),
+	}
+}
+
+func (c *nativePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+
+		if n > 0 && p[0] == common.Hello {
+			c.hello(p[:n], addr)
+			continue
+		}
+
+		w := c.widget(addr)
+		if w == nil {
+			// We've forgotten the widget, or it's moved, so it must say hello again
+			c.replyUnadmitted(common.NewHelloReply(http.StatusPreconditionRequired), addr)
+			continue
+		}
+
+		now := time.Now()
+		w.last.Store(now.UnixNano())
+		w.stats.addIngress(n)
+
+		if err := w.limit.allow(n, now); err != nil {
+			c.limited(w, addr, err)
+			continue
+		}
+
+		return n, addr, nil
+	}
+}
+
+func (c *nativePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	// Like any packet the network loses, packets we drop are left to QUIC to recover from
+	w := c.widget(addr)
+	if w == nil {
+		return len(p), nil
+	}
+
+	if err := w.limit.allow(len(p), time.Now()); err != nil {
+		c.limited(w, addr, err)
+		return len(p), nil
+	}
+
+	n, err := c.PacketConn.WriteTo(p, addr)
+	if err == nil {
+		w.stats.addEgress(n)
+	}
+
+	return n, err
+}
+
+// hello admits the widget at addr, if its hello passes
+func (c *nativePacketConn) hello(b []byte, addr net.Addr) {
+	q, ok := common.ParseHello(b)
+	if !ok {
+		return
+	}
+
+	// The widget didn't hear our reply
+	if c.widget(addr) != nil {
+		c.reply(http.StatusOK, addr)
+		return
+	}
+
+	r := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{RawQuery: q.Encode()},
+		Header:     make(http.Header),
+		RemoteAddr: addr.String(),
+	}
+
+	// A widget can't present its token in the clear, so it must answer a nonce instead. Since we
+	// send the nonce to its address, answering also proves the address is really its own.
+	if c.l.auth != nil {
+		nonce := q.Get("nonce")
+		if !c.validNonce(nonce, addr, time.Now()) {
+			c.replyUnadmitted(common.NewHelloChallenge(c.nonce(addr, time.Now())), addr)
+			return
+		}
+		r = r.WithContext(withChallenge(context.Background(), nonce))
+	}
+
+	identity, status := c.l.admit(r, transportQUIC)
+	if status != http.StatusOK {
+		c.replyUnadmitted(common.NewHelloReply(status), addr)
+		return
+	}
+
+	// Anonymous widgets are limited by their IP address
+	if identity == "" {
+		identity, _, _ = net.SplitHostPort(addr.String())
+	}
+
+	session := uuid.NewString()
+	w := &nativeWidget{
+		widget: widget{
+			name:  fmt.Sprintf("native widget %v", session),
+			addr:  addr,
+			stats: newConnStats(r, transportQUIC, c.l.labels, c.l.m),
+			log:   logger.With("session", session, "remoteAddr", addr, "identity", identity),
+		},
+		limit: c.l.limiter.acquire(identity),
+	}
+	w.last.Store(time.Now().UnixNano())
+
+	c.mx.Lock()
+	c.widgets[addr.String()] = w
+	c.mx.Unlock()
+
+	w.log.Debug("admitted a native widget")
+	c.reply(http.StatusOK, addr)
+}
+
+func (c *nativePacketConn) reply(status int, addr net.Addr) {
+	c.PacketConn.WriteTo(common.NewHelloReply(status), addr)
+}
+
+// replyUnadmitted sends reply to addr, which we haven't admitted, unless we've sent too many such
+// replies lately. A widget which doesn't hear from us says hello again.
+func (c *nativePacketConn) replyUnadmitted(reply []byte, addr net.Addr) {
+	if c.replies.allow(1, time.Now()) {
+		c.PacketConn.WriteTo(reply, addr)
+	}
+}
+
+// nonce returns a nonce to challenge the hello from addr with at now. Rather than remember the
+// nonces we hand out to addresses which may be spoofed, we sign each with the time and address it
+// was made for, and check that when it comes back.
+func (c *nativePacketConn) nonce(addr net.Addr, now time.Time) string {
+	b := binary.BigEndian.AppendUint64(nil, uint64(now.Unix()))
+	return base64.RawURLEncoding.EncodeToString(append(b, c.nonceMAC(b, addr)...))
+}
+
+// validNonce reports whether nonce is one we made for addr no more than nativeChallengeTTL before
+// now
+func (c *nativePacketConn) validNonce(nonce string, addr net.Addr, now time.Time) bool {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) < 8 || !hmac.Equal(b[8:], c.nonceMAC(b[:8], addr)) {
+		return false
+	}
+
+	made := time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0)
+	return !now.Before(made) && now.Sub(made) <= nativeChallengeTTL
+}
+
+func (c *nativePacketConn) nonceMAC(made []byte, addr net.Addr) []byte {
+	h := hmac.New(sha256.New, c.secret)
+	h.Write(made)
+	h.Write([]byte(addr.String()))
+	return h.Sum(nil)[:16]
+}
+
+// limited handles an error from a widget's connLimit. If it's exceeded a quota, we forget it, and
+// tell it why.
+func (c *nativePacketConn) limited(w *nativeWidget, addr net.Addr, err error) {
+	if !errors.Is(err, ErrQuotaExceeded) {
+		return
+	}
+
+	w.log.Info("forgetting a native widget which exceeded its quota")
+	c.l.m.quotaExceeded.Add(context.Background(), 1)
+	c.forget(addr.String(), "quota")
+	c.reply(http.StatusTooManyRequests, addr)
+}
+
+func (c *nativePacketConn) widget(addr net.Addr) *nativeWidget {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.widgets[addr.String()]
+}
+
+// widgetFor returns the widget which relayed conn to us
+func (c *nativePacketConn) widgetFor(conn quic.Connection) *widget {
+	if w := c.widget(conn.RemoteAddr()); w != nil {
+		return &w.widget
+	}
+
+	return nil
+}
+
+func (c *nativePacketConn) forget(addr, reason string) {
+	c.mx.Lock()
+	w, ok := c.widgets[addr]
+	delete(c.widgets, addr)
+	c.mx.Unlock()
+
+	if ok {
+		w.limit.release()
+		w.log.Debug("forgot a native widget", append(w.stats.close(), "reason", reason)...)
+	}
+}
+
+// reap forgets widgets we've received nothing from for idle. A live QUIC connection sends
+// keepalives far more often than that.
+func (c *nativePacketConn) reap(idle time.Duration) {
+	t := time.NewTicker(idle / 4)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-c.done:
+			return
+		}
+
+		var quiet []string
+		c.mx.Lock()
+		for addr, w := range c.widgets {
+			if time.Since(time.Unix(0, w.last.Load())) >= idle {
+				quiet = append(quiet, addr)
+			}
+		}
+		c.mx.Unlock()
+
+		for _, addr := range quiet {
+			c.forget(addr, "idle")
+		}
+	}
+}
+
+// Close the socket, forgetting every widget
+func (c *nativePacketConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.done)
+		err = c.PacketConn.Close()
+
+		c.mx.Lock()
+		addrs := make([]string, 0, len(c.widgets))
+		for addr := range c.widgets {
+			addrs = append(addrs, addr)
+		}
+		c.mx.Unlock()
+
+		for _, addr := range addrs {
+			c.forget(addr, "closed")
+		}
+	})
+
+	return err
+}
+
+// ServeQUIC accepts QUIC which native widgets relay to us over conn, a UDP socket, until the
+// Listener is closed, when it closes conn and returns net.ErrClosed. Unlike over a WebSocket, a
+// packet lost on its way to us doesn't hold up the packets behind it. Widgets must say hello before
+// we accept what they relay (see common.Hello), and we forget widgets which are idle for the
+// Listener's idle timeout. Hellos can't carry tokens, so if the Listener authenticates widgets, we
+// challenge each hello with a nonce, which the widget must answer with proof of its token.
+func (l *Listener) ServeQUIC(conn net.PacketConn) error {
+	c := newNativePacketConn(conn, l)
+
+	listener, err := quic.Listen(c, l.tlsConfig, &common.QUICCfg)
+	if err != nil {
+		c.Close()
+		return err
+	}
+
+	closeTransport := func() {
+		listener.Close()
+		c.Close()
+	}
+
+	sess := l.addSession(closeTransport)
+	if sess == nil {
+		closeTransport()
+		return net.ErrClosed
+	}
+	defer l.removeSession(sess)
+
+	go c.reap(l.idleTimeout)
+
+	logger.Info("egress server listening for native QUIC", "addr", conn.LocalAddr())
+	err = l.serveQUIC(listener, sess, c.widgetFor)
+	c.Close()
+
+	if l.draining.Load() {
+		return net.ErrClosed
+	}
+	return err
+}
@@ -0,0 +1,256 @@
+package egress
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// serveUDP serves l's native QUIC or WebTransport ingress on a new UDP socket, whose address it
+// returns. Our cleanup expects serve to return net.ErrClosed once l is closed.
+func serveUDP(t *testing.T, l *Listener, serve func(*Listener, net.PacketConn) error) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- serve(l, conn) }()
+
+	t.Cleanup(func() {
+		l.Close()
+		if err := <-served; !errors.Is(err, net.ErrClosed) {
+			t.Errorf("got %v, expected serving to end with net.ErrClosed", err)
+		}
+	})
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// hello says hello to the egress server at addr over conn, returning the status it replies with
+func hello(t *testing.T, conn *net.UDPConn, addr net.Addr, q url.Values) int {
+	status, _ := common.ParseHelloReply(helloReply(t, conn, addr, q))
+	return status
+}
+
+// helloReply says hello to the egress server at addr over conn, returning its reply
+func helloReply(t *testing.T, conn *net.UDPConn, addr net.Addr, q url.Values) []byte {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	if _, err := conn.WriteTo(common.NewHello(q), addr); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 1500)
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := common.ParseHelloReply(b[:n]); !ok {
+		t.Fatalf("expected a reply to our hello, got %x", b[:n])
+	}
+	return b[:n]
+}
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestServeQUIC(t *testing.T) {
+	echo := startEcho(t)
+	l, _ := startListener(t, nil)
+	go NewForwarder(nil).Serve(l)
+	egress := serveUDP(t, l, (*Listener).ServeQUIC)
+
+	// Widgets must present the same version they would in a WebSocket's handshake...
+	conn := listenUDP(t)
+	if status := hello(t, conn, egress, url.Values{"version": {"v999.0.0"}}); status != http.StatusTeapot {
+		t.Errorf("got %v, expected a widget with the wrong version to be refused", status)
+	}
+
+	// ...and widgets which haven't said hello are asked to
+	if _, err := conn.WriteTo([]byte{0xc0, 0, 0, 0, 1}, egress); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, _, err := conn.ReadFrom(b); err != nil {
+		t.Fatal(err)
+	} else if status, _ := common.ParseHelloReply(b[:n]); status != http.StatusPreconditionRequired {
+		t.Errorf("got %v, expected to be asked to say hello", status)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	q := url.Values{"version": {common.Version}}
+	if status := hello(t, conn, egress, q); status != http.StatusOK {
+		t.Fatalf("got %v, expected to be admitted", status)
+	}
+
+	// Saying hello again, as if our reply was lost, is harmless
+	if status := hello(t, conn, egress, q); status != http.StatusOK {
+		t.Fatalf("got %v, expected to be admitted again", status)
+	}
+
+	// Once admitted, the widget relays its clients' QUIC packets as they are
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tr := &quic.Transport{Conn: conn}
+	qconn, err := tr.Dial(ctx, egress, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"broflake"}}, &common.QUICCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qconn.CloseWithError(0, "")
+
+	stream, err := openEcho(qconn, echo)
+	if err != nil || !echoes(stream) {
+		t.Fatalf("couldn't echo over native QUIC: %v", err)
+	}
+}
+
+// Hellos travel in the clear, so a Listener which authenticates widgets challenges them to prove
+// they hold a token without presenting it
+func TestServeQUICAuth(t *testing.T) {
+	key := []byte("NELSON WUZ HERE NELSON WUZ HERE!")
+	l, _ := startListener(t, &ListenerOptions{Auth: &TokenAuthenticator{Keys: [][]byte{key}}})
+	egress := serveUDP(t, l, (*Listener).ServeQUIC)
+	token := common.SignToken(key, "widget-1", time.Now().Add(time.Minute))
+
+	// A token in the clear isn't good enough
+	conn := listenUDP(t)
+	q := url.Values{"version": {common.Version}, "token": {token}}
+	nonce, ok := common.ParseHelloChallenge(helloReply(t, conn, egress, q))
+	if !ok {
+		t.Fatal("expected to be challenged")
+	}
+
+	claims, proof, err := common.TokenProof(token, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q = url.Values{"version": {common.Version}, "nonce": {nonce}, "claims": {claims}, "proof": {proof}}
+	if status := hello(t, conn, egress, q); status != http.StatusOK {
+		t.Fatalf("got %v, expected our proof to be accepted", status)
+	}
+
+	// A nonce is only good from the address it was sent to, so a sniffed proof can't be replayed...
+	other := listenUDP(t)
+	if _, ok := common.ParseHelloChallenge(helloReply(t, other, egress, q)); !ok {
+		t.Error("expected a replayed proof to be challenged")
+	}
+
+	// ...and a proof of a token we didn't sign is refused
+	nonce, _ = common.ParseHelloChallenge(helloReply(t, other, egress, url.Values{"version": {common.Version}}))
+	claims, proof, _ = common.TokenProof(common.SignToken([]byte("some other key"), "widget-1", time.Now().Add(time.Minute)), nonce)
+	q = url.Values{"version": {common.Version}, "nonce": {nonce}, "claims": {claims}, "proof": {proof}}
+	if status := hello(t, other, egress, q); status != http.StatusUnauthorized {
+		t.Errorf("got %v, expected a forged proof to be refused", status)
+	}
+}
+
+func TestNativeNonce(t *testing.T) {
+	c := newNativePacketConn(nil, nil)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	now := time.Now().Truncate(time.Second) // Nonces are made to the second
+	nonce := c.nonce(addr, now)
+
+	if !c.validNonce(nonce, addr, now.Add(nativeChallengeTTL)) {
+		t.Error("expected a nonce to be valid until it expires")
+	}
+
+	if c.validNonce(nonce, addr, now.Add(nativeChallengeTTL+time.Second)) {
+		t.Error("expected an expired nonce to be invalid")
+	}
+
+	if c.validNonce(nonce, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}, now) {
+		t.Error("expected a nonce to be invalid from another address")
+	}
+
+	if c.validNonce(newNativePacketConn(nil, nil).nonce(addr, now), addr, now) {
+		t.Error("expected a nonce we didn't make to be invalid")
+	}
+}
+
+// Anyone can send us packets from a spoofed address, so we mustn't answer every one
+func TestServeQUICReplyRate(t *testing.T) {
+	l, _ := startListener(t, nil)
+	egress := serveUDP(t, l, (*Listener).ServeQUIC)
+
+	conn := listenUDP(t)
+	for i := 0; i < 3*nativeReplyRate; i++ {
+		if _, err := conn.WriteTo([]byte{0xc0, 0, 0, 0, 1}, egress); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var replies int
+	b := make([]byte, 1500)
+	for {
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		if _, _, err := conn.ReadFrom(b); err != nil {
+			break
+		}
+		replies++
+	}
+
+	if replies == 0 || replies > 2*nativeReplyRate {
+		t.Errorf("got %v replies to %v unknown packets, expected some, but not many more than %v", replies, 3*nativeReplyRate, nativeReplyRate)
+	}
+}
+
+func TestServeQUICShutdown(t *testing.T) {
+	echo := startEcho(t)
+	l, _ := startListener(t, nil)
+	go NewForwarder(nil).Serve(l)
+	egress := serveUDP(t, l, (*Listener).ServeQUIC)
+
+	conn := listenUDP(t)
+	if status := hello(t, conn, egress, url.Values{"version": {common.Version}}); status != http.StatusOK {
+		t.Fatalf("got %v, expected to be admitted", status)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tr := &quic.Transport{Conn: conn}
+	qconn, err := tr.Dial(ctx, egress, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"broflake"}}, &common.QUICCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qconn.CloseWithError(0, "")
+
+	if _, err := openEcho(qconn, echo); err != nil {
+		t.Fatal(err)
+	}
+
+	go l.Shutdown(ctx)
+
+	// Native widgets' clients are asked to go away too
+	goAway, err := qconn.AcceptStream(ctx)
+	if err != nil {
+		t.Fatalf("expected a GOAWAY: %v", err)
+	}
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(goAway, b); err != nil || b[0] != common.GoAway {
+		t.Errorf("got %#x %v, expected a GOAWAY", b[0], err)
+	}
+}
@@ -0,0 +1,202 @@
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ErrDestinationDenied is returned when a Policy won't let us connect to a destination
+var ErrDestinationDenied = errors.New("destination denied by policy")
+
+// DeniedError says why a Policy denied a destination. It's an ErrDestinationDenied.
+type DeniedError struct {
+	Addr   string // The destination, as requested
+	Reason string // "port" or "address"
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("%v: %v (%v)", ErrDestinationDenied, e.Addr, e.Reason)
+}
+
+func (e *DeniedError) Is(target error) bool {
+	return target == ErrDestinationDenied
+}
+
+// DefaultDenyCIDRs are the addresses which no widget should be able to reach through us: our own
+// host, the networks it's attached to, and the cloud metadata services which live on them
+var DefaultDenyCIDRs = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "This network"
+	netip.MustParsePrefix("10.0.0.0/8"),     // Private
+	netip.MustParsePrefix("100.64.0.0/10"),  // Carrier-grade NAT, and Alibaba Cloud's metadata service
+	netip.MustParsePrefix("127.0.0.0/8"),    // Loopback
+	netip.MustParsePrefix("169.254.0.0/16"), // Link-local, and most clouds' metadata services
+	netip.MustParsePrefix("172.16.0.0/12"),  // Private
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("192.168.0.0/16"), // Private
+	netip.MustParsePrefix("198.18.0.0/15"),  // Benchmarking
+	netip.MustParsePrefix("224.0.0.0/4"),    // Multicast
+	netip.MustParsePrefix("240.0.0.0/4"),    // Reserved, and broadcast
+	netip.MustParsePrefix("::/128"),         // Unspecified
+	netip.MustParsePrefix("::1/128"),        // Loopback
+	netip.MustParsePrefix("64:ff9b:1::/48"), // Local-use NAT64
+	netip.MustParsePrefix("fc00::/7"),       // Unique local, and AWS's IPv6 metadata service
+	netip.MustParsePrefix("fe80::/10"),      // Link-local
+	netip.MustParsePrefix("ff00::/8"),       // Multicast
+}
+
+// IPv6 addresses in these prefixes embed an IPv4 address, which a NAT64 or 6to4 gateway on our
+// network would deliver them to
+var (
+	nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFour   = netip.MustParsePrefix("2002::/16")
+)
+
+// embeddedIPv4 returns the IPv4 address embedded in addr, if it's a NAT64 or 6to4 address
+func embeddedIPv4(addr netip.Addr) (netip.Addr, bool) {
+	b := addr.As16()
+
+	switch {
+	case nat64Prefix.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[12:16])), true
+	case sixToFour.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[2:6])), true
+	}
+
+	return netip.Addr{}, false
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Lo, Hi uint16
+}
+
+func (r PortRange) contains(port uint16) bool {
+	return port >= r.Lo && port <= r.Hi
+}
+
+// ParsePortRange parses a port, like "443", or a range of ports, like "8000-8999"
+func ParsePortRange(s string) (PortRange, error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hi = lo
+	}
+
+	l, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port '%v'", s)
+	}
+
+	h, err := strconv.ParseUint(strings.TrimSpace(hi), 10, 16)
+	if err != nil || h < l {
+		return PortRange{}, fmt.Errorf("invalid port range '%v'", s)
+	}
+
+	return PortRange{Lo: uint16(l), Hi: uint16(h)}, nil
+}
+
+// Policy decides which destinations a Forwarder may connect to. It judges the addresses which
+// destinations resolve to, rather than their names, and the Forwarder connects only to addresses
+// which it allows, so a name can't be rebound to a denied address between the check and the dial.
+type Policy struct {
+	DenyCIDRs  []netip.Prefix // Addresses we may not connect to
+	AllowCIDRs []netip.Prefix // Exceptions to DenyCIDRs
+	AllowPorts []PortRange    // If non-empty, the only ports we may connect to
+	DenyPorts  []PortRange    // Ports we may not connect to
+}
+
+// DefaultPolicy returns a Policy which denies DefaultDenyCIDRs
+func DefaultPolicy() *Policy {
+	return &Policy{DenyCIDRs: append([]netip.Prefix(nil), DefaultDenyCIDRs...)}
+}
+
+// allowPort returns true if we may connect to port
+func (p *Policy) allowPort(port uint16) bool {
+	for _, r := range p.DenyPorts {
+		if r.contains(port) {
+			return false
+		}
+	}
+
+	if len(p.AllowPorts) == 0 {
+		return true
+	}
+
+	for _, r := range p.AllowPorts {
+		if r.contains(port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowAddr returns true if we may connect to addr. An address which embeds an IPv4 address may
+// reach it, so unless it's allowed explicitly, it must pass as that IPv4 address too.
+func (p *Policy) allowAddr(addr netip.Addr) bool {
+	// Zoned addresses never match a prefix, and IPv4-mapped IPv6 addresses don't match IPv4 ones
+	addr = addr.Unmap().WithZone("")
+
+	for _, prefix := range p.AllowCIDRs {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	for _, prefix := range p.DenyCIDRs {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	if v4, ok := embeddedIPv4(addr); ok {
+		return p.allowAddr(v4)
+	}
+
+	return true
+}
+
+// Resolve returns the addresses at which the policy lets us reach addr, a host:port, resolving it
+// if it's a name. If we may not reach it at any of them, it returns a *DeniedError.
+func (p *Policy) Resolve(ctx context.Context, addr string) ([]netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := net.DefaultResolver.LookupPort(ctx, "tcp", portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.allowPort(uint16(port)) {
+		return nil, &DeniedError{Addr: addr, Reason: "port"}
+	}
+
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip}
+	} else {
+		ips, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var allowed []netip.AddrPort
+	for _, ip := range ips {
+		if p.allowAddr(ip) {
+			allowed = append(allowed, netip.AddrPortFrom(ip.Unmap().WithZone(""), uint16(port)))
+		}
+	}
+
+	if len(allowed) == 0 {
+		return nil, &DeniedError{Addr: addr, Reason: "address"}
+	}
+
+	return allowed, nil
+}
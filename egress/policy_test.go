@@ -0,0 +1,132 @@
+package egress
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"testing"
+
+	"github.com/getlantern/broflake/common"
+)
+
+func TestParsePortRange(t *testing.T) {
+	for s, want := range map[string]PortRange{"443": {443, 443}, "8000-8999": {8000, 8999}, " 1 - 2 ": {1, 2}} {
+		if got, err := ParsePortRange(s); err != nil || got != want {
+			t.Errorf("ParsePortRange(%q) = %v, %v, expected %v", s, got, err, want)
+		}
+	}
+
+	for _, bad := range []string{"", "http", "65536", "9-1", "1-2-3"} {
+		if _, err := ParsePortRange(bad); err == nil {
+			t.Errorf("expected %q not to parse", bad)
+		}
+	}
+}
+
+func TestPolicyResolve(t *testing.T) {
+	p := DefaultPolicy()
+	p.AllowCIDRs = []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}
+	p.DenyPorts = []PortRange{{25, 25}}
+
+	tests := []struct {
+		addr   string
+		reason string // "" if allowed
+	}{
+		{"93.184.215.14:443", ""},
+		{"[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:443", ""},
+		{"10.1.2.3:80", ""},
+		{"93.184.215.14:25", "port"},
+		{"127.0.0.1:80", "address"},
+		{"10.2.3.4:80", "address"},
+		{"169.254.169.254:80", "address"},
+		{"100.100.100.200:80", "address"},
+		{"[::1]:80", "address"},
+		{"[::ffff:127.0.0.1]:80", "address"},
+		{"[fe80::1%eth0]:80", "address"},
+		{"[fd00:ec2::254]:80", "address"},
+		{"0.0.0.0:80", "address"},
+
+		// IPv6 addresses which embed an IPv4 address are judged by it too
+		{"[64:ff9b::7f00:1]:80", "address"},
+		{"[64:ff9b::a9fe:a9fe]:80", "address"},
+		{"[64:ff9b::5db8:d70e]:443", ""},
+		{"[2002:a00:1::1]:80", "address"},
+		{"[2002:c0a8:101::1]:80", "address"},
+		{"[2002:5db8:d70e::1]:443", ""},
+		{"[64:ff9b::a01:203]:80", ""},
+
+		// Names are judged by what they resolve to
+		{"localhost:80", "address"},
+	}
+
+	for _, tt := range tests {
+		addrs, err := p.Resolve(context.Background(), tt.addr)
+
+		var denied *DeniedError
+		switch {
+		case tt.reason == "" && err != nil:
+			t.Errorf("%v: expected it to be allowed, got %v", tt.addr, err)
+		case tt.reason == "" && len(addrs) != 1:
+			t.Errorf("%v: resolved to %v", tt.addr, addrs)
+		case tt.reason != "" && (!errors.As(err, &denied) || denied.Reason != tt.reason):
+			t.Errorf("%v: got %v, expected it to be denied by %v", tt.addr, err, tt.reason)
+		case tt.reason != "" && !errors.Is(err, ErrDestinationDenied):
+			t.Errorf("%v: %v isn't an ErrDestinationDenied", tt.addr, err)
+		}
+	}
+
+	// Once ports are allowed explicitly, every other port is denied
+	p.AllowPorts = []PortRange{{443, 443}}
+	if _, err := p.Resolve(context.Background(), "93.184.215.14:80"); !errors.Is(err, ErrDestinationDenied) {
+		t.Errorf("expected port 80 to be denied, got %v", err)
+	}
+}
+
+func TestForwarderPolicy(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+
+	dial := startForwarder(t, &ForwarderOptions{Policy: DefaultPolicy()})
+
+	// Our echo server listens on loopback, which we mustn't reach however it's named
+	for _, addr := range []string{echo, net.JoinHostPort("localhost", port), net.JoinHostPort("::ffff:127.0.0.1", port)} {
+		conn := dial()
+		(common.TargetHeader{Type: common.StreamTCP, Addr: addr}).Write(conn)
+
+		if err := common.ReadTargetStatus(conn); !errors.Is(err, common.ErrTargetStatus(common.TargetNotAllowed)) {
+			t.Errorf("%v: got %v, expected it to be denied", addr, err)
+		}
+	}
+
+	// Older clients get a 403
+	conn := dial()
+	io.WriteString(conn, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected CONNECT to be forbidden, got %v %v", res, err)
+	}
+
+	// Allowing loopback lets us through, but only to the ports we allow
+	p := DefaultPolicy()
+	p.AllowCIDRs = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	n, _ := strconv.Atoi(port)
+	p.AllowPorts = []PortRange{{uint16(n), uint16(n)}}
+	dial = startForwarder(t, &ForwarderOptions{Policy: p})
+
+	for addr, want := range map[string]error{
+		net.JoinHostPort("localhost", port): nil,
+		net.JoinHostPort("127.0.0.1", "1"):  common.ErrTargetStatus(common.TargetNotAllowed),
+	} {
+		conn := dial()
+		(common.TargetHeader{Type: common.StreamTCP, Addr: addr}).Write(conn)
+
+		if err := common.ReadTargetStatus(conn); !errors.Is(err, want) {
+			t.Errorf("%v: got %v, expected %v", addr, err, want)
+		}
+	}
+}
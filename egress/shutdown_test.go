@@ -0,0 +1,176 @@
+package egress
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/quic-go/quic-go"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// dialQUIC connects to the Listener at ws over a WebSocket, as a client would through a widget
+func dialQUIC(t *testing.T, ws string) quic.Connection {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, _, err := websocket.Dial(ctx, ws+"?version="+common.Version, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client end of a widget's WebSocket carries QUIC just like ours does
+	m := testInstruments(t, nil)
+	pconn := &websocketPacketConn{
+		w:     c,
+		addr:  common.DebugAddr("client"),
+		log:   logger,
+		stats: newConnStats(httptest.NewRequest("GET", "/ws", nil), transportWebSocket, nil, m),
+		m:     m,
+	}
+
+	// Like clientcore, we dial with our own Transport, which doesn't close pconn when we're done
+	t.Cleanup(func() { c.CloseNow() })
+	tr := &quic.Transport{Conn: pconn}
+	conn, err := tr.Dial(ctx, common.DebugAddr("egress"), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"broflake"}}, &common.QUICCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseWithError(0, "") })
+
+	return conn
+}
+
+// openEcho opens a stream to addr, an echo server, through conn
+func openEcho(conn quic.Connection, addr string) (quic.Stream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+	(common.TargetHeader{Type: common.StreamTCP, Addr: addr}).Write(stream)
+	return stream, common.ReadTargetStatus(stream)
+}
+
+func echoes(stream quic.Stream) bool {
+	if _, err := io.WriteString(stream, "hello"); err != nil {
+		return false
+	}
+
+	b := make([]byte, 5)
+	_, err := io.ReadFull(stream, b)
+	return err == nil && string(b) == "hello"
+}
+
+func TestListenerShutdown(t *testing.T) {
+	echo := startEcho(t)
+	l, ws := startListener(t, nil)
+
+	served := make(chan error, 1)
+	go func() { served <- NewForwarder(nil).Serve(l) }()
+
+	conn := dialQUIC(t, ws)
+	stream, err := openEcho(conn, echo)
+	if err != nil || !echoes(stream) {
+		t.Fatalf("couldn't echo before shutting down: %v", err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdown <- l.Shutdown(ctx)
+	}()
+
+	// We're asked to go away...
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	goAway, err := conn.AcceptStream(ctx)
+	if err != nil {
+		t.Fatalf("expected a GOAWAY: %v", err)
+	}
+	if b, err := bufio.NewReader(goAway).ReadByte(); err != nil || b != common.GoAway {
+		t.Errorf("got %#x %v, expected a GOAWAY", b, err)
+	}
+
+	// ...but our stream in flight still works...
+	if !echoes(stream) {
+		t.Error("couldn't echo while draining")
+	}
+
+	// ...while new streams and WebSockets are refused
+	var streamErr *quic.StreamError
+	if _, err := openEcho(conn, echo); !errors.As(err, &streamErr) || streamErr.ErrorCode != common.StreamGoingAway {
+		t.Errorf("got %v, expected a new stream to be refused", err)
+	}
+
+	if _, res, err := websocket.Dial(ctx, ws+"?version="+common.Version, nil); err == nil || (res != nil && res.StatusCode != http.StatusServiceUnavailable) {
+		t.Errorf("expected a new WebSocket to be refused, got %v", err)
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shut down with a stream still open: %v", err)
+	default:
+	}
+
+	// Once our stream is done, so is the drain
+	stream.Close()
+	stream.CancelRead(0)
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("expected to drain cleanly, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out draining")
+	}
+
+	var appErr *quic.ApplicationError
+	<-conn.Context().Done()
+	if err := context.Cause(conn.Context()); !errors.As(err, &appErr) || appErr.ErrorCode != common.QUICGoingAway {
+		t.Errorf("got %v, expected our connection to be closed as going away", err)
+	}
+
+	if err := <-served; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got %v, expected Serve to return net.ErrClosed", err)
+	}
+}
+
+func TestListenerShutdownDeadline(t *testing.T) {
+	echo := startEcho(t)
+	l, ws := startListener(t, nil)
+	go NewForwarder(nil).Serve(l)
+
+	conn := dialQUIC(t, ws)
+	if _, err := openEcho(conn, echo); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stream which never finishes can't hold us up past our deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if err := l.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, expected the drain to time out", err)
+	}
+
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got %v, expected the Listener to be closed", err)
+	}
+}
@@ -0,0 +1,57 @@
+package egress
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// nUDPFlows is the number of open UDP flows
+var nUDPFlows uint64
+
+// udpBufferSize fits the largest UDP payload
+const udpBufferSize = 65535
+
+// relayUDP relays datagrams between flow and udpConn for as long as the stream read by br stays
+// open. The stream carries nothing once the flow is established.
+func relayUDP(udpConn net.Conn, flow *common.DatagramFlow, br *bufio.Reader, addr string, log common.Logger) {
+	log.Debug("opened a UDP flow", "addr", addr, "total", atomic.AddUint64(&nUDPFlows, 1))
+	defer func() {
+		log.Debug("closed a UDP flow", "addr", addr, "total", atomic.AddUint64(&nUDPFlows, ^uint64(0)))
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// relay copies datagrams from src to dst until src fails. Lost datagrams are UDP's business, so
+	// we carry on after failed writes.
+	relay := func(dst io.Writer, src io.Reader) {
+		defer cancel()
+
+		b := make([]byte, udpBufferSize)
+		for {
+			n, err := src.Read(b)
+			if err != nil {
+				return
+			}
+
+			if _, err := dst.Write(b[:n]); err != nil {
+				log.Debug("can't relay UDP datagram", "err", err)
+			}
+		}
+	}
+
+	go relay(udpConn, flow)
+	go relay(flow, udpConn)
+
+	go func() {
+		io.Copy(io.Discard, br)
+		cancel()
+	}()
+
+	<-ctx.Done()
+}
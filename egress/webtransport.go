@@ -0,0 +1,226 @@
+package egress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// webtransportPacketConn wraps a widget's WebTransport session as a net.PacketConn, carrying QUIC
+// packets in its datagrams. Datagrams are neither retransmitted nor ordered, so unlike over a
+// WebSocket, a packet lost on its way to us doesn't hold up the packets behind it.
+type webtransportPacketConn struct {
+	net.PacketConn
+	s        *webtransport.Session
+	addr     net.Addr
+	log      common.Logger
+	limit    *connLimit
+	stats    *connStats
+	m        *instruments
+	exceeded atomic.Bool // Set once we've closed the session for exceeding a quota
+}
+
+func (q *webtransportPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if q.exceeded.Load() {
+		return 0, nil, net.ErrClosed
+	}
+
+	b, err := q.s.ReceiveDatagram(q.s.Context())
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n := copy(p, b)
+	q.stats.addIngress(len(b))
+
+	if err := q.limit.use(len(b)); err != nil {
+		return 0, nil, q.limited(err)
+	}
+
+	return n, q.s.RemoteAddr(), nil
+}
+
+func (q *webtransportPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if q.exceeded.Load() {
+		return 0, net.ErrClosed
+	}
+
+	if err := q.limit.use(len(p)); err != nil {
+		return 0, q.limited(err)
+	}
+
+	// Like a packet too large for any other path, a packet too large for a datagram is lost
+	err := q.s.SendDatagram(p)
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		return len(p), nil
+	}
+
+	if err == nil {
+		q.stats.addEgress(len(p))
+	}
+
+	return len(p), err
+}
+
+// limited handles an error from our connLimit, returning the error to report. The first time we
+// exceed a quota, we tell the widget why we're closing the session; after that, it's just closed.
+func (q *webtransportPacketConn) limited(err error) error {
+	if !errors.Is(err, ErrQuotaExceeded) {
+		return err
+	}
+
+	if q.exceeded.Swap(true) {
+		return net.ErrClosed
+	}
+
+	q.log.Info("closing a WebTransport session which exceeded its quota")
+	q.m.quotaExceeded.Add(context.Background(), 1)
+	q.s.CloseWithError(webtransport.SessionErrorCode(StatusQuotaExceeded), ErrQuotaExceeded.Error())
+	return err
+}
+
+func (q *webtransportPacketConn) Close() error {
+	defer q.log.Debug("closed a WebTransport session", q.stats.close()...)
+	q.limit.release()
+	return q.s.CloseWithError(0, "")
+}
+
+func (q *webtransportPacketConn) LocalAddr() net.Addr {
+	return q.addr
+}
+
+// checkOrigin applies our allowed origins to browsers' WebTransport sessions, just as
+// websocket.Accept applies them to their WebSockets
+func (l *Listener) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(l.allowedOrigins) == 0 {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range l.allowedOrigins {
+		target := u.Host
+		if strings.Contains(pattern, "://") {
+			target = u.Scheme + "://" + u.Host
+		}
+
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(target)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *Listener) handleWebTransport(srv *webtransport.Server, w http.ResponseWriter, r *http.Request) {
+	identity, status := l.admit(r, transportWebTransport)
+	if status != http.StatusOK {
+		refuse(w, status)
+		return
+	}
+
+	s, err := srv.Upgrade(w, r)
+	if err != nil {
+		logger.Debug("refused a WebTransport session", "remoteAddr", r.RemoteAddr, "err", err)
+		l.reject(transportWebTransport, "handshake")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Anonymous widgets are limited by their IP address
+	if identity == "" {
+		identity, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+
+	sess := l.addSession(func() { s.CloseWithError(0, "shutting down") })
+	if sess == nil {
+		s.CloseWithError(0, "shutting down")
+		return
+	}
+	defer l.removeSession(sess)
+
+	session := uuid.NewString()
+	connLog := logger.With("session", session, "remoteAddr", r.RemoteAddr, "identity", identity)
+
+	wtpconn := &webtransportPacketConn{
+		s:     s,
+		addr:  common.DebugAddr(fmt.Sprintf("WebTransport session %v", session)),
+		log:   connLog,
+		limit: l.limiter.acquire(identity),
+		stats: newConnStats(r, transportWebTransport, l.labels, l.m),
+		m:     l.m,
+	}
+
+	defer wtpconn.Close()
+
+	connLog.Debug("accepted a new WebTransport session")
+
+	listener, err := quic.Listen(wtpconn, l.tlsConfig, &common.QUICCfg)
+	if err != nil {
+		connLog.Error("error creating QUIC listener", "err", err)
+		return
+	}
+
+	wdg := &widget{name: wtpconn.addr.String(), addr: s.RemoteAddr(), stats: wtpconn.stats, log: connLog}
+	err = l.serveQUIC(listener, sess, func(quic.Connection) *widget { return wdg })
+	connLog.Debug("QUIC listener error, closing", "err", err)
+}
+
+// ServeWebTransport accepts WebTransport sessions at /wt over conn, a UDP socket, from widgets which
+// carry QUIC to us in their datagrams, until the Listener is closed, when it closes conn and returns
+// net.ErrClosed. Browsers only open sessions to servers whose certificates they trust, so this
+// Listener needs to have been given one.
+func (l *Listener) ServeWebTransport(conn net.PacketConn) error {
+	mux := http.NewServeMux()
+	srv := &webtransport.Server{
+		H3: http3.Server{
+			Handler:   mux,
+			TLSConfig: l.tlsConfig,
+			QUICConfig: &quic.Config{
+				MaxIdleTimeout:  common.QUICCfg.MaxIdleTimeout,
+				KeepAlivePeriod: common.QUICCfg.KeepAlivePeriod,
+			},
+		},
+		CheckOrigin: l.checkOrigin,
+	}
+	mux.HandleFunc("/wt", func(w http.ResponseWriter, r *http.Request) { l.handleWebTransport(srv, w, r) })
+
+	closeTransport := func() {
+		srv.Close()
+		conn.Close()
+	}
+
+	sess := l.addSession(closeTransport)
+	if sess == nil {
+		closeTransport()
+		return net.ErrClosed
+	}
+	defer l.removeSession(sess)
+
+	logger.Info("egress server listening for WebTransport sessions", "addr", conn.LocalAddr())
+	err := srv.Serve(conn)
+	closeTransport()
+
+	if l.draining.Load() {
+		return net.ErrClosed
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package egress
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+
+	"github.com/getlantern/broflake/common"
+)
+
+// sessionPacketConn is the widget's end of a WebTransport session, carrying QUIC in datagrams
+type sessionPacketConn struct {
+	net.PacketConn
+	s *webtransport.Session
+}
+
+func (c sessionPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	b, err := c.s.ReceiveDatagram(c.s.Context())
+	return copy(p, b), c.s.RemoteAddr(), err
+}
+
+func (c sessionPacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	return len(p), c.s.SendDatagram(p)
+}
+
+// LocalAddr isn't the session's, since quic-go won't share an address with the session's own QUIC
+func (c sessionPacketConn) LocalAddr() net.Addr {
+	return common.DebugAddr("WebTransport session")
+}
+
+func dialWebTransport(t *testing.T, addr net.Addr, q url.Values, origin string) (*http.Response, *webtransport.Session, error) {
+	d := &webtransport.Dialer{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{http3.NextProtoH3}},
+		QUICConfig:      &quic.Config{EnableDatagrams: true},
+	}
+	t.Cleanup(func() { d.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	h := http.Header{}
+	if origin != "" {
+		h.Set("Origin", origin)
+	}
+
+	return d.Dial(ctx, fmt.Sprintf("https://%v/wt?%v", addr, q.Encode()), h)
+}
+
+func TestServeWebTransport(t *testing.T) {
+	echo := startEcho(t)
+	l, _ := startListener(t, &ListenerOptions{AllowedOrigins: []string{"widget.example.com"}})
+	go NewForwarder(nil).Serve(l)
+	egress := serveUDP(t, l, (*Listener).ServeWebTransport)
+
+	if res, _, err := dialWebTransport(t, egress, url.Values{"version": {"v999.0.0"}}, ""); err == nil || res == nil || res.StatusCode != http.StatusTeapot {
+		t.Errorf("expected a widget with the wrong version to be refused, got %v", err)
+	}
+
+	if _, _, err := dialWebTransport(t, egress, url.Values{"version": {common.Version}}, "https://evil.example.com"); err == nil {
+		t.Error("expected a page from a disallowed origin to be refused")
+	}
+
+	_, s, err := dialWebTransport(t, egress, url.Values{"version": {common.Version}}, "https://widget.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseWithError(0, "")
+
+	// Our client's QUIC travels in the session's datagrams
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tr := &quic.Transport{Conn: sessionPacketConn{s: s}}
+	qconn, err := tr.Dial(ctx, common.DebugAddr("egress"), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"broflake"}}, &common.QUICCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qconn.CloseWithError(0, "")
+
+	stream, err := openEcho(qconn, echo)
+	if err != nil || !echoes(stream) {
+		t.Fatalf("couldn't echo over WebTransport: %v", err)
+	}
+}
+
+func TestWebTransportQuota(t *testing.T) {
+	l, _ := startListener(t, &ListenerOptions{Limits: &Limits{ConnQuota: 4096, QuotaWindow: time.Hour}})
+	egress := serveUDP(t, l, (*Listener).ServeWebTransport)
+
+	_, s, err := dialWebTransport(t, egress, url.Values{"version": {common.Version}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.CloseWithError(0, "")
+
+	// The egress server counts our datagrams against the quota before QUIC gets to ignore them
+	for i := 0; i < 5; i++ {
+		if err := s.SendDatagram(make([]byte, 1024)); err != nil {
+			break
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Stream operations report why the session was closed, where datagrams only see that it was
+	_, err = s.AcceptStream(ctx)
+	var sessErr *webtransport.SessionError
+	if !errors.As(err, &sessErr) || sessErr.ErrorCode != webtransport.SessionErrorCode(StatusQuotaExceeded) {
+		t.Errorf("got %v, expected the session to be closed with code %v", err, StatusQuotaExceeded)
+	}
+}
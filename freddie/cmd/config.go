@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/getlantern/broflake/config"
+	"github.com/getlantern/broflake/freddie"
+)
+
+type freddieConfig struct {
+	Port        int             `json:"port" env:"PORT"`
+	TLS         config.TLS      `json:"tls"`
+	ConsumerTTL config.Duration `json:"consumerTTL" env:"CONSUMER_TTL"`
+	MsgTTL      config.Duration `json:"msgTTL" env:"MSG_TTL"`
+	Log         config.Log      `json:"log"`
+}
+
+func defaultConfig() *freddieConfig {
+	return &freddieConfig{
+		Port:        9000,
+		ConsumerTTL: config.Duration(freddie.DefaultConsumerTTL),
+		MsgTTL:      config.Duration(freddie.DefaultMsgTTL),
+		Log:         config.DefaultLog(),
+	}
+}
+
+func (c *freddieConfig) Validate() error {
+	return errors.Join(
+		config.Port("port", c.Port, false),
+		c.TLS.Validate(),
+		config.Positive("consumerTTL", c.ConsumerTTL),
+		config.Positive("msgTTL", c.MsgTTL),
+		c.Log.Validate(),
+	)
+}
+
+func (c *freddieConfig) apply(f *freddie.Freddie) {
+	f.ConsumerTTL = time.Duration(c.ConsumerTTL)
+	f.MsgTTL = time.Duration(c.MsgTTL)
+}
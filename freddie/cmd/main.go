@@ -5,23 +5,44 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/getlantern/telemetry"
+
+	"github.com/getlantern/broflake/config"
 	"github.com/getlantern/broflake/freddie"
 )
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "9000"
+	cfg := defaultConfig()
+	config.Init("freddie", cfg)
+
+	if err := cfg.Log.Apply(); err != nil {
+		panic(err)
 	}
-	listenAddr := fmt.Sprintf(":%v", port)
+
+	listenAddr := fmt.Sprintf(":%v", cfg.Port)
 
 	ctx := context.Background()
+
+	// The OTel exporters are configured with the standard OTEL_* environment variables
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		defer telemetry.EnableOTELTracing(ctx)(ctx)
+		defer telemetry.EnableOTELMetrics(ctx)(ctx)
+	}
+
 	f, err := freddie.New(ctx, listenAddr)
 	if err != nil {
 		panic(err)
 	}
 
-	if err = f.ListenAndServe(); err != nil {
+	cfg.apply(f)
+
+	if cfg.TLS.Enabled() {
+		err = f.ListenAndServeTLS(cfg.TLS.Cert, cfg.TLS.Key)
+	} else {
+		err = f.ListenAndServe()
+	}
+
+	if err != nil {
 		panic(err)
 	}
 }
@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
 	"sync"
@@ -16,21 +17,19 @@ import (
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/mod/semver"
 
 	"github.com/getlantern/broflake/common"
 )
 
-const (
-	consumerTTL = 20
-	msgTTL      = 5
-	bufferSz    = 1000
-)
+var logger = common.NewLogger("component", "freddie")
 
-var (
-	consumerTable = userTable{Data: make(map[string]chan string)}
-	signalTable   = userTable{Data: make(map[string]chan string)}
+const (
+	DefaultConsumerTTL = 20 * time.Second
+	DefaultMsgTTL      = 5 * time.Second
+	bufferSz           = 1000
 )
 
 type userTable struct {
@@ -78,9 +77,17 @@ func (t *userTable) Size() int {
 type Freddie struct {
 	TLSConfig *tls.Config
 
+	// ConsumerTTL is how long a consumer's genesis message stream stays open; MsgTTL is how long a
+	// signaling partner has to respond to a message. They may be changed before serving.
+	ConsumerTTL time.Duration
+	MsgTTL      time.Duration
+
 	ctx context.Context
 	srv *http.Server
 
+	consumerTable *userTable
+	signalTable   *userTable
+
 	currentGets  atomic.Int64
 	currentPosts atomic.Int64
 
@@ -103,10 +110,14 @@ func New(ctx context.Context, listenAddr string) (*Freddie, error) {
 			Addr:         listenAddr,
 			Handler:      mux,
 		},
-		currentGets:  atomic.Int64{},
-		currentPosts: atomic.Int64{},
-		tracer:       otel.Tracer("github.com/getlantern/broflake/freddie"),
-		meter:        otel.Meter("github.com/getlantern/broflake/freddie"),
+		ConsumerTTL:   DefaultConsumerTTL,
+		MsgTTL:        DefaultMsgTTL,
+		consumerTable: &userTable{Data: make(map[string]chan string)},
+		signalTable:   &userTable{Data: make(map[string]chan string)},
+		currentGets:   atomic.Int64{},
+		currentPosts:  atomic.Int64{},
+		tracer:        otel.Tracer("github.com/getlantern/broflake/freddie"),
+		meter:         otel.Meter("github.com/getlantern/broflake/freddie"),
 	}
 
 	var err error
@@ -137,7 +148,7 @@ func New(ctx context.Context, listenAddr string) (*Freddie, error) {
 		metric.WithDescription("total number of users in the consumers table"),
 		metric.WithUnit("user"),
 		metric.WithInt64Callback(func(ctx context.Context, m metric.Int64Observer) error {
-			m.Observe(int64(consumerTable.Size()))
+			m.Observe(int64(f.consumerTable.Size()))
 			return nil
 		}))
 	if err != nil {
@@ -148,7 +159,7 @@ func New(ctx context.Context, listenAddr string) (*Freddie, error) {
 		metric.WithDescription("total number of users in the signal table"),
 		metric.WithUnit("user"),
 		metric.WithInt64Callback(func(ctx context.Context, m metric.Int64Observer) error {
-			m.Observe(int64(signalTable.Size()))
+			m.Observe(int64(f.signalTable.Size()))
 			return nil
 		}))
 	if err != nil {
@@ -167,14 +178,21 @@ func New(ctx context.Context, listenAddr string) (*Freddie, error) {
 }
 
 func (f *Freddie) ListenAndServe() error {
-	common.Debugf("Freddie (%v) listening on %v", common.Version, f.srv.Addr)
+	logger.Info("Freddie listening", "version", common.Version, "addr", f.srv.Addr)
 	return f.srv.ListenAndServe()
 }
 
+// Serve accepts connections on a caller supplied listener, which is useful for serving Freddie on
+// an ephemeral loopback port
+func (f *Freddie) Serve(l net.Listener) error {
+	logger.Info("Freddie listening", "version", common.Version, "addr", l.Addr())
+	return f.srv.Serve(l)
+}
+
 func (f *Freddie) ListenAndServeTLS(certFile, keyFile string) error {
 	f.srv.TLSConfig = f.TLSConfig
 
-	common.Debugf("Freddie (%v/tls) listening on %v", common.Version, f.srv.Addr)
+	logger.Info("Freddie listening", "version", common.Version, "addr", f.srv.Addr, "tls", true)
 	return f.srv.ListenAndServeTLS(certFile, keyFile)
 }
 
@@ -183,7 +201,9 @@ func (f *Freddie) Shutdown() error {
 }
 
 func (f *Freddie) handleSignal(w http.ResponseWriter, r *http.Request) {
-	ctx, span := f.tracer.Start(r.Context(), "handleSignal")
+	// Clients send W3C trace context headers, so our spans join the trace for their connection attempt
+	ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := f.tracer.Start(ctx, "handleSignal")
 	defer span.End()
 
 	enableCors(&w)
@@ -195,7 +215,8 @@ func (f *Freddie) handleSignal(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set(
 			"Access-Control-Allow-Headers",
 			"Access-Control-Allow-Headers, Origin, Accept, X-Requested-With, Content-Type, "+
-				"Access-Control-Request-Method, Access-Control-Request-Headers, "+common.VersionHeader,
+				"Access-Control-Request-Method, Access-Control-Request-Headers, traceparent, tracestate, "+
+				common.VersionHeader,
 		)
 
 		w.WriteHeader(http.StatusOK)
@@ -229,15 +250,15 @@ func (f *Freddie) handleSignalGet(ctx context.Context, w http.ResponseWriter, r
 	consumerID := uuid.NewString()
 	span.SetAttributes(attribute.String("consumer.id", consumerID))
 
-	consumerChan := consumerTable.Add(consumerID)
+	consumerChan := f.consumerTable.Add(consumerID)
 	defer func() { close(consumerChan) }()
-	defer consumerTable.Delete(consumerID)
+	defer f.consumerTable.Delete(consumerID)
 
 	// TODO: Matchmaking would happen here. (Just be selective about which consumers you broadcast
 	// to, and you've implemented matchmaking!) If consumerTable was an indexed datastore, we could
 	// select slices of consumers in O(1) based on some deterministic function
 	w.WriteHeader(http.StatusOK)
-	timeoutChan := time.After(consumerTTL * time.Second)
+	timeoutChan := time.After(f.ConsumerTTL)
 
 	for {
 		select {
@@ -261,9 +282,9 @@ func (f *Freddie) handleSignalPost(ctx context.Context, w http.ResponseWriter, r
 	reqID := uuid.NewString()
 	span.SetAttributes(attribute.String("request.id", reqID))
 
-	reqChan := signalTable.Add(reqID)
+	reqChan := f.signalTable.Add(reqID)
 	defer func() { close(reqChan) }()
-	defer signalTable.Delete(reqID)
+	defer f.signalTable.Delete(reqID)
 
 	r.ParseForm()
 	sendTo := r.Form.Get("send-to")
@@ -297,11 +318,11 @@ func (f *Freddie) handleSignalPost(ctx context.Context, w http.ResponseWriter, r
 
 	if sendTo == "genesis" {
 		// It's a genesis message, so let's broadcast it to all consumers
-		consumerTable.SendAll(string(msg))
+		f.consumerTable.SendAll(string(msg))
 	} else {
 		// It's a regular message, so let's signal it to its recipient (or return a 404 if the
 		// recipient is no longer available)
-		ok := signalTable.Send(sendTo, string(msg))
+		ok := f.signalTable.Send(sendTo, string(msg))
 		if !ok {
 			span.SetStatus(codes.Error, "recipient not found")
 			w.WriteHeader(http.StatusNotFound)
@@ -328,7 +349,7 @@ func (f *Freddie) handleSignalPost(ctx context.Context, w http.ResponseWriter, r
 	select {
 	case res := <-reqChan:
 		w.Write([]byte(fmt.Sprintf("%v\n", res)))
-	case <-time.After(msgTTL * time.Second):
+	case <-time.After(f.MsgTTL):
 		span.AddEvent("timeout waiting for response")
 		w.Write(nil)
 	}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/getlantern/broflake/config"
+)
+
+type netstatedConfig struct {
+	// The gv client is hardcoded to hit the /neato endpoint on port 8080, so changing the port
+	// breaks it
+	Port int `json:"port" env:"PORT"`
+
+	// URL of a compressed MaxMind database file ending in .tar.gz. If it's empty, we don't perform
+	// geolocation.
+	GeoDB string `json:"geoDB" env:"GEODB"`
+
+	// If true, we expose the Graphviz-related endpoints which are useful for debugging, but which
+	// surface private user data including IP address
+	Unsafe bool       `json:"unsafe" env:"UNSAFE"`
+	Log    config.Log `json:"log"`
+}
+
+func defaultConfig() *netstatedConfig {
+	return &netstatedConfig{
+		Port: 8080,
+		Log:  config.DefaultLog(),
+	}
+}
+
+func (c *netstatedConfig) Validate() error {
+	var errs []error
+	errs = append(errs, config.Port("port", c.Port, false), c.Log.Validate())
+
+	if c.GeoDB != "" {
+		errs = append(errs, config.URL("geoDB", c.GeoDB, "http", "https"))
+	}
+
+	return errors.Join(errs...)
+}
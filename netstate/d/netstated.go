@@ -7,19 +7,19 @@ import (
 	"net"
 	"net/http"
 	"net/netip"
-	"net/url"
-	"os"
 	"path"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/getlantern/broflake/common"
+	"github.com/getlantern/broflake/config"
 	netstatecl "github.com/getlantern/broflake/netstate/client"
 	"github.com/getlantern/geo"
 )
 
+var logger = common.NewLogger("component", "netstated")
+
 const (
 	ttl = 5 * time.Minute // How long do vertices live before we prune them?
 )
@@ -267,7 +267,7 @@ func handleExec(w http.ResponseWriter, r *http.Request) {
 
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		common.Debugf("Error: %v", err)
+		logger.Warn("error decoding instruction", "err", err)
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("400\n"))
 		return
@@ -276,7 +276,7 @@ func handleExec(w http.ResponseWriter, r *http.Request) {
 	inst := netstatecl.Instruction{}
 	err = json.Unmarshal(b, &inst)
 	if err != nil {
-		common.Debugf("Error: %v", err)
+		logger.Warn("error decoding instruction", "err", err)
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("400\n"))
 		return
@@ -383,40 +383,25 @@ func geolocate(geoDb string, addr net.IP) (lat float64, lon float64) {
 }
 
 func main() {
-	// If GEODB is unspecified, we'll run netstated sans geolocation
-	geoDb = os.Getenv("GEODB")
-
-	if geoDb != "" {
-		_, err := url.ParseRequestURI(geoDb)
+	cfg := defaultConfig()
+	config.Init("netstated", cfg)
 
-		if err != nil {
-			common.Debugf("GEODB is not a valid URL! We won't perform geolocation...")
-		} else {
-			common.Debugf("Using %v for geolocation...", geoDb)
-		}
-	} else {
-		common.Debug("GEODB not specified! We won't perform geolocation...")
+	if err := cfg.Log.Apply(); err != nil {
+		panic(err)
 	}
 
-	// If UNSAFE == 1, we'll expose the Graphviz-related endpoints which are useful for debugging,
-	// but which surface private user data including IP address
-	unsafe, err := strconv.ParseInt(os.Getenv("UNSAFE"), 10, 64)
+	geoDb = cfg.GeoDB
 
-	if err != nil {
-		common.Debugf("UNSAFE not specified or not valid! Using default value...")
-	}
-
-	if unsafe == 0 {
-		common.Debugf("UNSAFE=0, we won't expose Graphviz endpoints...")
-	} else if unsafe == 1 {
-		common.Debugf("*** WARNING *** UNSAFE=1, we'll expose Graphviz endpoints!")
+	if geoDb != "" {
+		logger.Info("using GEODB for geolocation", "geodb", geoDb)
+	} else {
+		logger.Info("GEODB not specified! We won't perform geolocation...")
 	}
 
-	// The gv client is hardcoded to hit the /neato endpoint on port 8080, so we don't currently
-	// support running netstated on a different port
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	if cfg.Unsafe {
+		logger.Warn("*** WARNING *** unsafe mode, we'll expose Graphviz endpoints!")
+	} else {
+		logger.Info("safe mode, we won't expose Graphviz endpoints...")
 	}
 
 	world = *newMultigraph()
@@ -442,19 +427,19 @@ func main() {
 	srv := &http.Server{
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 30 * time.Second,
-		Addr:         fmt.Sprintf(":%v", port),
+		Addr:         fmt.Sprintf(":%v", cfg.Port),
 	}
 
-	if unsafe == 1 {
+	if cfg.Unsafe {
 		http.Handle("/", http.FileServer(http.Dir("./webclients/gv/public")))
 		http.HandleFunc("/neato", handleNeato)
 	}
 
 	http.HandleFunc("/data", handleData)
 	http.HandleFunc("/exec", handleExec)
-	common.Debugf("netstated listening on %v", srv.Addr)
-	err = srv.ListenAndServe()
+	logger.Info("netstated listening", "addr", srv.Addr)
+	err := srv.ListenAndServe()
 	if err != nil {
-		common.Debug(err)
+		logger.Error("netstated stopped", "err", err)
 	}
 }
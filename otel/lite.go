@@ -0,0 +1,548 @@
+// lite.go implements a minimal OpenTelemetry exporter for build targets which can't run the OTel
+// SDK. It aggregates cumulative sums and histograms in memory, buffers finished spans, and exports
+// both to an OTLP/HTTP collector using the OTLP JSON encoding. It has no build tags so that it can
+// be tested natively, but only the wasm implementation uses it.
+package otel
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/getlantern/broflake/common"
+)
+
+const (
+	liteMaxSpans  = 1024 // Spans finished beyond this many between exports are dropped
+	liteScopeName = "broflake"
+)
+
+// Histogram bucket bounds, matching the OTel SDK's defaults
+var liteHistBounds = []float64{0, 5, 10, 25, 50, 75, 100, 250, 500, 750, 1000, 2500, 5000, 7500, 10000}
+
+const (
+	liteSum = iota
+	liteUpDownSum
+	liteHistogram
+)
+
+// litePoint is one timeseries: the cumulative state of an instrument for one set of attributes
+type litePoint struct {
+	inst    instrument
+	kind    int
+	attrs   []attribute.KeyValue
+	sum     int64
+	count   uint64
+	total   float64
+	buckets []uint64
+}
+
+type liteExporter struct {
+	endpoint string
+	client   *http.Client
+	start    time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mx      sync.Mutex
+	spans   []*liteSpan
+	dropped uint64
+	points  map[string]*litePoint
+}
+
+// newLiteExporter returns a liteExporter which exports to the OTLP/HTTP collector at endpoint, eg
+// "https://otel.example.com", using client
+func newLiteExporter(endpoint string, client *http.Client) *liteExporter {
+	return &liteExporter{
+		endpoint: endpoint,
+		client:   client,
+		start:    time.Now(),
+		stop:     make(chan struct{}),
+		points:   make(map[string]*litePoint),
+	}
+}
+
+// run exports every interval until the liteExporter is closed, and once more on the way out
+func (e *liteExporter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.stop:
+			e.export()
+			return
+		}
+
+		e.export()
+	}
+}
+
+func (e *liteExporter) close() {
+	e.stopOnce.Do(func() { close(e.stop) })
+}
+
+func (e *liteExporter) export() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := e.flush(ctx); err != nil {
+		logger.Debug("error exporting telemetry", "endpoint", e.endpoint, "err", err)
+	}
+}
+
+// point returns the timeseries for instrument i and attrs, creating it if necessary. The caller
+// must hold e.mx.
+func (e *liteExporter) point(i instrument, kind int, attrs []attribute.KeyValue) *litePoint {
+	set := attribute.NewSet(attrs...)
+	key := i.name + "|" + set.Encoded(attribute.DefaultEncoder())
+
+	p, ok := e.points[key]
+	if !ok {
+		p = &litePoint{inst: i, kind: kind, attrs: set.ToSlice()}
+		if kind == liteHistogram {
+			p.buckets = make([]uint64, len(liteHistBounds)+1)
+		}
+		e.points[key] = p
+	}
+
+	return p
+}
+
+// add adds n to a monotonic sum
+func (e *liteExporter) add(i instrument, n int64, attrs ...attribute.KeyValue) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	e.point(i, liteSum, attrs).sum += n
+}
+
+// addUpDown adds n, which may be negative, to a non-monotonic sum
+func (e *liteExporter) addUpDown(i instrument, n int64, attrs ...attribute.KeyValue) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+	e.point(i, liteUpDownSum, attrs).sum += n
+}
+
+// record adds v to a histogram
+func (e *liteExporter) record(i instrument, v float64, attrs ...attribute.KeyValue) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	p := e.point(i, liteHistogram, attrs)
+	p.count++
+	p.total += v
+
+	b := sort.SearchFloat64s(liteHistBounds, v)
+	p.buckets[b]++
+}
+
+// startSpan starts a span as a child of the liteSpan carried by ctx, if any
+func (e *liteExporter) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, *liteSpan) {
+	s := &liteSpan{e: e, name: name, start: time.Now(), attrs: attrs}
+
+	if parent := liteSpanFrom(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, liteSpanKey{}, s), s
+}
+
+func (e *liteExporter) finish(s *liteSpan) {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	if len(e.spans) >= liteMaxSpans {
+		e.dropped++
+		return
+	}
+
+	e.spans = append(e.spans, s)
+}
+
+// flush exports every finished span, and the current value of every timeseries
+func (e *liteExporter) flush(ctx context.Context) error {
+	now := time.Now()
+
+	e.mx.Lock()
+	spans := e.spans
+	e.spans = nil
+	dropped := e.dropped
+	e.dropped = 0
+	metrics := e.encodeMetrics(now)
+	e.mx.Unlock()
+
+	if dropped > 0 {
+		logger.Debug("dropped spans", "spans", dropped)
+	}
+
+	if len(spans) > 0 {
+		if err := e.post(ctx, "/v1/traces", e.encodeTraces(spans)); err != nil {
+			return err
+		}
+	}
+
+	if len(metrics) > 0 {
+		body := otlpMetrics{ResourceMetrics: []otlpResourceMetrics{{
+			Resource:     liteResource(),
+			ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: liteScopeName}, Metrics: metrics}},
+		}}}
+
+		if err := e.post(ctx, "/v1/metrics", body); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *liteExporter) post(ctx context.Context, path string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.endpoint+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%v: unexpected status %v", path, res.StatusCode)
+	}
+
+	return nil
+}
+
+func (e *liteExporter) encodeTraces(spans []*liteSpan) otlpTraces {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		encoded = append(encoded, s.encode())
+	}
+
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   liteResource(),
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: liteScopeName}, Spans: encoded}},
+	}}}
+}
+
+// encodeMetrics encodes every timeseries, grouped by instrument. The caller must hold e.mx.
+func (e *liteExporter) encodeMetrics(now time.Time) []otlpMetric {
+	keys := make([]string, 0, len(e.points))
+	for k := range e.points {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	start := unixNano(e.start)
+	ts := unixNano(now)
+	byName := make(map[string]*otlpMetric)
+	var metrics []*otlpMetric
+
+	for _, k := range keys {
+		p := e.points[k]
+
+		m, ok := byName[p.inst.name]
+		if !ok {
+			m = &otlpMetric{Name: p.inst.name, Description: p.inst.description, Unit: p.inst.unit}
+			switch p.kind {
+			case liteSum, liteUpDownSum:
+				m.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: p.kind == liteSum}
+			case liteHistogram:
+				m.Histogram = &otlpHistogram{AggregationTemporality: otlpCumulative}
+			}
+			byName[p.inst.name] = m
+			metrics = append(metrics, m)
+		}
+
+		attrs := encodeAttrs(p.attrs)
+
+		switch p.kind {
+		case liteSum, liteUpDownSum:
+			m.Sum.DataPoints = append(m.Sum.DataPoints, otlpNumberDataPoint{
+				Attributes:        attrs,
+				StartTimeUnixNano: start,
+				TimeUnixNano:      ts,
+				AsInt:             strconv.FormatInt(p.sum, 10),
+			})
+		case liteHistogram:
+			buckets := make([]string, len(p.buckets))
+			for i, n := range p.buckets {
+				buckets[i] = strconv.FormatUint(n, 10)
+			}
+
+			m.Histogram.DataPoints = append(m.Histogram.DataPoints, otlpHistogramDataPoint{
+				Attributes:        attrs,
+				StartTimeUnixNano: start,
+				TimeUnixNano:      ts,
+				Count:             strconv.FormatUint(p.count, 10),
+				Sum:               p.total,
+				BucketCounts:      buckets,
+				ExplicitBounds:    liteHistBounds,
+			})
+		}
+	}
+
+	encoded := make([]otlpMetric, 0, len(metrics))
+	for _, m := range metrics {
+		encoded = append(encoded, *m)
+	}
+
+	return encoded
+}
+
+type liteSpanKey struct{}
+
+// liteSpanFrom returns the liteSpan carried by ctx, or nil if it doesn't carry one
+func liteSpanFrom(ctx context.Context) *liteSpan {
+	s, _ := ctx.Value(liteSpanKey{}).(*liteSpan)
+	return s
+}
+
+// liteSpan implements Span for the liteExporter
+type liteSpan struct {
+	e        *liteExporter
+	name     string
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // All zeroes for a root span
+	start    time.Time
+
+	mx     sync.Mutex
+	end    time.Time
+	attrs  []attribute.KeyValue
+	failed bool
+	status string
+	ended  bool
+}
+
+func (s *liteSpan) SetAttributes(kv ...attribute.KeyValue) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if !s.ended {
+		s.attrs = append(s.attrs, kv...)
+	}
+}
+
+func (s *liteSpan) SetError(description string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if !s.ended {
+		s.failed = true
+		s.status = description
+	}
+}
+
+func (s *liteSpan) End() {
+	s.mx.Lock()
+	if s.ended {
+		s.mx.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mx.Unlock()
+
+	s.e.finish(s)
+}
+
+// traceparent returns the W3C traceparent header value which identifies this span
+func (s *liteSpan) traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
+}
+
+func (s *liteSpan) encode() otlpSpan {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: unixNano(s.start),
+		EndTimeUnixNano:   unixNano(s.end),
+		Attributes:        encodeAttrs(s.attrs),
+	}
+
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+
+	if s.failed {
+		span.Status = otlpStatus{Code: otlpStatusError, Message: s.status}
+	}
+
+	return span
+}
+
+func liteResource() otlpResource {
+	return otlpResource{Attributes: encodeAttrs([]attribute.KeyValue{
+		attribute.String("service.name", "broflake"),
+		attribute.String("service.version", common.Version),
+	})}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func encodeAttrs(attrs []attribute.KeyValue) []otlpKeyValue {
+	encoded := make([]otlpKeyValue, 0, len(attrs))
+
+	for _, kv := range attrs {
+		var v otlpAnyValue
+
+		switch kv.Value.Type() {
+		case attribute.BOOL:
+			b := kv.Value.AsBool()
+			v.BoolValue = &b
+		case attribute.INT64:
+			i := strconv.FormatInt(kv.Value.AsInt64(), 10)
+			v.IntValue = &i
+		case attribute.FLOAT64:
+			f := kv.Value.AsFloat64()
+			v.DoubleValue = &f
+		default:
+			s := kv.Value.Emit()
+			v.StringValue = &s
+		}
+
+		encoded = append(encoded, otlpKeyValue{Key: string(kv.Key), Value: v})
+	}
+
+	return encoded
+}
+
+// The OTLP JSON encoding. See https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusError      = 2
+	otlpCumulative       = 2
+)
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpMetrics struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Unit        string         `json:"unit,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsInt             string         `json:"asInt"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+}
@@ -0,0 +1,200 @@
+package otel
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// collector is a fake OTLP/HTTP collector which keeps the last request to each path
+type collector struct {
+	mx   sync.Mutex
+	reqs map[string][]byte
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.mx.Lock()
+	c.reqs[r.URL.Path] = body
+	c.mx.Unlock()
+}
+
+func (c *collector) decode(t *testing.T, path string, v interface{}) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	b, ok := c.reqs[path]
+	if !ok {
+		t.Fatalf("nothing was exported to %v", path)
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLiteExporterTraces(t *testing.T) {
+	c := &collector{reqs: make(map[string][]byte)}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	e := newLiteExporter(srv.URL, srv.Client())
+
+	ctx, parent := e.startSpan(context.Background(), "attempt", attribute.Int("worker", 3))
+	_, child := e.startSpan(ctx, "discover")
+	child.SetError("no genesis messages")
+	child.End()
+	child.End()
+	parent.End()
+
+	parentHdr := parent.traceparent()
+	if !strings.HasPrefix(parentHdr, "00-") || len(parentHdr) != 55 {
+		t.Fatalf("malformed traceparent %v", parentHdr)
+	}
+
+	if err := e.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var traces otlpTraces
+	c.decode(t, "/v1/traces", &traces)
+	spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+
+	if len(spans) != 2 {
+		t.Fatalf("exported %v spans, expected 2", len(spans))
+	}
+
+	d, a := spans[0], spans[1]
+	if d.Name != "discover" || a.Name != "attempt" {
+		t.Fatalf("spans exported in the wrong order: %v, %v", d.Name, a.Name)
+	}
+
+	if d.TraceID != a.TraceID || d.ParentSpanID != a.SpanID || a.ParentSpanID != "" {
+		t.Fatalf("child span isn't linked to its parent: %+v, %+v", d, a)
+	}
+
+	if d.Status.Code != otlpStatusError || d.Status.Message != "no genesis messages" {
+		t.Fatalf("unexpected status %+v", d.Status)
+	}
+
+	if a.Status.Code != 0 || len(a.Attributes) != 1 || *a.Attributes[0].Value.IntValue != "3" {
+		t.Fatalf("unexpected parent span %+v", a)
+	}
+
+	if parentHdr != "00-"+a.TraceID+"-"+a.SpanID+"-01" {
+		t.Fatalf("traceparent %v doesn't identify the exported span", parentHdr)
+	}
+
+	// Spans are exported exactly once
+	c.mx.Lock()
+	c.reqs = make(map[string][]byte)
+	c.mx.Unlock()
+
+	if err := e.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := c.reqs["/v1/traces"]; ok {
+		t.Fatal("expected no spans in the second export")
+	}
+}
+
+func TestLiteExporterMetrics(t *testing.T) {
+	c := &collector{reqs: make(map[string][]byte)}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	e := newLiteExporter(srv.URL, srv.Client())
+
+	e.add(bytesTransferred, 10, bytesAttrs("upstream")...)
+	e.add(bytesTransferred, 5, bytesAttrs("upstream")...)
+	e.add(bytesTransferred, 7, bytesAttrs("downstream")...)
+	e.addUpDown(slotsActive, 1, slotAttrs("producer")...)
+	e.addUpDown(slotsActive, -1, slotAttrs("producer")...)
+	e.record(stateDuration, 3, stateAttrs("producer", "discover", "signal_offer")...)
+	e.record(stateDuration, 5, stateAttrs("producer", "discover", "signal_offer")...)
+	e.record(stateDuration, 20000, stateAttrs("producer", "discover", "signal_offer")...)
+
+	if err := e.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var metrics otlpMetrics
+	c.decode(t, "/v1/metrics", &metrics)
+
+	byName := make(map[string]otlpMetric)
+	for _, m := range metrics.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		byName[m.Name] = m
+	}
+
+	b := byName[bytesTransferred.name]
+	if b.Sum == nil || !b.Sum.IsMonotonic || len(b.Sum.DataPoints) != 2 {
+		t.Fatalf("unexpected bytes metric %+v", b)
+	}
+
+	for _, p := range b.Sum.DataPoints {
+		dir := *p.Attributes[0].Value.StringValue
+		if (dir == "upstream" && p.AsInt != "15") || (dir == "downstream" && p.AsInt != "7") {
+			t.Fatalf("unexpected %v bytes %v", dir, p.AsInt)
+		}
+	}
+
+	s := byName[slotsActive.name]
+	if s.Sum == nil || s.Sum.IsMonotonic || s.Sum.DataPoints[0].AsInt != "0" {
+		t.Fatalf("unexpected slots metric %+v", s)
+	}
+
+	h := byName[stateDuration.name]
+	if h.Histogram == nil || len(h.Histogram.DataPoints) != 1 {
+		t.Fatalf("unexpected state duration metric %+v", h)
+	}
+
+	p := h.Histogram.DataPoints[0]
+	if p.Count != "3" || p.Sum != 20008 || len(p.BucketCounts) != len(liteHistBounds)+1 {
+		t.Fatalf("unexpected histogram data point %+v", p)
+	}
+
+	// 3 falls in (0, 5], 5 in (0, 5] (bounds are inclusive), 20000 in the overflow bucket
+	if p.BucketCounts[1] != "2" || p.BucketCounts[len(liteHistBounds)] != "1" {
+		t.Fatalf("unexpected bucket counts %v", p.BucketCounts)
+	}
+}
+
+func TestLiteExporterClose(t *testing.T) {
+	c := &collector{reqs: make(map[string][]byte)}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	e := newLiteExporter(srv.URL, srv.Client())
+	done := make(chan struct{})
+
+	go func() {
+		e.run(time.Hour)
+		close(done)
+	}()
+
+	e.add(quicDials, 1, dialAttrs(nil)...)
+	e.close()
+	e.close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("liteExporter didn't stop")
+	}
+
+	var metrics otlpMetrics
+	c.decode(t, "/v1/metrics", &metrics)
+}
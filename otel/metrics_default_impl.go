@@ -0,0 +1,131 @@
+//go:build !wasm
+
+package otel
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var (
+	droppedChunksCounter  metric.Int64Counter
+	droppedBytesCounter   metric.Int64Counter
+	bytesCounter          metric.Int64Counter
+	activeSlotsCounter    metric.Int64UpDownCounter
+	stateDurationHist     metric.Float64Histogram
+	quicDialsCounter      metric.Int64Counter
+	quicReconnectsCounter metric.Int64Counter
+	instrumentsOnce       sync.Once
+
+	// RecordBytes is called for every chunk, so we only build each direction's attribute set once
+	bytesOpts sync.Map
+)
+
+func broflakeMeter() metric.Meter {
+	return otel.GetMeterProvider().Meter("broflake")
+}
+
+// initInstruments creates our instruments. If an instrument can't be created, it's left nil and
+// the functions which record to it do nothing.
+func initInstruments() {
+	m := broflakeMeter()
+
+	counter := func(i instrument) metric.Int64Counter {
+		c, err := m.Int64Counter(i.name, metric.WithDescription(i.description), metric.WithUnit(i.unit))
+		if err != nil {
+			logger.Error("error creating counter", "name", i.name, "err", err)
+			return nil
+		}
+		return c
+	}
+
+	droppedChunksCounter = counter(chunksDropped)
+	droppedBytesCounter = counter(bytesDropped)
+	bytesCounter = counter(bytesTransferred)
+	quicDialsCounter = counter(quicDials)
+	quicReconnectsCounter = counter(quicReconnects)
+
+	var err error
+	activeSlotsCounter, err = m.Int64UpDownCounter(slotsActive.name,
+		metric.WithDescription(slotsActive.description),
+		metric.WithUnit(slotsActive.unit))
+	if err != nil {
+		logger.Error("error creating up/down counter", "name", slotsActive.name, "err", err)
+	}
+
+	stateDurationHist, err = m.Float64Histogram(stateDuration.name,
+		metric.WithDescription(stateDuration.description),
+		metric.WithUnit(stateDuration.unit))
+	if err != nil {
+		logger.Error("error creating histogram", "name", stateDuration.name, "err", err)
+	}
+}
+
+// RecordChunkDrops adds 'chunks' and 'bytes' to the counters which track data discarded by the
+// worker at 'workerIdx' in 'table' because it couldn't keep up with the data rate
+func RecordChunkDrops(table string, workerIdx int, chunks, bytes int64) {
+	instrumentsOnce.Do(initInstruments)
+	attrs := metric.WithAttributes(chunkDropAttrs(table, workerIdx)...)
+
+	if droppedChunksCounter != nil {
+		droppedChunksCounter.Add(context.Background(), chunks, attrs)
+	}
+
+	if droppedBytesCounter != nil {
+		droppedBytesCounter.Add(context.Background(), bytes, attrs)
+	}
+}
+
+// RecordBytes adds 'n' to the count of bytes moving in 'direction' ("upstream" or "downstream")
+func RecordBytes(direction string, n int64) {
+	instrumentsOnce.Do(initInstruments)
+
+	if bytesCounter == nil {
+		return
+	}
+
+	opt, ok := bytesOpts.Load(direction)
+	if !ok {
+		opt, _ = bytesOpts.LoadOrStore(direction, metric.WithAttributes(bytesAttrs(direction)...))
+	}
+
+	bytesCounter.Add(context.Background(), n, opt.(metric.AddOption))
+}
+
+// AddActiveSlots adds 'delta' to the number of connected worker slots in 'table'
+func AddActiveSlots(table string, delta int64) {
+	instrumentsOnce.Do(initInstruments)
+
+	if activeSlotsCounter != nil {
+		activeSlotsCounter.Add(context.Background(), delta, metric.WithAttributes(slotAttrs(table)...))
+	}
+}
+
+// RecordStateDuration records the time 'd' which a worker in 'table' spent in 'state' before it
+// transitioned to 'next'
+func RecordStateDuration(table, state, next string, d time.Duration) {
+	instrumentsOnce.Do(initInstruments)
+
+	if stateDurationHist != nil {
+		ms := float64(d) / float64(time.Millisecond)
+		stateDurationHist.Record(context.Background(), ms, metric.WithAttributes(stateAttrs(table, state, next)...))
+	}
+}
+
+// RecordQUICDial records the outcome of an attempt to dial the egress server. 'reconnect' is true
+// if a previous QUIC connection had been established.
+func RecordQUICDial(err error, reconnect bool) {
+	instrumentsOnce.Do(initInstruments)
+
+	if quicDialsCounter != nil {
+		quicDialsCounter.Add(context.Background(), 1, metric.WithAttributes(dialAttrs(err)...))
+	}
+
+	if err == nil && reconnect && quicReconnectsCounter != nil {
+		quicReconnectsCounter.Add(context.Background(), 1)
+	}
+}
@@ -0,0 +1,49 @@
+//go:build wasm
+
+package otel
+
+import (
+	"time"
+)
+
+// RecordChunkDrops adds 'chunks' and 'bytes' to the counters which track data discarded by the
+// worker at 'workerIdx' in 'table' because it couldn't keep up with the data rate
+func RecordChunkDrops(table string, workerIdx int, chunks, bytes int64) {
+	if e := exporter.Load(); e != nil {
+		e.add(chunksDropped, chunks, chunkDropAttrs(table, workerIdx)...)
+		e.add(bytesDropped, bytes, chunkDropAttrs(table, workerIdx)...)
+	}
+}
+
+// RecordBytes adds 'n' to the count of bytes moving in 'direction' ("upstream" or "downstream")
+func RecordBytes(direction string, n int64) {
+	if e := exporter.Load(); e != nil {
+		e.add(bytesTransferred, n, bytesAttrs(direction)...)
+	}
+}
+
+// AddActiveSlots adds 'delta' to the number of connected worker slots in 'table'
+func AddActiveSlots(table string, delta int64) {
+	if e := exporter.Load(); e != nil {
+		e.addUpDown(slotsActive, delta, slotAttrs(table)...)
+	}
+}
+
+// RecordStateDuration records the time 'd' which a worker in 'table' spent in 'state' before it
+// transitioned to 'next'
+func RecordStateDuration(table, state, next string, d time.Duration) {
+	if e := exporter.Load(); e != nil {
+		e.record(stateDuration, float64(d)/float64(time.Millisecond), stateAttrs(table, state, next)...)
+	}
+}
+
+// RecordQUICDial records the outcome of an attempt to dial the egress server. 'reconnect' is true
+// if a previous QUIC connection had been established.
+func RecordQUICDial(err error, reconnect bool) {
+	if e := exporter.Load(); e != nil {
+		e.add(quicDials, 1, dialAttrs(err)...)
+		if err == nil && reconnect {
+			e.add(quicReconnects, 1)
+		}
+	}
+}
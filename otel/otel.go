@@ -0,0 +1,114 @@
+// Package otel is broflake's interface to OpenTelemetry. On native build targets, metrics and
+// traces go to the global MeterProvider and TracerProvider, which the embedding application (or
+// one of our binaries) is responsible for configuring. On wasm build targets, the OTel SDK isn't
+// an option, so we use a lightweight exporter instead (see ConfigureExporter).
+package otel
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/getlantern/broflake/common"
+)
+
+var logger = common.NewLogger("component", "otel")
+
+// Span is the part of an OpenTelemetry span which broflake uses
+type Span interface {
+	SetAttributes(kv ...attribute.KeyValue)
+
+	// SetError marks the span as failed, with a short human readable description
+	SetError(description string)
+
+	End()
+}
+
+// noopSpan is returned by StartSpan when telemetry is disabled
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(kv ...attribute.KeyValue) {}
+func (noopSpan) SetError(description string)            {}
+func (noopSpan) End()                                   {}
+
+// instrument describes a metric instrument. All of broflake's instruments are defined here, so the
+// native and wasm implementations report identical metrics.
+type instrument struct {
+	name        string
+	unit        string
+	description string
+}
+
+var (
+	chunksDropped = instrument{
+		"broflake.chunks.dropped",
+		"chunk",
+		"chunks dropped because a worker's IPC channel was full",
+	}
+
+	bytesDropped = instrument{
+		"broflake.bytes.dropped",
+		"By",
+		"bytes dropped because a worker's IPC channel was full",
+	}
+
+	bytesTransferred = instrument{
+		"broflake.bytes",
+		"By",
+		"bytes which crossed the bus, upstream (toward the producer table) or downstream",
+	}
+
+	slotsActive = instrument{
+		"broflake.slots.active",
+		"slot",
+		"worker slots with an established connection",
+	}
+
+	stateDuration = instrument{
+		"broflake.fsm.state.duration",
+		"ms",
+		"time spent in each worker state",
+	}
+
+	quicDials = instrument{
+		"broflake.quic.dials",
+		"dial",
+		"attempts to dial the egress server over QUIC",
+	}
+
+	quicReconnects = instrument{
+		"broflake.quic.reconnects",
+		"connection",
+		"QUIC connections to the egress server established after the first",
+	}
+)
+
+// Attribute sets for each of our instruments. Keeping these in one place keeps the two
+// implementations honest.
+
+func chunkDropAttrs(table string, workerIdx int) []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.String("table", table), attribute.Int("worker", workerIdx)}
+}
+
+func bytesAttrs(direction string) []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.String("direction", direction)}
+}
+
+func slotAttrs(table string) []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.String("table", table)}
+}
+
+func stateAttrs(table, state, next string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("table", table),
+		attribute.String("state", state),
+		attribute.String("next", next),
+	}
+}
+
+func dialAttrs(err error) []attribute.KeyValue {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+
+	return []attribute.KeyValue{attribute.String("outcome", outcome)}
+}
@@ -4,10 +4,13 @@ package otel
 
 import (
 	"context"
+	"net/http"
 
 	goNATs "github.com/enobufs/go-nats/nats"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 )
 
@@ -15,9 +18,36 @@ func broflakeTracer() trace.Tracer {
 	return otel.GetTracerProvider().Tracer("broflake")
 }
 
-// collectAndSendNATBehaviorTelemetry attempts to perform NAT behavior discovery, trying one batch
-// of STUN servers, and sends the results in an attribute-rich Otel trace under name 'name'
-func CollectAndSendNATBehaviorTelemetry(srvs []string, name string) {
+// otelSpan adapts a trace.Span to our Span interface
+type otelSpan struct {
+	trace.Span
+}
+
+func (s otelSpan) SetError(description string) {
+	s.Span.SetStatus(codes.Error, description)
+}
+
+func (s otelSpan) End() {
+	s.Span.End()
+}
+
+// StartSpan starts a span named 'name' as a child of the span carried by ctx, if any. The returned
+// context carries the new span.
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, Span) {
+	ctx, span := broflakeTracer().Start(ctx, name, trace.WithAttributes(attrs...))
+	return ctx, otelSpan{span}
+}
+
+// InjectTraceHeaders adds W3C trace context headers describing the span carried by ctx to h, so
+// the server which receives the request can continue the trace
+func InjectTraceHeaders(ctx context.Context, h http.Header) {
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(h))
+}
+
+// CollectAndSendNATBehaviorTelemetry attempts to perform NAT behavior discovery, trying one batch
+// of STUN servers, and sends the results in an attribute-rich Otel trace under name 'name', as a
+// child of the span carried by ctx
+func CollectAndSendNATBehaviorTelemetry(ctx context.Context, srvs []string, name string) {
 	var res *goNATs.DiscoverResult
 	attrs := trace.WithAttributes()
 
@@ -46,6 +76,6 @@ func CollectAndSendNATBehaviorTelemetry(srvs []string, name string) {
 		}
 	}
 
-	_, span := broflakeTracer().Start(context.Background(), name, attrs)
+	_, span := broflakeTracer().Start(ctx, name, attrs)
 	span.End()
 }
@@ -2,8 +2,52 @@
 
 package otel
 
-// CollectAndSendNATBehaviorTelemetry is a noop for wasm build targets, because OpenTelemetry's Go
-// implementation abuses the call stack in ways that mobile Safari doesn't appreciate
-func CollectAndSendNATBehaviorTelemetry(srvs []string, name string) {
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// OpenTelemetry's Go SDK abuses the call stack in ways that mobile Safari doesn't appreciate, so on
+// wasm build targets we export telemetry with a liteExporter (see lite.go) instead
+var exporter atomic.Pointer[liteExporter]
+
+// ConfigureExporter starts exporting metrics and traces to the OTLP/HTTP collector at endpoint (eg
+// "https://otel.example.com") every interval, replacing any previously configured exporter. Until
+// it's called, telemetry is discarded. For wasm build targets only.
+func ConfigureExporter(endpoint string, interval time.Duration) {
+	e := newLiteExporter(endpoint, http.DefaultClient)
+	if old := exporter.Swap(e); old != nil {
+		old.close()
+	}
+
+	go e.run(interval)
+}
+
+// StartSpan starts a span named 'name' as a child of the span carried by ctx, if any. The returned
+// context carries the new span.
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, Span) {
+	e := exporter.Load()
+	if e == nil {
+		return ctx, noopSpan{}
+	}
+
+	return e.startSpan(ctx, name, attrs...)
+}
+
+// InjectTraceHeaders adds W3C trace context headers describing the span carried by ctx to h, so
+// the server which receives the request can continue the trace
+func InjectTraceHeaders(ctx context.Context, h http.Header) {
+	if s := liteSpanFrom(ctx); s != nil {
+		h.Set("traceparent", s.traceparent())
+	}
+}
+
+// CollectAndSendNATBehaviorTelemetry is a noop for wasm build targets, because NAT behavior
+// discovery requires UDP sockets, which browsers don't expose
+func CollectAndSendNATBehaviorTelemetry(ctx context.Context, srvs []string, name string) {
 
 }